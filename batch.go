@@ -0,0 +1,108 @@
+package pathdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PutBatch puts the given values without full text indexing them, inserting many rows per
+// statement, which is considerably faster than putting values one at a time when importing a lot
+// of data. Nil values delete their paths.
+func (t *tx) PutBatch(values map[string]interface{}) error {
+	paths := make([]string, 0, len(values))
+	for _, path := range sortedKeys(values) {
+		if values[path] == nil {
+			// Delete records the previous value itself
+			err := t.Delete(path)
+			if err != nil {
+				return fmt.Errorf("putbatch: %w", err)
+			}
+			continue
+		}
+		err := t.recordPrevious(path)
+		if err != nil {
+			return fmt.Errorf("putbatch: %w", err)
+		}
+		paths = append(paths, path)
+	}
+
+	row := "(?, ?)"
+	if t.opts.TrackInsertionOrder {
+		row = "(?, ?, ?)"
+	}
+	rowsPerStatement := maxPathsPerQuery / strings.Count(row, "?")
+	for start := 0; start < len(paths); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(paths) {
+			end = len(paths)
+		}
+		err := t.putChunk(paths[start:end], values, row)
+		if err != nil {
+			return fmt.Errorf("putbatch: %w", err)
+		}
+	}
+	return nil
+}
+
+// putChunk inserts the given paths with a single statement for the data table and another for the
+// generations table
+func (t *tx) putChunk(paths []string, values map[string]interface{}, row string) error {
+	var firstSequence int64
+	if t.opts.TrackInsertionOrder {
+		var err error
+		firstSequence, err = t.reserveSequences(len(paths))
+		if err != nil {
+			return err
+		}
+	}
+
+	serializedValues := make([][]byte, 0, len(paths))
+	args := make([]interface{}, 0, len(paths)*strings.Count(row, "?"))
+	generationArgs := make([]interface{}, 0, len(paths))
+	for i, path := range paths {
+		serializedValue, err := t.serde.serialize(values[path])
+		if err != nil {
+			return fmt.Errorf("serialize value at %v: %w", path, err)
+		}
+		serializedValues = append(serializedValues, serializedValue)
+		storedPath := t.paths.encode(path)
+		args = append(args, storedPath, serializedValue)
+		if t.opts.TrackInsertionOrder {
+			args = append(args, firstSequence+int64(i))
+		}
+		generationArgs = append(generationArgs, storedPath)
+	}
+
+	columns := "path, value"
+	onConflictClause := "ON CONFLICT(path) DO UPDATE SET value = EXCLUDED.value"
+	if t.opts.TrackInsertionOrder {
+		columns += ", sequence"
+		if t.opts.ResequenceOnUpdate {
+			onConflictClause += ", sequence = EXCLUDED.sequence"
+		}
+	}
+	rows := strings.TrimSuffix(strings.Repeat(row+", ", len(paths)), ", ")
+	err := t.tx.Exec(fmt.Sprintf("INSERT INTO %s_data(%s) VALUES %s %s", t.schema, columns, rows, onConflictClause), args...)
+	if err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	generationRows := strings.TrimSuffix(strings.Repeat("(?, 1), ", len(paths)), ", ")
+	err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_generations(path, generation) VALUES %s ON CONFLICT(path) DO UPDATE SET generation = generation+1", t.schema, generationRows), generationArgs...)
+	if err != nil {
+		return fmt.Errorf("increment generations: %w", err)
+	}
+
+	for i, path := range paths {
+		delete(t.deletes, path)
+		t.updates[path] = &Item[*Raw[any]]{
+			Path: path,
+			Value: &Raw[any]{
+				serde:  t.serde,
+				Bytes:  serializedValues[i],
+				loaded: true,
+				value:  values[path],
+			},
+		}
+	}
+	return nil
+}
@@ -1,9 +1,18 @@
 package pathdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/tchap/go-patricia/v2/patricia"
 
@@ -13,24 +22,261 @@ import (
 
 var log = golog.LoggerFor("pathdb")
 
+const (
+	// maxPathsPerQuery caps the number of bound path parameters in a single IN (...) clause to
+	// stay well below SQLite's limit on host parameters
+	maxPathsPerQuery = 500
+
+	// maxJoinDepth caps QueryParams.JoinDepth, which keeps queries reasonably sized and bounds the
+	// work done for chains of pointers that form cycles
+	maxJoinDepth = 8
+)
+
 var (
-	ErrUnexpectedDBError = errors.New("unexpected database error")
+	ErrUnexpectedDBError   = errors.New("unexpected database error")
+	ErrDBClosed            = errors.New("database closed")
+	ErrFullTextTooLarge    = errors.New("full text too large")
+	ErrLengthMismatch      = errors.New("length mismatch")
+	ErrInvalidQuery        = errors.New("invalid query")
+	ErrInvalidOptions      = errors.New("invalid options")
+	ErrInvalidSubscription = errors.New("invalid subscription")
+	ErrNotAnInteger        = errors.New("not an integer")
+	ErrIntegerOverflow     = errors.New("integer overflow")
+	// ErrInvalidSchema is returned for schema names that aren't plain SQL identifiers
+	ErrInvalidSchema = errors.New("invalid schema")
+	// ErrPathExists is returned when putting a value without updateIfPresent at a path that
+	// already has a value
+	ErrPathExists = errors.New("path already exists")
 )
 
+// errEncryptedDetailPaths is returned for queries that join details when values are encrypted
+// (see Options.ValueCipher), since the detail paths in index entries are encrypted as well
+var errEncryptedDetailPaths = fmt.Errorf("can't join details of encrypted index entries: %w", ErrInvalidQuery)
+
 type item struct {
 	path       string
 	detailPath string
 	value      []byte
 	snippet    string
+	highlights []Highlight
+	size       int
+	total      int
+	indexValue []byte
+}
+
+// OversizedFullTextPolicy determines what happens to full text content that exceeds
+// Options.MaxFullTextBytes
+type OversizedFullTextPolicy int
+
+const (
+	// TruncateOversizedFullText truncates oversized full text on a word or character boundary
+	TruncateOversizedFullText OversizedFullTextPolicy = iota
+	// RejectOversizedFullText fails puts of oversized full text with ErrFullTextTooLarge
+	RejectOversizedFullText
+)
+
+// Options configures a DB created with NewDBWithOptions
+type Options struct {
+	// MaxFullTextBytes, if greater than zero, limits the size of full text content that gets
+	// indexed
+	MaxFullTextBytes int
+	// OversizedFullTextPolicy determines how full text content larger than MaxFullTextBytes is
+	// handled
+	OversizedFullTextPolicy OversizedFullTextPolicy
+	// IgnoreGlobalTypes prevents the DB from starting out with the types registered using
+	// RegisterGlobal
+	IgnoreGlobalTypes bool
+	// PathDictionary optionally lists common path prefixes (e.g. "/accounts/") that are stored
+	// using short codes to save space. Paths are encoded using the longest matching prefix. This is
+	// transparent to callers, except that LIKE patterns match dictionary prefixes case sensitively
+	// and patterns that end partway through a dictionary prefix can't use the path index. The
+	// dictionary must not change once a DB contains data. See MaxPathDictionarySize.
+	PathDictionary []string
+	// PageSize, if set, is the SQLite page size in bytes. It must be a power of two between 512
+	// and 65536. The page size of an existing database only changes after a Vacuum.
+	PageSize int
+	// CacheSize, if set, is the SQLite page cache size. Positive values are a number of pages and
+	// negative values are a number of KiB. Note that this only applies to the connection on which
+	// the DB is opened.
+	CacheSize int
+	// Pragmas are additional SQLite pragmas, like "journal_mode": "WAL" or "busy_timeout": "5000",
+	// that are set in order of their names once all tables have been created. Pragmas that only
+	// apply to new tables therefore don't take effect, which is why PageSize is a separate option.
+	// Values other than plain identifiers and integers are quoted as strings. Like CacheSize, most
+	// pragmas only apply to the connection on which the DB is opened.
+	Pragmas map[string]string
+	// FullTextColumns optionally names the columns of the full text index, which allows indexing
+	// several fields of a value separately (see PutWithFullTextFields). The fullText argument of
+	// Put indexes the first column. Defaults to a single column named "value". Changing the
+	// columns of an existing DB requires RebuildFullTextIndex.
+	FullTextColumns []string
+	// Tokenizer is the fts5 tokenizer used by the full text index, including any arguments, for
+	// example "unicode61 remove_diacritics 2", "porter unicode61", "ascii" or "trigram". See
+	// https://www.sqlite.org/fts5.html#tokenizers for all valid tokenizers. "porter" stems English
+	// words, while "trigram" supports substring matching and languages that don't separate words
+	// with spaces, at the cost of a larger index. Defaults to DefaultTokenizer. Changing the
+	// tokenizer of an existing DB requires RebuildFullTextIndex.
+	Tokenizer string
+	// RebuildFullTextIndex allows opening an existing DB whose full text index has different
+	// columns or a different tokenizer than FullTextColumns and Tokenizer. The index is then
+	// rebuilt, keeping the contents of retained columns, which can take a while for large DBs.
+	// Without it, opening such a DB fails with ErrInvalidOptions.
+	RebuildFullTextIndex bool
+	// TrackInsertionOrder, if true, records the order in which paths are first put, which allows
+	// listing and searching with OrderByInsertion. Paths that were put before tracking was enabled
+	// sort before all others.
+	TrackInsertionOrder bool
+	// ResequenceOnUpdate, if true, moves paths to the end of the insertion order whenever they're
+	// updated rather than only when they're first put. Only applies with TrackInsertionOrder.
+	ResequenceOnUpdate bool
+	// CompressionThreshold, if greater than zero, gzip compresses serialized values larger than
+	// this many bytes, unless compressing doesn't make them smaller. Compression is transparent to
+	// readers and compressed values stay readable if compression is turned off again. Text values
+	// aren't compressed, since they may be detail paths. Note that ProjectSize reports the
+	// compressed size.
+	CompressionThreshold int
+	// ValueCipher, if set, encrypts serialized values before they're stored (after compressing
+	// them) and decrypts them when they're read. Paths aren't encrypted, so they can still be
+	// matched with LIKE patterns. The full text passed to Put is indexed as is, so keeping
+	// sensitive data out of the full text index is up to the caller. Since index entries are
+	// encrypted too, joining details isn't supported, and queries and subscriptions that use
+	// JoinDetails fail with ErrInvalidQuery and ErrInvalidSubscription respectively. Values stored
+	// without a cipher remain readable, but encrypted values can't be read without one.
+	ValueCipher ValueCipher
+}
+
+// validate checks that these Options have sane values
+func (opts *Options) validate() error {
+	if opts.PageSize != 0 && (opts.PageSize < 512 || opts.PageSize > 65536 || opts.PageSize&(opts.PageSize-1) != 0) {
+		return fmt.Errorf("page size %d is not a power of two between 512 and 65536: %w", opts.PageSize, ErrInvalidOptions)
+	}
+	if opts.CompressionThreshold < 0 {
+		return fmt.Errorf("compression threshold %d is negative: %w", opts.CompressionThreshold, ErrInvalidOptions)
+	}
+	for name := range opts.Pragmas {
+		if !isPlainIdentifier(name) {
+			return fmt.Errorf("invalid pragma %q: %w", name, ErrInvalidOptions)
+		}
+	}
+	return opts.validateFullTextColumns()
+}
+
+// limitFullText applies MaxFullTextBytes and OversizedFullTextPolicy to the given full text
+func (opts *Options) limitFullText(fullText string) (string, error) {
+	if opts.MaxFullTextBytes <= 0 || len(fullText) <= opts.MaxFullTextBytes {
+		return fullText, nil
+	}
+	if opts.OversizedFullTextPolicy == RejectOversizedFullText {
+		return "", fmt.Errorf("%d bytes exceeds limit of %d: %w", len(fullText), opts.MaxFullTextBytes, ErrFullTextTooLarge)
+	}
+
+	// back up to the start of a rune so that we don't split a multi-byte character
+	end := opts.MaxFullTextBytes
+	for end > 0 && !utf8.RuneStart(fullText[end]) {
+		end--
+	}
+	truncated := fullText[:end]
+	// prefer to break at whitespace so that we don't index a partial word
+	lastSpace := strings.LastIndexFunc(truncated, unicode.IsSpace)
+	if lastSpace > 0 {
+		truncated = truncated[:lastSpace]
+	}
+	return truncated, nil
 }
 
+// OrderBy specifies how the results of a query are ordered
+type OrderBy int
+
+const (
+	// OrderByDefault orders searches by rank and lists by path
+	OrderByDefault OrderBy = iota
+	// OrderByPath orders results by path
+	OrderByPath
+	// OrderByRank orders results by full text search rank, best matches first. Lists that aren't
+	// searches are ordered by path instead.
+	OrderByRank
+	// OrderByDetailPath orders results by detail path. Queries that don't join details are ordered
+	// by path instead.
+	OrderByDetailPath
+	// OrderByInsertion orders results by the order in which their paths were first put. This
+	// requires Options.TrackInsertionOrder.
+	OrderByInsertion
+)
+
+// Projection is a set of flags selecting which fields of each item a query loads. Paths are always
+// loaded.
+type Projection int
+
+const (
+	// ProjectDetailPath loads the DetailPath of items in queries that join details
+	ProjectDetailPath Projection = 1 << iota
+	// ProjectValue loads the Value of items
+	ProjectValue
+	// ProjectSize loads the size in bytes of each stored value into Raw.Size (see RList)
+	ProjectSize
+	// projectTotal loads the number of rows that match the query regardless of Start and Count
+	// into each item (see ListWithTotal)
+	projectTotal
+	// projectIndexValue loads the stored value of the index entry into each item of a query that
+	// joins details (see SubscribeDetails)
+	projectIndexValue
+
+	// ProjectDefault loads detail paths and values, but not sizes
+	ProjectDefault = ProjectDetailPath | ProjectValue
+)
+
+// MatchMode specifies how QueryParams.Path is matched against paths
+type MatchMode int
+
+const (
+	// MatchLike matches paths using SQL LIKE, with % and _ wildcards
+	MatchLike MatchMode = iota
+	// MatchGlob matches paths using SQLite GLOB, with * and ? wildcards. Unlike LIKE, GLOB is case
+	// sensitive and treats % as a literal character.
+	MatchGlob
+)
+
 type QueryParams struct {
 	Path                string
+	MatchMode           MatchMode
 	Start               int
 	Count               int
 	ReverseSort         bool
+	OrderBy             OrderBy
 	JoinDetails         bool
 	IncludeEmptyDetails bool
+	// After, if set, limits results to paths that sort after it (or before it when using
+	// ReverseSort) instead of skipping Start results. Set it to the last path of the previous page
+	// (see ListPage) to page through results efficiently and without skipping or repeating items
+	// when data changes between pages. After is only supported for lists ordered by path.
+	After string
+	// StrictDetailPaths affects JoinDetails, which treats the matching paths as index entries whose
+	// values are the paths of details. Detail paths have to be stored as strings, and matching
+	// entries with other values are normally skipped. If StrictDetailPaths is true, such entries
+	// instead make the list or search fail with ErrInvalidQuery.
+	StrictDetailPaths bool
+	// DistinctDetails affects JoinDetails, making lists return each detail referenced by matching
+	// index entries only once, no matter how many entries refer to it. Items are then keyed by
+	// detail path, so their Path and DetailPath are both the detail path, and results are ordered
+	// by detail path unless ordering by insertion, which orders by when the details were inserted.
+	// It can't be combined with IncludeEmptyDetails and isn't supported for searches.
+	DistinctDetails bool
+	// JoinDepth affects JoinDetails, making lists follow chains of index entries that point to
+	// other index entries, up to the given number of hops. With a JoinDepth of 2, for example, the
+	// detail path of each matching entry points to another entry whose value is the path of the
+	// actual detail. Entries whose chain ends early at a value that isn't a path are treated like
+	// entries whose detail doesn't exist. DetailPath is the path of the actual detail. Defaults to
+	// 1, can't be greater than 8 and isn't supported for searches.
+	JoinDepth int
+	// ProjectionFields selects which fields of each item get loaded. Omitting ProjectValue avoids
+	// reading values from the database, leaving them empty. Defaults to ProjectDefault.
+	ProjectionFields Projection
+	// Paths, if set, matches paths against each of the given patterns instead of Path, so that
+	// results under several prefixes are ordered and paginated as one list
+	Paths []string
+	// Exclude optionally lists patterns of paths to leave out of the results, for example to skip
+	// a nested index. They're matched the same way as Path.
+	Exclude []string
 }
 
 func (query *QueryParams) ApplyDefaults() {
@@ -39,12 +285,197 @@ func (query *QueryParams) ApplyDefaults() {
 	}
 }
 
+// projection returns the effective ProjectionFields of this query
+func (query *QueryParams) projection() Projection {
+	if query.ProjectionFields == 0 {
+		return ProjectDefault
+	}
+	return query.ProjectionFields
+}
+
+// valueColumns returns the SQL for the value columns selected by this query's projection, given
+// the column that holds values
+func (query *QueryParams) valueColumns(column string) string {
+	projection := query.projection()
+	result := column
+	if projection&ProjectValue == 0 {
+		// select an empty value rather than transferring the actual one
+		result = "X''"
+	}
+	if projection&ProjectSize != 0 {
+		result = fmt.Sprintf("%s, IFNULL(LENGTH(%s), 0)", result, column)
+	}
+	if projection&projectTotal != 0 {
+		// the window covers all matching rows, since it's computed before LIMIT and OFFSET
+		result += ", COUNT(*) OVER ()"
+	}
+	return result
+}
+
+// matchClause returns the SQL condition for matching column against this query's path patterns
+// and exclusions, along with its arguments
+func (query *QueryParams) matchClause(column string, paths *pathCodec) (string, []interface{}) {
+	patterns := query.Paths
+	if len(patterns) == 0 {
+		patterns = []string{query.Path}
+	}
+	operator := query.matchOperator()
+	matches := make([]string, 0, len(patterns))
+	args := make([]interface{}, 0, len(patterns))
+	for _, pattern := range patterns {
+		match, arg := paths.matchClause(column, operator, pattern)
+		matches = append(matches, match)
+		args = append(args, arg)
+	}
+	clause := matches[0]
+	if len(matches) > 1 {
+		clause = fmt.Sprintf("(%s)", strings.Join(matches, " OR "))
+	}
+	for _, pattern := range query.Exclude {
+		match, arg := paths.matchClause(column, operator, pattern)
+		clause = fmt.Sprintf("%s AND NOT %s", clause, match)
+		args = append(args, arg)
+	}
+	return clause, args
+}
+
+// matchOperator returns the SQL operator used to match Path
+func (query *QueryParams) matchOperator() string {
+	if query.MatchMode == MatchGlob {
+		return "GLOB"
+	}
+	return "LIKE"
+}
+
+// orderByClause builds the ORDER BY expression for this query. For searches, rank is the
+// expression by which results are ranked, while for lists it's empty. Searches alias the fts table
+// as f, the data table as d and the index table (when joining details) as l. Lists alias the index
+// table as l and intermediate entries as h1, h2, ... when joining details and don't use an alias
+// otherwise.
+func (query *QueryParams) orderByClause(rank string, paths *pathCodec) string {
+	isSearch := rank != ""
+	sortOrder := "ASC"
+	if query.ReverseSort {
+		sortOrder = "DESC"
+	}
+
+	pathColumn := "path"
+	detailPathColumn := "path"
+	sequenceColumn := "sequence"
+	if isSearch {
+		pathColumn, detailPathColumn, sequenceColumn = "d.path", "d.path", "d.sequence"
+		if query.JoinDetails {
+			pathColumn, sequenceColumn = "l.path", "l.sequence"
+		}
+	} else if query.JoinDetails {
+		pointer := "l"
+		if query.JoinDepth > 1 {
+			// see hopJoins
+			pointer = fmt.Sprintf("h%d", query.JoinDepth-1)
+		}
+		pathColumn, detailPathColumn, sequenceColumn = "l.path", fmt.Sprintf("CAST(%s.value AS TEXT)", pointer), "l.sequence"
+	}
+
+	// stored paths may be encoded, so decode them to get the right order
+	column := paths.decodeSQL(pathColumn)
+	switch query.OrderBy {
+	case OrderByDefault, OrderByRank:
+		if isSearch {
+			column = rank
+		}
+	case OrderByDetailPath:
+		column = detailPathColumn
+		if !strings.HasPrefix(detailPathColumn, "CAST(") {
+			column = paths.decodeSQL(detailPathColumn)
+		}
+	case OrderByInsertion:
+		column = sequenceColumn
+	}
+	return fmt.Sprintf("%s %s", column, sortOrder)
+}
+
 type SearchParams struct {
 	Search         string
 	HighlightStart string
 	HighlightEnd   string
 	Ellipses       string
 	NumTokens      int
+	// HighlightRanges, if true, returns snippets as plain text and reports the highlighted parts
+	// in SearchResult.Highlights rather than surrounding them with HighlightStart and
+	// HighlightEnd, so that highlighting is unambiguous even if the content contains the markers
+	HighlightRanges bool
+	// Columns optionally limits the search to the given columns of the full text index (see
+	// Options.FullTextColumns)
+	Columns []string
+	// ColumnWeights optionally weights matches in each column of the full text index when ranking
+	// results with BM25, for example to rank matches in a title above matches in a body. If
+	// specified, it must have one weight per column of the full text index, in the same order as
+	// Options.FullTextColumns. By default, all columns are weighted equally.
+	ColumnWeights []float64
+	// Terms optionally builds the search from the given terms, which are combined according to
+	// Combinator. Unlike Search, which uses FTS5 query syntax, terms are always matched literally.
+	// If Terms is specified, Search is ignored.
+	Terms      []SearchTerm
+	Combinator SearchCombinator
+	// MaxSnippetDocumentLength, if positive, skips building snippets for matched documents whose
+	// full text is longer than this many characters, since building snippets requires scanning the
+	// whole document, which is slow for very large documents. Such results get SnippetPlaceholder
+	// as their snippet instead.
+	MaxSnippetDocumentLength int
+	// SnippetPlaceholder is the snippet of results whose documents exceed
+	// MaxSnippetDocumentLength. Defaults to Ellipses.
+	SnippetPlaceholder string
+}
+
+// snippetSQL returns the SQL expression that builds the snippet for each result of this search,
+// given the columns of the full text index, which is aliased as f, along with its arguments
+func (search *SearchParams) snippetSQL(schema string, columns []string, highlightStart string, highlightEnd string) (string, []interface{}) {
+	snippet := fmt.Sprintf("snippet(%s_fts2, -1, ?, ?, ?, ?)", schema)
+	args := []interface{}{highlightStart, highlightEnd, search.Ellipses, search.NumTokens}
+	if search.MaxSnippetDocumentLength <= 0 {
+		return snippet, args
+	}
+	lengths := make([]string, 0, len(columns))
+	for _, column := range columns {
+		lengths = append(lengths, fmt.Sprintf("IFNULL(LENGTH(f.%s), 0)", column))
+	}
+	sql := fmt.Sprintf("CASE WHEN %s > ? THEN ? ELSE %s END", strings.Join(lengths, " + "), snippet)
+	return sql, append([]interface{}{search.MaxSnippetDocumentLength, search.SnippetPlaceholder}, args...)
+}
+
+// rankExpression returns the SQL expression by which to rank results of this search, given the
+// columns of the full text index, which is aliased as f
+func (search *SearchParams) rankExpression(schema string, columns []string) (string, error) {
+	if len(search.ColumnWeights) == 0 {
+		return "f.rank", nil
+	}
+	if len(search.ColumnWeights) != len(columns) {
+		return "", fmt.Errorf("%d column weights for %d full text columns: %w", len(search.ColumnWeights), len(columns), ErrInvalidQuery)
+	}
+	weights := make([]string, 0, len(search.ColumnWeights))
+	for _, weight := range search.ColumnWeights {
+		if math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return "", fmt.Errorf("invalid column weight %v: %w", weight, ErrInvalidQuery)
+		}
+		weights = append(weights, strconv.FormatFloat(weight, 'g', -1, 64))
+	}
+	return fmt.Sprintf("bm25(%s_fts2, %s)", schema, strings.Join(weights, ", ")), nil
+}
+
+// matchExpression returns the full text query for this search, limited to Columns if specified
+func (search *SearchParams) matchExpression() (string, error) {
+	expression := search.Search
+	if len(search.Terms) > 0 {
+		var err error
+		expression, err = termsExpression(search.Terms, search.Combinator)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(search.Columns) == 0 {
+		return expression, nil
+	}
+	return fmt.Sprintf("{%s} : (%s)", strings.Join(search.Columns, " "), expression), nil
 }
 
 func (search *SearchParams) ApplyDefaults() {
@@ -60,101 +491,334 @@ func (search *SearchParams) ApplyDefaults() {
 	if search.NumTokens <= 0 {
 		search.NumTokens = 64
 	}
+	if search.SnippetPlaceholder == "" {
+		search.SnippetPlaceholder = search.Ellipses
+	}
 }
 
 type Queryable interface {
 	getSerde() *serde
+	getSchema() string
+	rawQuery(sql string, args ...interface{}) (minisql.ScannableRows, error)
 	Get(path string) ([]byte, error)
+	GetMulti(paths []string) (map[string][]byte, error)
+	FTSTokens(path string) ([]string, error)
+	Generation(path string) (int64, error)
+	HasAny(pattern string) (bool, error)
+	// Count returns the number of items that List would return for the given query if it weren't
+	// limited by Start, Count and After
+	Count(query *QueryParams) (int, error)
 	List(query *QueryParams, search *SearchParams) ([]*item, error)
+	Iterate(query *QueryParams, search *SearchParams, fn func(*item) error) error
 }
 
 type DB interface {
 	Queryable
 	Begin() (TX, error)
+	// BeginContext is like Begin, but the transaction's statements run with ctx, so long running
+	// queries are interrupted once it's done. If ctx is done by the time the transaction is
+	// committed, the transaction is rolled back instead and Commit returns an error wrapping
+	// ctx.Err().
+	BeginContext(ctx context.Context) (TX, error)
+	// WithSchema returns a sibling DB that reads and writes the given schema of the same underlying
+	// database, whose tables have to exist already (see NewSiblingDB). Siblings share this DB's
+	// types, lifecycle and mainLoop, so commits to all of them are processed one at a time in the
+	// order in which they're made. Subscriptions only receive changes to the schema of the DB through
+	// which they were made, but they share a registry, so IDs have to be unique across siblings
+	// and Subscriptions and UnsubscribeAll apply to all of them. WithSchema panics with
+	// ErrInvalidSchema if the schema isn't a valid schema name (see NewDBWithOptions), which is
+	// only meant for programmer errors like a typo in a constant. Schema names that come from
+	// configuration or user input should go through the WithSchemaE function instead.
 	WithSchema(string) DB
-	Subscribe(*subscription)
+	Subscribe(*subscription) error
 	Unsubscribe(string)
+	// UnsubscribeAll removes all subscriptions. After the DB is closed, this is a no-op.
+	UnsubscribeAll()
+	// Subscriptions returns the IDs of all current subscriptions, sorted. Like Stats, it's
+	// answered by the mainLoop and thus can't be called from a synchronous subscriber's OnUpdate.
+	Subscriptions() []string
+	// Barrier waits until all commits that were submitted before it have been processed and
+	// their subscribers notified (see the Barrier function)
+	Barrier() error
 	RegisterType(id int16, example interface{})
+	// Snapshot opens a read-only view of the DB. All reads through the snapshot see the data as
+	// it was when the snapshot was opened, even as other transactions commit. This relies on the
+	// underlying database providing read isolation (e.g. SQLite in WAL mode). The snapshot must
+	// be closed when no longer needed.
+	Snapshot() (Snapshot, error)
+	// Stats returns statistics about this DB. Subscription statistics are gathered by the
+	// goroutine that notifies synchronous subscribers, so Stats must not be called from their
+	// OnUpdate.
+	Stats() (*Stats, error)
+	// SchemaStats returns row counts for the tables that hold this DB's schema
+	SchemaStats() (*DBStats, error)
+	// RebuildFTS rebuilds the full text index, dropping entries for paths that no longer exist
+	// and renumbering the rowids of indexed paths so that the counter from which new rowids are
+	// assigned is reset to the number of indexed paths
+	RebuildFTS() error
+	// Vacuum rebuilds the database file to reclaim the space left behind by deleted data. It may
+	// take a while on large databases and holds a write lock while it runs. It must not be called
+	// with a transaction open.
+	Vacuum() error
+	// Compact releases free pages back to the file system using incremental vacuuming, which is
+	// much cheaper than Vacuum but only has an effect on databases with auto_vacuum set to
+	// INCREMENTAL. It must not be called with a transaction open.
+	Compact() error
+	// Close stops the DB's background processing and closes the underlying minisql.DB. After
+	// Close, operations that need the background processing (like Commit and Subscribe) return
+	// ErrDBClosed rather than blocking forever.
+	Close() error
 }
 
 type TX interface {
 	Queryable
+	// Put puts a value at path, either as value or as its already serialized form. If both are
+	// nil, the path is deleted instead. Empty values like "" and []byte{} aren't nil and are
+	// stored like any other value, since serialized values always include their type tag.
 	Put(path string, value interface{}, serializedValue []byte, fullText string, updateIfPresent bool) error
+	// PutFullTextFields is like Put, but full text indexes each of the given fields in the column
+	// of the full text index with the same name (see Options.FullTextColumns)
+	PutFullTextFields(path string, value interface{}, serializedValue []byte, fullText map[string]string, updateIfPresent bool) error
+	// PutBatch puts the given values without full text indexing them, using as few statements as
+	// possible. Nil values delete their paths.
+	PutBatch(values map[string]interface{}) error
 	Delete(path string) error
+	// DeleteExisting is like Delete, but also reports whether there was a value at path
+	DeleteExisting(path string) (bool, error)
+	// DeleteMatching deletes all paths that match the given LIKE pattern, except for the paths
+	// listed in keep, and returns the number of paths deleted
+	DeleteMatching(pathPattern string, keep []string) (int, error)
+	// DeleteMulti deletes the given paths using as few statements as possible and returns the
+	// number of paths that actually had a value
+	DeleteMulti(paths []string) (int, error)
+	// Savepoint marks a point in the transaction to which it can later be rolled back using
+	// RollbackTo. Savepoints nest, and a name that's reused refers to the most recent savepoint
+	// with that name.
+	Savepoint(name string) error
+	// RollbackTo undoes all changes made since the named savepoint. The savepoint remains active.
+	RollbackTo(name string) error
+	// Release removes the named savepoint and any savepoints created after it, keeping their changes
+	Release(name string) error
+	// AfterCommit registers fn to be called after the transaction successfully commits. Callbacks
+	// run in the order in which they were registered, on the goroutine that called Commit. They
+	// don't run if the transaction is rolled back, and callbacks registered after a savepoint are
+	// discarded when rolling back to that savepoint.
+	AfterCommit(fn func())
 	Commit() error
 	Rollback() error
+	migrationApplied(version int) (bool, error)
+	recordMigration(version int) error
+	setUpSchema(schema string) error
+	putIndexed(path string, value interface{}, fullText string) (int64, error)
+}
+
+// Snapshot is a consistent, read-only view of a DB
+type Snapshot interface {
+	Queryable
+	Close() error
+}
+
+// Stats reports statistics about a DB
+type Stats struct {
+	// OpenTransactions is the number of transactions that have begun but not yet been committed
+	// or rolled back
+	OpenTransactions int64
+	// LeakedTransactions is the number of transactions that were garbage collected without having
+	// been committed or rolled back
+	LeakedTransactions int64
+	// SubscriptionPrefixCount is the number of distinct path prefixes that have subscriptions
+	SubscriptionPrefixCount int
+	// TrieNodeCount is the number of entries in the tries used to match changes to subscriptions,
+	// including entries for the detail paths of subscriptions that join details
+	TrieNodeCount int
+}
+
+// DBStats reports row counts for the tables of a single schema, which is useful for diagnosing
+// problems like full text index entries that outlive their data
+type DBStats struct {
+	// DataRows is the number of paths that have values
+	DataRows int64
+	// IndexedRows is the number of paths that are full text indexed
+	IndexedRows int64
+	// FTSRows is the number of rows in the full text index. It should equal IndexedRows.
+	FTSRows int64
+	// CounterValue is the current value of the counter used to assign full text index rowids
+	CounterValue int64
+}
+
+// transactionCounters tracks transactions across a DB and all of its WithSchema copies
+type transactionCounters struct {
+	open   atomic.Int64
+	leaked atomic.Int64
 }
 
 type queryable struct {
-	core   *minisql.QueryableAPI
-	schema string
-	serde  *serde
+	core            *minisql.QueryableAPI
+	schema          string
+	serde           *serde
+	paths           *pathCodec
+	fullTextColumns []string
+	// tracksInsertionOrder indicates whether the data table has a sequence column (see
+	// Options.TrackInsertionOrder)
+	tracksInsertionOrder bool
 }
 
 type db struct {
 	queryable
 	db                        *minisql.DBAPI
+	opts                      *Options
 	commits                   chan *commit
 	subscribes                chan *subscribeRequest
 	unsubscribes              chan *unsubscribeRequest
+	statsRequests             chan *statsRequest
+	subscriptionListRequests  chan *subscriptionListRequest
+	done                      chan interface{}
+	stopped                   chan interface{}
+	closeOnce                 *sync.Once
+	txCounters                *transactionCounters
+	previousValueSubscribers  *atomic.Int64
 	subscriptionsByPath       patricia.Trie
 	detailSubscriptionsByPath patricia.Trie
 }
 
 type tx struct {
 	queryable
-	commits chan *commit
-	tx      *minisql.TxAPI
-	updates map[string]*Item[*Raw[any]]
-	deletes map[string]bool
+	ctx        context.Context
+	commits    chan *commit
+	done       chan interface{}
+	stopped    chan interface{}
+	tx         *minisql.TxAPI
+	opts       *Options
+	txCounters *transactionCounters
+	finished   atomic.Bool
+	updates    map[string]*Item[*Raw[any]]
+	deletes    map[string]bool
+	// previous holds the values that paths had before this transaction first modified them. It's
+	// only populated while there are subscribers that want previous values.
+	previous                 map[string][]byte
+	previousValueSubscribers *atomic.Int64
+	// savepoints holds the active savepoints, most recent last
+	savepoints []*savepoint
+	// afterCommit holds the callbacks registered with AfterCommit
+	afterCommit []func()
+}
+
+// savepoint remembers the pending updates and deletes of a tx at the time the savepoint was created
+type savepoint struct {
+	name           string
+	updates        map[string]*Item[*Raw[any]]
+	deletes        map[string]bool
+	numAfterCommit int
+}
+
+type snapshot struct {
+	queryable
+	tx *minisql.TxAPI
 }
 
+// commit is a request to commit t on the mainLoop. A commit with a nil t is a barrier, which
+// commits nothing and finishes once all commits ahead of it have been processed.
 type commit struct {
 	t        *tx
 	finished chan error
+	// asyncBarriers are set for barriers (which have no t), see subscription.barrier
+	asyncBarriers []chan interface{}
 }
 
 func NewDB(core minisql.DB, schema string) (DB, error) {
-	_core := minisql.Wrap(core)
+	return NewDBWithOptions(core, schema, &Options{})
+}
 
-	// All data is stored in a single table that has a TEXT path and a BLOB value. The table is
-	// stored as an index organized table (WITHOUT ROWID option) as a performance
-	// optimization for range scans on the path. To support full text indexing in a separate
-	// fts5 table, we include a manually managed INTEGER rowid to which we can join the fts5
-	// table. Rows that are not full text indexed leave rowid null to save space.
-	err := _core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_data (path TEXT PRIMARY KEY, value BLOB, rowid INTEGER) WITHOUT ROWID", schema))
+// NewDBWithOptions opens a DB that stores its data in tables prefixed with the given schema, which
+// has to be a plain SQL identifier made up of letters, digits and underscores that doesn't start
+// with a digit. Tables are created as needed.
+func NewDBWithOptions(core minisql.DB, schema string, opts *Options) (DB, error) {
+	err := validateSchema(schema)
 	if err != nil {
-		return nil, fmt.Errorf("newdb: create data table: %w", err)
+		return nil, fmt.Errorf("newdb: %w", err)
 	}
-
-	// Create an index on only text values to speed up detail lookups that join on path = value
-	err = _core.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_data_value_index ON %s_data(value) WHERE SUBSTR(CAST(value AS TEXT), 1, 1) = 'T'", schema, schema))
+	if opts == nil {
+		opts = &Options{}
+	}
+	err = opts.validate()
 	if err != nil {
-		return nil, fmt.Errorf("newdb: create data value index: %w", err)
+		return nil, fmt.Errorf("newdb: %w", err)
 	}
+	_core := minisql.Wrap(core)
 
-	// Create a table for full text search
-	err = _core.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %s_fts2 USING fts5(value, tokenize='porter trigram')", schema))
+	// page size has to be set before any tables are created in order to take effect
+	if opts.PageSize > 0 {
+		err = _core.Exec(fmt.Sprintf("PRAGMA page_size = %d", opts.PageSize))
+		if err != nil {
+			return nil, fmt.Errorf("newdb: set page size: %w", err)
+		}
+	}
+	if opts.CacheSize != 0 {
+		err = _core.Exec(fmt.Sprintf("PRAGMA cache_size = %d", opts.CacheSize))
+		if err != nil {
+			return nil, fmt.Errorf("newdb: set cache size: %w", err)
+		}
+	}
+
+	// set up the tables in a single transaction so that concurrent callers don't see them half done
+	tx, err := _core.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("newdb: begin: %w", err)
+	}
+	err = setUpSchema(tx.QueryableAPI, schema, opts)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("newdb: %w", err)
+	}
+	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("newdb: create search table: %w", err)
+		return nil, fmt.Errorf("newdb: commit: %w", err)
+	}
+
+	for _, name := range sortedKeys(opts.Pragmas) {
+		value := opts.Pragmas[name]
+		if _, parseErr := strconv.ParseInt(value, 10, 64); parseErr != nil && !isPlainIdentifier(value) {
+			value = sqlQuote(value)
+		}
+		err = _core.Exec(fmt.Sprintf("PRAGMA %s = %s", name, value))
+		if err != nil {
+			return nil, fmt.Errorf("newdb: set pragma %v: %w", name, err)
+		}
 	}
 
-	// Create a table for managing custom counters (currently used only for full text indexing)
-	err = _core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_counters (id INTEGER PRIMARY KEY, value INTEGER)", schema))
+	paths, err := newPathCodec(opts.PathDictionary)
 	if err != nil {
-		return nil, fmt.Errorf("newdb: create counters table: %w", err)
+		return nil, fmt.Errorf("newdb: %w", err)
+	}
+
+	serde := newSerde()
+	if !opts.IgnoreGlobalTypes {
+		serde = newSerdeFromGlobal()
 	}
+	serde.compressionThreshold = opts.CompressionThreshold
+	serde.cipher = opts.ValueCipher
 
 	d := &db{
 		queryable: queryable{
-			core:   _core.QueryableAPI,
-			schema: schema,
-			serde:  newSerde(),
+			core:                 _core.QueryableAPI,
+			schema:               schema,
+			serde:                serde,
+			paths:                paths,
+			fullTextColumns:      opts.fullTextColumns(),
+			tracksInsertionOrder: opts.TrackInsertionOrder,
 		},
 		db:                        _core,
+		opts:                      opts,
 		commits:                   make(chan *commit, 100),
 		subscribes:                make(chan *subscribeRequest, 100),
 		unsubscribes:              make(chan *unsubscribeRequest, 100),
+		statsRequests:             make(chan *statsRequest),
+		subscriptionListRequests:  make(chan *subscriptionListRequest),
+		done:                      make(chan interface{}),
+		stopped:                   make(chan interface{}),
+		closeOnce:                 &sync.Once{},
+		txCounters:                &transactionCounters{},
+		previousValueSubscribers:  &atomic.Int64{},
 		subscriptionsByPath:       *patricia.NewTrie(),
 		detailSubscriptionsByPath: *patricia.NewTrie(),
 	}
@@ -162,16 +826,269 @@ func NewDB(core minisql.DB, schema string) (DB, error) {
 	return d, nil
 }
 
+// setUpSchema creates the tables of the given schema that don't exist yet and migrates the ones
+// that do to the given options
+func setUpSchema(core *minisql.QueryableAPI, schema string, opts *Options) error {
+	// All data is stored in a single table that has a TEXT path and a BLOB value. The table is
+	// stored as an index organized table (WITHOUT ROWID option) as a performance
+	// optimization for range scans on the path. To support full text indexing in a separate
+	// fts5 table, we include a manually managed INTEGER rowid to which we can join the fts5
+	// table. Rows that are not full text indexed leave rowid null to save space.
+	err := core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_data (path TEXT PRIMARY KEY, value BLOB, rowid INTEGER) WITHOUT ROWID", schema))
+	if err != nil {
+		return fmt.Errorf("create data table: %w", err)
+	}
+
+	if opts.TrackInsertionOrder {
+		err = addSequenceColumn(core, schema)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create an index on only text values to speed up detail lookups that join on path = value
+	err = core.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_data_value_index ON %s_data(value) WHERE SUBSTR(CAST(value AS TEXT), 1, 1) = 'T'", schema, schema))
+	if err != nil {
+		return fmt.Errorf("create data value index: %w", err)
+	}
+
+	// Create a table for full text search
+	err = core.Exec(fullTextTableSQL(fmt.Sprintf("%s_fts2", schema), opts.fullTextColumns(), opts.tokenizer()))
+	if err != nil {
+		return fmt.Errorf("create search table: %w", err)
+	}
+	err = migrateFullTextIndex(core, schema, opts)
+	if err != nil {
+		return err
+	}
+
+	// Create a table for inspecting the tokens in the full text index (used only for diagnostics)
+	err = core.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %s_fts2_vocab USING fts5vocab(%s_fts2, instance)", schema, schema))
+	if err != nil {
+		return fmt.Errorf("create search vocabulary table: %w", err)
+	}
+
+	// Create a table for tracking the generation of each path, which is incremented on every put.
+	// This is kept separate from the data table so that existing databases don't need migrating.
+	err = core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_generations (path TEXT PRIMARY KEY, generation INTEGER) WITHOUT ROWID", schema))
+	if err != nil {
+		return fmt.Errorf("create generations table: %w", err)
+	}
+
+	// Create a table for managing custom counters (used for full text indexing and for tracking
+	// insertion order)
+	err = core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_counters (id INTEGER PRIMARY KEY, value INTEGER)", schema))
+	if err != nil {
+		return fmt.Errorf("create counters table: %w", err)
+	}
+
+	// Create a table for tracking which migrations have been applied (see Migrate)
+	err = core.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_migrations (version INTEGER PRIMARY KEY)", schema))
+	if err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+	return nil
+}
+
 func (d *db) WithSchema(schema string) DB {
+	err := validateSchema(schema)
+	if err != nil {
+		// schemas are interpolated into SQL, so an invalid one can't be allowed to get that far
+		panic(fmt.Errorf("withschema: %w", err))
+	}
 	return &db{
 		queryable: queryable{
-			core:   d.core,
-			schema: schema,
-			serde:  d.serde,
+			core:                 d.core,
+			schema:               schema,
+			serde:                d.serde,
+			paths:                d.paths,
+			fullTextColumns:      d.fullTextColumns,
+			tracksInsertionOrder: d.tracksInsertionOrder,
+		},
+		db:                       d.db,
+		opts:                     d.opts,
+		commits:                  d.commits,
+		subscribes:               d.subscribes,
+		unsubscribes:             d.unsubscribes,
+		statsRequests:            d.statsRequests,
+		subscriptionListRequests: d.subscriptionListRequests,
+		done:                     d.done,
+		stopped:                  d.stopped,
+		closeOnce:                d.closeOnce,
+		txCounters:               d.txCounters,
+		previousValueSubscribers: d.previousValueSubscribers,
+	}
+}
+
+// validateSchema checks that the given schema is safe to interpolate into SQL
+func validateSchema(schema string) error {
+	if !isPlainIdentifier(schema) {
+		return fmt.Errorf("%q is not a plain identifier: %w", schema, ErrInvalidSchema)
+	}
+	return nil
+}
+
+type statsRequest struct {
+	stats *Stats
+	done  chan interface{}
+}
+
+// Stats returns statistics about the DB. After the DB is closed, subscription statistics are zero.
+// Called from a synchronous OnUpdate, it would wait for the mainLoop that's running OnUpdate and
+// never return.
+func (d *db) Stats() (*Stats, error) {
+	sr := &statsRequest{
+		stats: &Stats{
+			OpenTransactions:   d.txCounters.open.Load(),
+			LeakedTransactions: d.txCounters.leaked.Load(),
 		},
-		db:      d.db,
-		commits: d.commits,
+		done: make(chan interface{}),
+	}
+	// subscription statistics are gathered on the mainLoop, which owns the tries
+	select {
+	case d.statsRequests <- sr:
+		<-sr.done
+	case <-d.done:
+	}
+	return sr.stats, nil
+}
+
+func (d *db) Barrier() error {
+	barrier := &commit{
+		finished: make(chan error, 1),
+	}
+	select {
+	case d.commits <- barrier:
+	case <-d.done:
+		return fmt.Errorf("barrier: %w", ErrDBClosed)
+	}
+	select {
+	case <-barrier.finished:
+	case <-d.done:
+		return fmt.Errorf("barrier: %w", ErrDBClosed)
+	}
+	// asynchronous subscriptions close their barriers even once they're stopped
+	for _, asyncBarrier := range barrier.asyncBarriers {
+		<-asyncBarrier
+	}
+	return nil
+}
+
+func (d *db) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		<-d.stopped
+		err = d.db.Close()
+	})
+	return err
+}
+
+func (d *db) SchemaStats() (*DBStats, error) {
+	stats := &DBStats{}
+	queries := []struct {
+		sql    string
+		result *int64
+	}{
+		{fmt.Sprintf("SELECT COUNT(*) FROM %s_data", d.schema), &stats.DataRows},
+		{fmt.Sprintf("SELECT COUNT(*) FROM %s_data WHERE rowid IS NOT NULL", d.schema), &stats.IndexedRows},
+		{fmt.Sprintf("SELECT COUNT(*) FROM %s_fts2", d.schema), &stats.FTSRows},
+		{fmt.Sprintf("SELECT value FROM %s_counters WHERE id = 0", d.schema), &stats.CounterValue},
+	}
+	for _, query := range queries {
+		n, err := d.queryInt(query.sql)
+		if err != nil {
+			return nil, fmt.Errorf("schemastats: %w", err)
+		}
+		*query.result = int64(n)
+	}
+	return stats, nil
+}
+
+// queryInt runs the given query and returns the integer in the first column of the first row, or
+// 0 if there are no rows
+func (q *queryable) queryInt(sql string, args ...interface{}) (int, error) {
+	rows, err := q.core.Query(sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, nil
+	}
+	var n int
+	err = rows.Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("scan: %w", err)
+	}
+	return n, nil
+}
+
+func (d *db) RebuildFTS() error {
+	select {
+	case <-d.done:
+		return fmt.Errorf("rebuildfts: %w", ErrDBClosed)
+	default:
+	}
+
+	_tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("rebuildfts: begin: %w", err)
+	}
+	columns := strings.Join(d.opts.fullTextColumns(), ", ")
+	statements := []string{
+		// number the rowids of the indexed paths consecutively starting at 0, like the counter does
+		"DROP TABLE IF EXISTS temp.pathdb_rebuild_fts",
+		fmt.Sprintf("CREATE TEMP TABLE pathdb_rebuild_fts (old_rowid INTEGER PRIMARY KEY, new_rowid INTEGER, %s)", columns),
+		fmt.Sprintf("INSERT INTO temp.pathdb_rebuild_fts(old_rowid, new_rowid, %s) SELECT d.rowid, ROW_NUMBER() OVER (ORDER BY d.rowid) - 1, %s FROM %s_data d INNER JOIN %s_fts2 f ON f.rowid = d.rowid WHERE d.rowid IS NOT NULL", columns, prefixColumns("f", d.opts.fullTextColumns()), d.schema, d.schema),
+		// paths without an index entry end up with a null rowid
+		fmt.Sprintf("UPDATE %s_data SET rowid = (SELECT new_rowid FROM temp.pathdb_rebuild_fts WHERE old_rowid = %s_data.rowid) WHERE rowid IS NOT NULL", d.schema, d.schema),
+		fmt.Sprintf("DELETE FROM %s_fts2", d.schema),
+		fmt.Sprintf("INSERT INTO %s_fts2(rowid, %s) SELECT new_rowid, %s FROM temp.pathdb_rebuild_fts", d.schema, columns, columns),
+		fmt.Sprintf("INSERT INTO %s_fts2(%s_fts2) VALUES('optimize')", d.schema, d.schema),
+		fmt.Sprintf("DELETE FROM %s_counters WHERE id = 0", d.schema),
+		fmt.Sprintf("INSERT INTO %s_counters(id, value) SELECT 0, MAX(new_rowid) FROM temp.pathdb_rebuild_fts HAVING COUNT(*) > 0", d.schema),
+		"DROP TABLE temp.pathdb_rebuild_fts",
+	}
+	for _, statement := range statements {
+		err = _tx.Exec(statement)
+		if err != nil {
+			_tx.Rollback()
+			return fmt.Errorf("rebuildfts: %w", err)
+		}
+	}
+	err = _tx.Commit()
+	if err != nil {
+		return fmt.Errorf("rebuildfts: commit: %w", err)
+	}
+	return nil
+}
+
+func (d *db) Vacuum() error {
+	err := d.runMaintenance("VACUUM")
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	return nil
+}
+
+func (d *db) Compact() error {
+	err := d.runMaintenance("PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return nil
+}
+
+// runMaintenance runs the given statement directly against the database, outside of any
+// transaction
+func (d *db) runMaintenance(statement string) error {
+	select {
+	case <-d.done:
+		return ErrDBClosed
+	default:
 	}
+	return d.db.Exec(statement)
 }
 
 func (d *db) RegisterType(id int16, example interface{}) {
@@ -179,34 +1096,132 @@ func (d *db) RegisterType(id int16, example interface{}) {
 }
 
 func (d *db) Begin() (TX, error) {
-	_tx, err := d.db.Begin()
+	return d.BeginContext(context.Background())
+}
+
+func (d *db) BeginContext(ctx context.Context) (TX, error) {
+	select {
+	case <-d.done:
+		return nil, fmt.Errorf("begin: %w", ErrDBClosed)
+	default:
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	_tx, err := d.db.BeginContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("begin: %w", err)
 	}
 
-	return &tx{
+	t := &tx{
+		queryable: queryable{
+			core:                 _tx.QueryableAPI,
+			schema:               d.schema,
+			serde:                d.serde,
+			paths:                d.paths,
+			fullTextColumns:      d.fullTextColumns,
+			tracksInsertionOrder: d.tracksInsertionOrder,
+		},
+		ctx:        ctx,
+		tx:         _tx,
+		opts:       d.opts,
+		txCounters: d.txCounters,
+		commits:    d.commits,
+		done:       d.done,
+		stopped:    d.stopped,
+		updates:    make(map[string]*Item[*Raw[any]]),
+		deletes:    make(map[string]bool),
+		previous:   make(map[string][]byte),
+
+		previousValueSubscribers: d.previousValueSubscribers,
+	}
+	d.txCounters.open.Add(1)
+	runtime.SetFinalizer(t, func(t *tx) {
+		if !t.finished.Load() {
+			t.txCounters.leaked.Add(1)
+			log.Errorf("transaction was garbage collected without being committed or rolled back")
+		}
+	})
+	return t, nil
+}
+
+func (d *db) Snapshot() (Snapshot, error) {
+	select {
+	case <-d.done:
+		return nil, fmt.Errorf("snapshot: %w", ErrDBClosed)
+	default:
+	}
+
+	_tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: begin: %w", err)
+	}
+	// SQLite transactions are deferred, meaning that the snapshot is only established at the
+	// first read, so read something now
+	rows, err := _tx.Query(fmt.Sprintf("SELECT path FROM %s_data LIMIT 1", d.schema))
+	if err != nil {
+		_tx.Rollback()
+		return nil, fmt.Errorf("snapshot: initial read: %w", err)
+	}
+	rows.Next()
+	rows.Close()
+
+	return &snapshot{
 		queryable: queryable{
-			core:   _tx.QueryableAPI,
-			schema: d.schema,
-			serde:  d.serde,
+			core:                 _tx.QueryableAPI,
+			schema:               d.schema,
+			serde:                d.serde,
+			paths:                d.paths,
+			fullTextColumns:      d.fullTextColumns,
+			tracksInsertionOrder: d.tracksInsertionOrder,
 		},
-		tx:      _tx,
-		commits: d.commits,
-		updates: make(map[string]*Item[*Raw[any]]),
-		deletes: make(map[string]bool),
+		tx: _tx,
 	}, nil
 }
 
+func (s *snapshot) Close() error {
+	return s.tx.Rollback()
+}
+
+// mainLoop processes commits and subscription requests one at a time, for this DB and all of its
+// WithSchema siblings. It's the only goroutine that touches the subscription tries.
 func (d *db) mainLoop() {
+	defer close(d.stopped)
 	for {
 		select {
+		case <-d.done:
+			d.stopSubscriptions()
+			return
 		case commit := <-d.commits:
-			d.onCommit(commit)
+			if commit.t == nil {
+				// barrier, everything ahead of it has been processed, but asynchronous subscriptions
+				// may still be delivering it
+				commit.asyncBarriers = d.asyncBarriers()
+				commit.finished <- nil
+				continue
+			}
+			err := commit.t.ctx.Err()
+			if err != nil {
+				// context was cancelled before we got around to committing, roll back instead
+				commit.finished <- commit.t.abort(err)
+				continue
+			}
+			err = d.onCommit(commit)
+			if err != nil {
+				commit.finished <- commit.t.abort(err)
+				continue
+			}
 			commit.finished <- commit.t.doCommit()
 		case s := <-d.subscribes:
 			d.onNewSubscription(s)
 		case id := <-d.unsubscribes:
 			d.onDeleteSubscription(id)
+		case sr := <-d.statsRequests:
+			d.onStats(sr)
+		case slr := <-d.subscriptionListRequests:
+			d.onListSubscriptions(slr)
 		}
 	}
 }
@@ -215,10 +1230,18 @@ func (q *queryable) getSerde() *serde {
 	return q.serde
 }
 
-func (q *queryable) Get(path string) ([]byte, error) {
-	rows, err := q.core.Query(fmt.Sprintf("SELECT value FROM %s_data WHERE path = ?", q.schema), path)
-	if err != nil {
-		return nil, fmt.Errorf("get: query: %w", err)
+func (q *queryable) getSchema() string {
+	return q.schema
+}
+
+func (q *queryable) rawQuery(sql string, args ...interface{}) (minisql.ScannableRows, error) {
+	return q.core.Query(sql, args...)
+}
+
+func (q *queryable) Get(path string) ([]byte, error) {
+	rows, err := q.core.Query(fmt.Sprintf("SELECT value FROM %s_data WHERE path = ?", q.schema), q.paths.encode(path))
+	if err != nil {
+		return nil, fmt.Errorf("get: query: %w", err)
 	}
 	defer rows.Close()
 	if !rows.Next() {
@@ -232,102 +1255,412 @@ func (q *queryable) Get(path string) ([]byte, error) {
 	return b, nil
 }
 
+// Generation returns the number of times that a value has been put at the given path, or 0 if no
+// value has ever been put there
+func (q *queryable) Generation(path string) (int64, error) {
+	rows, err := q.core.Query(fmt.Sprintf("SELECT generation FROM %s_generations WHERE path = ?", q.schema), q.paths.encode(path))
+	if err != nil {
+		return 0, fmt.Errorf("generation: query: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, nil
+	}
+	var generation int64
+	err = rows.Scan(&generation)
+	if err != nil {
+		return 0, fmt.Errorf("generation: scan: %w", err)
+	}
+	return generation, nil
+}
+
+// HasAny checks whether at least one path matches the given LIKE pattern
+func (q *queryable) HasAny(pattern string) (bool, error) {
+	match, pattern := q.paths.matchClause("path", "LIKE", pattern)
+	rows, err := q.core.Query(fmt.Sprintf("SELECT 1 FROM %s_data WHERE %s LIMIT 1", q.schema, match), pattern)
+	if err != nil {
+		return false, fmt.Errorf("hasany: query: %w", err)
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// FTSTokens returns the tokens that the full text index holds for the given path, in the order in
+// which they appear in the indexed text. It returns nil if the path isn't full text indexed.
+func (q *queryable) FTSTokens(path string) ([]string, error) {
+	rows, err := q.core.Query(fmt.Sprintf("SELECT v.term FROM %s_data d INNER JOIN %s_fts2_vocab v ON v.doc = d.rowid WHERE d.path = ? ORDER BY v.offset", q.schema, q.schema), q.paths.encode(path))
+	if err != nil {
+		return nil, fmt.Errorf("ftstokens: query: %w", err)
+	}
+	defer rows.Close()
+	var tokens []string
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, fmt.Errorf("ftstokens: scan: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (q *queryable) GetMulti(paths []string) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(paths))
+	err := inChunks(q.paths.encodeAll(paths), func(placeholders string, args []interface{}) error {
+		rows, err := q.core.Query(fmt.Sprintf("SELECT path, value FROM %s_data WHERE path IN (%s)", q.schema, placeholders), args...)
+		if err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var path string
+			var b []byte
+			err = rows.Scan(&path, &b)
+			if err != nil {
+				return fmt.Errorf("scan: %w", err)
+			}
+			result[q.paths.decode(path)] = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getmulti: %w", err)
+	}
+	return result, nil
+}
+
+// inChunks splits paths into chunks of at most maxPathsPerQuery and calls fn for each chunk with
+// the placeholders for an IN (...) clause and the corresponding query arguments
+func inChunks(paths []string, fn func(placeholders string, args []interface{}) error) error {
+	for start := 0; start < len(paths); start += maxPathsPerQuery {
+		end := start + maxPathsPerQuery
+		if end > len(paths) {
+			end = len(paths)
+		}
+		chunk := paths[start:end]
+		args := make([]interface{}, 0, len(chunk))
+		for _, path := range chunk {
+			args = append(args, path)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", ")
+		err := fn(placeholders, args)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (q *queryable) List(query *QueryParams, search *SearchParams) ([]*item, error) {
-	query.ApplyDefaults()
-	var err error
+	items := make([]*item, 0, 100)
+	err := q.Iterate(query, search, func(i *item) error {
+		items = append(items, i)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	return items, nil
+}
+
+// Iterate runs the given query and calls fn with each resulting item, one row at a time, without
+// buffering the full result set. If fn returns an error, iteration stops and that error is
+// returned.
+func (q *queryable) Iterate(query *QueryParams, search *SearchParams, fn func(*item) error) error {
+	err := q.validate(query, search)
+	if err != nil {
+		return fmt.Errorf("iterate: %w", err)
+	}
 	var rows minisql.ScannableRows
+	// detail paths are stored as plain text values, so encode them to join to stored paths
+	joinDetailPath := q.paths.encodeSQL("SUBSTR(CAST(l.value AS TEXT), 2)")
 	isSearch := search != nil
+	var highlightStart, highlightEnd string
 	if isSearch {
 		search.ApplyDefaults()
-		sql := fmt.Sprintf("SELECT d.path, d.value, snippet(%s_fts2, 0, ?, ?, ?, ?) FROM %s_fts2 f INNER JOIN %s_data d ON f.rowid = d.rowid WHERE d.path LIKE ? AND f.value MATCH ? ORDER BY f.rank LIMIT ? OFFSET ?", q.schema, q.schema, q.schema)
+		highlightStart, highlightEnd = search.HighlightStart, search.HighlightEnd
+		if search.HighlightRanges {
+			highlightStart, highlightEnd = newHighlightMarkers()
+		}
+		var rank string
+		rank, err = search.rankExpression(q.schema, q.fullTextColumns)
+		if err != nil {
+			return fmt.Errorf("iterate: %w", err)
+		}
+		var matchExpression string
+		matchExpression, err = search.matchExpression()
+		if err != nil {
+			return fmt.Errorf("iterate: %w", err)
+		}
+		orderBy := query.orderByClause(rank, q.paths)
+		match, patterns := query.matchClause("d.path", q.paths)
+		values := query.valueColumns("d.value")
+		snippet, args := search.snippetSQL(q.schema, q.fullTextColumns, highlightStart, highlightEnd)
+		sql := fmt.Sprintf("SELECT d.path, %s, %s FROM %s_fts2 f INNER JOIN %s_data d ON f.rowid = d.rowid WHERE %s AND f.%s_fts2 MATCH ? ORDER BY %s LIMIT ? OFFSET ?", values, snippet, q.schema, q.schema, match, q.schema, orderBy)
 		if query.JoinDetails {
 			join := "INNER JOIN"
 			if query.IncludeEmptyDetails {
 				join = "RIGHT OUTER JOIN"
 			}
-			sql = fmt.Sprintf("SELECT l.path, CAST(l.value AS TEXT), d.value, snippet(%s_fts2, 0, ?, ?, ?, ?) FROM %s_fts2 f INNER JOIN %s_data d ON f.rowid = d.rowid %s %s_data l ON SUBSTR(CAST(l.value AS TEXT), 2) = d.path WHERE l.path LIKE ? AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T' AND f.value MATCH ? ORDER BY f.rank LIMIT ? OFFSET ?", q.schema, q.schema, q.schema, join, q.schema)
-		}
-		rows, err = q.core.Query(
-			sql,
-			search.HighlightStart,
-			search.HighlightEnd,
-			search.Ellipses,
-			search.NumTokens,
-			query.Path,
-			search.Search,
-			query.Count,
-			query.Start,
-		)
+			match, patterns = query.matchClause("l.path", q.paths)
+			sql = fmt.Sprintf("SELECT l.path, CAST(l.value AS TEXT), %s, %s FROM %s_fts2 f INNER JOIN %s_data d ON f.rowid = d.rowid %s %s_data l ON %s = d.path WHERE %s AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T' AND f.%s_fts2 MATCH ? ORDER BY %s LIMIT ? OFFSET ?", values, snippet, q.schema, q.schema, join, q.schema, joinDetailPath, match, q.schema, orderBy)
+		}
+		args = append(args, patterns...)
+		args = append(args, matchExpression, query.Count, query.Start)
+		rows, err = q.core.Query(sql, args...)
 	} else {
-		sortOrder := "ASC"
-		if query.ReverseSort {
-			sortOrder = "DESC"
+		orderBy := query.orderByClause("", q.paths)
+		pathColumn := "path"
+		joinDetails := query.JoinDetails && !query.DistinctDetails
+		if joinDetails {
+			pathColumn = "l.path"
 		}
-		sql := fmt.Sprintf("SELECT path, value FROM %s_data WHERE path LIKE ? ORDER BY path %s LIMIT ? OFFSET ?", q.schema, sortOrder)
-		if query.JoinDetails {
+		match, args := query.matchClause(pathColumn, q.paths)
+		if query.DistinctDetails {
+			// list the details themselves, ordered as if they'd been listed directly
+			plain := *query
+			plain.JoinDetails = false
+			orderBy = plain.orderByClause("", q.paths)
+			match, args = q.distinctDetailsClause(query)
+		}
+		page := "LIMIT ? OFFSET ?"
+		if query.After != "" {
+			// keyset pagination, continue from the given path rather than skipping rows
+			comparison := ">"
+			if query.ReverseSort {
+				comparison = "<"
+			}
+			match = fmt.Sprintf("%s AND %s %s ?", match, q.paths.decodeSQL(pathColumn), comparison)
+			args = append(args, query.After, query.Count)
+			page = "LIMIT ?"
+		} else {
+			args = append(args, query.Count, query.Start)
+		}
+		sql := fmt.Sprintf("SELECT path, %s FROM %s_data WHERE %s ORDER BY %s %s", query.valueColumns("value"), q.schema, match, orderBy, page)
+		if joinDetails {
 			join := "INNER JOIN"
 			if query.IncludeEmptyDetails {
 				join = "LEFT OUTER JOIN"
 			}
-			sql = fmt.Sprintf("SELECT l.path, CAST(l.value AS TEXT), d.value FROM %s_data l %s %s_data d ON SUBSTR(CAST(l.value AS TEXT), 2) = d.path WHERE l.path LIKE ? AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T' ORDER BY l.path %s LIMIT ? OFFSET ?", q.schema, join, q.schema, sortOrder)
+			hops, pointer := q.hopJoins(query, join)
+			sql = fmt.Sprintf("SELECT l.path, IFNULL(CAST(%s.value AS TEXT), ''), %s FROM %s_data l%s %s %s_data d ON %s = d.path WHERE %s AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T' ORDER BY %s %s", pointer, query.valueColumns("d.value"), q.schema, hops, join, q.schema, q.detailPathSQL(pointer), match, orderBy, page)
 		}
-		rows, err = q.core.Query(
-			sql,
-			query.Path,
-			query.Count,
-			query.Start,
-		)
+		rows, err = q.core.Query(sql, args...)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("list: query: %w", err)
+		return fmt.Errorf("iterate: query: %w", err)
 	}
 
+	projection := query.projection()
 	defer rows.Close()
-	items := make([]*item, 0, 100)
 	for rows.Next() {
 		item := &item{}
 		var path string
 		var _detailPath string
+		// columns are path, detail path (if joining details), value, size and total (if
+		// projected) and snippet (if searching)
+		dest := []interface{}{&path}
+		if query.JoinDetails && !query.DistinctDetails {
+			dest = append(dest, &_detailPath)
+		}
+		dest = append(dest, &item.value)
+		if projection&ProjectSize != 0 {
+			dest = append(dest, &item.size)
+		}
+		if projection&projectTotal != 0 {
+			dest = append(dest, &item.total)
+		}
 		if isSearch {
-			if query.JoinDetails {
-				err = rows.Scan(&path, &_detailPath, &item.value, &item.snippet)
-			} else {
-				err = rows.Scan(&path, &item.value, &item.snippet)
-			}
-		} else {
-			if query.JoinDetails {
-				err = rows.Scan(&path, &_detailPath, &item.value)
-			} else {
-				err = rows.Scan(&path, &item.value)
-			}
+			dest = append(dest, &item.snippet)
 		}
+		err = rows.Scan(dest...)
 		if err != nil {
-			return nil, fmt.Errorf("list: scan: %w", err)
+			return fmt.Errorf("iterate: scan: %w", err)
 		}
-		item.path = path
-		if _detailPath != "" {
+		if isSearch && search.HighlightRanges {
+			item.snippet, item.highlights = parseHighlights(item.snippet, highlightStart, highlightEnd)
+		}
+		item.path = q.paths.decode(path)
+		if _detailPath != "" && projection&ProjectDetailPath != 0 {
 			item.detailPath = _detailPath[1:]
 		}
-		items = append(items, item)
+		if projection&projectIndexValue != 0 {
+			// the detail path is the index entry's value, which is always stored as plain text
+			item.indexValue = []byte(_detailPath)
+		}
+		if query.DistinctDetails && projection&ProjectDetailPath != 0 {
+			item.detailPath = item.path
+		}
+		err = fn(item)
+		if err != nil {
+			return err
+		}
 	}
 
-	return items, nil
+	return nil
+}
+
+// validate applies the defaults of the given query and checks that it can be run, optionally as a
+// search
+func (q *queryable) validate(query *QueryParams, search *SearchParams) error {
+	query.ApplyDefaults()
+	if query.JoinDepth < 0 || query.JoinDepth > maxJoinDepth || (query.JoinDepth > 1 && search != nil) {
+		return fmt.Errorf("join depth %d isn't between 0 and %d or used with a search: %w", query.JoinDepth, maxJoinDepth, ErrInvalidQuery)
+	}
+	if query.JoinDetails && q.serde.cipher != nil {
+		return errEncryptedDetailPaths
+	}
+	if query.DistinctDetails && (!query.JoinDetails || query.IncludeEmptyDetails || search != nil) {
+		return fmt.Errorf("distinct details require joining details without empty details and can't be searched: %w", ErrInvalidQuery)
+	}
+	if query.After != "" && (search != nil || query.OrderBy == OrderByInsertion || (query.JoinDetails && !query.DistinctDetails && query.OrderBy == OrderByDetailPath)) {
+		return fmt.Errorf("after requires a list ordered by path: %w", ErrInvalidQuery)
+	}
+	if query.OrderBy == OrderByInsertion && !q.tracksInsertionOrder {
+		return fmt.Errorf("ordering by insertion requires TrackInsertionOrder: %w", ErrInvalidQuery)
+	}
+	if query.JoinDetails && query.StrictDetailPaths {
+		err := q.checkDetailPaths(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queryable) Count(query *QueryParams) (int, error) {
+	err := q.validate(query, nil)
+	if err != nil {
+		return 0, fmt.Errorf("count: %w", err)
+	}
+	match, args := query.matchClause("path", q.paths)
+	if query.DistinctDetails {
+		match, args = q.distinctDetailsClause(query)
+	}
+	sql := fmt.Sprintf("SELECT COUNT(*) FROM %s_data WHERE %s", q.schema, match)
+	if query.JoinDetails && !query.DistinctDetails {
+		join := "INNER JOIN"
+		if query.IncludeEmptyDetails {
+			join = "LEFT OUTER JOIN"
+		}
+		match, args = query.matchClause("l.path", q.paths)
+		hops, pointer := q.hopJoins(query, join)
+		sql = fmt.Sprintf("SELECT COUNT(*) FROM %s_data l%s %s %s_data d ON %s = d.path WHERE %s AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T'", q.schema, hops, join, q.schema, q.detailPathSQL(pointer), match)
+	}
+	count, err := q.queryInt(sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("count: %w", err)
+	}
+	return count, nil
+}
+
+// distinctDetailsClause returns the SQL condition that matches the details referenced by the index
+// entries that match the given query, along with its arguments
+func (q *queryable) distinctDetailsClause(query *QueryParams) (string, []interface{}) {
+	match, args := query.matchClause("l.path", q.paths)
+	hops, pointer := q.hopJoins(query, "INNER JOIN")
+	return fmt.Sprintf("path IN (SELECT %s FROM %s_data l%s WHERE %s AND SUBSTR(CAST(l.value AS TEXT), 1, 1) = 'T')", q.detailPathSQL(pointer), q.schema, hops, match), args
+}
+
+// hopJoins returns the SQL that joins the intermediate index entries (aliased h1, h2, ...) when
+// following chains of index entries (see QueryParams.JoinDepth), along with the alias of the entry
+// that points to the detail, which is l for the index itself if there are no intermediate entries
+func (q *queryable) hopJoins(query *QueryParams, join string) (string, string) {
+	var b strings.Builder
+	pointer := "l"
+	for i := 1; i < query.JoinDepth; i++ {
+		hop := fmt.Sprintf("h%d", i)
+		fmt.Fprintf(&b, " %s %s_data %s ON %s = %s.path AND SUBSTR(CAST(%s.value AS TEXT), 1, 1) = 'T'", join, q.schema, hop, q.detailPathSQL(pointer), hop, hop)
+		pointer = hop
+	}
+	return b.String(), pointer
+}
+
+// detailPathSQL returns the SQL for the stored path to which the entry with the given alias points
+func (q *queryable) detailPathSQL(alias string) string {
+	return q.paths.encodeSQL(fmt.Sprintf("SUBSTR(CAST(%s.value AS TEXT), 2)", alias))
+}
+
+// checkDetailPaths checks that all index entries matching the given query are strings, which is
+// how detail paths are stored
+func (q *queryable) checkDetailPaths(query *QueryParams) error {
+	match, args := query.matchClause("path", q.paths)
+	rows, err := q.core.Query(fmt.Sprintf("SELECT path FROM %s_data WHERE %s AND SUBSTR(CAST(value AS TEXT), 1, 1) != 'T' LIMIT 1", q.schema, match), args...)
+	if err != nil {
+		return fmt.Errorf("check detail paths: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil
+	}
+	var path string
+	err = rows.Scan(&path)
+	if err != nil {
+		return fmt.Errorf("check detail paths: scan: %w", err)
+	}
+	return fmt.Errorf("index entry at %v isn't a string detail path: %w", q.paths.decode(path), ErrInvalidQuery)
 }
 
 func (t *tx) Put(path string, value interface{}, serializedValue []byte, fullText string, updateIfPresent bool) error {
+	var fullTextFields map[string]string
+	if fullText != "" {
+		fullTextFields = map[string]string{t.opts.fullTextColumns()[0]: fullText}
+	}
+	return t.PutFullTextFields(path, value, serializedValue, fullTextFields, updateIfPresent)
+}
+
+func (t *tx) PutFullTextFields(path string, value interface{}, serializedValue []byte, fullText map[string]string, updateIfPresent bool) error {
+	_, err := t.putFullTextFields(path, value, serializedValue, fullText, updateIfPresent)
+	return err
+}
+
+func (t *tx) putIndexed(path string, value interface{}, fullText string) (int64, error) {
+	var fullTextFields map[string]string
+	if fullText != "" {
+		fullTextFields = map[string]string{t.opts.fullTextColumns()[0]: fullText}
+	}
+	return t.putFullTextFields(path, value, nil, fullTextFields, true)
+}
+
+// putFullTextFields implements PutFullTextFields and returns the rowid used for full text
+// indexing, or -1 if the value wasn't full text indexed
+func (t *tx) putFullTextFields(path string, value interface{}, serializedValue []byte, fullText map[string]string, updateIfPresent bool) (int64, error) {
+	rowID, err := t.doPut(path, value, serializedValue, fullText, updateIfPresent)
+	if err != nil {
+		return -1, err
+	}
+	if value == nil && serializedValue == nil {
+		// this was a delete, which leaves the generation alone
+		return -1, nil
+	}
+	err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_generations(path, generation) VALUES(?, 1) ON CONFLICT(path) DO UPDATE SET generation = generation+1", t.schema), t.paths.encode(path))
+	if err != nil {
+		return -1, fmt.Errorf("put: increment generation: %w", err)
+	}
+	return rowID, nil
+}
+
+// doPut puts the value and returns the rowid used for full text indexing, or -1 if the value
+// wasn't full text indexed
+func (t *tx) doPut(path string, value interface{}, serializedValue []byte, fullText map[string]string, updateIfPresent bool) (int64, error) {
+	err := t.recordPrevious(path)
+	if err != nil {
+		return -1, fmt.Errorf("put: %w", err)
+	}
+
 	if value == nil && serializedValue == nil {
 		err := t.Delete(path)
 		if err != nil {
-			return fmt.Errorf("put: delete: %w", err)
+			return -1, fmt.Errorf("put: delete: %w", err)
 		}
-		return nil
+		return -1, nil
 	}
 
-	var err error
 	if serializedValue == nil && value != nil {
 		serializedValue, err = t.serde.serialize(value)
 		if err != nil {
-			return fmt.Errorf("put: serialize value: %w", err)
+			return -1, fmt.Errorf("put: serialize value: %w", err)
 		}
 	}
 
@@ -344,33 +1677,73 @@ func (t *tx) Put(path string, value interface{}, serializedValue []byte, fullTex
 		}
 	}
 
+	storedPath := t.paths.encode(path)
+	if !updateIfPresent {
+		// check up front rather than relying on driver specific constraint violation errors
+		rows, err := t.tx.Query(fmt.Sprintf("SELECT 1 FROM %s_data WHERE path = ?", t.schema), storedPath)
+		if err != nil {
+			return -1, fmt.Errorf("put: check existing: %w", err)
+		}
+		exists := rows.Next()
+		rows.Close()
+		if exists {
+			return -1, fmt.Errorf("put: %v: %w", path, ErrPathExists)
+		}
+	}
 	onConflictClause := ""
 	if updateIfPresent {
 		onConflictClause = " ON CONFLICT(path) DO UPDATE SET value = EXCLUDED.value"
+		if t.opts.TrackInsertionOrder && t.opts.ResequenceOnUpdate {
+			onConflictClause += ", sequence = EXCLUDED.sequence"
+		}
+	}
+	sequenceColumn, sequenceValue, err := t.nextSequence()
+	if err != nil {
+		return -1, fmt.Errorf("put: %w", err)
+	}
+	columns := t.opts.fullTextColumns()
+	for column := range fullText {
+		if !slices.Contains(columns, column) {
+			return -1, fmt.Errorf("put: %v: %w", column, ErrUnknownFullTextColumn)
+		}
 	}
-	if fullText == "" {
+	hasFullText := false
+	texts := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		text := fullText[column]
+		if text != "" {
+			hasFullText = true
+			text, err = t.opts.limitFullText(text)
+			if err != nil {
+				return -1, fmt.Errorf("put: limit full text: %w", err)
+			}
+		}
+		texts = append(texts, text)
+	}
+
+	if !hasFullText {
 		// not doing full text, simple path
-		err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_data(path, value) VALUES(?, ?)%s", t.schema, onConflictClause), path, serializedValue)
+		err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_data(path, value%s) VALUES(?, ?%s)%s", t.schema, sequenceColumn, sequenceValue, onConflictClause), storedPath, serializedValue)
 		if err != nil {
-			return fmt.Errorf("put: insert: %w", err)
+			return -1, fmt.Errorf("put: insert: %w", err)
 		}
 		saveUpdate()
-		return nil
+		return -1, nil
 	}
 
 	// get existing row ID for full text indexing
-	existingRowID := -1
+	existingRowID := int64(-1)
 	isUpdate := false
-	rows, err := t.tx.Query(fmt.Sprintf("SELECT rowid FROM %s_data WHERE path = ?", t.schema), path)
+	rows, err := t.tx.Query(fmt.Sprintf("SELECT rowid FROM %s_data WHERE path = ?", t.schema), storedPath)
 	if err != nil {
-		return fmt.Errorf("put: select rowid: %w", err)
+		return -1, fmt.Errorf("put: select rowid: %w", err)
 	}
 	defer rows.Close()
 	if rows.Next() {
 		// record already exists, update index
 		err = rows.Scan(&existingRowID)
 		if err != nil {
-			return fmt.Errorf("put: scan rowid: %w", err)
+			return -1, fmt.Errorf("put: scan rowid: %w", err)
 		}
 		isUpdate = true
 	}
@@ -381,68 +1754,380 @@ func (t *tx) Put(path string, value interface{}, serializedValue []byte, fullTex
 		// we're inserting a new row, get the next rowID from the sequence
 		err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_counters(id, value) VALUES(0, 0) ON CONFLICT(id) DO UPDATE SET value = value+1", t.schema))
 		if err != nil {
-			return fmt.Errorf("put: increment sequence: %w", err)
+			return -1, fmt.Errorf("put: increment sequence: %w", err)
 		}
 		rows, err = t.tx.Query(fmt.Sprintf("SELECT value FROM %s_counters WHERE id = 0", t.schema))
 		if err != nil {
-			return fmt.Errorf("put: query sequence value: %w", err)
+			return -1, fmt.Errorf("put: query sequence value: %w", err)
 		}
 		defer rows.Close()
 		if !rows.Next() {
-			return fmt.Errorf("put: read sequence value: %w", ErrUnexpectedDBError)
+			return -1, fmt.Errorf("put: read sequence value: %w", ErrUnexpectedDBError)
 		}
 		err = rows.Scan(&rowID)
 		if err != nil {
-			return fmt.Errorf("put: scan sequence value: %w", err)
+			return -1, fmt.Errorf("put: scan sequence value: %w", err)
 		}
 	}
 
 	// insert value
-	err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_data(path, value, rowid) VALUES(?, ?, ?)%s", t.schema, onConflictClause), path, serializedValue, rowID)
+	err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_data(path, value, rowid%s) VALUES(?, ?, ?%s)%s", t.schema, sequenceColumn, sequenceValue, onConflictClause), storedPath, serializedValue, rowID)
 	if err != nil {
-		return fmt.Errorf("put: insert indexed value: %w", err)
+		return -1, fmt.Errorf("put: insert indexed value: %w", err)
 	}
 
 	// maintain full text index
 	if !isUpdate {
-		err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_fts2(value, rowid) VALUES(?, ?)", t.schema), fullText, rowID)
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+		err = t.tx.Exec(fmt.Sprintf("INSERT INTO %s_fts2(%s, rowid) VALUES(%s, ?)", t.schema, strings.Join(columns, ", "), placeholders), append(texts, rowID)...)
 		if err != nil {
-			return fmt.Errorf("put: insert into fts index: %w", err)
+			return -1, fmt.Errorf("put: insert into fts index: %w", err)
 		}
-		return nil
+		return rowID, nil
 	}
-	err = t.tx.Exec(fmt.Sprintf("UPDATE %s_fts2 SET value = ? where rowid = ?", t.schema), fullText, rowID)
+	err = t.tx.Exec(fmt.Sprintf("UPDATE %s_fts2 SET %s = ? where rowid = ?", t.schema, strings.Join(columns, " = ?, ")), append(texts, rowID)...)
 	if err != nil {
-		return fmt.Errorf("put: update fts index: %w", err)
+		return -1, fmt.Errorf("put: update fts index: %w", err)
 	}
 	saveUpdate()
-	return nil
+	return rowID, nil
+}
+
+// nextSequence increments the insertion sequence if tracking insertion order and returns the column
+// and value (as SQL) to append when inserting into the data table, or empty strings otherwise.
+// Sequence numbers aren't contiguous since the sequence is also incremented by updates.
+func (t *tx) nextSequence() (string, string, error) {
+	if !t.opts.TrackInsertionOrder {
+		return "", "", nil
+	}
+	err := t.tx.Exec(fmt.Sprintf("INSERT INTO %s_counters(id, value) VALUES(%d, 0) ON CONFLICT(id) DO UPDATE SET value = value+1", t.schema, insertionSequenceCounter))
+	if err != nil {
+		return "", "", fmt.Errorf("increment insertion sequence: %w", err)
+	}
+	return ", sequence", fmt.Sprintf(", (SELECT value FROM %s_counters WHERE id = %d)", t.schema, insertionSequenceCounter), nil
 }
 
 func (t *tx) Delete(path string) error {
-	err := t.tx.Exec(fmt.Sprintf("DELETE FROM %s_data WHERE path = ?", t.schema), path)
+	err := t.recordPrevious(path)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	err = t.deleteFullText(path)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	err = t.tx.Exec(fmt.Sprintf("DELETE FROM %s_data WHERE path = ?", t.schema), t.paths.encode(path))
 	if err != nil {
 		return fmt.Errorf("delete: delete: %w", err)
 	}
+	t.recordDelete(path)
+	return nil
+}
+
+func (t *tx) DeleteExisting(path string) (bool, error) {
+	err := t.recordPrevious(path)
+	if err != nil {
+		return false, fmt.Errorf("deleteexisting: %w", err)
+	}
+	existed := false
+	if !t.tx.ReportsRowsAffected() {
+		// the driver can't tell us whether the delete did anything, so check beforehand
+		b, err := t.Get(path)
+		if err != nil {
+			return false, fmt.Errorf("deleteexisting: %w", err)
+		}
+		existed = b != nil
+	}
+	err = t.deleteFullText(path)
+	if err != nil {
+		return false, fmt.Errorf("deleteexisting: %w", err)
+	}
+	rowsAffected, err := t.tx.ExecResult(fmt.Sprintf("DELETE FROM %s_data WHERE path = ?", t.schema), t.paths.encode(path))
+	if err != nil {
+		return false, fmt.Errorf("deleteexisting: delete: %w", err)
+	}
+	if rowsAffected >= 0 {
+		existed = rowsAffected > 0
+	}
+	t.recordDelete(path)
+	return existed, nil
+}
+
+// deleteFullText deletes the full text index entry (if any) for the value at path
+func (t *tx) deleteFullText(path string) error {
+	err := t.tx.Exec(fmt.Sprintf("DELETE FROM %s_fts2 WHERE rowid IN (SELECT rowid FROM %s_data WHERE path = ? AND rowid IS NOT NULL)", t.schema, t.schema), t.paths.encode(path))
+	if err != nil {
+		return fmt.Errorf("delete from fts index: %w", err)
+	}
+	return nil
+}
+
+// recordDelete records that path was deleted so that subscribers can be notified
+func (t *tx) recordDelete(path string) {
 	delete(t.updates, path)
 	t.deletes[path] = true
+}
+
+func (t *tx) DeleteMatching(pathPattern string, keep []string) (int, error) {
+	keepSet := make(map[string]bool, len(keep))
+	for _, path := range keep {
+		keepSet[path] = true
+	}
+
+	// find the paths to delete so that we can notify subscribers
+	var paths []string
+	match, pattern := t.paths.matchClause("path", "LIKE", pathPattern)
+	rows, err := t.tx.Query(fmt.Sprintf("SELECT path FROM %s_data WHERE %s", t.schema, match), pattern)
+	if err != nil {
+		return 0, fmt.Errorf("deletematching: select paths: %w", err)
+	}
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("deletematching: scan path: %w", err)
+		}
+		path = t.paths.decode(path)
+		if !keepSet[path] {
+			paths = append(paths, path)
+		}
+	}
+	rows.Close()
+
+	for _, path := range paths {
+		err = t.recordPrevious(path)
+		if err != nil {
+			return 0, fmt.Errorf("deletematching: %w", err)
+		}
+	}
+
+	if len(keep) == 0 {
+		// nothing to keep, delete everything in one statement
+		err = t.tx.Exec(fmt.Sprintf("DELETE FROM %s_fts2 WHERE rowid IN (SELECT rowid FROM %s_data WHERE %s AND rowid IS NOT NULL)", t.schema, t.schema, match), pattern)
+		if err != nil {
+			return 0, fmt.Errorf("deletematching: delete from fts index: %w", err)
+		}
+		err = t.tx.Exec(fmt.Sprintf("DELETE FROM %s_data WHERE %s", t.schema, match), pattern)
+		if err != nil {
+			return 0, fmt.Errorf("deletematching: delete: %w", err)
+		}
+	} else {
+		err = t.deletePaths(paths)
+		if err != nil {
+			return 0, fmt.Errorf("deletematching: %w", err)
+		}
+	}
+
+	for _, path := range paths {
+		delete(t.updates, path)
+		t.deletes[path] = true
+	}
+	return len(paths), nil
+}
+
+func (t *tx) DeleteMulti(paths []string) (int, error) {
+	// find the paths that exist so that we only notify subscribers of those
+	var existing []string
+	err := inChunks(t.paths.encodeAll(paths), func(placeholders string, args []interface{}) error {
+		rows, err := t.tx.Query(fmt.Sprintf("SELECT path FROM %s_data WHERE path IN (%s)", t.schema, placeholders), args...)
+		if err != nil {
+			return fmt.Errorf("select paths: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var path string
+			err = rows.Scan(&path)
+			if err != nil {
+				return fmt.Errorf("scan path: %w", err)
+			}
+			existing = append(existing, t.paths.decode(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("deletemulti: %w", err)
+	}
+
+	for _, path := range existing {
+		err = t.recordPrevious(path)
+		if err != nil {
+			return 0, fmt.Errorf("deletemulti: %w", err)
+		}
+	}
+	err = t.deletePaths(existing)
+	if err != nil {
+		return 0, fmt.Errorf("deletemulti: %w", err)
+	}
+	for _, path := range existing {
+		t.recordDelete(path)
+	}
+	return len(existing), nil
+}
+
+// recordPrevious remembers the current value at path if this is the first time that the
+// transaction modifies path and there are subscribers that want previous values
+func (t *tx) recordPrevious(path string) error {
+	if t.previousValueSubscribers.Load() == 0 {
+		return nil
+	}
+	_, alreadyRecorded := t.previous[path]
+	if alreadyRecorded {
+		return nil
+	}
+	b, err := t.Get(path)
+	if err != nil {
+		return fmt.Errorf("record previous value: %w", err)
+	}
+	t.previous[path] = b
+	return nil
+}
+
+// deletePaths deletes the given paths and their full text index entries
+func (t *tx) deletePaths(paths []string) error {
+	return inChunks(t.paths.encodeAll(paths), func(placeholders string, args []interface{}) error {
+		err := t.tx.Exec(fmt.Sprintf("DELETE FROM %s_fts2 WHERE rowid IN (SELECT rowid FROM %s_data WHERE path IN (%s) AND rowid IS NOT NULL)", t.schema, t.schema, placeholders), args...)
+		if err != nil {
+			return fmt.Errorf("delete from fts index: %w", err)
+		}
+		err = t.tx.Exec(fmt.Sprintf("DELETE FROM %s_data WHERE path IN (%s)", t.schema, placeholders), args...)
+		if err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+		return nil
+	})
+}
+
+func (t *tx) Savepoint(name string) error {
+	err := t.tx.Exec(fmt.Sprintf("SAVEPOINT %s", sqlQuoteIdentifier(name)))
+	if err != nil {
+		return fmt.Errorf("savepoint: %w", err)
+	}
+	t.savepoints = append(t.savepoints, &savepoint{
+		name:           name,
+		updates:        copyMap(t.updates),
+		deletes:        copyMap(t.deletes),
+		numAfterCommit: len(t.afterCommit),
+	})
 	return nil
 }
 
+func (t *tx) RollbackTo(name string) error {
+	err := t.tx.Exec(fmt.Sprintf("ROLLBACK TO %s", sqlQuoteIdentifier(name)))
+	if err != nil {
+		return fmt.Errorf("rollbackto: %w", err)
+	}
+	i := t.lastSavepoint(name)
+	if i >= 0 {
+		sp := t.savepoints[i]
+		t.updates = copyMap(sp.updates)
+		t.deletes = copyMap(sp.deletes)
+		t.afterCommit = t.afterCommit[:sp.numAfterCommit]
+		t.savepoints = t.savepoints[:i+1]
+	}
+	return nil
+}
+
+func (t *tx) Release(name string) error {
+	err := t.tx.Exec(fmt.Sprintf("RELEASE %s", sqlQuoteIdentifier(name)))
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	i := t.lastSavepoint(name)
+	if i >= 0 {
+		t.savepoints = t.savepoints[:i]
+	}
+	return nil
+}
+
+// lastSavepoint returns the index of the most recent savepoint with the given name, or -1
+func (t *tx) lastSavepoint(name string) int {
+	for i := len(t.savepoints) - 1; i >= 0; i-- {
+		if t.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func sqlQuoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	result := make(map[K]V, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
 func (t *tx) Rollback() error {
-	return t.tx.Rollback()
+	defer t.finish()
+	err := t.tx.Rollback()
+	// once its context is done, the transaction may have been rolled back already
+	if err != nil && t.ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// finish records that this transaction is no longer open
+func (t *tx) finish() {
+	if t.finished.CompareAndSwap(false, true) {
+		t.txCounters.open.Add(-1)
+		runtime.SetFinalizer(t, nil)
+	}
 }
 
 func (t *tx) Commit() error {
+	defer t.finish()
+
 	// perform commit in mainLoop to avoid race conditions with registering listeners
 	commit := &commit{
 		t:        t,
-		finished: make(chan error),
+		finished: make(chan error, 1),
+	}
+	select {
+	case t.commits <- commit:
+	case <-t.done:
+		return fmt.Errorf("commit: %w", ErrDBClosed)
+	}
+	// the mainLoop finishes every commit that it takes on, even if the DB is closed meanwhile, so
+	// only report ErrDBClosed for commits that it stopped without taking on
+	var err error
+	select {
+	case err = <-commit.finished:
+	case <-t.stopped:
+		select {
+		case err = <-commit.finished:
+		default:
+			return fmt.Errorf("commit: %w", ErrDBClosed)
+		}
 	}
-	t.commits <- commit
-	return <-commit.finished
+	if err != nil {
+		return err
+	}
+	for _, fn := range t.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+func (t *tx) AfterCommit(fn func()) {
+	t.afterCommit = append(t.afterCommit, fn)
 }
 
 func (t *tx) doCommit() error {
 	return t.tx.Commit()
 }
+
+// abort rolls back the transaction because of the given cause
+func (t *tx) abort(cause error) error {
+	err := t.tx.Rollback()
+	// once its context is done, the transaction may have been rolled back already
+	if err != nil && t.ctx.Err() == nil {
+		return fmt.Errorf("commit: rollback after %v: %w", cause, err)
+	}
+	return fmt.Errorf("commit: %w", cause)
+}
@@ -1,8 +1,15 @@
 package pathdb
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/pathdb/minisql"
 )
 
 type Item[T any] struct {
@@ -14,10 +21,44 @@ type Item[T any] struct {
 type SearchResult[T any] struct {
 	Item[T]
 	Snippet string
+	// Highlights holds the highlighted ranges of Snippet when searching with
+	// SearchParams.HighlightRanges
+	Highlights []Highlight
+}
+
+var nestedSavepoints atomic.Int64
+
+// Nested runs fn inside a savepoint of the given transaction. If fn returns an error, only the
+// changes that fn made are rolled back and the error is returned, leaving the rest of the
+// transaction intact.
+func Nested(t TX, fn func(TX) error) error {
+	name := fmt.Sprintf("pathdb_nested_%d", nestedSavepoints.Add(1))
+	err := t.Savepoint(name)
+	if err != nil {
+		return fmt.Errorf("nested: %w", err)
+	}
+	fnErr := fn(t)
+	if fnErr != nil {
+		err = t.RollbackTo(name)
+		if err != nil {
+			return fmt.Errorf("nested: rollback after %v: %w", fnErr, err)
+		}
+	}
+	err = t.Release(name)
+	if err != nil {
+		return fmt.Errorf("nested: %w", err)
+	}
+	return fnErr
 }
 
 func Mutate(d DB, fn func(TX) error) error {
-	t, err := d.Begin()
+	return MutateContext(context.Background(), d, fn)
+}
+
+// MutateContext is like Mutate, but if ctx is done before the transaction commits, the transaction
+// is rolled back and the returned error wraps ctx.Err().
+func MutateContext(ctx context.Context, d DB, fn func(TX) error) error {
+	t, err := d.BeginContext(ctx)
 	if err != nil {
 		return fmt.Errorf("mutate: begin transaction: %w", err)
 	}
@@ -38,6 +79,24 @@ func Mutate(d DB, fn func(TX) error) error {
 	}
 }
 
+// View calls fn with a read-only view of d in which all reads see the same consistent snapshot,
+// unaffected by transactions that commit while fn runs. The view is only valid until fn returns.
+func View(d DB, fn func(q Queryable) error) error {
+	s, err := d.Snapshot()
+	if err != nil {
+		return fmt.Errorf("view: %w", err)
+	}
+	defer s.Close()
+
+	err = fn(s)
+	if err != nil {
+		return fmt.Errorf("view: fn: %w", err)
+	}
+	return nil
+}
+
+// PutAll puts all of the given values without full text indexing. The order in which the values
+// are put is unspecified, use PutAllOrdered if it matters.
 func PutAll[T any](t TX, values map[string]T) error {
 	for path, value := range values {
 		err := Put(t, path, value, "")
@@ -48,10 +107,69 @@ func PutAll[T any](t TX, values map[string]T) error {
 	return nil
 }
 
+// PutAllWithFullText is like PutAll, but full text indexes each value using the corresponding
+// entry in fullText. Paths that have no entry in fullText are not full text indexed.
+func PutAllWithFullText[T any](t TX, values map[string]T, fullText map[string]string) error {
+	for path, value := range values {
+		err := Put(t, path, value, fullText[path])
+		if err != nil {
+			return fmt.Errorf("putallwithfulltext: put: %w", err)
+		}
+	}
+	return nil
+}
+
+// PutBatch is like PutAll, but inserts many values per statement, which is much faster for large
+// numbers of values. Values are not full text indexed.
+func PutBatch[T any](t TX, values map[string]T) error {
+	batch := make(map[string]interface{}, len(values))
+	for path, value := range values {
+		batch[path] = value
+	}
+	return t.PutBatch(batch)
+}
+
+// PutAllOrdered puts values[i] at paths[i] in order, full text indexing each value using
+// fullText[i] (unless it's empty). fullText may be nil to skip full text indexing entirely. Returns
+// ErrLengthMismatch if values or a non-nil fullText have a different length from paths.
+func PutAllOrdered[T any](t TX, paths []string, values []T, fullText []string) error {
+	if len(values) != len(paths) || (fullText != nil && len(fullText) != len(paths)) {
+		return fmt.Errorf("putallordered: %d paths, %d values and %d full texts: %w", len(paths), len(values), len(fullText), ErrLengthMismatch)
+	}
+	for i, path := range paths {
+		var _fullText string
+		if fullText != nil {
+			_fullText = fullText[i]
+		}
+		err := Put(t, path, values[i], _fullText)
+		if err != nil {
+			return fmt.Errorf("putallordered: put %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
 func Put[T any](t TX, path string, value T, fullText string) error {
 	return t.Put(path, value, nil, fullText, true)
 }
 
+// PutIndexed is like Put, but returns the rowid under which the value is full text indexed, which
+// is the existing rowid when updating a value and a newly allocated one when inserting. If fullText
+// is empty, the value isn't full text indexed and PutIndexed returns -1.
+func PutIndexed[T any](t TX, path string, value T, fullText string) (int64, error) {
+	rowID, err := t.putIndexed(path, value, fullText)
+	if err != nil {
+		return -1, fmt.Errorf("putindexed: %w", err)
+	}
+	return rowID, nil
+}
+
+// PutWithFullTextFields is like Put, but full text indexes each of the given fields in the column
+// of the same name (see Options.FullTextColumns), so that they can be searched separately
+func PutWithFullTextFields[T any](t TX, path string, value T, fullText map[string]string) error {
+	return t.PutFullTextFields(path, value, nil, fullText, true)
+}
+
 func PutRaw[T any](t TX, path string, value *Raw[T], fullText string) error {
 	return t.Put(path, nil, value.Bytes, fullText, true)
 }
@@ -59,8 +177,7 @@ func PutRaw[T any](t TX, path string, value *Raw[T], fullText string) error {
 func PutIfAbsent[T any](t TX, path string, value T, fullText string) (bool, error) {
 	err := t.Put(path, value, nil, fullText, false)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			// this means there was already a value at that path
+		if errors.Is(err, ErrPathExists) {
 			return false, nil
 		}
 		return false, fmt.Errorf("putifabsent: put: %w", err)
@@ -68,6 +185,166 @@ func PutIfAbsent[T any](t TX, path string, value T, fullText string) (bool, erro
 	return true, nil
 }
 
+// PutExisting puts the value at path only if there's already a value there, and returns whether
+// it did. It's the opposite of PutIfAbsent. Full text, generations and subscribers are updated just
+// like with Put.
+func PutExisting[T any](t TX, path string, value T, fullText string) (bool, error) {
+	existing, err := t.Get(path)
+	if err != nil {
+		return false, fmt.Errorf("putexisting: %w", err)
+	}
+	if existing == nil {
+		return false, nil
+	}
+	err = Put(t, path, value, fullText)
+	if err != nil {
+		return false, fmt.Errorf("putexisting: put: %w", err)
+	}
+	return true, nil
+}
+
+// CompareAndSwap puts new at path only if the value currently stored there equals expected, and
+// returns whether it did. Values are compared by their serialized bytes, so types whose
+// serialization isn't deterministic (like protocol buffers with map fields) may fail to compare
+// equal. Since transactions are serialized, the comparison and the put are atomic. Full text,
+// generations and subscribers are updated just like with Put.
+func CompareAndSwap[T any](t TX, path string, expected, new T, fullText string) (bool, error) {
+	serde := t.getSerde()
+	expectedBytes, err := serde.serializeUncompressed(expected)
+	if err != nil {
+		return false, fmt.Errorf("compareandswap: serialize expected value: %w", err)
+	}
+	existing, err := t.Get(path)
+	if err != nil {
+		return false, fmt.Errorf("compareandswap: %w", err)
+	}
+	if existing == nil {
+		return false, nil
+	}
+	// compare the values themselves, since encryption may produce different bytes every time
+	existing, err = serde.unwrap(existing)
+	if err != nil {
+		return false, fmt.Errorf("compareandswap: %w", err)
+	}
+	if !bytes.Equal(existing, expectedBytes) {
+		return false, nil
+	}
+	err = Put(t, path, new, fullText)
+	if err != nil {
+		return false, fmt.Errorf("compareandswap: put: %w", err)
+	}
+	return true, nil
+}
+
+// Increment adds delta (which may be negative) to the integer stored at path, treating a missing
+// value as 0, and returns the result, which is stored as an int64. It fails with ErrNotAnInteger
+// if the stored value isn't an integer and with ErrIntegerOverflow if the result doesn't fit into
+// an int64, leaving the stored value as is.
+func Increment(t TX, path string, delta int64) (int64, error) {
+	var current int64
+	existing, err := t.Get(path)
+	if err != nil {
+		return 0, fmt.Errorf("increment: %w", err)
+	}
+	if existing != nil {
+		v, err := t.getSerde().deserialize(existing)
+		if err != nil {
+			return 0, fmt.Errorf("increment: deserialize: %w", err)
+		}
+		switch _v := v.(type) {
+		case int64:
+			current = _v
+		case int32:
+			current = int64(_v)
+		case int16:
+			current = int64(_v)
+		case byte:
+			current = int64(_v)
+		default:
+			return 0, fmt.Errorf("increment: value at %v is a %T: %w", path, v, ErrNotAnInteger)
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, fmt.Errorf("increment: %d + %d: %w", current, delta, ErrIntegerOverflow)
+	}
+	result := current + delta
+	err = Put(t, path, result, "")
+	if err != nil {
+		return 0, fmt.Errorf("increment: put: %w", err)
+	}
+	return result, nil
+}
+
+// PutIfGeneration puts the value at path only if the path's current generation (see Generation)
+// equals expectedGen. It returns whether the value was put along with the path's generation after
+// the call. Use an expectedGen of 0 to put only if no value has ever been put at the path.
+func PutIfGeneration[T any](t TX, path string, value T, expectedGen int64, fullText string) (bool, int64, error) {
+	gen, err := t.Generation(path)
+	if err != nil {
+		return false, 0, fmt.Errorf("putifgeneration: %w", err)
+	}
+	if gen != expectedGen {
+		return false, gen, nil
+	}
+	err = Put(t, path, value, fullText)
+	if err != nil {
+		return false, gen, fmt.Errorf("putifgeneration: put: %w", err)
+	}
+	gen, err = t.Generation(path)
+	if err != nil {
+		return false, 0, fmt.Errorf("putifgeneration: %w", err)
+	}
+	return true, gen, nil
+}
+
+// AppendToJSONArray appends element to the JSON array stored at path, creating a single-element
+// array if there's nothing at path yet. Arrays are stored as *[]T, which must be registered as a
+// JSON type (e.g. with RegisterJSONType(db, id, &[]T{})).
+func AppendToJSONArray[T any](t TX, path string, element T) error {
+	array, err := Get[*[]T](t, path)
+	if err != nil {
+		return fmt.Errorf("appendtojsonarray: %w", err)
+	}
+	if array == nil {
+		array = &[]T{}
+	}
+	*array = append(*array, element)
+	err = Put(t, path, array, "")
+	if err != nil {
+		return fmt.Errorf("appendtojsonarray: %w", err)
+	}
+	return nil
+}
+
+// RemoveFromJSONArray removes all occurrences of element from the JSON array stored at path (see
+// AppendToJSONArray) and returns the number of elements removed. If there's nothing at path, this
+// does nothing.
+func RemoveFromJSONArray[T comparable](t TX, path string, element T) (int, error) {
+	array, err := Get[*[]T](t, path)
+	if err != nil {
+		return 0, fmt.Errorf("removefromjsonarray: %w", err)
+	}
+	if array == nil {
+		return 0, nil
+	}
+	remaining := (*array)[:0]
+	for _, e := range *array {
+		if e != element {
+			remaining = append(remaining, e)
+		}
+	}
+	removed := len(*array) - len(remaining)
+	if removed == 0 {
+		return 0, nil
+	}
+	*array = remaining
+	err = Put(t, path, array, "")
+	if err != nil {
+		return 0, fmt.Errorf("removefromjsonarray: %w", err)
+	}
+	return removed, nil
+}
+
 func GetOrPut[T any](t TX, path string, value T, fullText string) (T, error) {
 	var result T
 	b, err := t.Get(path)
@@ -95,6 +372,129 @@ func Delete(t TX, path string) error {
 	return t.Delete(path)
 }
 
+// DeleteExisting deletes the value at path and reports whether there was a value to delete, which
+// is useful for detecting when a concurrent transaction already deleted it
+func DeleteExisting(t TX, path string) (bool, error) {
+	return t.DeleteExisting(path)
+}
+
+// DeleteAll deletes all paths matching the given LIKE pattern (e.g. "/contacts/X/%") and returns
+// the number of paths deleted. Subscribers are notified of each deleted path.
+func DeleteAll(t TX, pathPattern string) (int, error) {
+	n, err := t.DeleteMatching(pathPattern, nil)
+	if err != nil {
+		return n, fmt.Errorf("deleteall: %w", err)
+	}
+	return n, nil
+}
+
+// DeleteMulti deletes the given paths and returns the number of them that had a value.
+// Subscribers are notified of each deleted path.
+func DeleteMulti(t TX, paths []string) (int, error) {
+	n, err := t.DeleteMulti(paths)
+	if err != nil {
+		return n, fmt.Errorf("deletemulti: %w", err)
+	}
+	return n, nil
+}
+
+// DeletePrefixExcept deletes all paths under the given prefix except for the paths listed in keep
+// and returns the number of paths deleted.
+func DeletePrefixExcept(t TX, prefix string, keep []string) (int, error) {
+	n, err := t.DeleteMatching(fmt.Sprintf("%s%%", strings.TrimRight(prefix, "%")), keep)
+	if err != nil {
+		return n, fmt.Errorf("deleteprefixexcept: %w", err)
+	}
+	return n, nil
+}
+
+// SchemaStats returns row counts for the tables that hold d's schema. See DBStats.
+func SchemaStats(d DB) (*DBStats, error) {
+	return d.SchemaStats()
+}
+
+// RebuildFTS rebuilds d's full text index and resets its rowid counter. See DB.RebuildFTS.
+func RebuildFTS(d DB) error {
+	return d.RebuildFTS()
+}
+
+// Vacuum rebuilds the database file to reclaim the space left behind by deleted data. See
+// DB.Vacuum.
+func Vacuum(d DB) error {
+	return d.Vacuum()
+}
+
+// Compact incrementally releases free pages back to the file system. See DB.Compact.
+func Compact(d DB) error {
+	return d.Compact()
+}
+
+// Generation returns the generation of the given path, which starts at 0 and is incremented every
+// time that a value is put at the path. Deleting a path doesn't reset its generation, so a path that
+// is deleted and recreated continues from its prior generation.
+func Generation(q Queryable, path string) (int64, error) {
+	return q.Generation(path)
+}
+
+// HasAny checks whether any path exists under the given prefix. This is cheaper than listing or
+// counting, since it stops at the first match.
+func HasAny(q Queryable, prefix string) (bool, error) {
+	return q.HasAny(fmt.Sprintf("%s%%", strings.TrimRight(prefix, "%")))
+}
+
+// FTSTokens returns the tokens that the full text index holds for the value at path, which is
+// useful for diagnosing why a search does or doesn't match
+func FTSTokens(q Queryable, path string) ([]string, error) {
+	return q.FTSTokens(path)
+}
+
+// RawQuery runs an arbitrary SQL query against the database underlying q, within q's transaction
+// or snapshot if it has one, for queries that don't fit List and Search. Table names have to be
+// qualified with the schema (see SchemaName), e.g. fmt.Sprintf("SELECT COUNT(*) FROM %s_data",
+// SchemaName(q)). Values are stored serialized (see Deserialize), and paths are stored encoded if
+// the DB uses a PathDictionary. The caller must close the returned rows.
+func RawQuery(q Queryable, sql string, args ...interface{}) (minisql.ScannableRows, error) {
+	rows, err := q.rawQuery(sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("rawquery: %w", err)
+	}
+	return rows, nil
+}
+
+// SchemaName returns the schema of q, which prefixes the names of its tables (like
+// <schema>_data)
+func SchemaName(q Queryable) string {
+	return q.getSchema()
+}
+
+// WithSchemaE is like DB.WithSchema, but returns an error wrapping ErrInvalidSchema instead of
+// panicking if the schema isn't a valid schema name
+func WithSchemaE(d DB, schema string) (DB, error) {
+	err := validateSchema(schema)
+	if err != nil {
+		return nil, fmt.Errorf("withschema: %w", err)
+	}
+	return d.WithSchema(schema), nil
+}
+
+// NewSiblingDB sets up the given schema in the database underlying d, creating its tables with d's
+// options like NewDBWithOptions does, and returns d's WithSchema sibling for it. Opening the schema
+// with NewDB instead would start a separate DB with its own mainLoop that closes the shared
+// database when it's closed.
+func NewSiblingDB(d DB, schema string) (DB, error) {
+	err := validateSchema(schema)
+	if err != nil {
+		return nil, fmt.Errorf("newsiblingdb: %w", err)
+	}
+	err = Mutate(d, func(t TX) error {
+		return t.setUpSchema(schema)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("newsiblingdb: %w", err)
+	}
+	return d.WithSchema(schema), nil
+}
+
 func Get[T any](q Queryable, path string) (T, error) {
 	var result T
 	var _result *Raw[T]
@@ -111,6 +511,20 @@ func Get[T any](q Queryable, path string) (T, error) {
 	return result, nil
 }
 
+// GetOr is like Get, but returns def if there's no value at path, which distinguishes missing
+// values from stored zero values
+func GetOr[T any](q Queryable, path string, def T) (T, error) {
+	_result, err := RGet[T](q, path)
+	if err != nil {
+		return def, fmt.Errorf("getor: rget: %w", err)
+	}
+	result, err := _result.ValueOr(def)
+	if err != nil {
+		return result, fmt.Errorf("getor: value: %w", err)
+	}
+	return result, nil
+}
+
 func RGet[T any](q Queryable, path string) (*Raw[T], error) {
 	var result *Raw[T]
 	var b []byte
@@ -127,6 +541,51 @@ func RGet[T any](q Queryable, path string) (*Raw[T], error) {
 	return result, nil
 }
 
+// GetMulti gets the values at all of the given paths using as few queries as possible. Paths
+// that have no value are absent from the resulting map.
+func GetMulti[T any](q Queryable, paths []string) (map[string]T, error) {
+	bs, err := q.GetMulti(paths)
+	if err != nil {
+		return nil, fmt.Errorf("getmulti: %w", err)
+	}
+	serde := q.getSerde()
+	result := make(map[string]T, len(bs))
+	for path, b := range bs {
+		if len(b) == 0 {
+			continue
+		}
+		_value, err := serde.deserialize(b)
+		if err != nil {
+			return nil, fmt.Errorf("getmulti: deserialize: %w", err)
+		}
+		result[path] = _value.(T)
+	}
+	return result, nil
+}
+
+// GetBatch is like GetMulti, but returns a slice of items in the same order as paths, with nil
+// entries for paths that have no value.
+func GetBatch[T any](q Queryable, paths []string) ([]*Item[T], error) {
+	bs, err := q.GetMulti(paths)
+	if err != nil {
+		return nil, fmt.Errorf("getbatch: %w", err)
+	}
+	serde := q.getSerde()
+	result := make([]*Item[T], len(paths))
+	for i, path := range paths {
+		b := bs[path]
+		if len(b) == 0 {
+			continue
+		}
+		item, err := newItem[T](serde, &item{path: path, value: b})
+		if err != nil {
+			return nil, fmt.Errorf("getbatch: %w", err)
+		}
+		result[i] = item
+	}
+	return result, nil
+}
+
 func List[T any](q Queryable, query *QueryParams) ([]*Item[T], error) {
 	serde := q.getSerde()
 	result, err := doSearch(q, query, nil, func(i *item) (*Item[T], error) {
@@ -142,6 +601,93 @@ func List[T any](q Queryable, query *QueryParams) ([]*Item[T], error) {
 	return result, nil
 }
 
+// GetAll is like List, but returns the values keyed by path. When joining details, values are
+// keyed by the path of the index entry rather than the detail path, since different index entries
+// may refer to the same detail. Paths are unique, so no value is ever dropped in favor of another.
+func GetAll[T any](q Queryable, query *QueryParams) (map[string]T, error) {
+	items, err := List[T](q, query)
+	if err != nil {
+		return nil, fmt.Errorf("getall: %w", err)
+	}
+	result := make(map[string]T, len(items))
+	for _, item := range items {
+		result[item.Path] = item.Value
+	}
+	return result, nil
+}
+
+// ListPage lists a page of up to query.Count items and returns them along with the cursor to use
+// as query.After to get the next page. The cursor is empty once there are no more pages. See
+// QueryParams.After.
+func ListPage[T any](q Queryable, query *QueryParams) ([]*Item[T], string, error) {
+	items, err := List[T](q, query)
+	if err != nil {
+		return nil, "", fmt.Errorf("listpage: %w", err)
+	}
+	if len(items) == 0 || len(items) < query.Count {
+		return items, "", nil
+	}
+	return items, items[len(items)-1].Path, nil
+}
+
+// Page is a page of items along with the total number of items in all pages (see ListWithTotal)
+type Page[T any] struct {
+	Items []*Item[T]
+	Total int
+}
+
+// ListWithTotal is like List, but also returns the total number of items that match the query
+// regardless of Start, Count and After, for example to show how many pages there are. The total is
+// read along with the items using a window function. Only if the page is empty or query.After is
+// set does it take a separate query, in which case the items and the total may disagree if data
+// changes in between, unless q is a TX or a snapshot (see View).
+//
+// This isn't called ListPage because that name is taken by keyset pagination.
+func ListWithTotal[T any](q Queryable, query *QueryParams) (*Page[T], error) {
+	serde := q.getSerde()
+	withTotal := *query
+	withTotal.ProjectionFields = query.projection() | projectTotal
+	page := &Page[T]{}
+	err := q.Iterate(&withTotal, nil, func(i *item) error {
+		item, err := newItem[T](serde, i)
+		if err != nil {
+			return fmt.Errorf("newitem: %w", err)
+		}
+		page.Items = append(page.Items, item)
+		page.Total = i.total
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listwithtotal: %w", err)
+	}
+	if len(page.Items) == 0 || query.After != "" {
+		// the window only covers rows after query.After, and there's no row to carry it on an
+		// empty page
+		page.Total, err = q.Count(query)
+		if err != nil {
+			return nil, fmt.Errorf("listwithtotal: %w", err)
+		}
+	}
+	return page, nil
+}
+
+// ForEach calls fn with each item matching the given query, one at a time, without buffering the
+// full result set in memory. If fn returns an error, iteration stops and the error is returned.
+func ForEach[T any](q Queryable, query *QueryParams, fn func(*Item[T]) error) error {
+	serde := q.getSerde()
+	err := q.Iterate(query, nil, func(i *item) error {
+		item, err := newItem[T](serde, i)
+		if err != nil {
+			return fmt.Errorf("newitem: %w", err)
+		}
+		return fn(item)
+	})
+	if err != nil {
+		return fmt.Errorf("foreach: %w", err)
+	}
+	return nil
+}
+
 func RList[T any](q Queryable, query *QueryParams) ([]*Item[*Raw[T]], error) {
 	serde := q.getSerde()
 	result, err := doSearch(q, query, nil, func(i *item) (*Item[*Raw[T]], error) {
@@ -171,8 +717,9 @@ func Search[T any](q Queryable, query *QueryParams, search *SearchParams) ([]*Se
 			return nil, fmt.Errorf("search: dosearch: newitem: %w", err)
 		}
 		return &SearchResult[T]{
-			Item:    *item,
-			Snippet: i.snippet,
+			Item:       *item,
+			Snippet:    i.snippet,
+			Highlights: i.highlights,
 		}, nil
 	})
 	if err != nil {
@@ -186,8 +733,9 @@ func RSearch[T any](q Queryable, query *QueryParams, search *SearchParams) ([]*S
 	result, err := doSearch(q, query, search, func(i *item) (*SearchResult[*Raw[T]], error) {
 		item := newRawItem[T](serde, i)
 		return &SearchResult[*Raw[T]]{
-			Item:    *item,
-			Snippet: i.snippet,
+			Item:       *item,
+			Snippet:    i.snippet,
+			Highlights: i.highlights,
 		}, nil
 	})
 	if err != nil {
@@ -218,15 +766,21 @@ func doSearch[I any](q Queryable, query *QueryParams, search *SearchParams, buil
 }
 
 func newItem[T any](s *serde, i *item) (*Item[T], error) {
+	result := &Item[T]{
+		Path:       i.path,
+		DetailPath: i.detailPath,
+	}
+	if len(i.value) == 0 {
+		// value wasn't loaded (see ProjectionFields) or the detail doesn't exist (see
+		// IncludeEmptyDetails)
+		return result, nil
+	}
 	_value, err := s.deserialize(i.value)
 	if err != nil {
 		return nil, fmt.Errorf("newitem: deserialize: %w", err)
 	}
-	return &Item[T]{
-		Path:       i.path,
-		DetailPath: i.detailPath,
-		Value:      _value.(T),
-	}, nil
+	result.Value = _value.(T)
+	return result, nil
 }
 
 func newRawItem[T any](s *serde, i *item) *Item[*Raw[T]] {
@@ -234,10 +788,13 @@ func newRawItem[T any](s *serde, i *item) *Item[*Raw[T]] {
 		Path:       i.path,
 		DetailPath: i.detailPath,
 	}
-	if len(i.value) > 0 {
+	if len(i.value) > 0 || i.size > 0 {
 		result.Value = &Raw[T]{
 			serde: s,
-			Bytes: i.value,
+			Size:  i.size,
+		}
+		if len(i.value) > 0 {
+			result.Value.Bytes = i.value
 		}
 	}
 	return result
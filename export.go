@@ -0,0 +1,255 @@
+package pathdb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	exportWireVersion = 1
+)
+
+var (
+	ErrInvalidExport = errors.New("invalid export")
+)
+
+// Export writes all values in q's schema to w in a portable format that can be read back with
+// Import, for example to back up a DB or to move it to another device. Values are written using
+// their serialized bytes, so type ids are preserved and the importing side needs to have the same
+// types registered. Full text indexes and generations aren't exported.
+//
+// The format is a version byte followed by one entry per path, in path order. Each entry is the
+// path followed by the value, each encoded as a uvarint length followed by the data.
+func Export(q Queryable, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	err := bw.WriteByte(exportWireVersion)
+	if err != nil {
+		return fmt.Errorf("export: write version: %w", err)
+	}
+	var b []byte
+	err = q.Iterate(&QueryParams{Path: "%"}, nil, func(i *item) error {
+		b = appendBytes(b[:0], []byte(i.path))
+		b = appendBytes(b, i.value)
+		_, err := bw.Write(b)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("export: flush: %w", err)
+	}
+	return nil
+}
+
+// Import puts all values read from r, which must have been written by Export, using their
+// serialized bytes as is. Values at paths that already exist are overwritten.
+func Import(t TX, r io.Reader) error {
+	br := bufio.NewReader(r)
+	version, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("import: read version: %v: %w", err, ErrInvalidExport)
+	}
+	if version != exportWireVersion {
+		return fmt.Errorf("import: unsupported version %d: %w", version, ErrInvalidExport)
+	}
+	for {
+		path, err := readExportBytes(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("import: read path: %w", err)
+		}
+		value, err := readExportBytes(br)
+		if err == io.EOF || (err == nil && len(value) == 0) {
+			err = fmt.Errorf("missing value for %v: %w", string(path), ErrInvalidExport)
+		}
+		if err != nil {
+			return fmt.Errorf("import: read value: %w", err)
+		}
+		err = t.Put(string(path), nil, value, "", true)
+		if err != nil {
+			return fmt.Errorf("import: put %v: %w", string(path), err)
+		}
+	}
+}
+
+// readExportBytes reads a length prefixed byte array as written by Export. It returns io.EOF only
+// if r is at its end before the length.
+func readExportBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid length: %v: %w", err, ErrInvalidExport)
+	}
+	// read incrementally rather than allocating length bytes up front, which could be huge if the
+	// data is corrupt
+	b, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != length {
+		return nil, fmt.Errorf("length %d exceeds remaining data: %w", length, ErrInvalidExport)
+	}
+	return b, nil
+}
+
+// ExportCSV writes the results of the given query to w as CSV with the columns path, detailPath
+// and value. Rows are streamed from the database one at a time. Text values are written as is,
+// byte arrays and protocol buffers are base64 encoded, JSON values are written as JSON and all
+// other values are written using their default string form.
+func ExportCSV[T any](q Queryable, query *QueryParams, w io.Writer) error {
+	serde := q.getSerde()
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"path", "detailPath", "value"})
+	if err != nil {
+		return fmt.Errorf("exportcsv: write header: %w", err)
+	}
+	err = q.Iterate(query, nil, func(i *item) error {
+		value, err := renderValue(serde, i.value)
+		if err != nil {
+			return fmt.Errorf("render value at %v: %w", i.path, err)
+		}
+		return cw.Write([]string{i.path, i.detailPath, value})
+	})
+	if err != nil {
+		return fmt.Errorf("exportcsv: iterate: %w", err)
+	}
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		return fmt.Errorf("exportcsv: flush: %w", err)
+	}
+	return nil
+}
+
+// jsonExportItem is an item as written by ExportJSON
+type jsonExportItem struct {
+	Path       string          `json:"path"`
+	DetailPath string          `json:"detailPath,omitempty"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// ExportJSON writes the results of the given query to w as a JSON array of objects with the fields
+// path, detailPath (if joining details) and value, which is meant for eyeballing what's stored. Rows
+// are streamed from the database one at a time. Values are written as JSON using their registered
+// types where possible. JSON values are written as stored even if their types aren't registered,
+// while other values that can't be deserialized are written as their base64 encoded serialized
+// bytes. Corrupt values fail the export with ErrCorruptValue.
+func ExportJSON(q Queryable, query *QueryParams, w io.Writer) error {
+	serde := q.getSerde()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	separator := "["
+	err := q.Iterate(query, nil, func(i *item) error {
+		value, err := renderJSONValue(serde, i.value)
+		if err != nil {
+			return fmt.Errorf("render value at %v: %w", i.path, err)
+		}
+		_, err = bw.WriteString(separator)
+		if err != nil {
+			return err
+		}
+		separator = ","
+		return enc.Encode(&jsonExportItem{Path: i.path, DetailPath: i.detailPath, Value: value})
+	})
+	if err != nil {
+		return fmt.Errorf("exportjson: iterate: %w", err)
+	}
+	if separator == "[" {
+		// no items
+		_, err = bw.WriteString(separator)
+		if err != nil {
+			return fmt.Errorf("exportjson: %w", err)
+		}
+	}
+	_, err = bw.WriteString("]\n")
+	if err != nil {
+		return fmt.Errorf("exportjson: %w", err)
+	}
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("exportjson: flush: %w", err)
+	}
+	return nil
+}
+
+// renderJSONValue renders the given serialized value as JSON, falling back to the base64 encoded
+// serialized bytes if the value's type isn't registered or can't be marshaled to JSON. Corrupt
+// values fail with ErrCorruptValue rather than being exported as if they were intact.
+func renderJSONValue(s *serde, b []byte) (json.RawMessage, error) {
+	if len(b) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	unwrapped, err := s.unwrap(b)
+	if errors.Is(err, ErrCorruptValue) {
+		return nil, err
+	}
+	if err != nil {
+		// for example an encrypted value without a cipher
+		return json.Marshal(b)
+	}
+	if unwrapped[0] == JSON && len(unwrapped) >= minLengths[JSON] && json.Valid(unwrapped[3:]) {
+		return json.RawMessage(unwrapped[3:]), nil
+	}
+	v, err := s.deserialize(b)
+	if errors.Is(err, ErrCorruptValue) {
+		return nil, err
+	}
+	if err != nil {
+		return json.Marshal(b)
+	}
+	var result []byte
+	if pb, ok := v.(proto.Message); ok {
+		result, err = protojson.Marshal(pb)
+	} else {
+		result, err = json.Marshal(v)
+	}
+	if err != nil {
+		// the value's type doesn't support JSON
+		return json.Marshal(b)
+	}
+	return result, nil
+}
+
+// renderValue renders the given serialized value as a human readable string
+func renderValue(s *serde, b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	b, err := s.unwrap(b)
+	if err != nil {
+		return "", err
+	}
+	if s.isProtocolBuffer(b) {
+		return base64.StdEncoding.EncodeToString(s.stripProtocolBufferHeader(b)), nil
+	}
+	if b[0] == JSON && len(b) >= minLengths[JSON] {
+		return string(b[3:]), nil
+	}
+	v, err := s.deserialize(b)
+	if err != nil {
+		return "", err
+	}
+	switch _v := v.(type) {
+	case string:
+		return _v, nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(_v), nil
+	default:
+		return fmt.Sprint(_v), nil
+	}
+}
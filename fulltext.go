@@ -0,0 +1,151 @@
+package pathdb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/getlantern/pathdb/minisql"
+)
+
+const (
+	// defaultFullTextColumn is the only column of the full text index unless
+	// Options.FullTextColumns says otherwise
+	defaultFullTextColumn = "value"
+
+	// DefaultTokenizer is the fts5 tokenizer of the full text index unless Options.Tokenizer says
+	// otherwise
+	DefaultTokenizer = "porter trigram"
+)
+
+var (
+	ErrUnknownFullTextColumn = errors.New("unknown full text column")
+)
+
+// fullTextColumns returns the configured columns of the full text index
+func (opts *Options) fullTextColumns() []string {
+	if len(opts.FullTextColumns) == 0 {
+		return []string{defaultFullTextColumn}
+	}
+	return opts.FullTextColumns
+}
+
+// tokenizer returns the configured tokenizer of the full text index
+func (opts *Options) tokenizer() string {
+	if opts.Tokenizer == "" {
+		return DefaultTokenizer
+	}
+	return opts.Tokenizer
+}
+
+// validateFullTextColumns checks that the configured full text columns are unique, plain
+// identifiers that don't collide with fts5's own column names
+func (opts *Options) validateFullTextColumns() error {
+	seen := make(map[string]bool, len(opts.FullTextColumns))
+	for _, column := range opts.FullTextColumns {
+		lower := strings.ToLower(column)
+		if !isPlainIdentifier(column) || seen[lower] || lower == "rank" || lower == "rowid" {
+			return fmt.Errorf("invalid or duplicate full text column %q: %w", column, ErrInvalidOptions)
+		}
+		seen[lower] = true
+	}
+	return nil
+}
+
+// isPlainIdentifier checks whether s consists of only ASCII letters, digits and underscores and
+// doesn't start with a digit
+func isPlainIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		isLetter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		isDigit := r >= '0' && r <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// fullTextTableSQL returns the statement that creates a full text index with the given name,
+// columns and tokenizer
+func fullTextTableSQL(table string, columns []string, tokenizer string) string {
+	return fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5(%s, tokenize=%s)", table, strings.Join(columns, ", "), sqlQuote(tokenizer))
+}
+
+// migrateFullTextIndex recreates the full text index of the given schema if its columns or
+// tokenizer don't match the configured ones and opts.RebuildFullTextIndex allows it, for example
+// when opening a database that was created with the default single column. Contents of columns
+// that exist both before and after are preserved and reindexed using the configured tokenizer.
+// core should be a transaction, so that the index is migrated either completely or not at all.
+func migrateFullTextIndex(core *minisql.QueryableAPI, schema string, opts *Options) error {
+	columns, tokenizer := opts.fullTextColumns(), opts.tokenizer()
+	rows, err := core.Query(fmt.Sprintf("SELECT sql FROM sqlite_master WHERE name = '%s_fts2'", schema))
+	if err != nil {
+		return fmt.Errorf("query full text index definition: %w", err)
+	}
+	var definition string
+	if rows.Next() {
+		err = rows.Scan(&definition)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scan full text index definition: %w", err)
+		}
+	}
+	rows.Close()
+	sameTokenizer := strings.Contains(definition, fmt.Sprintf("tokenize=%s", sqlQuote(tokenizer)))
+
+	rows, err = core.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s_fts2')", schema))
+	if err != nil {
+		return fmt.Errorf("query full text columns: %w", err)
+	}
+	var existing []string
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scan full text column: %w", err)
+		}
+		existing = append(existing, column)
+	}
+	rows.Close()
+	if sameTokenizer && slices.Equal(existing, columns) {
+		return nil
+	}
+	if !opts.RebuildFullTextIndex {
+		return fmt.Errorf("full text index doesn't have columns %v and tokenizer %q, set RebuildFullTextIndex to rebuild it: %w", columns, tokenizer, ErrInvalidOptions)
+	}
+
+	copied := []string{"rowid"}
+	for _, column := range columns {
+		if slices.Contains(existing, column) {
+			copied = append(copied, column)
+		}
+	}
+	statements := []string{
+		fullTextTableSQL(fmt.Sprintf("%s_fts2_migrate", schema), columns, tokenizer),
+		fmt.Sprintf("INSERT INTO %s_fts2_migrate(%s) SELECT %s FROM %s_fts2", schema, strings.Join(copied, ", "), strings.Join(copied, ", "), schema),
+		fmt.Sprintf("DROP TABLE %s_fts2", schema),
+		fmt.Sprintf("ALTER TABLE %s_fts2_migrate RENAME TO %s_fts2", schema, schema),
+	}
+	for _, statement := range statements {
+		err = core.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("migrate full text index: %w", err)
+		}
+	}
+	return nil
+}
+
+// prefixColumns prefixes each of the given columns with the given table alias and joins them into
+// a comma separated list
+func prefixColumns(alias string, columns []string) string {
+	prefixed := make([]string, 0, len(columns))
+	for _, column := range columns {
+		prefixed = append(prefixed, alias+"."+column)
+	}
+	return strings.Join(prefixed, ", ")
+}
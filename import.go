@@ -0,0 +1,44 @@
+package pathdb
+
+import (
+	"fmt"
+)
+
+// ConflictResolver decides what to store when an import encounters a path that already has a
+// value. It's called with the existing and incoming values and returns the value to store, which
+// may be either of them or something new entirely. Returning nil deletes the path.
+type ConflictResolver func(path string, existing, incoming *Raw[any]) (*Raw[any], error)
+
+// ImportItems puts the given items in order using their serialized bytes as is, so type ids are
+// preserved. Detail paths are ignored. When an item's path already has a value, resolve decides
+// what gets stored. If resolve is nil, incoming values overwrite existing ones.
+func ImportItems(t TX, items []*Item[*Raw[any]], resolve ConflictResolver) error {
+	for _, i := range items {
+		value := i.Value
+		if resolve != nil {
+			existing, err := RGet[any](t, i.Path)
+			if err != nil {
+				return fmt.Errorf("importitems: %w", err)
+			}
+			if existing != nil {
+				value, err = resolve(i.Path, existing, i.Value)
+				if err != nil {
+					return fmt.Errorf("importitems: resolve conflict at %v: %w", i.Path, err)
+				}
+				if value == existing {
+					// keeping the existing value, nothing to do
+					continue
+				}
+			}
+		}
+		var b []byte
+		if value != nil {
+			b = value.Bytes
+		}
+		err := t.Put(i.Path, nil, b, "", true)
+		if err != nil {
+			return fmt.Errorf("importitems: put %v: %w", i.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1066 @@
+// Package memdb provides an in-memory minisql.DB for running pathdb's tests without cgo.
+package memdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/pathdb/minisql"
+)
+
+// ErrUnsupportedSQL is returned by a DB for statements outside of the subset of SQL that it
+// understands
+var ErrUnsupportedSQL = errors.New("unsupported SQL")
+
+var (
+	errMemDBClosed = errors.New("sql: database is closed")
+	errMemTxDone   = errors.New("sql: transaction has already been committed or rolled back")
+	// errMemDBLocked mirrors SQLite's SQLITE_BUSY_SNAPSHOT, which pathdb retries like other busy
+	// errors
+	errMemDBLocked = errors.New("database is locked")
+)
+
+// DB is a minisql.DB that keeps its tables in memory, in plain Go maps, so that pathdb can be
+// tested without cgo. It understands the subset of SQLite's SQL that pathdb emits, except for full
+// text search (MATCH, bm25, snippet and fts5vocab) and RebuildFTS, which fail with
+// ErrUnsupportedSQL. Full text index tables are kept as ordinary tables, so values can still be
+// put into and deleted from them.
+//
+// Transactions read from the snapshot taken by their first statement, like SQLite in WAL mode.
+// Only one transaction writes at a time, and one that read from a snapshot that has since been
+// superseded fails to write with a "database is locked" error.
+type DB struct {
+	// writeMx is held by the transaction that's currently writing
+	writeMx sync.Mutex
+	mx      sync.Mutex
+	state   *memState
+	version int64
+	closed  bool
+}
+
+// New creates an empty DB
+func New() *DB {
+	return &DB{state: &memState{tables: make(map[string]*memTable)}}
+}
+
+func (db *DB) snapshot() (*memState, int64, error) {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	if db.closed {
+		return nil, 0, errMemDBClosed
+	}
+	return db.state.clone(), db.version, nil
+}
+
+func (db *DB) publish(state *memState) {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	db.state = state
+	db.version++
+}
+
+func (db *DB) Exec(query string, args minisql.Values) error {
+	_, err := db.ExecResult(query, args)
+	return err
+}
+
+func (db *DB) ExecResult(query string, args minisql.Values) (int64, error) {
+	stmt, params, err := prepare(query, args)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := stmt.(*savepointStmt); ok {
+		return 0, unsupported("savepoints outside of transactions")
+	}
+	write := isWrite(stmt)
+	if write {
+		db.writeMx.Lock()
+		defer db.writeMx.Unlock()
+	}
+	state, _, err := db.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	x := &executor{state: state, params: params}
+	n, err := x.exec(stmt)
+	if err != nil {
+		return 0, err
+	}
+	if write {
+		db.publish(state)
+	}
+	return n, nil
+}
+
+func (db *DB) Query(query string, args minisql.Values) (minisql.Rows, error) {
+	stmt, params, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isWrite(stmt) {
+		_, err = db.ExecResult(query, args)
+		return &memRows{}, err
+	}
+	state, _, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return query2Rows(&executor{state: state, params: params}, stmt)
+}
+
+func (db *DB) Begin() (minisql.Tx, error) {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	if db.closed {
+		return nil, errMemDBClosed
+	}
+	return &memTx{db: db}, nil
+}
+
+func (db *DB) Close() error {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	db.closed = true
+	return nil
+}
+
+type memSavepoint struct {
+	name  string
+	state *memState
+}
+
+type memTx struct {
+	db *DB
+	// state is nil until the first statement takes a snapshot
+	state      *memState
+	version    int64
+	writing    bool
+	savepoints []memSavepoint
+	done       bool
+}
+
+func (tx *memTx) begin() error {
+	if tx.done {
+		return errMemTxDone
+	}
+	if tx.state != nil {
+		return nil
+	}
+	var err error
+	tx.state, tx.version, err = tx.db.snapshot()
+	return err
+}
+
+// beginWrite makes this the writing transaction, waiting for any other one to finish first
+func (tx *memTx) beginWrite() error {
+	if tx.done {
+		return errMemTxDone
+	}
+	if tx.writing {
+		return nil
+	}
+	tx.db.writeMx.Lock()
+	if tx.state == nil {
+		tx.writing = true
+		return tx.begin()
+	}
+	tx.db.mx.Lock()
+	current := tx.db.version
+	tx.db.mx.Unlock()
+	if current != tx.version {
+		tx.db.writeMx.Unlock()
+		return errMemDBLocked
+	}
+	tx.writing = true
+	return nil
+}
+
+func (tx *memTx) Exec(query string, args minisql.Values) error {
+	_, err := tx.ExecResult(query, args)
+	return err
+}
+
+func (tx *memTx) ExecResult(query string, args minisql.Values) (int64, error) {
+	stmt, params, err := prepare(query, args)
+	if err != nil {
+		return 0, err
+	}
+	if sp, ok := stmt.(*savepointStmt); ok {
+		return 0, tx.savepoint(sp)
+	}
+	if isWrite(stmt) {
+		err = tx.beginWrite()
+	} else {
+		err = tx.begin()
+	}
+	if err != nil {
+		return 0, err
+	}
+	// statements either apply completely or not at all
+	state := tx.state.clone()
+	n, err := (&executor{state: state, params: params}).exec(stmt)
+	if err != nil {
+		return 0, err
+	}
+	tx.state = state
+	return n, nil
+}
+
+func (tx *memTx) savepoint(sp *savepointStmt) error {
+	err := tx.begin()
+	if err != nil {
+		return err
+	}
+	if sp.kind == "SAVEPOINT" {
+		tx.savepoints = append(tx.savepoints, memSavepoint{sp.name, tx.state.clone()})
+		return nil
+	}
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if !strings.EqualFold(tx.savepoints[i].name, sp.name) {
+			continue
+		}
+		if sp.kind == "ROLLBACK" {
+			// the savepoint stays in place after rolling back to it
+			tx.state = tx.savepoints[i].state.clone()
+			tx.savepoints = tx.savepoints[:i+1]
+		} else {
+			tx.savepoints = tx.savepoints[:i]
+		}
+		return nil
+	}
+	return fmt.Errorf("no such savepoint: %s", sp.name)
+}
+
+func (tx *memTx) Query(query string, args minisql.Values) (minisql.Rows, error) {
+	stmt, params, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isWrite(stmt) {
+		_, err = tx.ExecResult(query, args)
+		return &memRows{}, err
+	}
+	err = tx.begin()
+	if err != nil {
+		return nil, err
+	}
+	return query2Rows(&executor{state: tx.state, params: params}, stmt)
+}
+
+func (tx *memTx) Commit() error {
+	if tx.done {
+		return errMemTxDone
+	}
+	tx.done = true
+	if tx.writing {
+		tx.db.publish(tx.state)
+		tx.db.writeMx.Unlock()
+	}
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.done {
+		return errMemTxDone
+	}
+	tx.done = true
+	if tx.writing {
+		tx.db.writeMx.Unlock()
+	}
+	return nil
+}
+
+type memRows struct {
+	rows [][]interface{}
+	pos  int
+}
+
+// query2Rows runs a statement that doesn't write. Statements other than SELECT return no rows.
+func query2Rows(x *executor, stmt statement) (minisql.Rows, error) {
+	query, ok := stmt.(*selectStmt)
+	if !ok {
+		_, err := x.exec(stmt)
+		return &memRows{}, err
+	}
+	rows, err := x.selectRows(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &memRows{rows: rows}, nil
+}
+
+func (r *memRows) Next() bool {
+	if r.pos >= len(r.rows) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *memRows) Scan(values minisql.Values) error {
+	if r.pos == 0 || r.pos > len(r.rows) {
+		return errors.New("sql: Scan called without calling Next")
+	}
+	row := r.rows[r.pos-1]
+	if values.Len() != len(row) {
+		return fmt.Errorf("sql: expected %d destination arguments in Scan, not %d", len(row), values.Len())
+	}
+	for i, v := range row {
+		err := scanValue(values.Get(i), v)
+		if err != nil {
+			return fmt.Errorf("sql: Scan error on column index %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// scanValue converts v to the type of dest, like database/sql does
+func scanValue(dest *minisql.Value, v interface{}) error {
+	if v == nil {
+		dest.SetNull()
+		return nil
+	}
+	switch dest.Type {
+	case minisql.ValueTypeBytes:
+		if b, ok := v.([]byte); ok {
+			dest.SetBytes(b)
+		} else {
+			dest.SetBytes([]byte(toText(v)))
+		}
+	case minisql.ValueTypeString:
+		dest.SetString(toText(v))
+	case minisql.ValueTypeBool:
+		dest.SetBool(truthy(v))
+	case minisql.ValueTypeFloat64:
+		dest.SetFloat64(toFloat(toNumber(v)))
+	case minisql.ValueTypeInt, minisql.ValueTypeInt64:
+		n := toNumber(v)
+		if f, ok := n.(float64); ok && f == float64(int64(f)) {
+			n = int64(f)
+		}
+		i, ok := n.(int64)
+		if !ok || storageClass(v) > 1 && toText(i) != strings.TrimSpace(toText(v)) {
+			return fmt.Errorf("converting %T %q to an integer: invalid syntax", v, toText(v))
+		}
+		if dest.Type == minisql.ValueTypeInt {
+			dest.SetInt(int(i))
+		} else {
+			dest.SetInt64(i)
+		}
+	}
+	return nil
+}
+
+func (r *memRows) Close() error {
+	r.pos = len(r.rows) + 1
+	return nil
+}
+
+// prepare parses query and converts its arguments to the values used by DB
+func prepare(query string, args minisql.Values) (statement, []interface{}, error) {
+	stmt, err := parse(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var params []interface{}
+	if args != nil {
+		params = make([]interface{}, args.Len())
+		for i := range params {
+			arg := args.Get(i)
+			if arg == nil {
+				return nil, nil, fmt.Errorf("argument %d has an unsupported type", i+1)
+			}
+			switch arg.Type {
+			case minisql.ValueTypeBytes:
+				params[i] = append([]byte{}, arg.Bytes()...)
+			case minisql.ValueTypeString:
+				params[i] = arg.String()
+			case minisql.ValueTypeInt:
+				params[i] = int64(arg.Int())
+			case minisql.ValueTypeBool:
+				params[i] = boolValue(arg.Bool())
+			case minisql.ValueTypeInt64:
+				params[i] = arg.Int64()
+			case minisql.ValueTypeFloat64:
+				params[i] = arg.Float64()
+			}
+		}
+	}
+	return stmt, params, nil
+}
+
+func isWrite(stmt statement) bool {
+	switch stmt.(type) {
+	case *noopStmt, *selectStmt, *savepointStmt:
+		return false
+	}
+	return true
+}
+
+// memState holds all tables. States are copied on write: clone shares tables with the original
+// until they're modified through writable.
+type memState struct {
+	tables map[string]*memTable
+	// owned holds the tables that this state copied and may therefore modify
+	owned map[*memTable]bool
+}
+
+func (s *memState) clone() *memState {
+	tables := make(map[string]*memTable, len(s.tables))
+	for name, table := range s.tables {
+		tables[name] = table
+	}
+	return &memState{tables: tables, owned: make(map[*memTable]bool)}
+}
+
+func (s *memState) table(name string) (*memTable, error) {
+	table := s.tables[strings.ToLower(name)]
+	if table == nil {
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+	if table.module == "fts5vocab" {
+		return nil, unsupported("fts5vocab tables")
+	}
+	return table, nil
+}
+
+// writable returns a copy of the named table that can be modified
+func (s *memState) writable(name string) (*memTable, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.owned[table] {
+		return table, nil
+	}
+	c := *table
+	c.columns = append([]string{}, table.columns...)
+	c.rows = make(map[interface{}][]interface{}, len(table.rows))
+	for key, row := range table.rows {
+		c.rows[key] = row
+	}
+	s.tables[strings.ToLower(name)] = &c
+	s.owned[&c] = true
+	return &c, nil
+}
+
+// memTable is a table whose rows are keyed by the value of their key column. Tables without a
+// PRIMARY KEY get a hidden rowid column at index 0 instead. Rows are never modified in place, so
+// that states can share them.
+type memTable struct {
+	name       string
+	columns    []string
+	hidden     int
+	key        int
+	integerKey bool
+	module     string
+	sql        string
+	rows       map[interface{}][]interface{}
+}
+
+func newMemTable(name string, columns []string, key string, integerKey bool, sql string) *memTable {
+	t := &memTable{name: name, columns: columns, integerKey: integerKey, sql: sql, rows: make(map[interface{}][]interface{})}
+	t.key = t.columnIndex(key)
+	if t.key < 0 {
+		t.columns = append([]string{"rowid"}, columns...)
+		t.hidden, t.key, t.integerKey = 1, 0, true
+	}
+	return t
+}
+
+func (t *memTable) columnIndex(column string) int {
+	for i, c := range t.columns {
+		if strings.EqualFold(c, column) {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyOf returns the map key for the given key column value
+func (t *memTable) keyOf(v interface{}) interface{} {
+	if t.integerKey {
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			return int64(f)
+		}
+	}
+	if b, ok := v.([]byte); ok {
+		return blobKey(b)
+	}
+	return v
+}
+
+// blobKey stands in for BLOB keys, since slices can't be map keys
+type blobKey string
+
+// sortedKeys returns the keys of all rows in the order of their key column
+func (t *memTable) sortedKeys() []interface{} {
+	keys := make([]interface{}, 0, len(t.rows))
+	for key := range t.rows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareValues(keyValue(keys[i]), keyValue(keys[j])) < 0
+	})
+	return keys
+}
+
+func keyValue(key interface{}) interface{} {
+	if b, ok := key.(blobKey); ok {
+		return []byte(b)
+	}
+	return key
+}
+
+// executor runs statements against a state
+type executor struct {
+	state  *memState
+	params []interface{}
+}
+
+// exec runs a statement and returns the number of rows that it changed
+func (x *executor) exec(stmt statement) (int64, error) {
+	switch s := stmt.(type) {
+	case *noopStmt:
+		return 0, nil
+	case *selectStmt:
+		_, err := x.selectRows(s, nil)
+		return 0, err
+	case *createTableStmt:
+		return 0, x.createTable(s.name, s.ifNotExists, func() *memTable {
+			return newMemTable(s.name, s.columns, s.key, s.integerKey, s.sql)
+		})
+	case *createVirtualTableStmt:
+		return 0, x.createTable(s.name, s.ifNotExists, func() *memTable {
+			t := newMemTable(s.name, s.columns, "", false, s.sql)
+			t.module = s.module
+			return t
+		})
+	case *dropTableStmt:
+		name := strings.ToLower(s.name)
+		if x.state.tables[name] == nil && !s.ifExists {
+			return 0, fmt.Errorf("no such table: %s", s.name)
+		}
+		delete(x.state.tables, name)
+		return 0, nil
+	case *alterTableStmt:
+		return 0, x.alterTable(s)
+	case *insertStmt:
+		return x.insert(s)
+	case *updateStmt:
+		return x.update(s)
+	case *deleteStmt:
+		return x.delete(s)
+	}
+	return 0, unsupported(fmt.Sprintf("statement %T", stmt))
+}
+
+func (x *executor) createTable(name string, ifNotExists bool, create func() *memTable) error {
+	if x.state.tables[strings.ToLower(name)] != nil {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("table %s already exists", name)
+	}
+	t := create()
+	x.state.tables[strings.ToLower(name)] = t
+	x.state.owned[t] = true
+	return nil
+}
+
+func (x *executor) alterTable(s *alterTableStmt) error {
+	t, err := x.state.writable(s.name)
+	if err != nil {
+		return err
+	}
+	if s.addColumn != "" {
+		if t.columnIndex(s.addColumn) >= 0 {
+			return fmt.Errorf("duplicate column name: %s", s.addColumn)
+		}
+		t.columns = append(t.columns, s.addColumn)
+		for key, row := range t.rows {
+			t.rows[key] = append(append(make([]interface{}, 0, len(row)+1), row...), nil)
+		}
+		return nil
+	}
+	if x.state.tables[strings.ToLower(s.renameTo)] != nil {
+		return fmt.Errorf("there is already another table or index with this name: %s", s.renameTo)
+	}
+	delete(x.state.tables, strings.ToLower(s.name))
+	t.sql = strings.Replace(t.sql, t.name, s.renameTo, 1)
+	t.name = s.renameTo
+	x.state.tables[strings.ToLower(s.renameTo)] = t
+	return nil
+}
+
+func (x *executor) insert(s *insertStmt) (int64, error) {
+	t, err := x.state.writable(s.table)
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]int, 0, len(t.columns))
+	if s.columns == nil {
+		for i := t.hidden; i < len(t.columns); i++ {
+			columns = append(columns, i)
+		}
+	}
+	for _, column := range s.columns {
+		i := t.columnIndex(column)
+		if i < 0 {
+			return 0, fmt.Errorf("table %s has no column named %s", s.table, column)
+		}
+		columns = append(columns, i)
+	}
+
+	var selected [][]interface{}
+	if s.query != nil {
+		// rows to insert are selected up front, so that they don't include inserted ones
+		selected, err = x.selectRows(s.query, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := len(s.rows) + len(selected)
+	changed := int64(0)
+	for r := 0; r < n; r++ {
+		row := make([]interface{}, len(t.columns))
+		if r < len(s.rows) {
+			if len(s.rows[r]) != len(columns) {
+				return 0, fmt.Errorf("%d values for %d columns", len(s.rows[r]), len(columns))
+			}
+			base := &env{x: x}
+			for i, value := range s.rows[r] {
+				row[columns[i]], err = value.eval(base)
+				if err != nil {
+					return 0, err
+				}
+			}
+		} else {
+			values := selected[r-len(s.rows)]
+			if len(values) != len(columns) {
+				return 0, fmt.Errorf("%d values for %d columns", len(values), len(columns))
+			}
+			for i, value := range values {
+				row[columns[i]] = value
+			}
+		}
+		inserted, err := x.insertRow(t, row, s.onConflict)
+		if err != nil {
+			return 0, err
+		}
+		if inserted {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// insertRow inserts a single row, resolving conflicts on its key as given by the statement's ON
+// CONFLICT clause (see insertStmt)
+func (x *executor) insertRow(t *memTable, row []interface{}, onConflict *[]assignment) (bool, error) {
+	if row[t.key] == nil {
+		if !t.integerKey {
+			return false, fmt.Errorf("NOT NULL constraint failed: %s.%s", t.name, t.columns[t.key])
+		}
+		next := int64(1)
+		for key := range t.rows {
+			if i, ok := key.(int64); ok && i >= next {
+				next = i + 1
+			}
+		}
+		row[t.key] = next
+	}
+	row[t.key] = keyValue(t.keyOf(row[t.key]))
+	key := t.keyOf(row[t.key])
+	existing, exists := t.rows[key]
+	if !exists {
+		t.rows[key] = row
+		return true, nil
+	}
+	if onConflict == nil {
+		return false, fmt.Errorf("UNIQUE constraint failed: %s.%s", t.name, t.columns[t.key])
+	}
+	if len(*onConflict) == 0 {
+		return false, nil
+	}
+	e := &env{x: x, bindings: []binding{{alias: t.name, table: t, row: existing}, {alias: "excluded", table: t, row: row}}}
+	return true, x.updateRow(t, key, existing, *onConflict, e)
+}
+
+// updateRow replaces the row stored under key with one to which the given assignments have been
+// applied, evaluating them in e
+func (x *executor) updateRow(t *memTable, key interface{}, row []interface{}, set []assignment, e *env) error {
+	updated := append([]interface{}{}, row...)
+	for _, a := range set {
+		i := t.columnIndex(a.column)
+		if i < 0 {
+			return fmt.Errorf("no such column: %s", a.column)
+		}
+		v, err := a.value.eval(e)
+		if err != nil {
+			return err
+		}
+		updated[i] = v
+	}
+	newKey := t.keyOf(updated[t.key])
+	if updated[t.key] == nil {
+		return fmt.Errorf("NOT NULL constraint failed: %s.%s", t.name, t.columns[t.key])
+	}
+	if newKey != key {
+		if _, exists := t.rows[newKey]; exists {
+			return fmt.Errorf("UNIQUE constraint failed: %s.%s", t.name, t.columns[t.key])
+		}
+		delete(t.rows, key)
+	}
+	t.rows[newKey] = updated
+	return nil
+}
+
+func (x *executor) update(s *updateStmt) (int64, error) {
+	t, err := x.state.writable(s.table)
+	if err != nil {
+		return 0, err
+	}
+	matches, err := x.matchingRows(t, s.where)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range matches {
+		row := t.rows[key]
+		err = x.updateRow(t, key, row, s.set, &env{x: x, bindings: []binding{{alias: t.name, table: t, row: row}}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(matches)), nil
+}
+
+func (x *executor) delete(s *deleteStmt) (int64, error) {
+	t, err := x.state.writable(s.table)
+	if err != nil {
+		return 0, err
+	}
+	matches, err := x.matchingRows(t, s.where)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range matches {
+		delete(t.rows, key)
+	}
+	return int64(len(matches)), nil
+}
+
+// matchingRows returns the keys of the rows of t that match where, in key order
+func (x *executor) matchingRows(t *memTable, where expr) ([]interface{}, error) {
+	base := &env{x: x}
+	candidates, err := x.candidates(t, t.name, where, base, true)
+	if err != nil {
+		return nil, err
+	}
+	var result []interface{}
+	for _, key := range candidates {
+		row := t.rows[key]
+		if where != nil {
+			v, err := where.eval(base.with(binding{alias: t.name, table: t, row: row}))
+			if err != nil {
+				return nil, err
+			}
+			if v == nil || !truthy(v) {
+				continue
+			}
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// candidates returns the keys of the rows of t (bound as alias) that may match condition, which
+// are all of them unless condition requires the key column to equal something that doesn't
+// depend on t. Such values are evaluated in e. If only is true, t is the only table in scope, so
+// unqualified columns refer to it.
+func (x *executor) candidates(t *memTable, alias string, condition expr, e *env, only bool) ([]interface{}, error) {
+	for _, conjunct := range conjuncts(condition) {
+		eq, ok := conjunct.(*binaryExpr)
+		if !ok || eq.op != "=" {
+			continue
+		}
+		for _, sides := range [][2]expr{{eq.left, eq.right}, {eq.right, eq.left}} {
+			column, ok := sides[0].(*columnExpr)
+			if !ok || t.columnIndex(column.column) != t.key || !refersTo(column, alias, only) || dependsOn(sides[1], alias, only) {
+				continue
+			}
+			v, err := sides[1].eval(e)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			key := t.keyOf(v)
+			if _, exists := t.rows[key]; !exists {
+				return nil, nil
+			}
+			return []interface{}{key}, nil
+		}
+	}
+	return t.sortedKeys(), nil
+}
+
+// conjuncts splits x into the conditions that are joined by AND
+func conjuncts(x expr) []expr {
+	if b, ok := x.(*binaryExpr); ok && b.op == "AND" {
+		return append(conjuncts(b.left), conjuncts(b.right)...)
+	}
+	if x == nil {
+		return nil
+	}
+	return []expr{x}
+}
+
+func refersTo(column *columnExpr, alias string, only bool) bool {
+	if column.table == "" {
+		return only
+	}
+	return strings.EqualFold(column.table, alias)
+}
+
+// dependsOn conservatively checks whether x might refer to the table bound as alias
+func dependsOn(x expr, alias string, only bool) bool {
+	depends := false
+	visit(x, func(x expr) {
+		switch t := x.(type) {
+		case *columnExpr:
+			if t.table == "" || refersTo(t, alias, only) {
+				depends = true
+			}
+		case *subqueryExpr, *inExpr:
+			depends = true
+		}
+	})
+	return depends
+}
+
+// selectRows runs a query, evaluating correlated references in outer
+func (x *executor) selectRows(s *selectStmt, outer *env) ([][]interface{}, error) {
+	base := &env{x: x, outer: outer}
+	envs := []*env{base}
+	if s.from != nil {
+		var err error
+		envs, err = x.scan(*s.from, s.where, base, len(s.joins) == 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range s.joins {
+			envs, err = x.join(envs, j)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var filtered []*env
+	for _, e := range envs {
+		if s.where != nil {
+			v, err := s.where.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil || !truthy(v) {
+				continue
+			}
+		}
+		filtered = append(filtered, e)
+	}
+
+	aggregate := false
+	for _, column := range s.columns {
+		aggregate = aggregate || containsAggregate(column)
+	}
+	if aggregate {
+		// without GROUP BY, aggregates produce a single row
+		// group is non-nil even without rows, since it marks aggregation
+		group := &env{x: x, outer: outer, group: append([]*env{}, filtered...)}
+		if len(filtered) > 0 {
+			group.bindings = filtered[0].bindings
+		}
+		filtered = []*env{group}
+	}
+	for _, e := range filtered {
+		e.window = int64(len(filtered))
+	}
+
+	type result struct {
+		row  []interface{}
+		sort []interface{}
+	}
+	results := make([]result, 0, len(filtered))
+	for _, e := range filtered {
+		r := result{row: make([]interface{}, len(s.columns)), sort: make([]interface{}, len(s.orderBy))}
+		for i, column := range s.columns {
+			v, err := column.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			r.row[i] = v
+		}
+		for i, term := range s.orderBy {
+			v, err := term.expr.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			r.sort[i] = v
+		}
+		results = append(results, r)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		for k, term := range s.orderBy {
+			c := compareValues(results[i].sort[k], results[j].sort[k])
+			if c != 0 {
+				return c < 0 != term.desc
+			}
+		}
+		return false
+	})
+
+	rows := make([][]interface{}, 0, len(results))
+	for _, r := range results {
+		if s.distinct && containsRow(rows, r.row) {
+			continue
+		}
+		rows = append(rows, r.row)
+	}
+	offset, limit := int64(0), int64(-1)
+	if s.limit != nil {
+		v, err := s.limit.eval(base)
+		if err != nil {
+			return nil, err
+		}
+		limit = toInt(v)
+	}
+	if s.offset != nil {
+		v, err := s.offset.eval(base)
+		if err != nil {
+			return nil, err
+		}
+		offset = toInt(v)
+	}
+	if offset > 0 {
+		if offset > int64(len(rows)) {
+			offset = int64(len(rows))
+		}
+		rows = rows[offset:]
+	}
+	if limit >= 0 && limit < int64(len(rows)) {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+func containsRow(rows [][]interface{}, row []interface{}) bool {
+	for _, existing := range rows {
+		same := true
+		for i := range row {
+			if storageClass(row[i]) != storageClass(existing[i]) || compareValues(row[i], existing[i]) != 0 {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// scan binds the rows of the given source that may match condition
+func (x *executor) scan(src source, condition expr, e *env, only bool) ([]*env, error) {
+	t, err := x.sourceTable(src, e)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := x.candidates(t, src.alias, condition, e, only)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*env, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, e.with(binding{alias: src.alias, table: t, row: t.rows[key]}))
+	}
+	return result, nil
+}
+
+func (x *executor) join(envs []*env, j join) ([]*env, error) {
+	var result []*env
+	for _, e := range envs {
+		matches, err := x.scan(j.source, j.on, e, false)
+		if err != nil {
+			return nil, err
+		}
+		matched := false
+		for _, m := range matches {
+			v, err := j.on.eval(m)
+			if err != nil {
+				return nil, err
+			}
+			if v != nil && truthy(v) {
+				result = append(result, m)
+				matched = true
+			}
+		}
+		if !matched && j.left {
+			t, err := x.sourceTable(j.source, e)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, e.with(binding{alias: j.alias, table: t}))
+		}
+	}
+	return result, nil
+}
+
+// sourceTable returns the table for a source of a query, which may be one of SQLite's built in
+// tables or table valued functions
+func (x *executor) sourceTable(src source, e *env) (*memTable, error) {
+	switch strings.ToLower(src.table) {
+	case "sqlite_master", "sqlite_schema", "sqlite_temp_master":
+		t := newMemTable(src.table, []string{"type", "name", "tbl_name", "rootpage", "sql"}, "", false, "")
+		for i, name := range sortedTableNames(x.state) {
+			table := x.state.tables[name]
+			t.rows[int64(i+1)] = []interface{}{int64(i + 1), "table", table.name, table.name, int64(i + 2), table.sql}
+		}
+		return t, nil
+	case "pragma_table_info":
+		if len(src.args) != 1 {
+			return nil, unsupported("pragma_table_info without a single table name")
+		}
+		name, err := src.args[0].eval(e)
+		if err != nil {
+			return nil, err
+		}
+		t := newMemTable(src.table, []string{"cid", "name", "type", "notnull", "dflt_value", "pk"}, "", false, "")
+		table := x.state.tables[strings.ToLower(toText(name))]
+		if table == nil {
+			return t, nil
+		}
+		for i, column := range table.columns[table.hidden:] {
+			pk := int64(0)
+			if i+table.hidden == table.key && table.hidden == 0 {
+				pk = 1
+			}
+			t.rows[int64(i+1)] = []interface{}{int64(i + 1), int64(i), column, "", int64(0), nil, pk}
+		}
+		return t, nil
+	}
+	if src.args != nil {
+		return nil, unsupported(fmt.Sprintf("table valued function %v", src.table))
+	}
+	return x.state.table(src.table)
+}
+
+func sortedTableNames(state *memState) []string {
+	names := make([]string, 0, len(state.tables))
+	for name := range state.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,849 @@
+package memdb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file evaluates the expressions parsed in memsql.go. Values are nil (NULL), int64, float64,
+// string or []byte, mirroring SQLite's storage classes.
+
+type expr interface {
+	eval(e *env) (interface{}, error)
+}
+
+// binding makes the columns of one row available under the given alias. A nil row stands for the
+// missing side of a LEFT JOIN, whose columns are all NULL.
+type binding struct {
+	alias string
+	table *memTable
+	row   []interface{}
+}
+
+// env is the context in which expressions are evaluated
+type env struct {
+	x        *executor
+	bindings []binding
+	outer    *env
+	// group holds the rows over which aggregate functions are computed
+	group []*env
+	// window is the number of rows that matched the query, before LIMIT and OFFSET
+	window int64
+}
+
+func (e *env) with(b binding) *env {
+	bindings := make([]binding, len(e.bindings), len(e.bindings)+1)
+	copy(bindings, e.bindings)
+	return &env{x: e.x, bindings: append(bindings, b), outer: e.outer}
+}
+
+func (e *env) lookup(table, column string) (interface{}, error) {
+	for scope := e; scope != nil; scope = scope.outer {
+		for _, b := range scope.bindings {
+			if table != "" && !strings.EqualFold(b.alias, table) {
+				continue
+			}
+			i := b.table.columnIndex(column)
+			if i < 0 {
+				continue
+			}
+			if b.row == nil {
+				return nil, nil
+			}
+			return b.row[i], nil
+		}
+	}
+	if table != "" {
+		return nil, fmt.Errorf("no such column: %s.%s", table, column)
+	}
+	return nil, fmt.Errorf("no such column: %s", column)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (l *literalExpr) eval(e *env) (interface{}, error) {
+	return l.value, nil
+}
+
+type paramExpr struct {
+	index int
+}
+
+func (p *paramExpr) eval(e *env) (interface{}, error) {
+	if p.index >= len(e.x.params) {
+		return nil, fmt.Errorf("missing argument %d", p.index+1)
+	}
+	return e.x.params[p.index], nil
+}
+
+type columnExpr struct {
+	table  string
+	column string
+}
+
+func (c *columnExpr) eval(e *env) (interface{}, error) {
+	return e.lookup(c.table, c.column)
+}
+
+type starExpr struct{}
+
+func (s *starExpr) eval(e *env) (interface{}, error) {
+	return nil, unsupported("* outside of COUNT(*)")
+}
+
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+func (u *unaryExpr) eval(e *env) (interface{}, error) {
+	v, err := u.operand.eval(e)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if u.op == "NOT" {
+		return boolValue(!truthy(v)), nil
+	}
+	switch n := toNumber(v).(type) {
+	case int64:
+		return -n, nil
+	default:
+		return -n.(float64), nil
+	}
+}
+
+type binaryExpr struct {
+	op    string
+	left  expr
+	right expr
+}
+
+func (b *binaryExpr) eval(e *env) (interface{}, error) {
+	left, err := b.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	// AND and OR use three valued logic and short circuit
+	switch b.op {
+	case "AND":
+		if left != nil && !truthy(left) {
+			return int64(0), nil
+		}
+	case "OR":
+		if left != nil && truthy(left) {
+			return int64(1), nil
+		}
+	}
+	right, err := b.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "AND":
+		if right != nil && !truthy(right) {
+			return int64(0), nil
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return int64(1), nil
+	case "OR":
+		if right != nil && truthy(right) {
+			return int64(1), nil
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return int64(0), nil
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	switch b.op {
+	case "=":
+		return boolValue(compareValues(left, right) == 0), nil
+	case "!=":
+		return boolValue(compareValues(left, right) != 0), nil
+	case "<":
+		return boolValue(compareValues(left, right) < 0), nil
+	case "<=":
+		return boolValue(compareValues(left, right) <= 0), nil
+	case ">":
+		return boolValue(compareValues(left, right) > 0), nil
+	case ">=":
+		return boolValue(compareValues(left, right) >= 0), nil
+	case "||":
+		return toText(left) + toText(right), nil
+	}
+	return arithmetic(b.op, toNumber(left), toNumber(right)), nil
+}
+
+func arithmetic(op string, left, right interface{}) interface{} {
+	l, lok := left.(int64)
+	r, rok := right.(int64)
+	if lok && rok {
+		switch op {
+		case "+":
+			return l + r
+		case "-":
+			return l - r
+		case "*":
+			return l * r
+		default:
+			if r == 0 {
+				return nil
+			}
+			return l / r
+		}
+	}
+	lf, rf := toFloat(left), toFloat(right)
+	switch op {
+	case "+":
+		return lf + rf
+	case "-":
+		return lf - rf
+	case "*":
+		return lf * rf
+	default:
+		if rf == 0 {
+			return nil
+		}
+		return lf / rf
+	}
+}
+
+type isNullExpr struct {
+	operand expr
+	not     bool
+}
+
+func (i *isNullExpr) eval(e *env) (interface{}, error) {
+	v, err := i.operand.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return boolValue((v == nil) != i.not), nil
+}
+
+// matchExpr is a LIKE or GLOB
+type matchExpr struct {
+	op      string
+	operand expr
+	pattern expr
+	not     bool
+}
+
+func (m *matchExpr) eval(e *env) (interface{}, error) {
+	v, err := m.operand.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := m.pattern.eval(e)
+	if err != nil || v == nil || pattern == nil {
+		return nil, err
+	}
+	var matched bool
+	if m.op == "LIKE" {
+		matched = like([]rune(toText(pattern)), []rune(toText(v)))
+	} else {
+		matched = glob([]rune(toText(pattern)), []rune(toText(v)))
+	}
+	return boolValue(matched != m.not), nil
+}
+
+// like matches s against a LIKE pattern, ignoring the case of ASCII letters
+func like(pattern, s []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '%':
+			for i := 0; i <= len(s); i++ {
+				if like(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || foldASCII(pattern[0]) != foldASCII(s[0]) {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func foldASCII(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+	return r
+}
+
+// glob matches s against a GLOB pattern
+func glob(pattern, s []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if glob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			n, matched := globClass(pattern, s[0])
+			if n == 0 {
+				// an unterminated class matches literally
+				if s[0] != '[' {
+					return false
+				}
+				break
+			}
+			if !matched {
+				return false
+			}
+			pattern, s = pattern[n:], s[1:]
+			continue
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// globClass matches r against the character class at the start of pattern, returning the length
+// of the class (or 0 if it isn't terminated) and whether r matched
+func globClass(pattern []rune, r rune) (int, bool) {
+	i := 1
+	invert := i < len(pattern) && pattern[i] == '^'
+	if invert {
+		i++
+	}
+	matched := false
+	first := true
+	for ; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == ']' && !first {
+			return i + 1, matched != invert
+		}
+		first = false
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			if r >= c && r <= pattern[i+2] {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+		if r == c {
+			matched = true
+		}
+	}
+	return 0, false
+}
+
+type inExpr struct {
+	operand expr
+	list    []expr
+	query   *selectStmt
+	not     bool
+}
+
+func (in *inExpr) eval(e *env) (interface{}, error) {
+	v, err := in.operand.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []interface{}
+	if in.query != nil {
+		rows, err := e.x.selectRows(in.query, e)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			candidates = append(candidates, row[0])
+		}
+	} else {
+		for _, item := range in.list {
+			candidate, err := item.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return boolValue(in.not), nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+	sawNull := false
+	for _, candidate := range candidates {
+		if candidate == nil {
+			sawNull = true
+		} else if compareValues(v, candidate) == 0 {
+			return boolValue(!in.not), nil
+		}
+	}
+	if sawNull {
+		return nil, nil
+	}
+	return boolValue(in.not), nil
+}
+
+type subqueryExpr struct {
+	query *selectStmt
+}
+
+func (s *subqueryExpr) eval(e *env) (interface{}, error) {
+	rows, err := e.x.selectRows(s.query, e)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0][0], nil
+}
+
+type castExpr struct {
+	operand expr
+	typ     string
+}
+
+func (c *castExpr) eval(e *env) (interface{}, error) {
+	v, err := c.operand.eval(e)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(c.typ, "INT"):
+		n := toNumber(v)
+		if f, ok := n.(float64); ok {
+			return int64(f), nil
+		}
+		return n, nil
+	case strings.Contains(c.typ, "CHAR"), strings.Contains(c.typ, "CLOB"), strings.Contains(c.typ, "TEXT"):
+		return toText(v), nil
+	case c.typ == "BLOB":
+		return []byte(toText(v)), nil
+	case strings.Contains(c.typ, "REAL"), strings.Contains(c.typ, "FLOA"), strings.Contains(c.typ, "DOUB"):
+		return toFloat(toNumber(v)), nil
+	}
+	return toNumber(v), nil
+}
+
+type when struct {
+	condition expr
+	result    expr
+}
+
+type caseExpr struct {
+	operand   expr
+	whens     []when
+	otherwise expr
+}
+
+func (c *caseExpr) eval(e *env) (interface{}, error) {
+	var operand interface{}
+	if c.operand != nil {
+		var err error
+		operand, err = c.operand.eval(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, w := range c.whens {
+		condition, err := w.condition.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		var matched bool
+		if c.operand != nil {
+			matched = operand != nil && condition != nil && compareValues(operand, condition) == 0
+		} else {
+			matched = condition != nil && truthy(condition)
+		}
+		if matched {
+			return w.result.eval(e)
+		}
+	}
+	if c.otherwise == nil {
+		return nil, nil
+	}
+	return c.otherwise.eval(e)
+}
+
+var knownFunctions = map[string]bool{
+	"SUBSTR":   true,
+	"IFNULL":   true,
+	"COALESCE": true,
+	"LENGTH":   true,
+	"CHAR":     true,
+	"COUNT":    true,
+	"MAX":      true,
+	"MIN":      true,
+}
+
+type callExpr struct {
+	name string
+	args []expr
+}
+
+// firstArg returns the first argument of c, if any
+func firstArg(c *callExpr) expr {
+	if len(c.args) == 0 {
+		return nil
+	}
+	return c.args[0]
+}
+
+// windowCountExpr is COUNT(*) OVER (), which counts all rows of the result
+type windowCountExpr struct{}
+
+func (w *windowCountExpr) eval(e *env) (interface{}, error) {
+	return e.window, nil
+}
+
+// isAggregate checks whether this call aggregates over rows rather than computing a scalar
+func (c *callExpr) isAggregate() bool {
+	return c.name == "COUNT" || (c.name == "MAX" || c.name == "MIN") && len(c.args) == 1
+}
+
+func (c *callExpr) eval(e *env) (interface{}, error) {
+	if c.isAggregate() {
+		return c.aggregate(e)
+	}
+	args := make([]interface{}, len(c.args))
+	for i, arg := range c.args {
+		var err error
+		args[i], err = arg.eval(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch c.name {
+	case "IFNULL", "COALESCE":
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	case "MAX", "MIN":
+		var result interface{}
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			if result == nil || c.name == "MAX" && compareValues(arg, result) > 0 || c.name == "MIN" && compareValues(arg, result) < 0 {
+				result = arg
+			}
+		}
+		return result, nil
+	case "CHAR":
+		var b strings.Builder
+		for _, arg := range args {
+			b.WriteRune(rune(toInt(arg)))
+		}
+		return b.String(), nil
+	}
+	if len(args) == 0 || args[0] == nil {
+		return nil, nil
+	}
+	switch c.name {
+	case "LENGTH":
+		if b, ok := args[0].([]byte); ok {
+			return int64(len(b)), nil
+		}
+		return int64(utf8.RuneCountInString(toText(args[0]))), nil
+	case "SUBSTR":
+		if len(args) < 2 || args[1] == nil || len(args) > 2 && args[2] == nil {
+			return nil, nil
+		}
+		length := int64(math.MaxInt32)
+		hasLength := len(args) > 2
+		if hasLength {
+			length = toInt(args[2])
+		}
+		if b, ok := args[0].([]byte); ok {
+			start, end := substrRange(int64(len(b)), toInt(args[1]), length, hasLength)
+			return append([]byte{}, b[start:end]...), nil
+		}
+		runes := []rune(toText(args[0]))
+		start, end := substrRange(int64(len(runes)), toInt(args[1]), length, hasLength)
+		return string(runes[start:end]), nil
+	}
+	return nil, unsupported(fmt.Sprintf("function %v", c.name))
+}
+
+// substrRange computes the range selected by SUBSTR(x, start, length) in an x of the given size,
+// following SQLite's rules for negative and zero arguments
+func substrRange(size, start, length int64, hasLength bool) (int64, int64) {
+	negativeLength := false
+	if length < 0 {
+		length = -length
+		negativeLength = true
+	}
+	if start < 0 {
+		start += size
+		if start < 0 {
+			length += start
+			if length < 0 {
+				length = 0
+			}
+			start = 0
+		}
+	} else if start > 0 {
+		start--
+	} else if length > 0 && hasLength {
+		length--
+	}
+	if negativeLength {
+		start -= length
+		if start < 0 {
+			length += start
+			start = 0
+		}
+	}
+	if start > size {
+		start = size
+	}
+	end := start + length
+	if end > size || end < start {
+		end = size
+	}
+	return start, end
+}
+
+func (c *callExpr) aggregate(e *env) (interface{}, error) {
+	if e.group == nil {
+		return nil, fmt.Errorf("misuse of aggregate function %v()", c.name)
+	}
+	if len(c.args) != 1 {
+		return nil, unsupported(fmt.Sprintf("%v with %d arguments", c.name, len(c.args)))
+	}
+	if _, ok := c.args[0].(*starExpr); ok {
+		if c.name != "COUNT" {
+			return nil, unsupported(fmt.Sprintf("%v(*)", c.name))
+		}
+		return int64(len(e.group)), nil
+	}
+	var result interface{}
+	count := int64(0)
+	for _, row := range e.group {
+		v, err := c.args[0].eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		count++
+		if result == nil || c.name == "MAX" && compareValues(v, result) > 0 || c.name == "MIN" && compareValues(v, result) < 0 {
+			result = v
+		}
+	}
+	if c.name == "COUNT" {
+		return count, nil
+	}
+	return result, nil
+}
+
+// containsAggregate checks whether x calls an aggregate function outside of subqueries
+func containsAggregate(x expr) bool {
+	found := false
+	visit(x, func(x expr) {
+		if call, ok := x.(*callExpr); ok && call.isAggregate() {
+			found = true
+		}
+	})
+	return found
+}
+
+// visit calls f for x and all expressions nested within it, except for those in subqueries
+func visit(x expr, f func(expr)) {
+	if x == nil {
+		return
+	}
+	f(x)
+	switch t := x.(type) {
+	case *unaryExpr:
+		visit(t.operand, f)
+	case *binaryExpr:
+		visit(t.left, f)
+		visit(t.right, f)
+	case *isNullExpr:
+		visit(t.operand, f)
+	case *matchExpr:
+		visit(t.operand, f)
+		visit(t.pattern, f)
+	case *inExpr:
+		visit(t.operand, f)
+		for _, item := range t.list {
+			visit(item, f)
+		}
+	case *castExpr:
+		visit(t.operand, f)
+	case *caseExpr:
+		visit(t.operand, f)
+		for _, w := range t.whens {
+			visit(w.condition, f)
+			visit(w.result, f)
+		}
+		visit(t.otherwise, f)
+	case *callExpr:
+		for _, arg := range t.args {
+			visit(arg, f)
+		}
+	}
+}
+
+func boolValue(b bool) interface{} {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func truthy(v interface{}) bool {
+	return toFloat(toNumber(v)) != 0
+}
+
+// storageClass orders values of different types the way SQLite does
+func storageClass(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// compareValues compares two values the way SQLite does with the BINARY collation
+func compareValues(a, b interface{}) int {
+	ca, cb := storageClass(a), storageClass(b)
+	if ca != cb {
+		return ca - cb
+	}
+	switch ca {
+	case 0:
+		return 0
+	case 1:
+		ai, aok := a.(int64)
+		bi, bok := b.(int64)
+		if aok && bok {
+			switch {
+			case ai < bi:
+				return -1
+			case ai > bi:
+				return 1
+			}
+			return 0
+		}
+		af, bf := toFloat(a), toFloat(b)
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	case 2:
+		return strings.Compare(a.(string), b.(string))
+	}
+	return bytes.Compare(a.([]byte), b.([]byte))
+}
+
+func toText(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1e15 {
+			return strconv.FormatFloat(t, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(t, 'g', 15, 64)
+	case string:
+		return t
+	default:
+		return string(t.([]byte))
+	}
+}
+
+// toNumber converts v to an int64 or float64, using the longest numeric prefix of text
+func toNumber(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int64, float64:
+		return t
+	case nil:
+		return int64(0)
+	}
+	s := strings.TrimSpace(toText(v))
+	end := 0
+	isFloat := false
+	for end < len(s) {
+		c := s[end]
+		if c >= '0' && c <= '9' || end == 0 && (c == '-' || c == '+') {
+			end++
+		} else if c == '.' && !isFloat {
+			isFloat = true
+			end++
+		} else {
+			break
+		}
+	}
+	if !isFloat {
+		i, err := strconv.ParseInt(s[:end], 10, 64)
+		if err == nil {
+			return i
+		}
+	}
+	f, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return int64(0)
+	}
+	return f
+}
+
+func toFloat(v interface{}) float64 {
+	switch t := v.(type) {
+	case int64:
+		return float64(t)
+	case float64:
+		return t
+	}
+	return toFloat(toNumber(v))
+}
+
+func toInt(v interface{}) int64 {
+	switch t := toNumber(v).(type) {
+	case int64:
+		return t
+	default:
+		return int64(t.(float64))
+	}
+}
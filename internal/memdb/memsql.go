@@ -0,0 +1,1096 @@
+package memdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file parses the subset of SQLite's SQL that pathdb emits (see DB). Anything else fails
+// with ErrUnsupportedSQL.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokQuotedIdent
+	tokString
+	tokBlob
+	tokNumber
+	tokParam
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits the given SQL into tokens
+func tokenize(sql string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end
+			}
+		case (c == 'X' || c == 'x') && i+1 < len(sql) && sql[i+1] == '\'':
+			end := strings.IndexByte(sql[i+2:], '\'')
+			if end < 0 {
+				return nil, unsupported("unterminated blob literal")
+			}
+			tokens = append(tokens, token{tokBlob, sql[i+2 : i+2+end]})
+			i += end + 3
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(sql) && (sql[i] == '_' || sql[i] >= 'a' && sql[i] <= 'z' || sql[i] >= 'A' && sql[i] <= 'Z' || sql[i] >= '0' && sql[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, sql[start:i]})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, sql[start:i]})
+		case c == '\'' || c == '"':
+			text, n, err := unquote(sql[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			kind := tokString
+			if c == '"' {
+				kind = tokQuotedIdent
+			}
+			tokens = append(tokens, token{kind, text})
+			i += n
+		case c == '?':
+			tokens = append(tokens, token{tokParam, "?"})
+			i++
+		default:
+			op := string(c)
+			if i+1 < len(sql) {
+				switch sql[i : i+2] {
+				case "<=", ">=", "!=", "<>", "==", "||":
+					op = sql[i : i+2]
+				}
+			}
+			if !strings.Contains("=<>!|+-*/(),.;", op[:1]) {
+				return nil, unsupported(fmt.Sprintf("unexpected character %q", c))
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// unquote reads a quoted string or identifier from the start of s, in which doubled quotes stand
+// for a single quote, and returns its contents along with the number of bytes read
+func unquote(s string, quote byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			b.WriteByte(quote)
+			i++
+			continue
+		}
+		return b.String(), i + 1, nil
+	}
+	return "", 0, unsupported("unterminated quoted string")
+}
+
+func unsupported(detail string) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedSQL, detail)
+}
+
+type statement interface{}
+
+type noopStmt struct{}
+
+type createTableStmt struct {
+	name        string
+	columns     []string
+	key         string
+	integerKey  bool
+	ifNotExists bool
+	sql         string
+}
+
+type createVirtualTableStmt struct {
+	name        string
+	module      string
+	columns     []string
+	ifNotExists bool
+	sql         string
+}
+
+type dropTableStmt struct {
+	name     string
+	ifExists bool
+}
+
+type alterTableStmt struct {
+	name      string
+	addColumn string
+	renameTo  string
+}
+
+type savepointStmt struct {
+	// kind is SAVEPOINT, RELEASE or ROLLBACK
+	kind string
+	name string
+}
+
+type assignment struct {
+	column string
+	value  expr
+}
+
+type insertStmt struct {
+	table   string
+	columns []string
+	rows    [][]expr
+	query   *selectStmt
+	// onConflict is nil if conflicts are errors, empty for DO NOTHING and holds the assignments
+	// for DO UPDATE
+	onConflict *[]assignment
+}
+
+type updateStmt struct {
+	table string
+	set   []assignment
+	where expr
+}
+
+type deleteStmt struct {
+	table string
+	where expr
+}
+
+type source struct {
+	table string
+	alias string
+	// args holds the arguments of table valued functions like pragma_table_info
+	args []expr
+}
+
+type join struct {
+	source
+	left bool
+	on   expr
+}
+
+type orderTerm struct {
+	expr expr
+	desc bool
+}
+
+type selectStmt struct {
+	distinct bool
+	columns  []expr
+	from     *source
+	joins    []join
+	where    expr
+	orderBy  []orderTerm
+	limit    expr
+	offset   expr
+}
+
+type parser struct {
+	sql    string
+	tokens []token
+	pos    int
+	params int
+}
+
+// parse parses a single statement
+func parse(sql string) (statement, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{sql: sql, tokens: tokens}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptOp(";")
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.peekAt(0)
+}
+
+func (p *parser) peekAt(offset int) token {
+	if p.pos+offset >= len(p.tokens) {
+		return token{kind: tokEOF}
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return unsupported(fmt.Sprintf("unexpected end of %q", p.sql))
+	}
+	return unsupported(fmt.Sprintf("unexpected %q in %q", t.text, p.sql))
+}
+
+func (p *parser) isKeyword(offset int, keyword string) bool {
+	t := p.peekAt(offset)
+	return t.kind == tokIdent && strings.EqualFold(t.text, keyword)
+}
+
+// acceptKeywords consumes the given sequence of keywords if it comes next
+func (p *parser) acceptKeywords(keywords ...string) bool {
+	for i, keyword := range keywords {
+		if !p.isKeyword(i, keyword) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+func (p *parser) expectKeywords(keywords ...string) error {
+	if !p.acceptKeywords(keywords...) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) acceptOp(op string) bool {
+	t := p.peek()
+	if t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.acceptOp(op) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) identifier() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent && t.kind != tokQuotedIdent {
+		return "", p.unexpected()
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// tableName reads a table name, dropping any schema qualifier like temp.
+func (p *parser) tableName() (string, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return "", err
+	}
+	if p.acceptOp(".") {
+		return p.identifier()
+	}
+	return name, nil
+}
+
+// skipRest consumes all remaining tokens
+func (p *parser) skipRest() {
+	p.pos = len(p.tokens)
+}
+
+func (p *parser) statement() (statement, error) {
+	switch {
+	case p.acceptKeywords("PRAGMA"), p.acceptKeywords("VACUUM"), p.acceptKeywords("ANALYZE"):
+		p.skipRest()
+		return &noopStmt{}, nil
+	case p.acceptKeywords("SAVEPOINT"):
+		name, err := p.identifier()
+		return &savepointStmt{kind: "SAVEPOINT", name: name}, err
+	case p.acceptKeywords("RELEASE"):
+		p.acceptKeywords("SAVEPOINT")
+		name, err := p.identifier()
+		return &savepointStmt{kind: "RELEASE", name: name}, err
+	case p.acceptKeywords("ROLLBACK", "TO"):
+		p.acceptKeywords("SAVEPOINT")
+		name, err := p.identifier()
+		return &savepointStmt{kind: "ROLLBACK", name: name}, err
+	case p.acceptKeywords("CREATE"):
+		return p.create()
+	case p.acceptKeywords("DROP", "TABLE"):
+		stmt := &dropTableStmt{ifExists: p.acceptKeywords("IF", "EXISTS")}
+		var err error
+		stmt.name, err = p.tableName()
+		return stmt, err
+	case p.acceptKeywords("ALTER", "TABLE"):
+		return p.alterTable()
+	case p.acceptKeywords("INSERT", "INTO"):
+		return p.insert()
+	case p.acceptKeywords("UPDATE"):
+		return p.update()
+	case p.acceptKeywords("DELETE", "FROM"):
+		stmt := &deleteStmt{}
+		var err error
+		stmt.table, err = p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		if p.acceptKeywords("WHERE") {
+			stmt.where, err = p.expr()
+		}
+		return stmt, err
+	case p.isKeyword(0, "SELECT"):
+		return p.selectStmt()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) create() (statement, error) {
+	p.acceptKeywords("TEMP")
+	p.acceptKeywords("TEMPORARY")
+	p.acceptKeywords("UNIQUE")
+	if p.acceptKeywords("INDEX") {
+		// indexes don't change results
+		p.skipRest()
+		return &noopStmt{}, nil
+	}
+	if p.acceptKeywords("VIRTUAL", "TABLE") {
+		stmt := &createVirtualTableStmt{ifNotExists: p.acceptKeywords("IF", "NOT", "EXISTS"), sql: p.sql}
+		var err error
+		stmt.name, err = p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectKeywords("USING")
+		if err != nil {
+			return nil, err
+		}
+		stmt.module, err = p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.definitions()
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range args {
+			// options like tokenize='...' aren't columns
+			if len(arg) == 1 && arg[0].kind == tokIdent {
+				stmt.columns = append(stmt.columns, arg[0].text)
+			}
+		}
+		return stmt, nil
+	}
+	err := p.expectKeywords("TABLE")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &createTableStmt{ifNotExists: p.acceptKeywords("IF", "NOT", "EXISTS"), sql: p.sql}
+	stmt.name, err = p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	definitions, err := p.definitions()
+	if err != nil {
+		return nil, err
+	}
+	for _, definition := range definitions {
+		if len(definition) == 0 || definition[0].kind != tokIdent && definition[0].kind != tokQuotedIdent {
+			return nil, unsupported(fmt.Sprintf("column definition in %q", p.sql))
+		}
+		stmt.columns = append(stmt.columns, definition[0].text)
+		for i := 1; i+1 < len(definition); i++ {
+			if strings.EqualFold(definition[i].text, "PRIMARY") && strings.EqualFold(definition[i+1].text, "KEY") {
+				stmt.key = definition[0].text
+				stmt.integerKey = strings.EqualFold(definition[1].text, "INTEGER")
+			}
+		}
+	}
+	p.skipRest()
+	return stmt, nil
+}
+
+// definitions reads a parenthesized list of column definitions or module arguments, returning the
+// tokens of each
+func (p *parser) definitions() ([][]token, error) {
+	err := p.expectOp("(")
+	if err != nil {
+		return nil, err
+	}
+	var result [][]token
+	var current []token
+	depth := 0
+	for {
+		t := p.next()
+		switch {
+		case t.kind == tokEOF:
+			return nil, p.unexpected()
+		case t.kind == tokOp && t.text == "(":
+			depth++
+		case t.kind == tokOp && t.text == ")":
+			if depth == 0 {
+				return append(result, current), nil
+			}
+			depth--
+		case t.kind == tokOp && t.text == "," && depth == 0:
+			result = append(result, current)
+			current = nil
+			continue
+		}
+		current = append(current, t)
+	}
+}
+
+func (p *parser) alterTable() (statement, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &alterTableStmt{name: name}
+	switch {
+	case p.acceptKeywords("ADD"):
+		p.acceptKeywords("COLUMN")
+		stmt.addColumn, err = p.identifier()
+		p.skipRest()
+	case p.acceptKeywords("RENAME", "TO"):
+		stmt.renameTo, err = p.tableName()
+	default:
+		err = p.unexpected()
+	}
+	return stmt, err
+}
+
+func (p *parser) insert() (statement, error) {
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &insertStmt{table: table}
+	if p.acceptOp("(") {
+		stmt.columns, err = p.identifiers()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword(0, "SELECT") {
+		stmt.query, err = p.selectStmt()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = p.expectKeywords("VALUES")
+		if err != nil {
+			return nil, err
+		}
+		for {
+			err = p.expectOp("(")
+			if err != nil {
+				return nil, err
+			}
+			row, err := p.exprs()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expectOp(")")
+			if err != nil {
+				return nil, err
+			}
+			stmt.rows = append(stmt.rows, row)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeywords("ON", "CONFLICT") {
+		if p.acceptOp("(") {
+			// the conflicting column is always the key
+			_, err = p.identifiers()
+			if err != nil {
+				return nil, err
+			}
+		}
+		set := []assignment{}
+		if !p.acceptKeywords("DO", "NOTHING") {
+			err = p.expectKeywords("DO", "UPDATE", "SET")
+			if err != nil {
+				return nil, err
+			}
+			set, err = p.assignments()
+			if err != nil {
+				return nil, err
+			}
+		}
+		stmt.onConflict = &set
+	}
+	return stmt, nil
+}
+
+// identifiers reads a comma separated list of identifiers up to and including the closing
+// parenthesis
+func (p *parser) identifiers() ([]string, error) {
+	var result []string
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, name)
+		if !p.acceptOp(",") {
+			return result, p.expectOp(")")
+		}
+	}
+}
+
+func (p *parser) assignments() ([]assignment, error) {
+	var result []assignment
+	for {
+		column, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectOp("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, assignment{column, value})
+		if !p.acceptOp(",") {
+			return result, nil
+		}
+	}
+}
+
+func (p *parser) update() (statement, error) {
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	err = p.expectKeywords("SET")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &updateStmt{table: table}
+	stmt.set, err = p.assignments()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeywords("WHERE") {
+		stmt.where, err = p.expr()
+	}
+	return stmt, err
+}
+
+func (p *parser) selectStmt() (*selectStmt, error) {
+	err := p.expectKeywords("SELECT")
+	if err != nil {
+		return nil, err
+	}
+	stmt := &selectStmt{distinct: p.acceptKeywords("DISTINCT")}
+	stmt.columns, err = p.exprs()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeywords("FROM") {
+		from, err := p.source()
+		if err != nil {
+			return nil, err
+		}
+		stmt.from = &from
+		for {
+			var j join
+			switch {
+			case p.acceptKeywords("INNER", "JOIN"), p.acceptKeywords("JOIN"):
+			case p.acceptKeywords("LEFT", "OUTER", "JOIN"), p.acceptKeywords("LEFT", "JOIN"):
+				j.left = true
+			default:
+				goto joined
+			}
+			j.source, err = p.source()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expectKeywords("ON")
+			if err != nil {
+				return nil, err
+			}
+			j.on, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.joins = append(stmt.joins, j)
+		}
+	}
+joined:
+	if p.acceptKeywords("WHERE") {
+		stmt.where, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword(0, "GROUP") || p.isKeyword(0, "HAVING") {
+		return nil, p.unexpected()
+	}
+	if p.acceptKeywords("ORDER", "BY") {
+		for {
+			term := orderTerm{}
+			term.expr, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if p.acceptKeywords("DESC") {
+				term.desc = true
+			} else {
+				p.acceptKeywords("ASC")
+			}
+			stmt.orderBy = append(stmt.orderBy, term)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeywords("LIMIT") {
+		stmt.limit, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.acceptKeywords("OFFSET") {
+			stmt.offset, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) source() (source, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return source{}, err
+	}
+	s := source{table: name, alias: name}
+	if p.acceptOp("(") {
+		s.args, err = p.exprs()
+		if err != nil {
+			return source{}, err
+		}
+		err = p.expectOp(")")
+		if err != nil {
+			return source{}, err
+		}
+	}
+	p.acceptKeywords("AS")
+	t := p.peek()
+	if t.kind == tokIdent && !isReserved(t.text) {
+		p.pos++
+		s.alias = t.text
+	}
+	return s, nil
+}
+
+// isReserved checks whether the given identifier is a keyword that can follow a table name, which
+// means that it isn't an alias
+func isReserved(ident string) bool {
+	switch strings.ToUpper(ident) {
+	case "WHERE", "JOIN", "INNER", "LEFT", "ON", "ORDER", "LIMIT", "GROUP", "HAVING":
+		return true
+	}
+	return false
+}
+
+func (p *parser) exprs() ([]expr, error) {
+	var result []expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.acceptKeywords("AS") {
+			// aliases don't matter since rows are scanned by position
+			_, err = p.identifier()
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, e)
+		if !p.acceptOp(",") {
+			return result, nil
+		}
+	}
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.or()
+}
+
+func (p *parser) or() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeywords("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeywords("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (expr, error) {
+	if p.acceptKeywords("NOT") {
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "NOT", operand: operand}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokOp && (t.text == "=" || t.text == "==" || t.text == "!=" || t.text == "<>" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+			p.pos++
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			op := t.text
+			switch op {
+			case "==":
+				op = "="
+			case "<>":
+				op = "!="
+			}
+			left = &binaryExpr{op: op, left: left, right: right}
+		case p.acceptKeywords("IS", "NOT", "NULL"):
+			left = &isNullExpr{operand: left, not: true}
+		case p.acceptKeywords("IS", "NULL"):
+			left = &isNullExpr{operand: left}
+		case p.isKeyword(0, "MATCH"):
+			return nil, unsupported("full text MATCH")
+		default:
+			not := p.acceptKeywords("NOT")
+			switch {
+			case p.acceptKeywords("LIKE"), p.acceptKeywords("GLOB"):
+				op := strings.ToUpper(p.tokens[p.pos-1].text)
+				pattern, err := p.additive()
+				if err != nil {
+					return nil, err
+				}
+				left = &matchExpr{op: op, operand: left, pattern: pattern, not: not}
+			case p.acceptKeywords("IN"):
+				in, err := p.in(left, not)
+				if err != nil {
+					return nil, err
+				}
+				left = in
+			default:
+				if not {
+					return nil, p.unexpected()
+				}
+				return left, nil
+			}
+		}
+	}
+}
+
+func (p *parser) in(operand expr, not bool) (expr, error) {
+	err := p.expectOp("(")
+	if err != nil {
+		return nil, err
+	}
+	in := &inExpr{operand: operand, not: not}
+	if p.isKeyword(0, "SELECT") {
+		in.query, err = p.selectStmt()
+	} else if !p.acceptOp(")") {
+		in.list, err = p.exprs()
+	} else {
+		return in, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return in, p.expectOp(")")
+}
+
+func (p *parser) additive() (expr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || t.text != "+" && t.text != "-" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) multiplicative() (expr, error) {
+	left, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || t.text != "*" && t.text != "/" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) concat() (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.acceptOp("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "-", operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokParam:
+		p.params++
+		return &paramExpr{index: p.params - 1}, nil
+	case tokString:
+		return &literalExpr{value: t.text}, nil
+	case tokBlob:
+		b := make([]byte, len(t.text)/2)
+		for i := range b {
+			v, err := strconv.ParseUint(t.text[2*i:2*i+2], 16, 8)
+			if err != nil {
+				return nil, unsupported(fmt.Sprintf("blob literal %q", t.text))
+			}
+			b[i] = byte(v)
+		}
+		return &literalExpr{value: b}, nil
+	case tokNumber:
+		if strings.Contains(t.text, ".") {
+			f, err := strconv.ParseFloat(t.text, 64)
+			if err != nil {
+				return nil, unsupported(fmt.Sprintf("number %q", t.text))
+			}
+			return &literalExpr{value: f}, nil
+		}
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, unsupported(fmt.Sprintf("number %q", t.text))
+		}
+		return &literalExpr{value: i}, nil
+	case tokOp:
+		if t.text == "*" {
+			// only valid as the argument of COUNT
+			return &starExpr{}, nil
+		}
+		if t.text != "(" {
+			break
+		}
+		if p.isKeyword(0, "SELECT") {
+			query, err := p.selectStmt()
+			if err != nil {
+				return nil, err
+			}
+			return &subqueryExpr{query: query}, p.expectOp(")")
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectOp(")")
+	case tokQuotedIdent:
+		return p.columnRef(t.text)
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "NULL":
+			return &literalExpr{}, nil
+		case "CASE":
+			return p.caseExpr()
+		case "CAST":
+			return p.cast()
+		}
+		if p.acceptOp("(") {
+			return p.call(t.text)
+		}
+		return p.columnRef(t.text)
+	}
+	p.pos--
+	return nil, p.unexpected()
+}
+
+func (p *parser) columnRef(name string) (expr, error) {
+	if !p.acceptOp(".") {
+		return &columnExpr{column: name}, nil
+	}
+	column, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	return &columnExpr{table: name, column: column}, nil
+}
+
+func (p *parser) call(name string) (expr, error) {
+	call := &callExpr{name: strings.ToUpper(name)}
+	if !p.acceptOp(")") {
+		var err error
+		call.args, err = p.exprs()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectOp(")")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeywords("OVER") {
+		// only COUNT(*) over all rows, which is how pathdb reads totals along with a page
+		_, isStar := firstArg(call).(*starExpr)
+		if call.name != "COUNT" || !isStar || !p.acceptOp("(") || !p.acceptOp(")") {
+			return nil, unsupported("window functions other than COUNT(*) OVER ()")
+		}
+		return &windowCountExpr{}, nil
+	}
+	if !knownFunctions[call.name] {
+		return nil, unsupported(fmt.Sprintf("function %v", call.name))
+	}
+	return call, nil
+}
+
+func (p *parser) cast() (expr, error) {
+	err := p.expectOp("(")
+	if err != nil {
+		return nil, err
+	}
+	operand, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	err = p.expectKeywords("AS")
+	if err != nil {
+		return nil, err
+	}
+	typ, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	return &castExpr{operand: operand, typ: strings.ToUpper(typ)}, p.expectOp(")")
+}
+
+func (p *parser) caseExpr() (expr, error) {
+	c := &caseExpr{}
+	var err error
+	if !p.isKeyword(0, "WHEN") {
+		c.operand, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for p.acceptKeywords("WHEN") {
+		var w when
+		w.condition, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectKeywords("THEN")
+		if err != nil {
+			return nil, err
+		}
+		w.result, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		c.whens = append(c.whens, w)
+	}
+	if p.acceptKeywords("ELSE") {
+		c.otherwise, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, p.expectKeywords("END")
+}
@@ -0,0 +1,82 @@
+package pathdb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Migration is a versioned change to a DB's data or layout (see Migrate)
+type Migration struct {
+	// Version identifies the migration and determines the order in which migrations are applied.
+	// It must be positive and unique within the migrations passed to Migrate.
+	Version int
+	// Up applies the migration
+	Up func(TX) error
+}
+
+// Migrate applies the given migrations that haven't been applied to d's schema yet, in order of
+// their versions. Applied versions are tracked in the schema's migrations table. Each migration
+// runs in its own transaction together with recording its version, so a migration is either
+// applied and recorded or not at all. If a migration fails, the migrations before it remain
+// applied and the error is returned without attempting the ones after it.
+func Migrate(d DB, migrations []Migration) error {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, m := range sorted {
+		if m.Version <= 0 {
+			return fmt.Errorf("migrate: version %d is not positive: %w", m.Version, ErrInvalidOptions)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("migrate: version %d has no Up: %w", m.Version, ErrInvalidOptions)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return fmt.Errorf("migrate: duplicate version %d: %w", m.Version, ErrInvalidOptions)
+		}
+	}
+
+	for _, m := range sorted {
+		err := Mutate(d, func(t TX) error {
+			// checked within the transaction so that concurrent callers don't apply it twice
+			applied, err := t.migrationApplied(m.Version)
+			if err != nil || applied {
+				return err
+			}
+			err = m.Up(t)
+			if err != nil {
+				return err
+			}
+			return t.recordMigration(m.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("migrate: version %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// migrationApplied checks whether the migration with the given version has been recorded
+func (t *tx) migrationApplied(version int) (bool, error) {
+	rows, err := t.tx.Query(fmt.Sprintf("SELECT 1 FROM %s_migrations WHERE version = ?", t.schema), version)
+	if err != nil {
+		return false, fmt.Errorf("query migrations: %w", err)
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// setUpSchema creates the tables of the given schema with the DB's options (see NewSiblingDB)
+func (t *tx) setUpSchema(schema string) error {
+	return setUpSchema(t.tx.QueryableAPI, schema, t.opts)
+}
+
+// recordMigration records that the migration with the given version has been applied
+func (t *tx) recordMigration(version int) error {
+	err := t.tx.Exec(fmt.Sprintf("INSERT INTO %s_migrations(version) VALUES(?)", t.schema), version)
+	if err != nil {
+		return fmt.Errorf("record migration: %w", err)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package minisql
 
+import "context"
+
 type ScannableRows interface {
 	Close() error
 	Next() bool
@@ -8,16 +10,79 @@ type ScannableRows interface {
 
 type QueryableAPI struct {
 	Queryable
+	// ctx, if set, is used by Exec, ExecResult and Query (see DBAPI.BeginContext)
+	ctx context.Context
+}
+
+func (q *QueryableAPI) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
 }
 
 func (q *QueryableAPI) Exec(query string, args ...interface{}) error {
-	return q.Queryable.Exec(query, NewValues(args))
+	return q.ExecContext(q.context(), query, args...)
 }
 
-func (q *QueryableAPI) Query(query string, args ...interface{}) (ScannableRows, error) {
-	rows, err := q.Queryable.Query(query, NewValues(args))
+// ExecContext is like Exec, but abandons the statement once ctx is done. If the underlying
+// Queryable doesn't implement ContextQueryable, ctx is only checked before running the statement.
+func (q *QueryableAPI) ExecContext(ctx context.Context, query string, args ...interface{}) error {
+	cq, ok := q.Queryable.(ContextQueryable)
+	if !ok {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return q.Queryable.Exec(query, NewValues(args))
+	}
+	return cq.ExecContext(ctx, query, NewValues(args))
+}
+
+// ExecResult is like Exec, but also returns the number of rows affected, or -1 if the underlying
+// Queryable doesn't implement ResultQueryable
+func (q *QueryableAPI) ExecResult(query string, args ...interface{}) (int64, error) {
+	err := q.context().Err()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	rq, ok := q.Queryable.(ResultQueryable)
+	if !ok {
+		return -1, q.Queryable.Exec(query, NewValues(args))
+	}
+	return rq.ExecResult(query, NewValues(args))
+}
+
+// ReportsRowsAffected indicates whether ExecResult is able to report the number of rows affected
+func (q *QueryableAPI) ReportsRowsAffected() bool {
+	_, ok := q.Queryable.(ResultQueryable)
+	return ok
+}
+
+func (q *QueryableAPI) Query(query string, args ...interface{}) (ScannableRows, error) {
+	return q.QueryContext(q.context(), query, args...)
+}
+
+// QueryContext is like Query, but abandons the query once ctx is done. If the underlying
+// Queryable doesn't implement ContextQueryable, ctx is only checked before running the query.
+func (q *QueryableAPI) QueryContext(ctx context.Context, query string, args ...interface{}) (ScannableRows, error) {
+	var rows Rows
+	cq, ok := q.Queryable.(ContextQueryable)
+	if ok {
+		var err error
+		rows, err = cq.QueryContext(ctx, query, NewValues(args))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		rows, err = q.Queryable.Query(query, NewValues(args))
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &scannableRows{rows}, nil
 }
@@ -32,11 +97,36 @@ func Wrap(db DB) *DBAPI {
 }
 
 func (db *DBAPI) Begin() (*TxAPI, error) {
-	tx, err := db.db.Begin()
-	if err != nil {
-		return nil, err
+	return db.BeginContext(context.Background())
+}
+
+// BeginContext is like Begin, but the transaction rolls back once ctx is done, and its Exec,
+// ExecResult and Query run their statements with ctx. If the underlying DB doesn't implement
+// ContextDB, ctx is only checked before beginning the transaction and before each statement.
+func (db *DBAPI) BeginContext(ctx context.Context) (*TxAPI, error) {
+	var tx Tx
+	cdb, ok := db.db.(ContextDB)
+	if ok {
+		var err error
+		tx, err = cdb.BeginContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		tx, err = db.db.Begin()
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &TxAPI{tx: tx, QueryableAPI: &QueryableAPI{Queryable: tx}}, nil
+	return &TxAPI{tx: tx, QueryableAPI: &QueryableAPI{Queryable: tx, ctx: ctx}}, nil
+}
+
+func (db *DBAPI) Close() error {
+	return db.db.Close()
 }
 
 type TxAPI struct {
@@ -2,6 +2,8 @@
 // The interfaces are optimized for use with gomobile.
 package minisql
 
+import "context"
+
 type Rows interface {
 	Close() error
 	Next() bool
@@ -13,10 +15,30 @@ type Queryable interface {
 	Query(query string, args Values) (Rows, error)
 }
 
+// ResultQueryable is optionally implemented by Queryables that can report the number of rows
+// affected by a statement
+type ResultQueryable interface {
+	ExecResult(query string, args Values) (int64, error)
+}
+
+// ContextQueryable is optionally implemented by Queryables that can abandon statements once a
+// context is done. It's not part of Queryable since gomobile can't bind contexts.
+type ContextQueryable interface {
+	ExecContext(ctx context.Context, query string, args Values) error
+	QueryContext(ctx context.Context, query string, args Values) (Rows, error)
+}
+
+// ContextDB is optionally implemented by DBs that can begin transactions which roll back once a
+// context is done
+type ContextDB interface {
+	BeginContext(ctx context.Context) (Tx, error)
+}
+
 type DB interface {
 	Exec(query string, args Values) error
 	Query(query string, args Values) (Rows, error)
 	Begin() (Tx, error)
+	Close() error
 }
 
 type Tx interface {
@@ -1,40 +1,200 @@
 package minisql
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
 
+// DBAdapter adapts a *sql.DB to DB. Unless DisableStatementCache is set, statements are prepared
+// once and then reused, which saves re-parsing the same SQL over and over. The DB keeps up to
+// maxCachedStatements of the most recently used statements, which transactions bind to their
+// connection with sql.Tx.Stmt and keep until they end. Exec only uses cached statements for
+// INSERT, UPDATE, DELETE and REPLACE statements that don't return rows, since statements that
+// return rows would otherwise be left in progress.
 type DBAdapter struct {
 	*sql.DB
+	DisableStatementCache bool
+
+	stmtsOnce sync.Once
+	stmts     *stmtCache
+}
+
+// stmt returns the cached prepared statement for the given query, or nil if it should be run
+// directly. Statements that aren't nil have to be released once they've been run.
+func (db *DBAdapter) stmt(query string) *cachedStmt {
+	if db.DisableStatementCache {
+		return nil
+	}
+	db.stmtsOnce.Do(func() {
+		db.stmts = newStmtCache()
+	})
+	return db.stmts.acquire(db.DB, query)
 }
 
 func (db *DBAdapter) Begin() (Tx, error) {
-	tx, err := db.DB.Begin()
+	return db.BeginContext(context.Background())
+}
+
+func (db *DBAdapter) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &TxAdapter{tx}, nil
+	return &TxAdapter{Tx: tx, db: db}, nil
 }
 
 func (db *DBAdapter) Exec(query string, args Values) error {
-	_, err := db.DB.Exec(query, argsToParams(args)...)
+	return db.ExecContext(context.Background(), query, args)
+}
+
+func (db *DBAdapter) ExecContext(ctx context.Context, query string, args Values) error {
+	_, err := db.exec(ctx, query, args)
 	return err
 }
 
+func (db *DBAdapter) ExecResult(query string, args Values) (int64, error) {
+	result, err := db.exec(context.Background(), query, args)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db *DBAdapter) exec(ctx context.Context, query string, args Values) (sql.Result, error) {
+	var stmt *cachedStmt
+	if cacheableExec(query) {
+		stmt = db.stmt(query)
+	}
+	if stmt != nil {
+		defer db.stmts.release(stmt)
+		return stmt.ExecContext(ctx, argsToParams(args)...)
+	}
+	return db.DB.ExecContext(ctx, query, argsToParams(args)...)
+}
+
 func (db *DBAdapter) Query(query string, args Values) (Rows, error) {
-	result, err := db.DB.Query(query, argsToParams(args)...)
+	return db.QueryContext(context.Background(), query, args)
+}
+
+func (db *DBAdapter) QueryContext(ctx context.Context, query string, args Values) (Rows, error) {
+	var result *sql.Rows
+	var err error
+	stmt := db.stmt(query)
+	if stmt != nil {
+		// the rows keep the statement open until they're closed, so it can be released right away
+		result, err = stmt.QueryContext(ctx, argsToParams(args)...)
+		db.stmts.release(stmt)
+	} else {
+		result, err = db.DB.QueryContext(ctx, query, argsToParams(args)...)
+	}
 	return &rowsAdapter{Rows: result}, err
 }
 
+// Close closes cached statements along with the underlying DB
+func (db *DBAdapter) Close() error {
+	db.stmtsOnce.Do(func() {})
+	if db.stmts != nil {
+		db.stmts.close()
+	}
+	return db.DB.Close()
+}
+
 type TxAdapter struct {
 	*sql.Tx
+	// db is the DBAdapter that started this transaction, if any, whose statement cache it uses
+	db *DBAdapter
+	// stmts holds statements prepared within this transaction, which are closed along with it
+	stmts map[string]*sql.Stmt
+}
+
+// stmt returns the DB's cached statement for the given query bound to this transaction, or nil if
+// it should be run directly. Once a statement has been prepared on the transaction's connection,
+// later transactions on the same connection reuse it.
+func (tx *TxAdapter) stmt(query string) *sql.Stmt {
+	if tx.db == nil {
+		return nil
+	}
+	stmt := tx.stmts[query]
+	if stmt != nil {
+		return stmt
+	}
+	cached := tx.db.stmt(query)
+	if cached == nil {
+		return nil
+	}
+	// the transaction's statement keeps the cached one open until it's closed
+	stmt = tx.Tx.Stmt(cached.Stmt)
+	tx.db.stmts.release(cached)
+	if tx.stmts == nil {
+		tx.stmts = make(map[string]*sql.Stmt)
+	}
+	tx.stmts[query] = stmt
+	return stmt
+}
+
+// Commit closes the statements prepared within this transaction and then commits it
+func (tx *TxAdapter) Commit() error {
+	tx.closeStmts()
+	return tx.Tx.Commit()
+}
+
+// Rollback closes the statements prepared within this transaction and then rolls it back
+func (tx *TxAdapter) Rollback() error {
+	tx.closeStmts()
+	return tx.Tx.Rollback()
+}
+
+// closeStmts closes the statements prepared within this transaction. database/sql would close
+// them too, but only after the transaction has ended.
+func (tx *TxAdapter) closeStmts() {
+	for query, stmt := range tx.stmts {
+		stmt.Close()
+		delete(tx.stmts, query)
+	}
 }
 
 func (tx *TxAdapter) Exec(query string, args Values) error {
-	_, err := tx.Tx.Exec(query, argsToParams(args)...)
+	return tx.ExecContext(context.Background(), query, args)
+}
+
+func (tx *TxAdapter) ExecContext(ctx context.Context, query string, args Values) error {
+	_, err := tx.exec(ctx, query, args)
 	return err
 }
 
+func (tx *TxAdapter) ExecResult(query string, args Values) (int64, error) {
+	result, err := tx.exec(context.Background(), query, args)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (tx *TxAdapter) exec(ctx context.Context, query string, args Values) (sql.Result, error) {
+	var stmt *sql.Stmt
+	if cacheableExec(query) {
+		stmt = tx.stmt(query)
+	}
+	if stmt != nil {
+		return stmt.ExecContext(ctx, argsToParams(args)...)
+	}
+	return tx.Tx.ExecContext(ctx, query, argsToParams(args)...)
+}
+
 func (tx *TxAdapter) Query(query string, args Values) (Rows, error) {
-	result, err := tx.Tx.Query(query, argsToParams(args)...)
+	return tx.QueryContext(context.Background(), query, args)
+}
+
+func (tx *TxAdapter) QueryContext(ctx context.Context, query string, args Values) (Rows, error) {
+	var result *sql.Rows
+	var err error
+	stmt := tx.stmt(query)
+	if stmt != nil {
+		result, err = stmt.QueryContext(ctx, argsToParams(args)...)
+	} else {
+		result, err = tx.Tx.QueryContext(ctx, query, argsToParams(args)...)
+	}
 	return &rowsAdapter{Rows: result}, err
 }
 
@@ -53,7 +213,7 @@ type rowsAdapter struct {
 func (ra *rowsAdapter) Scan(values Values) error {
 	row := make([]interface{}, 0, values.Len())
 	for i := 0; i < values.Len(); i++ {
-		row = append(row, values.Get(i).pointerToEmptyValue())
+		row = append(row, values.Get(i).pointerToNullableValue())
 	}
 	err := ra.Rows.Scan(row...)
 	if err == nil {
@@ -0,0 +1,126 @@
+package minisql
+
+import (
+	"container/list"
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// maxCachedStatements caps the number of prepared statements that a DBAdapter keeps. Once it's
+// reached, the least recently used statement is evicted to make room for a new one.
+const maxCachedStatements = 256
+
+// stmtCache holds prepared statements keyed by their SQL, evicting the least recently used ones
+// once it's full. Statements that are evicted while they're in use are closed once they're
+// released.
+type stmtCache struct {
+	mx    sync.Mutex
+	stmts map[string]*list.Element
+	// lru holds the cached statements, most recently used first
+	lru *list.List
+}
+
+type cachedStmt struct {
+	*sql.Stmt
+	query   string
+	users   int
+	evicted bool
+}
+
+// cacheableExec reports whether the statement for the given query can be cached when it's run
+// with Exec. Exec doesn't reset statements, so statements that return rows, like many PRAGMAs or
+// statements with a RETURNING clause, would stay in progress after running, which keeps their
+// connection from committing or vacuuming. Plain INSERT, UPDATE, DELETE and REPLACE statements
+// finish on their own and are safe to reuse.
+func cacheableExec(query string) bool {
+	query = strings.ToUpper(strings.TrimSpace(query))
+	if strings.Contains(query, "RETURNING") {
+		return false
+	}
+	for _, prefix := range []string{"INSERT", "UPDATE", "DELETE", "REPLACE"} {
+		if strings.HasPrefix(query, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*list.Element), lru: list.New()}
+}
+
+// acquire returns the cached statement for the given query, preparing it if necessary, and keeps
+// it from being closed until it's released. It returns nil if the query can't be prepared, in
+// which case the caller should run the query directly so that errors are reported as usual.
+func (c *stmtCache) acquire(db *sql.DB, query string) *cachedStmt {
+	cs := c.lookup(query)
+	if cs != nil {
+		return cs
+	}
+
+	// prepare outside of the lock, since that may have to wait for a connection
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	elem, found := c.stmts[query]
+	if found {
+		// prepared concurrently
+		stmt.Close()
+		return c.use(elem)
+	}
+	cs = &cachedStmt{Stmt: stmt, query: query, users: 1}
+	c.stmts[query] = c.lru.PushFront(cs)
+	for c.lru.Len() > maxCachedStatements {
+		c.evict(c.lru.Back())
+	}
+	return cs
+}
+
+// lookup is like acquire, but returns nil if the query hasn't been cached
+func (c *stmtCache) lookup(query string) *cachedStmt {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	elem, found := c.stmts[query]
+	if !found {
+		return nil
+	}
+	return c.use(elem)
+}
+
+func (c *stmtCache) use(elem *list.Element) *cachedStmt {
+	c.lru.MoveToFront(elem)
+	cs := elem.Value.(*cachedStmt)
+	cs.users++
+	return cs
+}
+
+func (c *stmtCache) evict(elem *list.Element) {
+	cs := c.lru.Remove(elem).(*cachedStmt)
+	delete(c.stmts, cs.query)
+	cs.evicted = true
+	if cs.users == 0 {
+		cs.Close()
+	}
+}
+
+// release allows the given statement to be closed again
+func (c *stmtCache) release(cs *cachedStmt) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	cs.users--
+	if cs.evicted && cs.users == 0 {
+		cs.Close()
+	}
+}
+
+func (c *stmtCache) close() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
@@ -1,23 +1,29 @@
 package minisql
 
 import (
+	"database/sql"
 	"fmt"
 	"reflect"
 )
 
 const (
-	ValueTypeBytes  = 0
-	ValueTypeString = 1
-	ValueTypeInt    = 2
-	ValueTypeBool   = 3
+	ValueTypeBytes   = 0
+	ValueTypeString  = 1
+	ValueTypeInt     = 2
+	ValueTypeBool    = 3
+	ValueTypeInt64   = 4
+	ValueTypeFloat64 = 5
+	ValueTypeNull    = 6
 )
 
 type Value struct {
-	Type   int
-	string *string
-	int    *int
-	bool   *bool
-	bytes  *[]byte
+	Type    int
+	string  *string
+	int     *int
+	bool    *bool
+	bytes   *[]byte
+	int64   *int64
+	float64 *float64
 }
 
 func (v *Value) Bool() bool {
@@ -56,6 +62,54 @@ func (v *Value) SetInt(i int) {
 	*v.int = i
 }
 
+func (v *Value) Int64() int64 {
+	if v.int64 == nil {
+		return 0
+	}
+	return *v.int64
+}
+
+func (v *Value) SetInt64(i int64) {
+	v.Type = ValueTypeInt64
+	*v.int64 = i
+}
+
+func (v *Value) Float64() float64 {
+	if v.float64 == nil {
+		return 0
+	}
+	return *v.float64
+}
+
+func (v *Value) SetFloat64(f float64) {
+	v.Type = ValueTypeFloat64
+	*v.float64 = f
+}
+
+// IsNull indicates whether this value is a SQL NULL
+func (v *Value) IsNull() bool {
+	return v.Type == ValueTypeNull
+}
+
+// SetNull marks this value as a SQL NULL and resets whatever it points to to its zero value
+func (v *Value) SetNull() {
+	v.Type = ValueTypeNull
+	switch {
+	case v.bytes != nil:
+		*v.bytes = nil
+	case v.string != nil:
+		*v.string = ""
+	case v.int != nil:
+		*v.int = 0
+	case v.bool != nil:
+		*v.bool = false
+	case v.int64 != nil:
+		*v.int64 = 0
+	case v.float64 != nil:
+		*v.float64 = 0
+	}
+}
+
 func (v *Value) Bytes() []byte {
 	if v.bytes == nil {
 		return nil
@@ -73,6 +127,8 @@ func (v *Value) SetBytes(i []byte) {
 
 func NewValue(i interface{}) *Value {
 	switch v := i.(type) {
+	case nil:
+		return NewValueNull()
 	case []byte:
 		return NewValueBytes(v)
 	case string:
@@ -82,7 +138,11 @@ func NewValue(i interface{}) *Value {
 	case int32:
 		return NewValueInt(int(v))
 	case int64:
-		return NewValueInt(int(v))
+		return NewValueInt64(v)
+	case float32:
+		return NewValueFloat64(float64(v))
+	case float64:
+		return NewValueFloat64(v)
 	case bool:
 		return NewValueBool(v)
 	}
@@ -107,6 +167,18 @@ func NewValueBool(i bool) *Value {
 	return &Value{Type: ValueTypeBool, bool: &i}
 }
 
+func NewValueInt64(i int64) *Value {
+	return &Value{Type: ValueTypeInt64, int64: &i}
+}
+
+func NewValueFloat64(f float64) *Value {
+	return &Value{Type: ValueTypeFloat64, float64: &f}
+}
+
+func NewValueNull() *Value {
+	return &Value{Type: ValueTypeNull}
+}
+
 func valueFromPointer(i interface{}) *Value {
 	switch t := i.(type) {
 	case *[]byte:
@@ -117,6 +189,10 @@ func valueFromPointer(i interface{}) *Value {
 		return &Value{Type: ValueTypeInt, int: t}
 	case *bool:
 		return &Value{Type: ValueTypeBool, bool: t}
+	case *int64:
+		return &Value{Type: ValueTypeInt64, int64: t}
+	case *float64:
+		return &Value{Type: ValueTypeFloat64, float64: t}
 	default:
 		panic(fmt.Errorf("type can't be used to initialize value from pointer: %v", reflect.TypeOf(i)))
 	}
@@ -132,39 +208,60 @@ func (v *Value) value() interface{} {
 		return *v.int
 	case ValueTypeBool:
 		return *v.bool
+	case ValueTypeInt64:
+		return *v.int64
+	case ValueTypeFloat64:
+		return *v.float64
 	default:
 		return nil
 	}
 }
 
+// set sets this value from a pointer obtained with pointerToNullableValue
 func (v *Value) set(i interface{}) {
 	if i != nil {
 		switch v.Type {
 		case ValueTypeBytes:
-			v.SetBytes(*i.(*[]byte))
+			setNullable(v, i, v.SetBytes)
 		case ValueTypeString:
-			v.SetString(*i.(*string))
+			setNullable(v, i, v.SetString)
 		case ValueTypeInt:
-			v.SetInt(*i.(*int))
+			setNullable(v, i, v.SetInt)
 		case ValueTypeBool:
-			v.SetBool(*i.(*bool))
+			setNullable(v, i, v.SetBool)
+		case ValueTypeInt64:
+			setNullable(v, i, v.SetInt64)
+		case ValueTypeFloat64:
+			setNullable(v, i, v.SetFloat64)
 		}
 	}
 }
 
-func (v *Value) pointerToEmptyValue() interface{} {
+func setNullable[T any](v *Value, i interface{}, set func(T)) {
+	n := i.(*sql.Null[T])
+	if !n.Valid {
+		v.SetNull()
+		return
+	}
+	set(n.V)
+}
+
+// pointerToNullableValue returns a pointer to a sql.Null of this value's type, so that scanning
+// NULLs can be told apart from scanning empty values
+func (v *Value) pointerToNullableValue() interface{} {
 	switch v.Type {
 	case ValueTypeBytes:
-		return &[]byte{}
+		return &sql.Null[[]byte]{}
 	case ValueTypeString:
-		str := ""
-		return &str
+		return &sql.Null[string]{}
 	case ValueTypeInt:
-		i := 0
-		return &i
+		return &sql.Null[int]{}
 	case ValueTypeBool:
-		i := false
-		return &i
+		return &sql.Null[bool]{}
+	case ValueTypeInt64:
+		return &sql.Null[int64]{}
+	case ValueTypeFloat64:
+		return &sql.Null[float64]{}
 	default:
 		return nil
 	}
@@ -0,0 +1,175 @@
+package pathdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// pathCodeMarker starts every encoded path prefix. It's followed by a single byte identifying
+	// the dictionary entry. Both are control characters so that they're unaffected by the case
+	// insensitivity of LIKE.
+	pathCodeMarker = 0x01
+
+	// MaxPathDictionarySize is the maximum number of entries in Options.PathDictionary
+	MaxPathDictionarySize = 31
+)
+
+var (
+	ErrInvalidPathDictionary = errors.New("invalid path dictionary")
+)
+
+// pathCodec implements the optional prefix dictionary encoding of paths configured with
+// Options.PathDictionary. Paths that start with a dictionary entry are stored with the longest
+// such entry replaced by a two byte code. A nil *pathCodec leaves paths unchanged.
+type pathCodec struct {
+	// entries are the dictionary entries in the order in which they were configured
+	entries []string
+	// byLength holds the indexes of entries sorted by descending length
+	byLength []int
+}
+
+func newPathCodec(dictionary []string) (*pathCodec, error) {
+	if len(dictionary) == 0 {
+		return nil, nil
+	}
+	if len(dictionary) > MaxPathDictionarySize {
+		return nil, fmt.Errorf("%d entries exceeds maximum of %d: %w", len(dictionary), MaxPathDictionarySize, ErrInvalidPathDictionary)
+	}
+	seen := make(map[string]bool, len(dictionary))
+	for _, entry := range dictionary {
+		if entry == "" || seen[entry] {
+			return nil, fmt.Errorf("empty or duplicate entry %q: %w", entry, ErrInvalidPathDictionary)
+		}
+		seen[entry] = true
+	}
+	c := &pathCodec{
+		entries:  dictionary,
+		byLength: make([]int, len(dictionary)),
+	}
+	for i := range dictionary {
+		c.byLength[i] = i
+	}
+	sort.SliceStable(c.byLength, func(i, j int) bool {
+		return len(dictionary[c.byLength[i]]) > len(dictionary[c.byLength[j]])
+	})
+	return c, nil
+}
+
+func (c *pathCodec) code(i int) string {
+	return string([]byte{pathCodeMarker, byte(i + 1)})
+}
+
+// encode encodes the given path for storage
+func (c *pathCodec) encode(path string) string {
+	if c == nil {
+		return path
+	}
+	for _, i := range c.byLength {
+		entry := c.entries[i]
+		if strings.HasPrefix(path, entry) {
+			return c.code(i) + path[len(entry):]
+		}
+	}
+	return path
+}
+
+// encodeAll encodes all of the given paths
+func (c *pathCodec) encodeAll(paths []string) []string {
+	if c == nil {
+		return paths
+	}
+	result := make([]string, 0, len(paths))
+	for _, path := range paths {
+		result = append(result, c.encode(path))
+	}
+	return result
+}
+
+// decode decodes a path that was read from storage
+func (c *pathCodec) decode(path string) string {
+	if c == nil || len(path) < 2 || path[0] != pathCodeMarker {
+		return path
+	}
+	i := int(path[1]) - 1
+	if i < 0 || i >= len(c.entries) {
+		return path
+	}
+	return c.entries[i] + path[2:]
+}
+
+// matchClause returns the SQL condition for matching column (which holds stored paths) against
+// the given LIKE or GLOB pattern, along with the pattern argument to use. When possible, the
+// pattern is encoded so that the match can use the index on column. Otherwise, the stored paths
+// are decoded in SQL before matching.
+func (c *pathCodec) matchClause(column string, operator string, pattern string) (string, string) {
+	if c == nil {
+		return fmt.Sprintf("%s %s ?", column, operator), pattern
+	}
+
+	wildcards := "%_"
+	if operator == "GLOB" {
+		wildcards = "*?["
+	}
+	literal := pattern
+	firstWildcard := strings.IndexAny(pattern, wildcards)
+	if firstWildcard >= 0 {
+		literal = pattern[:firstWildcard]
+	}
+
+	// Paths that match the pattern start with literal, so they were encoded using the longest
+	// entry that's a prefix of literal, unless some entry is longer than literal and starts with
+	// it, in which case we can't tell how matching paths were encoded.
+	longest := -1
+	for _, i := range c.byLength {
+		entry := c.entries[i]
+		if len(entry) > len(literal) && strings.HasPrefix(entry, literal) {
+			return fmt.Sprintf("%s %s ?", c.decodeSQL(column), operator), pattern
+		}
+		if longest < 0 && strings.HasPrefix(literal, entry) {
+			longest = i
+		}
+	}
+	if longest < 0 {
+		// matching paths weren't encoded
+		return fmt.Sprintf("%s %s ?", column, operator), pattern
+	}
+	return fmt.Sprintf("%s %s ?", column, operator), c.code(longest) + pattern[len(c.entries[longest]):]
+}
+
+// encodeSQL returns a SQL expression that encodes the plain path given by expr
+func (c *pathCodec) encodeSQL(expr string) string {
+	if c == nil {
+		return expr
+	}
+	var b strings.Builder
+	b.WriteString("(CASE")
+	for _, i := range c.byLength {
+		entry := c.entries[i]
+		length := utf8.RuneCountInString(entry)
+		fmt.Fprintf(&b, " WHEN SUBSTR(%s, 1, %d) = %s THEN char(%d, %d) || SUBSTR(%s, %d)", expr, length, sqlQuote(entry), pathCodeMarker, i+1, expr, length+1)
+	}
+	fmt.Fprintf(&b, " ELSE %s END)", expr)
+	return b.String()
+}
+
+// decodeSQL returns a SQL expression that decodes the stored path given by expr
+func (c *pathCodec) decodeSQL(expr string) string {
+	if c == nil {
+		return expr
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "(CASE WHEN SUBSTR(%s, 1, 1) = char(%d) THEN (CASE SUBSTR(%s, 2, 1)", expr, pathCodeMarker, expr)
+	for i, entry := range c.entries {
+		fmt.Fprintf(&b, " WHEN char(%d) THEN %s", i+1, sqlQuote(entry))
+	}
+	fmt.Fprintf(&b, " END) || SUBSTR(%s, 3) ELSE %s END)", expr, expr)
+	return b.String()
+}
+
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,88 @@
+package pathdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/pathdb/minisql"
+)
+
+func TestPathCodec(t *testing.T) {
+	c, err := newPathCodec([]string{"/a/", "/a/b/"})
+	require.NoError(t, err)
+	for _, path := range []string{"/a/1", "/a/b/1", "/a/b", "/c/1", ""} {
+		require.Equal(t, path, c.decode(c.encode(path)))
+	}
+	require.Equal(t, "\x01\x021", c.encode("/a/b/1"), "longest prefix should be used")
+
+	_, err = newPathCodec(make([]string, MaxPathDictionarySize+1))
+	require.ErrorIs(t, err, ErrInvalidPathDictionary)
+	_, err = newPathCodec([]string{""})
+	require.ErrorIs(t, err, ErrInvalidPathDictionary)
+}
+
+// BenchmarkPathDictionary lists the messages of one conversation from a dataset of deep paths
+// shaped like /accounts/<uuid>/conversations/<uuid>/messages/<id>
+func BenchmarkPathDictionary(b *testing.B) {
+	const numAccounts, numConversations, numMessages = 4, 25, 50
+	uuid := func(kind string, i int) string {
+		return fmt.Sprintf("%08x-0000-4000-8000-%012x", i, len(kind)*1000+i)
+	}
+	var dictionary []string
+	for a := 0; a < numAccounts; a++ {
+		dictionary = append(dictionary, fmt.Sprintf("/accounts/%s/conversations/", uuid("account", a)))
+	}
+
+	for _, opts := range []struct {
+		name string
+		opts *Options
+	}{
+		{"Plain", &Options{}},
+		{"Dictionary", &Options{PathDictionary: dictionary}},
+	} {
+		b.Run(opts.name, func(b *testing.B) {
+			mdb := newSQLiteImpl(b)
+			db, err := NewDBWithOptions(mdb, "test", opts.opts)
+			require.NoError(b, err)
+			defer db.Close()
+
+			err = Mutate(db, func(tx TX) error {
+				for a := 0; a < numAccounts; a++ {
+					for c := 0; c < numConversations; c++ {
+						for m := 0; m < numMessages; m++ {
+							path := fmt.Sprintf("/accounts/%s/conversations/%s/messages/%d", uuid("account", a), uuid("conversation", c), m)
+							err := Put(tx, path, "message", "")
+							if err != nil {
+								return err
+							}
+						}
+					}
+				}
+				return nil
+			})
+			require.NoError(b, err)
+
+			rows, err := minisql.Wrap(mdb).Query("SELECT SUM(LENGTH(CAST(path AS BLOB))) FROM test_data")
+			require.NoError(b, err)
+			require.True(b, rows.Next())
+			var keyBytes int
+			require.NoError(b, rows.Scan(&keyBytes))
+			rows.Close()
+
+			prefix := fmt.Sprintf("/accounts/%s/conversations/%s/messages/%%", uuid("account", 2), uuid("conversation", 7))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				items, err := List[string](db, &QueryParams{Path: prefix})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(items) != numMessages {
+					b.Fatalf("expected %d messages, got %d", numMessages, len(items))
+				}
+			}
+			b.ReportMetric(float64(keyBytes)/(numAccounts*numConversations*numMessages), "keybytes/path")
+		})
+	}
+}
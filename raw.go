@@ -1,28 +1,74 @@
 package pathdb
 
+import (
+	"fmt"
+	"reflect"
+)
+
 type Raw[T any] struct {
 	serde  *serde
 	Bytes  []byte
 	loaded bool
 	value  T
 	err    error
+	// Size is the size in bytes of the stored value. It's only populated by queries that use
+	// ProjectSize.
+	Size int
 }
 
 func (r *Raw[T]) Value() (T, error) {
 	if !r.loaded {
 		v, e := r.serde.deserialize(r.Bytes)
 		r.err = e
-		if e == nil {
-			r.value = v.(T)
+		if e == nil && v != nil {
+			value, ok := v.(T)
+			if ok {
+				r.value = value
+			} else {
+				r.err = typeMismatch[T](v)
+			}
 		}
 		r.loaded = true
 	}
 	return r.value, r.err
 }
 
+// ValueOr is like Value, but returns def if r is nil, as it is for paths that have no value (see
+// RGet)
+func (r *Raw[T]) ValueOr(def T) (T, error) {
+	if r == nil {
+		return def, nil
+	}
+	return r.Value()
+}
+
 func (r *Raw[T]) ValueOrProtoBytes() (interface{}, error) {
-	if r.serde.isProtocolBuffer(r.Bytes) {
-		return r.serde.stripProtocolBufferHeader(r.Bytes), nil
+	b, err := r.serde.unwrap(r.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if r.serde.isProtocolBuffer(b) {
+		return r.serde.stripProtocolBufferHeader(b), nil
 	}
 	return r.Value()
 }
+
+// Type returns the type tag of the stored value, like TEXT, JSON or PROTOCOLBUFFER, without
+// deserializing it. Encrypted and compressed values are unwrapped first, so the result is the type
+// of the value itself rather than ENCRYPTED or COMPRESSED. It fails with ErrCorruptValue if there
+// are no bytes.
+func (r *Raw[T]) Type() (byte, error) {
+	if len(r.Bytes) == 0 {
+		return 0, ErrCorruptValue
+	}
+	b, err := r.serde.unwrap(r.Bytes)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// typeMismatch returns the error for a value that was expected to be of type T but isn't
+func typeMismatch[T any](value interface{}) error {
+	return fmt.Errorf("%T isn't a %v: %w", value, reflect.TypeOf((*T)(nil)).Elem(), ErrTypeMismatch)
+}
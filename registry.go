@@ -0,0 +1,161 @@
+package pathdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// RegistryMismatchReason explains why a type id found in stored data doesn't match the registry
+type RegistryMismatchReason int
+
+const (
+	// MismatchUnregistered means that no type is registered with the id
+	MismatchUnregistered RegistryMismatchReason = iota
+	// MismatchSuspiciousType means that the type registered with the id either can't decode the
+	// stored data or decodes it while ignoring some of its fields, which suggests that the id was
+	// reassigned to a different type
+	MismatchSuspiciousType
+)
+
+func (r RegistryMismatchReason) String() string {
+	switch r {
+	case MismatchUnregistered:
+		return "unregistered"
+	case MismatchSuspiciousType:
+		return "suspicious type"
+	default:
+		return fmt.Sprintf("unknown reason %d", int(r))
+	}
+}
+
+// RegistryMismatch describes a type id found in stored data that doesn't match the DB's registry
+type RegistryMismatch struct {
+	// Kind is the type tag of the affected values, one of PROTOCOLBUFFER, JSON, CUSTOM or GOB
+	Kind byte
+	// TypeID is the type id stored with the affected values
+	TypeID int16
+	Reason RegistryMismatchReason
+	// Count is the number of affected values
+	Count int
+	// ExamplePath is the first affected path
+	ExamplePath string
+	// Err is the error encountered when decoding the value at ExamplePath, if any
+	Err error
+}
+
+// VerifyRegistry checks the type ids of all values stored under the given prefix against the types
+// currently registered with d, and reports ids that are unregistered or that appear to be registered
+// to a different type than the one with which the data was stored. Mismatches are sorted by kind
+// and type id. This is meant as a safety check after upgrades that might have changed the
+// registry, since reading values through a mismatched registry silently returns garbage.
+func VerifyRegistry(d DB, prefix string) ([]RegistryMismatch, error) {
+	type key struct {
+		kind   byte
+		typeID int16
+	}
+	s := d.getSerde()
+	mismatches := make(map[key]*RegistryMismatch)
+	query := &QueryParams{Path: fmt.Sprintf("%s%%", strings.TrimRight(prefix, "%"))}
+	err := d.Iterate(query, nil, func(i *item) error {
+		value, err := s.unwrap(i.value)
+		if err != nil {
+			return fmt.Errorf("%v: %w", i.path, err)
+		}
+		if len(value) < 3 || (value[0] != PROTOCOLBUFFER && value[0] != JSON && value[0] != CUSTOM && value[0] != GOB) {
+			return nil
+		}
+		k := key{value[0], int16(byteorder.Uint16(value[1:]))}
+		reason, mismatched, decodeErr := s.verifyTypeID(value)
+		if !mismatched {
+			return nil
+		}
+		mismatch := mismatches[k]
+		if mismatch == nil {
+			mismatch = &RegistryMismatch{
+				Kind:        k.kind,
+				TypeID:      k.typeID,
+				Reason:      reason,
+				ExamplePath: i.path,
+				Err:         decodeErr,
+			}
+			mismatches[k] = mismatch
+		}
+		mismatch.Count++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verifyregistry: %w", err)
+	}
+
+	result := make([]RegistryMismatch, 0, len(mismatches))
+	for _, mismatch := range mismatches {
+		result = append(result, *mismatch)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Kind != result[j].Kind {
+			return result[i].Kind < result[j].Kind
+		}
+		return result[i].TypeID < result[j].TypeID
+	})
+	return result, nil
+}
+
+// verifyTypeID checks whether the given serialized protocol buffer, JSON, custom or gob value can
+// be decoded by the type registered with its type id. If not, it returns the reason and the
+// decoding error, if any. Decoding is stricter than in deserialize, so that data written by a
+// different type is more likely to be caught.
+func (s *serde) verifyTypeID(b []byte) (RegistryMismatchReason, bool, error) {
+	id := int16(byteorder.Uint16(b[1:]))
+	switch b[0] {
+	case PROTOCOLBUFFER:
+		pbType, found := s.registeredProtocolBufferTypeIDs[id]
+		if !found {
+			return MismatchUnregistered, true, nil
+		}
+		pb := reflect.New(pbType.Elem()).Interface().(proto.Message)
+		err := proto.Unmarshal(b[3:], pb)
+		if err != nil {
+			return MismatchSuspiciousType, true, err
+		}
+		if len(pb.ProtoReflect().GetUnknown()) > 0 {
+			return MismatchSuspiciousType, true, fmt.Errorf("%v has unknown fields", pbType)
+		}
+	case JSON:
+		jsonType, found := s.registeredJSONTypeIDs[id]
+		if !found {
+			return MismatchUnregistered, true, nil
+		}
+		decoder := json.NewDecoder(bytes.NewReader(b[3:]))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(reflect.New(jsonType.Elem()).Interface())
+		if err != nil {
+			return MismatchSuspiciousType, true, err
+		}
+	case GOB:
+		gobType, found := s.registeredGobTypeIDs[id]
+		if !found {
+			return MismatchUnregistered, true, nil
+		}
+		err := gob.NewDecoder(bytes.NewReader(b[3:])).Decode(reflect.New(gobType).Interface())
+		if err != nil {
+			return MismatchSuspiciousType, true, err
+		}
+	case CUSTOM:
+		c, found := s.registeredCodecIDs[id]
+		if !found {
+			return MismatchUnregistered, true, nil
+		}
+		_, err := c.unmarshal(b[3:])
+		if err != nil {
+			return MismatchSuspiciousType, true, err
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,73 @@
+package pathdb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 10 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+)
+
+// RetryOptions configures MutateWithRetry
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of times the transaction is attempted, including the first
+	// attempt. Defaults to 5.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry. The wait doubles with every
+	// subsequent retry. Defaults to 10 milliseconds.
+	InitialBackoff time.Duration
+	// MaxBackoff caps how long to wait between retries. Defaults to 1 second.
+	MaxBackoff time.Duration
+}
+
+func (opts *RetryOptions) applyDefaults() {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+}
+
+// MutateWithRetry is like Mutate, but if the transaction fails because the database is busy or
+// locked, for example because another connection is writing to it, the whole transaction is
+// retried with exponential backoff. fn may therefore be called several times and must be safe to
+// re-run, which means that it shouldn't have side effects outside of the transaction. Other errors
+// are returned without retrying. If all attempts fail, the last error is returned.
+func MutateWithRetry(d DB, fn func(TX) error, opts RetryOptions) error {
+	opts.applyDefaults()
+	backoff := opts.InitialBackoff
+	var err error
+	for attempt := 1; attempt <= opts.MaxAttempts; attempt++ {
+		err = Mutate(d, fn)
+		if err == nil || !isBusy(err) {
+			return err
+		}
+		if attempt < opts.MaxAttempts {
+			log.Debugf("database busy on attempt %d, retrying in %v: %v", attempt, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > opts.MaxBackoff {
+				backoff = opts.MaxBackoff
+			}
+		}
+	}
+	return fmt.Errorf("mutatewithretry: giving up after %d attempts: %w", opts.MaxAttempts, err)
+}
+
+// isBusy checks whether err was caused by SQLite being busy or locked. Drivers don't share error
+// types, so this inspects the error message.
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY") ||
+		strings.Contains(msg, "SQLITE_LOCKED")
+}
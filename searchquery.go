@@ -0,0 +1,84 @@
+package pathdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SearchCombinator determines how the SearchParams.Terms of a search are combined
+type SearchCombinator int
+
+const (
+	// CombineAnd matches values that match all terms
+	CombineAnd SearchCombinator = iota
+	// CombineOr matches values that match any term
+	CombineOr
+)
+
+// SearchTerm is one term of a search built from SearchParams.Terms
+type SearchTerm struct {
+	// Text is the text to search for. Unless Phrase is true, each word in Text is matched
+	// independently, so all words have to appear but not necessarily next to each other.
+	Text string
+	// Phrase, if true, matches Text only where its words appear next to each other and in order
+	Phrase bool
+	// Negate, if true, excludes values that match this term. Negated terms aren't subject to the
+	// combinator, values that match any negated term are always excluded.
+	Negate bool
+}
+
+// termsExpression renders the given terms into an FTS5 query, quoting all text so that it's
+// matched literally
+func termsExpression(terms []SearchTerm, combinator SearchCombinator) (string, error) {
+	var included, excluded []string
+	for _, term := range terms {
+		expression := term.expression()
+		if expression == "" {
+			return "", fmt.Errorf("empty search term: %w", ErrInvalidQuery)
+		}
+		if term.Negate {
+			excluded = append(excluded, expression)
+		} else {
+			included = append(included, expression)
+		}
+	}
+	if len(included) == 0 {
+		// FTS5's NOT is a binary operator, so there has to be something to exclude from
+		return "", fmt.Errorf("search needs at least one term that isn't negated: %w", ErrInvalidQuery)
+	}
+
+	operator := " AND "
+	if combinator == CombineOr {
+		operator = " OR "
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "(%s)", strings.Join(included, operator))
+	for _, expression := range excluded {
+		fmt.Fprintf(&b, " NOT %s", expression)
+	}
+	return b.String(), nil
+}
+
+// expression renders this term into an FTS5 query, or returns "" if it has no text
+func (term SearchTerm) expression() string {
+	if term.Phrase {
+		if strings.TrimSpace(term.Text) == "" {
+			return ""
+		}
+		return quoteFullText(term.Text)
+	}
+	words := strings.Fields(term.Text)
+	if len(words) == 0 {
+		return ""
+	}
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, quoteFullText(word))
+	}
+	return fmt.Sprintf("(%s)", strings.Join(quoted, " AND "))
+}
+
+// quoteFullText quotes s as an FTS5 string, which matches s literally
+func quoteFullText(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
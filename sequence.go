@@ -0,0 +1,56 @@
+package pathdb
+
+import (
+	"fmt"
+
+	"github.com/getlantern/pathdb/minisql"
+)
+
+// insertionSequenceCounter is the id of the counter from which insertion sequence numbers are
+// taken (see Options.TrackInsertionOrder). Counter 0 holds full text rowids.
+const insertionSequenceCounter = 1
+
+// addSequenceColumn adds the column that records insertion order to the data table of the given
+// schema, along with an index on it, unless they already exist
+func addSequenceColumn(core *minisql.QueryableAPI, schema string) error {
+	rows, err := core.Query(fmt.Sprintf("SELECT 1 FROM pragma_table_info('%s_data') WHERE name = 'sequence'", schema))
+	if err != nil {
+		return fmt.Errorf("query sequence column: %w", err)
+	}
+	exists := rows.Next()
+	rows.Close()
+	if !exists {
+		err = core.Exec(fmt.Sprintf("ALTER TABLE %s_data ADD COLUMN sequence INTEGER", schema))
+		if err != nil {
+			return fmt.Errorf("add sequence column: %w", err)
+		}
+	}
+	err = core.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_data_sequence_index ON %s_data(sequence)", schema, schema))
+	if err != nil {
+		return fmt.Errorf("create sequence index: %w", err)
+	}
+	return nil
+}
+
+// reserveSequences increments the insertion sequence by n and returns the first of the n sequence
+// numbers reserved
+func (t *tx) reserveSequences(n int) (int64, error) {
+	err := t.tx.Exec(fmt.Sprintf("INSERT INTO %s_counters(id, value) VALUES(%d, ?) ON CONFLICT(id) DO UPDATE SET value = value+?", t.schema, insertionSequenceCounter), n-1, n)
+	if err != nil {
+		return 0, fmt.Errorf("increment insertion sequence: %w", err)
+	}
+	rows, err := t.tx.Query(fmt.Sprintf("SELECT value FROM %s_counters WHERE id = %d", t.schema, insertionSequenceCounter))
+	if err != nil {
+		return 0, fmt.Errorf("query insertion sequence: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, fmt.Errorf("read insertion sequence: %w", ErrUnexpectedDBError)
+	}
+	var last int
+	err = rows.Scan(&last)
+	if err != nil {
+		return 0, fmt.Errorf("scan insertion sequence: %w", err)
+	}
+	return int64(last - n + 1), nil
+}
@@ -1,11 +1,17 @@
 package pathdb
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"reflect"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -22,21 +28,122 @@ const (
 	DOUBLE         = 'D'
 	PROTOCOLBUFFER = 'P'
 	JSON           = 'J'
+	CUSTOM         = 'C'
+	GOB            = 'G'
+	// COMPRESSED wraps the gzip compressed serialization of a value of any other type (see
+	// Options.CompressionThreshold)
+	COMPRESSED = 'Z'
+	// ENCRYPTED wraps the encrypted serialization of a value of any other type, which may itself
+	// be COMPRESSED (see Options.ValueCipher)
+	ENCRYPTED = 'E'
 )
 
+// maxValueSize is the largest value that SQLite stores by default (SQLITE_MAX_LENGTH), which also
+// bounds the size to which a compressed value may expand
+const maxValueSize = 1000000000
+
 var (
 	byteorder = binary.LittleEndian
 
 	ErrUnregisteredProtobufType = errors.New("unregistered protocol buffer type")
 	ErrUnregisteredJSONType     = errors.New("unregistered json type")
+	ErrUnregisteredCustomType   = errors.New("unregistered custom type")
+	ErrUnregisteredGobType      = errors.New("unregistered gob type")
 	ErrUnkownDataType           = errors.New("unknown data type")
+	ErrCorruptValue             = errors.New("corrupt value")
+	ErrNoValueCipher            = errors.New("encrypted value but no value cipher")
+	// ErrTypeMismatch is returned when a stored value isn't of the type with which it's accessed
+	ErrTypeMismatch = errors.New("type mismatch")
 )
 
+// minLengths gives the minimum length in bytes (including the type tag) of serialized values by
+// type tag
+var minLengths = map[byte]int{
+	TEXT:           1,
+	BYTEARRAY:      1,
+	BYTE:           2,
+	BOOLEAN:        2,
+	SHORT:          3,
+	INT:            5,
+	LONG:           9,
+	FLOAT:          5,
+	DOUBLE:         9,
+	PROTOCOLBUFFER: 3,
+	JSON:           3,
+	CUSTOM:         3,
+	GOB:            3,
+	COMPRESSED:     2,
+	ENCRYPTED:      2,
+}
+
+// codec is a custom serializer registered for a specific Go type
+type codec struct {
+	id        int16
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte) (interface{}, error)
+}
+
+// ValueCipher encrypts and decrypts serialized values (see Options.ValueCipher). Implementations
+// must be safe for concurrent use.
+type ValueCipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
 type serde struct {
 	registeredProtocolBufferTypes   map[reflect.Type]int16
 	registeredProtocolBufferTypeIDs map[int16]reflect.Type
 	registeredJSONTypes             map[reflect.Type]int16
 	registeredJSONTypeIDs           map[int16]reflect.Type
+	registeredCodecs                map[reflect.Type]*codec
+	registeredCodecIDs              map[int16]*codec
+	registeredGobTypes              map[reflect.Type]int16
+	registeredGobTypeIDs            map[int16]reflect.Type
+	// compressionThreshold is the size in bytes above which serialized values are compressed, or
+	// 0 to not compress values
+	compressionThreshold int
+	// cipher, if set, encrypts serialized values
+	cipher ValueCipher
+	// maxDecompressedSize is the size in bytes beyond which decompressing a value fails, so that a
+	// corrupt or malicious value can't exhaust memory
+	maxDecompressedSize int64
+}
+
+var (
+	// globalSerde holds types registered with RegisterGlobal
+	globalSerde   = newSerde()
+	globalSerdeMx sync.RWMutex
+)
+
+// RegisterGlobal registers the type of the given example (as a protocol buffer if it is one,
+// otherwise as JSON) with a process-wide registry. Every DB opened after this call starts out
+// with a copy of the types in the global registry (unless opened with Options.IgnoreGlobalTypes),
+// so types only need to be registered once, e.g. at init. DBs that are already open are not
+// affected. RegisterGlobal is safe to call concurrently with itself and with opening DBs.
+func RegisterGlobal(id int16, example interface{}) {
+	globalSerdeMx.Lock()
+	defer globalSerdeMx.Unlock()
+	globalSerde.register(id, example)
+}
+
+// newSerdeFromGlobal creates a new serde with a copy of the types from the global registry
+func newSerdeFromGlobal() *serde {
+	globalSerdeMx.RLock()
+	defer globalSerdeMx.RUnlock()
+	s := newSerde()
+	for t, id := range globalSerde.registeredProtocolBufferTypes {
+		s.registeredProtocolBufferTypes[t] = id
+	}
+	for id, t := range globalSerde.registeredProtocolBufferTypeIDs {
+		s.registeredProtocolBufferTypeIDs[id] = t
+	}
+	for t, id := range globalSerde.registeredJSONTypes {
+		s.registeredJSONTypes[t] = id
+	}
+	for id, t := range globalSerde.registeredJSONTypeIDs {
+		s.registeredJSONTypeIDs[id] = t
+	}
+	return s
 }
 
 func newSerde() *serde {
@@ -45,22 +152,130 @@ func newSerde() *serde {
 		registeredProtocolBufferTypeIDs: make(map[int16]reflect.Type, 0),
 		registeredJSONTypes:             make(map[reflect.Type]int16, 0),
 		registeredJSONTypeIDs:           make(map[int16]reflect.Type, 0),
+		registeredCodecs:                make(map[reflect.Type]*codec, 0),
+		registeredCodecIDs:              make(map[int16]*codec, 0),
+		registeredGobTypes:              make(map[reflect.Type]int16, 0),
+		registeredGobTypeIDs:            make(map[int16]reflect.Type, 0),
+		maxDecompressedSize:             maxValueSize,
+	}
+}
+
+// RegisterCodec registers a custom serializer for values of the same type as example. Such values
+// are stored with the CUSTOM type tag followed by the given id, which must be unique among
+// custom codecs registered on the DB and stable across releases.
+func RegisterCodec(db DB, id int16, example interface{}, marshal func(interface{}) ([]byte, error), unmarshal func([]byte) (interface{}, error)) {
+	db.getSerde().registerCodec(id, example, marshal, unmarshal)
+}
+
+func (s *serde) registerCodec(id int16, example interface{}, marshal func(interface{}) ([]byte, error), unmarshal func([]byte) (interface{}, error)) {
+	c := &codec{
+		id:        id,
+		marshal:   marshal,
+		unmarshal: unmarshal,
 	}
+	s.registeredCodecs[reflect.TypeOf(example)] = c
+	s.registeredCodecIDs[id] = c
+}
+
+// RegisterProtobufType registers the type of the given protocol buffer message with the DB so that
+// values of that type can be stored. The id is stored alongside each value and must be unique
+// among protocol buffer types registered on the DB and stable across releases.
+func RegisterProtobufType(db DB, id int16, msg proto.Message) {
+	db.getSerde().registerProtobuf(id, msg)
+}
+
+// RegisterJSONType registers the type of the given example with the DB so that values of that
+// type can be stored as JSON. The id is stored alongside each value and must be unique among JSON
+// types registered on the DB and stable across releases.
+func RegisterJSONType(db DB, id int16, example interface{}) {
+	db.getSerde().registerJSON(id, example)
+}
+
+// RegisterGobType registers the type of the given example with the DB so that values of that type
+// can be stored using encoding/gob, which supports types that JSON doesn't, like maps with
+// non-string keys. Gob is Go specific, so this is only suitable for data that's never read outside
+// of Go. The id is stored alongside each value and must be unique among gob types registered on
+// the DB and stable across releases. If the type is also registered as JSON, for example to migrate
+// it to gob, new values are written using gob while values already stored as JSON remain readable.
+// A custom codec (see RegisterCodec) takes precedence over both.
+func RegisterGobType(db DB, id int16, example interface{}) {
+	db.getSerde().registerGob(id, example)
+}
+
+// Serialize serializes the given value exactly the way that the DB would store it
+func Serialize(db DB, value interface{}) ([]byte, error) {
+	return db.getSerde().serialize(value)
+}
+
+// Deserialize deserializes a value that was serialized by the DB (or by Serialize)
+func Deserialize(db DB, b []byte) (interface{}, error) {
+	return db.getSerde().deserialize(b)
 }
 
 func (s *serde) register(id int16, example interface{}) {
-	t := reflect.TypeOf(example)
-	_, isProtobuf := example.(proto.Message)
+	pb, isProtobuf := example.(proto.Message)
 	if isProtobuf {
-		s.registeredProtocolBufferTypes[t] = id
-		s.registeredProtocolBufferTypeIDs[id] = t
+		s.registerProtobuf(id, pb)
 	} else {
-		s.registeredJSONTypes[t] = id
-		s.registeredJSONTypeIDs[id] = t
+		s.registerJSON(id, example)
+	}
+}
+
+func (s *serde) registerProtobuf(id int16, msg proto.Message) {
+	t := reflect.TypeOf(msg)
+	s.registeredProtocolBufferTypes[t] = id
+	s.registeredProtocolBufferTypeIDs[id] = t
+}
+
+func (s *serde) registerJSON(id int16, example interface{}) {
+	t := reflect.TypeOf(example)
+	s.registeredJSONTypes[t] = id
+	s.registeredJSONTypeIDs[id] = t
+}
+
+func (s *serde) registerGob(id int16, example interface{}) {
+	t := reflect.TypeOf(example)
+	s.registeredGobTypes[t] = id
+	s.registeredGobTypeIDs[id] = t
+}
+
+func (s *serde) serialize(data interface{}) ([]byte, error) {
+	b, err := s.serializeUncompressed(data)
+	if err != nil {
+		return nil, err
+	}
+	b, err = s.compress(b)
+	if err != nil {
+		return nil, err
 	}
+	return s.encrypt(b)
 }
 
-func (s *serde) serialize(data interface{}) (result []byte, err error) {
+func (s *serde) serializeUncompressed(data interface{}) (result []byte, err error) {
+	c, foundCodec := s.registeredCodecs[reflect.TypeOf(data)]
+	if foundCodec {
+		var b []byte
+		b, err = c.marshal(data)
+		if err == nil {
+			result = make([]byte, 3+len(b))
+			result[0] = CUSTOM
+			byteorder.PutUint16(result[1:], uint16(c.id))
+			copy(result[3:], b)
+		}
+		return
+	}
+
+	gobType, foundGobType := s.registeredGobTypes[reflect.TypeOf(data)]
+	if foundGobType {
+		buf := bytes.NewBuffer([]byte{GOB, 0, 0})
+		byteorder.PutUint16(buf.Bytes()[1:], uint16(gobType))
+		err = gob.NewEncoder(buf).Encode(data)
+		if err == nil {
+			result = buf.Bytes()
+		}
+		return
+	}
+
 	switch v := data.(type) {
 	case string:
 		result = make([]byte, 1+len(v))
@@ -138,6 +353,18 @@ func (s *serde) serialize(data interface{}) (result []byte, err error) {
 }
 
 func (s *serde) deserialize(b []byte) (result interface{}, err error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value: %w", ErrCorruptValue)
+	}
+	b, err = s.unwrap(b)
+	if err != nil {
+		return nil, err
+	}
+	minLength, knownType := minLengths[b[0]]
+	if knownType && len(b) < minLength {
+		return nil, fmt.Errorf("value of type %q has %d bytes, need at least %d: %w", b[0], len(b), minLength, ErrCorruptValue)
+	}
+
 	switch b[0] {
 	case TEXT:
 		result = string(b[1:])
@@ -179,6 +406,25 @@ func (s *serde) deserialize(b []byte) (result interface{}, err error) {
 				result = jo
 			}
 		}
+	case GOB:
+		gobType, foundGobType := s.registeredGobTypeIDs[int16(byteorder.Uint16(b[1:]))]
+		if !foundGobType {
+			err = ErrUnregisteredGobType
+		} else {
+			// decode into a pointer to the registered type so that non-pointer types work too
+			v := reflect.New(gobType)
+			err = gob.NewDecoder(bytes.NewReader(b[3:])).Decode(v.Interface())
+			if err == nil {
+				result = v.Elem().Interface()
+			}
+		}
+	case CUSTOM:
+		c, foundCodec := s.registeredCodecIDs[int16(byteorder.Uint16(b[1:]))]
+		if !foundCodec {
+			err = ErrUnregisteredCustomType
+		} else {
+			result, err = c.unmarshal(b[3:])
+		}
 	default:
 		err = ErrUnkownDataType
 	}
@@ -187,9 +433,99 @@ func (s *serde) deserialize(b []byte) (result interface{}, err error) {
 }
 
 func (s *serde) isProtocolBuffer(b []byte) bool {
-	return b[0] == PROTOCOLBUFFER
+	return len(b) >= minLengths[PROTOCOLBUFFER] && b[0] == PROTOCOLBUFFER
 }
 
 func (s *serde) stripProtocolBufferHeader(b []byte) []byte {
 	return b[3:]
 }
+
+// compress wraps the given serialized value in a COMPRESSED value if it's larger than the
+// compression threshold and compressing actually makes it smaller. Text values are never
+// compressed, since they may be detail paths that are joined on in SQL.
+func (s *serde) compress(b []byte) ([]byte, error) {
+	if s.compressionThreshold <= 0 || len(b) <= s.compressionThreshold || b[0] == TEXT {
+		return b, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(COMPRESSED)
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	if err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	if buf.Len() >= len(b) {
+		return b, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress unwraps the given serialized value if it's COMPRESSED, otherwise it returns it as is.
+// Compressed values are always decompressed, whether or not the serde compresses new values.
+func (s *serde) decompress(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != COMPRESSED {
+		return b, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %v: %w", err, ErrCorruptValue)
+	}
+	result, err := io.ReadAll(io.LimitReader(r, s.maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %v: %w", err, ErrCorruptValue)
+	}
+	if int64(len(result)) > s.maxDecompressedSize {
+		return nil, fmt.Errorf("decompress: value exceeds %d bytes: %w", s.maxDecompressedSize, ErrCorruptValue)
+	}
+	if len(result) == 0 || result[0] == COMPRESSED {
+		return nil, fmt.Errorf("decompress: invalid compressed value: %w", ErrCorruptValue)
+	}
+	return result, nil
+}
+
+// encrypt wraps the given serialized value in an ENCRYPTED value if the serde has a cipher
+func (s *serde) encrypt(b []byte) ([]byte, error) {
+	if s.cipher == nil {
+		return b, nil
+	}
+	encrypted, err := s.cipher.Encrypt(b)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	result := make([]byte, 1+len(encrypted))
+	result[0] = ENCRYPTED
+	copy(result[1:], encrypted)
+	return result, nil
+}
+
+// decrypt unwraps the given serialized value if it's ENCRYPTED, otherwise it returns it as is
+func (s *serde) decrypt(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0] != ENCRYPTED {
+		return b, nil
+	}
+	if s.cipher == nil {
+		return nil, ErrNoValueCipher
+	}
+	result, err := s.cipher.Decrypt(b[1:])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	if len(result) == 0 || result[0] == ENCRYPTED {
+		return nil, fmt.Errorf("decrypt: invalid encrypted value: %w", ErrCorruptValue)
+	}
+	return result, nil
+}
+
+// unwrap decrypts and decompresses the given serialized value as necessary, returning the
+// serialization of the value itself
+func (s *serde) unwrap(b []byte) ([]byte, error) {
+	b, err := s.decrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	return s.decompress(b)
+}
@@ -1,6 +1,7 @@
 package pathdb
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -87,6 +88,41 @@ func TestSerdeJSON(t *testing.T) {
 	require.Equal(t, ErrUnregisteredJSONType, err, "attempt to deserialize unregistered type")
 }
 
+func TestSerdeGob(t *testing.T) {
+	s := newSerde()
+	o := &JSONObject{
+		A: "a",
+		B: 5,
+	}
+	s.register(1, &JSONObject{})
+	storedAsJSON, err := s.serialize(o)
+	require.NoError(t, err)
+	s.registerGob(1, &JSONObject{})
+	serialized, err := s.serialize(o)
+	require.NoError(t, err)
+	require.EqualValues(t, GOB, serialized[0], "gob should be used in place of JSON")
+	deserialized, err := s.deserialize(serialized)
+	require.NoError(t, err)
+	require.EqualValues(t, o, deserialized)
+	deserialized, err = s.deserialize(storedAsJSON)
+	require.NoError(t, err)
+	require.EqualValues(t, o, deserialized, "values stored as JSON should remain readable")
+
+	m := map[int]string{1: "one", 2: "two"}
+	_, err = s.serialize(m)
+	require.Equal(t, ErrUnregisteredJSONType, err, "attempt to serialize unregistered type")
+	s.registerGob(2, map[int]string{})
+	serialized, err = s.serialize(m)
+	require.NoError(t, err)
+	deserialized, err = s.deserialize(serialized)
+	require.NoError(t, err)
+	require.EqualValues(t, m, deserialized, "non-pointer types should round trip")
+
+	s2 := newSerde()
+	_, err = s2.deserialize(serialized)
+	require.Equal(t, ErrUnregisteredGobType, err, "attempt to deserialize unregistered type")
+}
+
 func roundTrip(t *testing.T, s *serde, value interface{}) interface{} {
 	serialized, err := s.serialize(value)
 	require.NoError(t, err)
@@ -94,3 +130,129 @@ func roundTrip(t *testing.T, s *serde, value interface{}) interface{} {
 	require.NoError(t, err)
 	return deserialized
 }
+
+type customObject struct {
+	A byte
+	B byte
+}
+
+func TestSerdeCustom(t *testing.T) {
+	s := newSerde()
+	o := &customObject{A: 1, B: 2}
+	s.registerCodec(
+		1,
+		&customObject{},
+		func(v interface{}) ([]byte, error) {
+			co := v.(*customObject)
+			return []byte{co.A, co.B}, nil
+		},
+		func(b []byte) (interface{}, error) {
+			return &customObject{A: b[0], B: b[1]}, nil
+		},
+	)
+	serialized, err := s.serialize(o)
+	require.NoError(t, err)
+	require.EqualValues(t, []byte{CUSTOM, 1, 0, 1, 2}, serialized, "custom codec should be used in place of JSON")
+	deserialized, err := s.deserialize(serialized)
+	require.NoError(t, err)
+	require.EqualValues(t, o, deserialized)
+
+	s2 := newSerde()
+	_, err = s2.deserialize(serialized)
+	require.ErrorIs(t, err, ErrUnregisteredCustomType, "attempt to deserialize unregistered type")
+}
+
+func TestSerdeCorruptValues(t *testing.T) {
+	s := newSerde()
+	for _, b := range [][]byte{nil, {}, {PROTOCOLBUFFER}, {SHORT}, {LONG, 1, 2, 3}, {JSON, 1}} {
+		require.NotPanics(t, func() {
+			_, err := s.deserialize(b)
+			require.ErrorIs(t, err, ErrCorruptValue, "%v", b)
+		})
+	}
+}
+
+func TestSerdeCompression(t *testing.T) {
+	s := newSerde()
+	s.register(1, &JSONObject{})
+	s.register(2, &PBUFObject{})
+	s.compressionThreshold = 64
+
+	small := &JSONObject{A: "a", B: 5}
+	serialized, err := s.serialize(small)
+	require.NoError(t, err)
+	require.EqualValues(t, JSON, serialized[0], "values below the threshold should not be compressed")
+
+	large := &JSONObject{A: strings.Repeat("a", 1000), B: 5}
+	serialized, err = s.serialize(large)
+	require.NoError(t, err)
+	require.EqualValues(t, COMPRESSED, serialized[0], "large values should be compressed")
+	require.Less(t, len(serialized), 1000)
+	deserialized, err := s.deserialize(serialized)
+	require.NoError(t, err)
+	require.EqualValues(t, large, deserialized)
+
+	text := strings.Repeat("a", 1000)
+	serialized, err = s.serialize(text)
+	require.NoError(t, err)
+	require.EqualValues(t, TEXT, serialized[0], "text should never be compressed")
+
+	pb := &PBUFObject{A: strings.Repeat("a", 1000), B: 5}
+	serialized, err = s.serialize(pb)
+	require.NoError(t, err)
+	require.EqualValues(t, COMPRESSED, serialized[0])
+	uncompressed, err := s.serializeUncompressed(pb)
+	require.NoError(t, err)
+	raw := &Raw[any]{serde: s, Bytes: serialized}
+	protoBytes, err := raw.ValueOrProtoBytes()
+	require.NoError(t, err)
+	require.EqualValues(t, uncompressed[3:], protoBytes, "proto bytes should be decompressed")
+
+	s2 := newSerde()
+	s2.register(1, &JSONObject{})
+	serialized, err = s.serialize(large)
+	require.NoError(t, err)
+	deserialized, err = s2.deserialize(serialized)
+	require.NoError(t, err)
+	require.EqualValues(t, large, deserialized, "compressed values should be readable without compression enabled")
+
+	for _, b := range [][]byte{{COMPRESSED}, {COMPRESSED, 1, 2, 3}} {
+		_, err = s.deserialize(b)
+		require.ErrorIs(t, err, ErrCorruptValue, "%v", b)
+		_, err = renderJSONValue(s, b)
+		require.ErrorIs(t, err, ErrCorruptValue, "export shouldn't hide corrupt value %v", b)
+	}
+
+	serialized, err = s.serialize(large)
+	require.NoError(t, err)
+	s.maxDecompressedSize = 100
+	_, err = s.deserialize(serialized)
+	require.ErrorIs(t, err, ErrCorruptValue, "values shouldn't decompress beyond the maximum size")
+}
+
+func TestRawType(t *testing.T) {
+	s := newSerde()
+	s.register(1, &JSONObject{})
+	s.register(2, &PBUFObject{})
+	s.compressionThreshold = 64
+	for _, tc := range []struct {
+		value    interface{}
+		expected byte
+	}{
+		{"", TEXT},
+		{[]byte("bytes"), BYTEARRAY},
+		{int64(1), LONG},
+		{&JSONObject{A: "a"}, JSON},
+		{&JSONObject{A: strings.Repeat("a", 1000)}, JSON},
+		{&PBUFObject{A: "a"}, PROTOCOLBUFFER},
+	} {
+		serialized, err := s.serialize(tc.value)
+		require.NoError(t, err)
+		typ, err := (&Raw[any]{serde: s, Bytes: serialized}).Type()
+		require.NoError(t, err)
+		require.EqualValues(t, tc.expected, typ, "%v", tc.value)
+	}
+
+	_, err := (&Raw[any]{serde: s}).Type()
+	require.ErrorIs(t, err, ErrCorruptValue, "empty bytes should be rejected")
+}
@@ -0,0 +1,50 @@
+package pathdb
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Highlight is the range [Start, End) of bytes within a search result's snippet that matched the
+// search
+type Highlight struct {
+	Start int
+	End   int
+}
+
+// newHighlightMarkers returns a pair of markers for delimiting highlights in snippets. The markers
+// include a random nonce so that they're practically guaranteed not to occur in indexed content.
+func newHighlightMarkers() (string, string) {
+	nonce := rand.Uint64()
+	return fmt.Sprintf("\x02%016x\x02", nonce), fmt.Sprintf("\x03%016x\x03", nonce)
+}
+
+// parseHighlights removes the given markers from snippet and returns the resulting plain text
+// along with the ranges of it that were highlighted
+func parseHighlights(snippet string, start string, end string) (string, []Highlight) {
+	var b strings.Builder
+	var highlights []Highlight
+	for {
+		i := strings.Index(snippet, start)
+		if i < 0 {
+			break
+		}
+		b.WriteString(snippet[:i])
+		snippet = snippet[i+len(start):]
+		h := Highlight{Start: b.Len()}
+		j := strings.Index(snippet, end)
+		if j < 0 {
+			// unterminated highlight, treat the rest of the snippet as highlighted
+			b.WriteString(snippet)
+			snippet = ""
+		} else {
+			b.WriteString(snippet[:j])
+			snippet = snippet[j+len(end):]
+		}
+		h.End = b.Len()
+		highlights = append(highlights, h)
+	}
+	b.WriteString(snippet)
+	return b.String(), highlights
+}
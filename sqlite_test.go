@@ -2,18 +2,113 @@ package pathdb
 
 import (
 	"database/sql"
+	"fmt"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/pathdb/minisql"
 )
 
-func newSQLiteImpl(t *testing.T) minisql.DB {
+func newSQLiteImpl(t testing.TB) minisql.DB {
 	tmpDir := t.TempDir()
 	db, err := sql.Open("sqlite3", filepath.Join(tmpDir, "test.db"))
 	require.NoError(t, err)
 	return &minisql.DBAdapter{DB: db}
 }
+
+// TestStatementCacheEviction runs more distinct queries than the adapter caches from several
+// goroutines at once, so that statements get evicted while they're in use
+func TestStatementCacheEviction(t *testing.T) {
+	db := minisql.Wrap(newSQLiteImpl(t))
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 600; i++ {
+				rows, err := db.Query(fmt.Sprintf("SELECT ? + %d", i), g)
+				if !assert.NoError(t, err) {
+					return
+				}
+				var result int
+				if assert.True(t, rows.Next()) {
+					assert.NoError(t, rows.Scan(&result))
+				}
+				assert.NoError(t, rows.Close())
+				assert.Equal(t, g+i, result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// queries also work within transactions after their statements have been evicted
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT ? + 0", 1)
+	require.NoError(t, err)
+	defer rows.Close()
+	require.True(t, rows.Next())
+	var result int
+	require.NoError(t, rows.Scan(&result))
+	require.Equal(t, 1, result)
+}
+
+// BenchmarkPut puts values with and without the adapter's statement cache, both in a single
+// transaction and in one transaction per value
+func BenchmarkPut(b *testing.B) {
+	for _, disableStatementCache := range []bool{false, true} {
+		name := "Cached"
+		if disableStatementCache {
+			name = "Uncached"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.Run("OneTransaction", func(b *testing.B) {
+				db := newBenchmarkDB(b, disableStatementCache)
+				b.ResetTimer()
+				err := Mutate(db, func(tx TX) error {
+					for i := 0; i < b.N; i++ {
+						err := Put(tx, fmt.Sprintf("/values/%d", i), i, "")
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			})
+			b.Run("TransactionPerPut", func(b *testing.B) {
+				db := newBenchmarkDB(b, disableStatementCache)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := Mutate(db, func(tx TX) error {
+						return Put(tx, fmt.Sprintf("/values/%d", i), i, "")
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func newBenchmarkDB(b *testing.B, disableStatementCache bool) DB {
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "test.db"))
+	require.NoError(b, err)
+	db, err := NewDB(&minisql.DBAdapter{DB: sqlDB, DisableStatementCache: disableStatementCache}, "test")
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
@@ -2,7 +2,11 @@ package pathdb
 
 import (
 	"fmt"
+	"math"
+	pathpkg "path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tchap/go-patricia/v2/patricia"
 )
@@ -10,24 +14,139 @@ import (
 type ChangeSet[T any] struct {
 	Updates map[string]*Item[*Raw[T]]
 	Deletes map[string]bool
+	// Previous holds the values that updated paths had before the update, keyed by path. It's only
+	// populated for subscriptions with IncludePrevious and has no entry for newly inserted paths.
+	Previous map[string]*Raw[T]
+	// indexValues holds the stored values of the index entries of updated paths, keyed by path.
+	// It's only populated for subscriptions made by SubscribeDetails.
+	indexValues map[string][]byte
 }
 
+// Len returns the total number of changes in this ChangeSet, counting both updates and deletes
+func (cs *ChangeSet[T]) Len() int {
+	return len(cs.Updates) + len(cs.Deletes)
+}
+
+// IsEmpty indicates whether this ChangeSet has no updates or deletes
+func (cs *ChangeSet[T]) IsEmpty() bool {
+	return cs.Len() == 0
+}
+
+// OrderedUpdates returns the updates in this ChangeSet sorted by path
+func (cs *ChangeSet[T]) OrderedUpdates() []*Item[*Raw[T]] {
+	result := make([]*Item[*Raw[T]], 0, len(cs.Updates))
+	for _, path := range sortedKeys(cs.Updates) {
+		result = append(result, cs.Updates[path])
+	}
+	return result
+}
+
+// OrderedDeletes returns the deleted paths in this ChangeSet, sorted
+func (cs *ChangeSet[T]) OrderedDeletes() []string {
+	return sortedKeys(cs.Deletes)
+}
+
+// PathMatcher determines how a subscription's PathPrefixes are matched against changed paths
+type PathMatcher int
+
+const (
+	// MatchPrefix matches all paths that start with one of the prefixes
+	MatchPrefix PathMatcher = iota
+	// MatchSegmentGlob treats each of the prefixes as a template like "/contacts/*/status", in
+	// which * matches a single path segment, and matches only paths that match the entire
+	// template. Templates use the syntax of path.Match.
+	MatchSegmentGlob
+)
+
 type Subscription[T any] struct {
-	ID             string
-	PathPrefixes   []string
+	// ID identifies the subscription. Subscribing with the ID of an existing subscription stops
+	// and replaces it.
+	ID           string
+	PathPrefixes []string
+	// Matcher determines how PathPrefixes are matched against changed paths. Defaults to
+	// MatchPrefix.
+	Matcher        PathMatcher
 	JoinDetails    bool
 	ReceiveInitial bool
-	OnUpdate       func(*ChangeSet[T]) error
+	// MinDelta, if greater than zero, suppresses updates to numeric values whose absolute change
+	// from the last value delivered for the same path is smaller than MinDelta. Non-numeric values
+	// are always delivered.
+	MinDelta float64
+	// IncludePrevious causes ChangeSet.Previous to be populated with the values that updated paths
+	// had before the update
+	IncludePrevious bool
+	// FailCommitOnError causes commits to fail and roll back if OnUpdate returns an error while
+	// being notified of the commit's changes. Subscribers with FailCommitOnError are notified
+	// before other subscribers, and other subscribers are not notified of failed commits.
+	// However, if multiple subscribers use FailCommitOnError, some of them may be notified of
+	// changes from a commit that subsequently fails.
+	FailCommitOnError bool
+	// BufferSize, if greater than zero, delivers change sets asynchronously on a dedicated
+	// goroutine through a buffer that holds up to BufferSize change sets, so that a slow OnUpdate
+	// doesn't hold up commits or other subscribers. What happens when the buffer is full is
+	// determined by OverflowPolicy. Asynchronous delivery can't be combined with FailCommitOnError.
+	BufferSize int
+	// OverflowPolicy determines what happens when a change set is delivered while the buffer of an
+	// asynchronous subscription is full. Defaults to BlockOnOverflow.
+	OverflowPolicy OverflowPolicy
+	// DebounceInterval, if greater than zero, collects the changes of all commits within this
+	// interval of the first one and delivers them as a single change set, which reduces the number
+	// of notifications during bursts of commits. Updates and deletes of the same path supersede
+	// each other, so that the change set reflects the final state. Like with BufferSize, change
+	// sets are delivered on a dedicated goroutine, so this can't be combined with
+	// FailCommitOnError.
+	DebounceInterval time.Duration
+	// Filter, if set, is called with each update (including initial values) before it's added to
+	// a change set, and updates for which it returns false are dropped. For subscriptions that join
+	// details, the item holds the detail value.
+	Filter func(*Item[*Raw[T]]) bool
+	// DeleteFilter, if set, is called with the path of each delete before it's added to a change
+	// set, and deletes for which it returns false are dropped
+	DeleteFilter func(path string) bool
+	// OnUpdate is called with each change set. Unless the subscription delivers asynchronously,
+	// it runs on the goroutine that processes commits, so it must not commit transactions or call
+	// Stats, Subscriptions or Barrier, which all wait for that goroutine.
+	OnUpdate func(*ChangeSet[T]) error
+	// includeIndexValues makes change sets of subscriptions that join details carry the stored
+	// values of index entries (see SubscribeDetails)
+	includeIndexValues bool
 }
 
+// OverflowPolicy determines how asynchronous subscriptions handle a full buffer
+type OverflowPolicy int
+
+const (
+	// BlockOnOverflow waits for the subscriber to make room in the buffer, which holds up commits
+	// and other subscribers in the meantime. No change sets are lost.
+	BlockOnOverflow OverflowPolicy = iota
+	// DropOldestOnOverflow discards the oldest buffered change set to make room for the new one,
+	// so that commits are never held up but the subscriber may miss changes
+	DropOldestOnOverflow
+)
+
 type subscription struct {
-	id             string
-	pathPrefixes   []string
-	joinDetails    bool
-	receiveInitial bool
-	onUpdate       func(item *Item[*Raw[any]], initial bool, isDetail bool)
-	onDelete       func(string, bool)
-	flush          func() error
+	id string
+	// schema is the schema of the DB through which the subscription was made, whose commits it
+	// receives
+	schema       string
+	pathPrefixes []string
+	// globs holds the templates of subscriptions that use MatchSegmentGlob, in which case
+	// pathPrefixes holds their literal prefixes
+	globs             []string
+	joinDetails       bool
+	receiveInitial    bool
+	includePrevious   bool
+	failCommitOnError bool
+	onUpdate          func(item *Item[*Raw[any]], indexValue []byte, previous []byte, initial bool, isDetail bool)
+	onDelete          func(string, bool)
+	flush             func() error
+	discard           func()
+	// barrier, if set, queues a marker behind the change sets that an asynchronous subscription
+	// has yet to deliver and returns a channel that's closed once they've been delivered
+	barrier func() chan interface{}
+	// stop releases resources held by the subscription once it's been removed. It may be called
+	// more than once.
+	stop func()
 }
 
 type subscribeRequest struct {
@@ -36,14 +155,47 @@ type subscribeRequest struct {
 }
 
 type unsubscribeRequest struct {
-	id   string
+	id string
+	// all indicates that all subscriptions should be removed, regardless of id
+	all  bool
+	done chan interface{}
+}
+
+type subscriptionListRequest struct {
+	ids  []string
 	done chan interface{}
 }
 
+// Subscribe registers a subscription for changes to the paths under sub.PathPrefixes. Values that
+// aren't of type T are still delivered, but reading them fails with ErrTypeMismatch, so prefixes
+// that hold values of different types should be subscribed to with SubscribeRaw instead.
 func Subscribe[T any](d DB, sub *Subscription[T]) error {
-	// clean up pathPrefixes in case they include an unnecessary trailing % wildcard
-	for i, prefix := range sub.PathPrefixes {
-		sub.PathPrefixes[i] = strings.TrimRight(prefix, "%")
+	if (sub.BufferSize > 0 || sub.DebounceInterval > 0) && sub.FailCommitOnError {
+		return fmt.Errorf("subscribe: asynchronous delivery can't fail commits: %w", ErrInvalidSubscription)
+	}
+	if sub.JoinDetails && d.getSerde().cipher != nil {
+		// see Options.ValueCipher
+		return fmt.Errorf("subscribe: can't join details of encrypted index entries: %w", ErrInvalidSubscription)
+	}
+
+	var globs []string
+	pathPrefixes := sub.PathPrefixes
+	if sub.Matcher == MatchSegmentGlob {
+		// index templates by their literal prefix to narrow down which ones need evaluating
+		globs = sub.PathPrefixes
+		pathPrefixes = make([]string, 0, len(globs))
+		for _, glob := range globs {
+			_, err := pathpkg.Match(glob, "")
+			if err != nil {
+				return fmt.Errorf("subscribe: invalid template %q: %w", glob, err)
+			}
+			pathPrefixes = append(pathPrefixes, globPrefix(glob))
+		}
+	} else {
+		// clean up pathPrefixes in case they include an unnecessary trailing % wildcard
+		for i, prefix := range sub.PathPrefixes {
+			sub.PathPrefixes[i] = strings.TrimRight(prefix, "%")
+		}
 	}
 
 	// we have to create a new subscription to adapt the generic onUpdate to a non-generic one because
@@ -55,15 +207,23 @@ func Subscribe[T any](d DB, sub *Subscription[T]) error {
 	initChangeset()
 
 	reverseDetailPaths := make(map[string]string)
+	indexValues := make(map[string][]byte)
+	lastDelivered := make(map[string]float64)
 
 	s := &subscription{
-		id:             sub.ID,
-		pathPrefixes:   sub.PathPrefixes,
-		joinDetails:    sub.JoinDetails,
-		receiveInitial: sub.ReceiveInitial,
-		onUpdate: func(u *Item[*Raw[any]], initial bool, isDetail bool) {
+		id:                sub.ID,
+		pathPrefixes:      pathPrefixes,
+		globs:             globs,
+		joinDetails:       sub.JoinDetails,
+		receiveInitial:    sub.ReceiveInitial,
+		includePrevious:   sub.IncludePrevious,
+		failCommitOnError: sub.FailCommitOnError,
+		onUpdate: func(u *Item[*Raw[any]], indexValue []byte, previous []byte, initial bool, isDetail bool) {
 			if sub.JoinDetails && !isDetail {
 				reverseDetailPaths[u.DetailPath] = u.Path
+				if sub.includeIndexValues {
+					indexValues[u.Path] = indexValue
+				}
 			}
 
 			if initial && !sub.ReceiveInitial {
@@ -77,11 +237,14 @@ func Subscribe[T any](d DB, sub *Subscription[T]) error {
 			}
 
 			var v T
+			loaded, err := u.Value.loaded, u.Value.err
 			if u.Value.value != nil {
-				v = u.Value.value.(T)
-			}
-			if cs.Updates == nil {
-				cs.Updates = make(map[string]*Item[*Raw[T]])
+				var ok bool
+				v, ok = u.Value.value.(T)
+				if !ok {
+					// let the subscriber find out when reading the value rather than panicking
+					loaded, err = true, typeMismatch[T](u.Value.value)
+				}
 			}
 
 			path := u.Path
@@ -89,84 +252,473 @@ func Subscribe[T any](d DB, sub *Subscription[T]) error {
 			if isDetail {
 				detailPath, path = path, reverseDetailPaths[path]
 			}
-			cs.Updates[path] = &Item[*Raw[T]]{
+			item := &Item[*Raw[T]]{
 				Path:       path,
 				DetailPath: detailPath,
 				Value: &Raw[T]{
 					serde:  u.Value.serde,
 					Bytes:  u.Value.Bytes,
-					loaded: u.Value.loaded,
+					loaded: loaded,
 					value:  v,
-					err:    u.Value.err,
+					err:    err,
 				},
 			}
+			if sub.Filter != nil && !sub.Filter(item) {
+				return
+			}
+
+			if sub.MinDelta > 0 {
+				_v, err := u.Value.Value()
+				if err == nil {
+					f, isNumeric := toFloat64(_v)
+					if isNumeric {
+						last, hasLast := lastDelivered[path]
+						if hasLast && math.Abs(f-last) < sub.MinDelta {
+							// change is too small to be worth notifying
+							return
+						}
+						lastDelivered[path] = f
+					}
+				}
+			}
+
+			if cs.Updates == nil {
+				cs.Updates = make(map[string]*Item[*Raw[T]])
+			}
+			cs.Updates[path] = item
+			if sub.includeIndexValues {
+				if cs.indexValues == nil {
+					cs.indexValues = make(map[string][]byte)
+				}
+				cs.indexValues[path] = indexValues[path]
+			}
+			if sub.IncludePrevious && len(previous) > 0 {
+				if cs.Previous == nil {
+					cs.Previous = make(map[string]*Raw[T])
+				}
+				cs.Previous[path] = &Raw[T]{
+					serde: u.Value.serde,
+					Bytes: previous,
+				}
+			}
 
 		},
 		onDelete: func(p string, isDetail bool) {
-			if cs.Deletes == nil {
-				cs.Deletes = make(map[string]bool)
-			}
 			if isDetail {
-				cs.Deletes[reverseDetailPaths[p]] = true
+				p = reverseDetailPaths[p]
 			} else {
-				cs.Deletes[p] = true
+				delete(indexValues, p)
 			}
+			delete(lastDelivered, p)
+			if sub.DeleteFilter != nil && !sub.DeleteFilter(p) {
+				return
+			}
+			if cs.Deletes == nil {
+				cs.Deletes = make(map[string]bool)
+			}
+			cs.Deletes[p] = true
 		},
 		flush: func() (err error) {
-			if len(cs.Updates) > 0 || len(cs.Deletes) > 0 {
+			if !cs.IsEmpty() {
 				err = sub.OnUpdate(cs)
 				initChangeset()
 			}
 			return
 		},
+		discard: initChangeset,
+		stop:    func() {},
+	}
+	if sub.BufferSize > 0 || sub.DebounceInterval > 0 {
+		deliverAsync(s, sub, func() *ChangeSet[T] {
+			pending := cs
+			initChangeset()
+			return pending
+		})
+	}
+	return d.Subscribe(s)
+}
+
+// RawSubscription is a Subscription whose change sets hold values of any type (see SubscribeRaw)
+type RawSubscription = Subscription[any]
+
+// SubscribeRaw is like Subscribe, but doesn't assume that all values are of the same type. Change
+// sets hold *Raw[any] values, so the subscriber can decide how to handle each item, for example by
+// checking Raw.Type or switching on the type returned by Raw.Value. This suits prefixes that hold
+// values of mixed types, for which Subscribe would report ErrTypeMismatch.
+func SubscribeRaw(d DB, sub *RawSubscription) error {
+	return Subscribe(d, sub)
+}
+
+// DetailItem is an index entry along with the detail that it refers to (see SubscribeDetails)
+type DetailItem[I, D any] struct {
+	Path       string
+	DetailPath string
+	// Value is the value of the index entry, which is the detail path
+	Value *Raw[I]
+	// Detail is the value at DetailPath
+	Detail *Raw[D]
+}
+
+// DetailChangeSet is like ChangeSet, but its updates carry both the index entries and their details
+type DetailChangeSet[I, D any] struct {
+	Updates map[string]*DetailItem[I, D]
+	Deletes map[string]bool
+	// Previous holds the previous values of updated details, keyed by the path of the index entry.
+	// It's only populated for subscriptions with IncludePrevious.
+	Previous map[string]*Raw[D]
+}
+
+// DetailSubscription is like a Subscription that joins details, except that change sets include
+// the values of the index entries alongside the details. The options mean the same as they do for
+// Subscription.
+type DetailSubscription[I, D any] struct {
+	ID                string
+	PathPrefixes      []string
+	Matcher           PathMatcher
+	ReceiveInitial    bool
+	IncludePrevious   bool
+	FailCommitOnError bool
+	BufferSize        int
+	OverflowPolicy    OverflowPolicy
+	DebounceInterval  time.Duration
+	OnUpdate          func(*DetailChangeSet[I, D]) error
+}
+
+// SubscribeDetails subscribes to the index entries under sub.PathPrefixes and the details to which
+// they refer, delivering both the index values (of type I) and the detail values (of type D)
+func SubscribeDetails[I, D any](d DB, sub *DetailSubscription[I, D]) error {
+	serde := d.getSerde()
+	return Subscribe(d, &Subscription[D]{
+		ID:                 sub.ID,
+		PathPrefixes:       sub.PathPrefixes,
+		Matcher:            sub.Matcher,
+		JoinDetails:        true,
+		ReceiveInitial:     sub.ReceiveInitial,
+		IncludePrevious:    sub.IncludePrevious,
+		FailCommitOnError:  sub.FailCommitOnError,
+		BufferSize:         sub.BufferSize,
+		OverflowPolicy:     sub.OverflowPolicy,
+		DebounceInterval:   sub.DebounceInterval,
+		includeIndexValues: true,
+		OnUpdate: func(cs *ChangeSet[D]) error {
+			dcs := &DetailChangeSet[I, D]{
+				Deletes:  cs.Deletes,
+				Previous: cs.Previous,
+			}
+			if len(cs.Updates) > 0 {
+				dcs.Updates = make(map[string]*DetailItem[I, D], len(cs.Updates))
+			}
+			for path, u := range cs.Updates {
+				dcs.Updates[path] = &DetailItem[I, D]{
+					Path:       path,
+					DetailPath: u.DetailPath,
+					Value:      &Raw[I]{serde: serde, Bytes: cs.indexValues[path]},
+					Detail:     u.Value,
+				}
+			}
+			return sub.OnUpdate(dcs)
+		},
+	})
+}
+
+// asyncDelivery is either a change set to deliver or a barrier to close once the change sets
+// ahead of it have been delivered
+type asyncDelivery[T any] struct {
+	cs      *ChangeSet[T]
+	barrier chan interface{}
+}
+
+// deliverAsync makes s deliver change sets to sub.OnUpdate on a dedicated goroutine, which stops
+// once s is stopped. takeChangeSet returns the pending change set and starts a new one.
+func deliverAsync[T any](s *subscription, sub *Subscription[T], takeChangeSet func() *ChangeSet[T]) {
+	changeSets := make(chan asyncDelivery[T], sub.BufferSize)
+	deliver := func(cs *ChangeSet[T]) {
+		err := sub.OnUpdate(cs)
+		if err != nil {
+			log.Debugf("subscriber %v failed to accept changes: %v", sub.ID, err)
+		}
+	}
+	go func() {
+		if sub.DebounceInterval <= 0 {
+			for delivery := range changeSets {
+				if delivery.barrier != nil {
+					close(delivery.barrier)
+					continue
+				}
+				deliver(delivery.cs)
+			}
+			return
+		}
+
+		var pending *ChangeSet[T]
+		var timer <-chan time.Time
+		for {
+			select {
+			case delivery, ok := <-changeSets:
+				if !ok {
+					if pending != nil {
+						deliver(pending)
+					}
+					return
+				}
+				if delivery.barrier != nil {
+					// don't keep whoever's waiting on the barrier waiting for the interval
+					if pending != nil {
+						deliver(pending)
+						pending, timer = nil, nil
+					}
+					close(delivery.barrier)
+				} else if pending == nil {
+					pending = delivery.cs
+					timer = time.After(sub.DebounceInterval)
+				} else {
+					mergeChangeSets(pending, delivery.cs)
+				}
+			case <-timer:
+				deliver(pending)
+				pending, timer = nil, nil
+			}
+		}
+	}()
+
+	// flush and barrier are only ever called from the mainLoop, so there's a single sender
+	send := func(delivery asyncDelivery[T]) {
+		if sub.OverflowPolicy != DropOldestOnOverflow || cap(changeSets) == 0 {
+			changeSets <- delivery
+			return
+		}
+		for {
+			select {
+			case changeSets <- delivery:
+				return
+			default:
+				// buffer is full, drop the oldest change set unless the subscriber just took it
+				select {
+				case dropped := <-changeSets:
+					if dropped.barrier != nil {
+						// everything ahead of the barrier has been delivered or dropped too
+						close(dropped.barrier)
+					}
+				default:
+				}
+			}
+		}
+	}
+	s.flush = func() error {
+		cs := takeChangeSet()
+		if cs.IsEmpty() {
+			return nil
+		}
+		send(asyncDelivery[T]{cs: cs})
+		return nil
+	}
+	s.barrier = func() chan interface{} {
+		barrier := make(chan interface{})
+		send(asyncDelivery[T]{barrier: barrier})
+		return barrier
+	}
+	var stopOnce sync.Once
+	s.stop = func() {
+		stopOnce.Do(func() {
+			close(changeSets)
+		})
+	}
+}
+
+// mergeChangeSets merges the later change set into the earlier one. Like with the updates and
+// deletes of a tx, an update of a path supersedes an earlier delete and vice versa. Previous values
+// are kept from the earliest update.
+func mergeChangeSets[T any](earlier, later *ChangeSet[T]) {
+	for path, u := range later.Updates {
+		delete(earlier.Deletes, path)
+		if earlier.Updates == nil {
+			earlier.Updates = make(map[string]*Item[*Raw[T]])
+		}
+		_, alreadyUpdated := earlier.Updates[path]
+		earlier.Updates[path] = u
+		indexValue, hasIndexValue := later.indexValues[path]
+		if hasIndexValue {
+			if earlier.indexValues == nil {
+				earlier.indexValues = make(map[string][]byte)
+			}
+			earlier.indexValues[path] = indexValue
+		}
+		previous, hasPrevious := later.Previous[path]
+		if hasPrevious && !alreadyUpdated {
+			if earlier.Previous == nil {
+				earlier.Previous = make(map[string]*Raw[T])
+			}
+			earlier.Previous[path] = previous
+		}
+	}
+	for path := range later.Deletes {
+		delete(earlier.Updates, path)
+		delete(earlier.Previous, path)
+		delete(earlier.indexValues, path)
+		if earlier.Deletes == nil {
+			earlier.Deletes = make(map[string]bool)
+		}
+		earlier.Deletes[path] = true
+	}
+}
+
+// globPrefix returns the literal part of the given template that precedes its first wildcard
+func globPrefix(glob string) string {
+	i := strings.IndexAny(glob, `*?[\`)
+	if i < 0 {
+		return glob
+	}
+	return glob[:i]
+}
+
+// matches checks whether the given path matches this subscription. Candidate subscriptions are
+// found by prefix, so this only needs checking for subscriptions with templates.
+func (s *subscription) matches(path string) bool {
+	if len(s.globs) == 0 {
+		return true
+	}
+	for _, glob := range s.globs {
+		matched, _ := pathpkg.Match(glob, path)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// toFloat64 converts numeric values to float64, returning false if the value isn't numeric
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case byte:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
 	}
-	d.Subscribe(s)
-	return nil
 }
 
 func Unsubscribe(d DB, id string) {
 	d.Unsubscribe(id)
 }
 
-func (d *db) Subscribe(s *subscription) {
+// Barrier waits until all commits to d that were submitted before it have been processed and their
+// subscribers notified, which makes it possible to wait for notifications deterministically. That
+// includes subscriptions with asynchronous delivery (see Subscription.BufferSize), whose pending
+// change sets are delivered right away rather than after their DebounceInterval. Barrier must not
+// be called from OnUpdate, since the notifications that it waits for can't be delivered while
+// OnUpdate is running.
+func Barrier(d DB) error {
+	return d.Barrier()
+}
+
+// UnsubscribeAll removes all of d's subscriptions, for example during teardown
+func UnsubscribeAll(d DB) {
+	d.UnsubscribeAll()
+}
+
+// Subscriptions returns the sorted IDs of d's current subscriptions, which is useful for debugging.
+// It must not be called from OnUpdate unless the subscription delivers asynchronously (see
+// BufferSize and DebounceInterval), since it would wait for the notification that's calling it.
+func Subscriptions(d DB) []string {
+	return d.Subscriptions()
+}
+
+func (d *db) Subscribe(s *subscription) error {
+	s.schema = d.schema
 	sr := &subscribeRequest{
 		s:    s,
 		done: make(chan interface{}),
 	}
-	d.subscribes <- sr
-	<-sr.done
+	select {
+	case d.subscribes <- sr:
+	case <-d.done:
+		return fmt.Errorf("subscribe: %w", ErrDBClosed)
+	}
+	select {
+	case <-sr.done:
+		return nil
+	case <-d.done:
+		return fmt.Errorf("subscribe: %w", ErrDBClosed)
+	}
 }
 
+// Unsubscribe removes the subscription with the given id. After the DB is closed, this is a no-op.
 func (d *db) Unsubscribe(id string) {
-	usr := &unsubscribeRequest{
+	d.doUnsubscribe(&unsubscribeRequest{
 		id:   id,
 		done: make(chan interface{}),
+	})
+}
+
+func (d *db) UnsubscribeAll() {
+	d.doUnsubscribe(&unsubscribeRequest{
+		all:  true,
+		done: make(chan interface{}),
+	})
+}
+
+func (d *db) doUnsubscribe(usr *unsubscribeRequest) {
+	select {
+	case d.unsubscribes <- usr:
+	case <-d.done:
+		return
+	}
+	select {
+	case <-usr.done:
+	case <-d.done:
 	}
-	d.unsubscribes <- usr
-	<-usr.done
 }
 
 func (d *db) onNewSubscription(sr *subscribeRequest) {
 	s := sr.s
 	defer close(sr.done)
 
+	// a subscription replaces any existing subscription with the same ID
+	d.removeSubscription(s.id)
+	if s.includePrevious {
+		d.previousValueSubscribers.Add(1)
+	}
+
 	for _, path := range s.pathPrefixes {
 		d.getOrCreateSubscriptionsByPath(path)[s.id] = s
 
 		if s.receiveInitial || s.joinDetails {
-			items, err := RList[any](
-				d,
-				&QueryParams{
-					Path:                fmt.Sprintf("%s%%", path),
-					JoinDetails:         s.joinDetails,
-					IncludeEmptyDetails: true,
-				},
-			)
+			query := &QueryParams{Path: fmt.Sprintf("%s%%", path)}
+			if s.joinDetails {
+				// include index entries whose details don't exist yet so that we subscribe to them
+				query.JoinDetails = true
+				query.IncludeEmptyDetails = true
+			}
+			if s.joinDetails {
+				query.ProjectionFields = ProjectDefault | projectIndexValue
+			}
+			var items []*Item[*Raw[any]]
+			var indexValues [][]byte
+			serde := d.getSerde()
+			err := d.WithSchema(s.schema).Iterate(query, nil, func(i *item) error {
+				items = append(items, newRawItem[any](serde, i))
+				indexValues = append(indexValues, i.indexValue)
+				return nil
+			})
 			if err != nil {
 				log.Debugf("unable to list initial values for path prefix %v: %v", path, err)
 			} else {
-				for _, item := range items {
-					s.onUpdate(item, true, false)
+				for i, item := range items {
+					if !s.matches(item.Path) {
+						continue
+					}
+					s.onUpdate(item, indexValues[i], nil, true, false)
 					if s.joinDetails {
 						// subscribe for updates to this detail path
 						d.getOrCreateDetailSubscriptionsByPath(item.DetailPath)[s.id] = s
@@ -181,47 +733,187 @@ func (d *db) onNewSubscription(sr *subscribeRequest) {
 	}
 }
 
+func (d *db) Subscriptions() []string {
+	slr := &subscriptionListRequest{
+		done: make(chan interface{}),
+	}
+	// subscriptions are tracked on the mainLoop, which owns the tries
+	select {
+	case d.subscriptionListRequests <- slr:
+		<-slr.done
+	case <-d.done:
+	}
+	return slr.ids
+}
+
+func (d *db) onListSubscriptions(slr *subscriptionListRequest) {
+	defer close(slr.done)
+
+	slr.ids = sortedKeys(d.allSubscriptions())
+}
+
+// allSubscriptions returns all current subscriptions by id
+func (d *db) allSubscriptions() map[string]*subscription {
+	subscriptions := make(map[string]*subscription)
+	_ = d.subscriptionsByPath.Visit(func(prefix patricia.Prefix, item patricia.Item) error {
+		for id, s := range item.(map[string]*subscription) {
+			subscriptions[id] = s
+		}
+		return nil
+	})
+	return subscriptions
+}
+
+// asyncBarriers queues barriers for all current subscriptions with asynchronous delivery
+func (d *db) asyncBarriers() []chan interface{} {
+	var barriers []chan interface{}
+	for _, s := range d.allSubscriptions() {
+		if s.barrier != nil {
+			barriers = append(barriers, s.barrier())
+		}
+	}
+	return barriers
+}
+
+// stopSubscriptions stops all current subscriptions when the DB is closed
+func (d *db) stopSubscriptions() {
+	for _, s := range d.allSubscriptions() {
+		s.stop()
+	}
+}
+
 func (d *db) onDeleteSubscription(usr *unsubscribeRequest) {
-	id := usr.id
+	if usr.all {
+		d.onDeleteAllSubscriptions(usr)
+		return
+	}
+
 	defer close(usr.done)
+	d.removeSubscription(usr.id)
+}
 
-	d.subscriptionsByPath.Visit(func(prefix patricia.Prefix, item patricia.Item) error {
-		subs := item.(map[string]*subscription)
-		delete(subs, id)
-		return nil
+// removeSubscription stops and removes the subscription with the given id, if there is one
+func (d *db) removeSubscription(id string) {
+	includedPrevious := false
+	deleteSubscription(&d.subscriptionsByPath, id, func(s *subscription) {
+		if s.includePrevious {
+			includedPrevious = true
+		}
+		s.stop()
 	})
-	d.detailSubscriptionsByPath.Visit(func(prefix patricia.Prefix, item patricia.Item) error {
+	if includedPrevious {
+		d.previousValueSubscribers.Add(-1)
+	}
+	deleteSubscription(&d.detailSubscriptionsByPath, id, func(s *subscription) {})
+}
+
+func (d *db) onDeleteAllSubscriptions(usr *unsubscribeRequest) {
+	defer close(usr.done)
+
+	includedPrevious := int64(0)
+	for _, s := range d.allSubscriptions() {
+		if s.includePrevious {
+			includedPrevious++
+		}
+		s.stop()
+	}
+	d.previousValueSubscribers.Add(-includedPrevious)
+	d.subscriptionsByPath = *patricia.NewTrie()
+	d.detailSubscriptionsByPath = *patricia.NewTrie()
+}
+
+// deleteSubscription removes the subscription with the given id from subscriptionsByPath, calling
+// onFound for each entry it's removed from, and prunes any entries that are left empty
+func deleteSubscription(subscriptionsByPath *patricia.Trie, id string, onFound func(*subscription)) {
+	var emptyPrefixes []patricia.Prefix
+	_ = subscriptionsByPath.Visit(func(prefix patricia.Prefix, item patricia.Item) error {
 		subs := item.(map[string]*subscription)
-		delete(subs, id)
+		s, found := subs[id]
+		if found {
+			onFound(s)
+			delete(subs, id)
+		}
+		if len(subs) == 0 {
+			emptyPrefixes = append(emptyPrefixes, append(patricia.Prefix(nil), prefix...))
+		}
 		return nil
 	})
+	// the trie can't be modified while visiting it, so prune afterwards
+	for _, prefix := range emptyPrefixes {
+		subscriptionsByPath.Delete(prefix)
+	}
+}
+
+func (d *db) onStats(sr *statsRequest) {
+	defer close(sr.done)
+
+	countEntries := func(subscriptionsByPath *patricia.Trie) (count int) {
+		_ = subscriptionsByPath.Visit(func(prefix patricia.Prefix, item patricia.Item) error {
+			count++
+			return nil
+		})
+		return
+	}
+	sr.stats.SubscriptionPrefixCount = countEntries(&d.subscriptionsByPath)
+	sr.stats.TrieNodeCount = sr.stats.SubscriptionPrefixCount + countEntries(&d.detailSubscriptionsByPath)
 }
 
-func (d *db) onCommit(c *commit) {
+// onCommit notifies subscribers of the changes in the given commit. Subscribers are notified in
+// order of subscription ID so that delivery order is deterministic. If a subscriber with
+// failCommitOnError fails to accept the changes, this returns an error and the commit should be
+// rolled back.
+func (d *db) onCommit(c *commit) error {
 	dirty := make(map[string]*subscription, 0)
 	d.notifySubscribers(c.t, dirty, &d.subscriptionsByPath, false)
 	d.notifySubscribers(c.t, dirty, &d.detailSubscriptionsByPath, true)
-	for _, s := range dirty {
-		s.flush()
+	ids := sortedKeys(dirty)
+	for _, id := range ids {
+		s := dirty[id]
+		if s.failCommitOnError {
+			err := s.flush()
+			if err != nil {
+				for _, s := range dirty {
+					s.discard()
+				}
+				return fmt.Errorf("subscriber %v failed to accept changes: %w", s.id, err)
+			}
+		}
 	}
+	for _, id := range ids {
+		s := dirty[id]
+		if !s.failCommitOnError {
+			err := s.flush()
+			if err != nil {
+				log.Debugf("subscriber %v failed to accept changes: %v", s.id, err)
+			}
+		}
+	}
+	return nil
 }
 
 func (d *db) notifySubscribers(t *tx, dirty map[string]*subscription, subscriptionsByPath *patricia.Trie, isDetail bool) {
 	for path, u := range t.updates {
 		_ = subscriptionsByPath.VisitPrefixes(patricia.Prefix(path), func(prefix patricia.Prefix, item patricia.Item) error {
-			for _, s := range item.(map[string]*subscription) {
+			subs := item.(map[string]*subscription)
+			for _, id := range sortedKeys(subs) {
+				s := subs[id]
+				if s.schema != t.schema || (!isDetail && !s.matches(path)) {
+					continue
+				}
 				if s.joinDetails && !isDetail {
 					// assume that this value is an index entry, go ahead and subscribe to the corresponding detail
 					_detailPath, err := u.Value.Value()
 					if err == nil {
 						detailPath, ok := _detailPath.(string)
-						if ok {
+						if !ok {
+							log.Debugf("Ignoring index entry at %v for subscriber %v, its value is a %T rather than a detail path", path, s.id, _detailPath)
+						} else {
 							d.getOrCreateDetailSubscriptionsByPath(detailPath)[s.id] = s
 							detail, err := RGet[any](t, detailPath)
 							if err == nil {
-								u.Value = detail
-								u.DetailPath = detailPath
-								s.onUpdate(u, false, isDetail)
+								// don't modify u, which other subscribers see as the index entry
+								joined := &Item[*Raw[any]]{Path: u.Path, DetailPath: detailPath, Value: detail}
+								s.onUpdate(joined, u.Value.Bytes, t.previous[detailPath], false, isDetail)
 								dirty[s.id] = s
 							} else {
 								log.Debugf("Error reading detail: %v", err)
@@ -229,7 +921,7 @@ func (d *db) notifySubscribers(t *tx, dirty map[string]*subscription, subscripti
 						}
 					}
 				} else {
-					s.onUpdate(u, false, isDetail)
+					s.onUpdate(u, nil, t.previous[path], false, isDetail)
 					dirty[s.id] = s
 				}
 			}
@@ -238,7 +930,12 @@ func (d *db) notifySubscribers(t *tx, dirty map[string]*subscription, subscripti
 	}
 	for path := range t.deletes {
 		_ = subscriptionsByPath.VisitPrefixes(patricia.Prefix(path), func(prefix patricia.Prefix, item patricia.Item) error {
-			for _, s := range item.(map[string]*subscription) {
+			subs := item.(map[string]*subscription)
+			for _, id := range sortedKeys(subs) {
+				s := subs[id]
+				if s.schema != t.schema || (!isDetail && !s.matches(path)) {
+					continue
+				}
 				s.onDelete(path, isDetail)
 				dirty[s.id] = s
 			}
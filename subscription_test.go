@@ -0,0 +1,43 @@
+package pathdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeSetLen(t *testing.T) {
+	cs := &ChangeSet[string]{}
+	require.Zero(t, cs.Len())
+	require.True(t, cs.IsEmpty())
+
+	cs.Deletes = map[string]bool{"/deleted": true}
+	require.Equal(t, 1, cs.Len())
+	require.False(t, cs.IsEmpty())
+
+	cs.Updates = map[string]*Item[*Raw[string]]{
+		"/a": {Path: "/a"},
+		"/b": {Path: "/b"},
+	}
+	cs.Previous = map[string]*Raw[string]{"/a": {}}
+	require.Equal(t, 3, cs.Len(), "previous values shouldn't count as changes")
+}
+
+func TestChangeSetOrdered(t *testing.T) {
+	cs := &ChangeSet[string]{}
+	require.Empty(t, cs.OrderedUpdates())
+	require.Empty(t, cs.OrderedDeletes())
+
+	cs.Updates = map[string]*Item[*Raw[string]]{
+		"/c": {Path: "/c"},
+		"/a": {Path: "/a"},
+		"/b": {Path: "/b"},
+	}
+	cs.Deletes = map[string]bool{"/z": true, "/x": true, "/y": true}
+	paths := make([]string, 0, len(cs.Updates))
+	for _, u := range cs.OrderedUpdates() {
+		paths = append(paths, u.Path)
+	}
+	require.EqualValues(t, []string{"/a", "/b", "/c"}, paths)
+	require.EqualValues(t, []string{"/x", "/y", "/z"}, cs.OrderedDeletes())
+}
@@ -0,0 +1,137 @@
+package pathdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tail returns the newest n items under the given path prefix in chronological order. Items are
+// considered to be ordered by path, so paths in append-only logs should sort in the order in
+// which they're appended (e.g. by using zero-padded sequence numbers or timestamps).
+func Tail[T any](q Queryable, prefix string, n int) ([]*Item[T], error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	items, err := List[T](q, &QueryParams{
+		Path:        fmt.Sprintf("%s%%", strings.TrimRight(prefix, "%")),
+		Count:       n,
+		ReverseSort: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tail: list: %w", err)
+	}
+	// we queried in reverse, put items back into chronological order
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+// FollowTail calls onAppend with the newest n items under the given path prefix and then
+// subscribes (using the given subscription id) to receive items that are subsequently appended.
+// Items are always delivered in chronological (path) order and updates to paths that sort before
+// the last delivered item are ignored. Use Unsubscribe with the same id to stop following.
+//
+// The initial tail, along with anything appended while it's being delivered, is delivered on the
+// calling goroutine, so onAppend may write to d at that point. Later appends are delivered like
+// with Subscribe.
+func FollowTail[T any](d DB, id string, prefix string, n int, onAppend func([]*Item[T]) error) error {
+	// mx guards the fields below, but is never held while calling onAppend or the DB, since
+	// either might wait for the DB to notify subscribers
+	var mx sync.Mutex
+	lastPath := ""
+	initialized := false
+	// pending holds the items appended before the initial tail has been delivered, keyed by path
+	pending := make(map[string]*Item[T])
+
+	// newItems returns the given items that are newer than the last delivered one in path order and
+	// marks them as delivered. It must be called with mx held.
+	newItems := func(items map[string]*Item[T]) []*Item[T] {
+		result := make([]*Item[T], 0, len(items))
+		for path, item := range items {
+			if path > lastPath {
+				result = append(result, item)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Path < result[j].Path
+		})
+		if len(result) > 0 {
+			lastPath = result[len(result)-1].Path
+		}
+		return result
+	}
+
+	err := Subscribe(d, &Subscription[T]{
+		ID:           id,
+		PathPrefixes: []string{prefix},
+		OnUpdate: func(cs *ChangeSet[T]) error {
+			appended := make(map[string]*Item[T], len(cs.Updates))
+			for path, u := range cs.Updates {
+				value, err := u.Value.Value()
+				if err != nil {
+					return fmt.Errorf("followtail: value: %w", err)
+				}
+				appended[path] = &Item[T]{
+					Path:       u.Path,
+					DetailPath: u.DetailPath,
+					Value:      value,
+				}
+			}
+
+			mx.Lock()
+			if !initialized {
+				// hold on to these until the initial tail has been delivered
+				for path, item := range appended {
+					pending[path] = item
+				}
+				mx.Unlock()
+				return nil
+			}
+			items := newItems(appended)
+			mx.Unlock()
+			if len(items) == 0 {
+				return nil
+			}
+			return onAppend(items)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("followtail: subscribe: %w", err)
+	}
+
+	tail, err := Tail[T](d, prefix, n)
+	if err != nil {
+		Unsubscribe(d, id)
+		return fmt.Errorf("followtail: %w", err)
+	}
+	initial := make(map[string]*Item[T], len(tail))
+	for _, item := range tail {
+		initial[item.Path] = item
+	}
+	mx.Lock()
+	items := newItems(initial)
+	mx.Unlock()
+	for {
+		if len(items) > 0 {
+			err = onAppend(items)
+			if err != nil {
+				Unsubscribe(d, id)
+				return fmt.Errorf("followtail: onappend: %w", err)
+			}
+		}
+
+		// deliver whatever was appended in the meantime before handing over to the subscription
+		mx.Lock()
+		items = newItems(pending)
+		clear(pending)
+		if len(items) == 0 {
+			initialized = true
+			mx.Unlock()
+			return nil
+		}
+		mx.Unlock()
+	}
+}
@@ -0,0 +1,19 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/getlantern/pathdb/testsupport"
+)
+
+func adapt(t *testing.T) testsupport.TestingT {
+	return &testingTAdapter{t}
+}
+
+type testingTAdapter struct {
+	*testing.T
+}
+
+func (ta *testingTAdapter) Errorf(msg string) {
+	ta.T.Error(msg)
+}
@@ -1,3 +1,5 @@
+//go:build cgo
+
 package tests
 
 import (
@@ -17,9 +19,66 @@ func TestDB(t *testing.T) {
 	t.Run("TestTransactions", func(t *testing.T) {
 		testsupport.TestTransactions(adapt(t), newSQLiteImpl(t))
 	})
+	t.Run("TestCancelQuery", func(t *testing.T) {
+		testsupport.TestCancelQuery(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestReadYourWrites", func(t *testing.T) {
+		testsupport.TestReadYourWrites(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestMinisqlContext", func(t *testing.T) {
+		testsupport.TestMinisqlContext(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestTransactionStats", func(t *testing.T) {
+		testsupport.TestTransactionStats(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionStats", func(t *testing.T) {
+		testsupport.TestSubscriptionStats(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSchemaStats", func(t *testing.T) {
+		testsupport.TestSchemaStats(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDeleteFullText", func(t *testing.T) {
+		testsupport.TestDeleteFullText(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestRebuildFTS", func(t *testing.T) {
+		testsupport.TestRebuildFTS(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSnapshot", func(t *testing.T) {
+		testsupport.TestSnapshot(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestView", func(t *testing.T) {
+		testsupport.TestView(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestVacuum", func(t *testing.T) {
+		testsupport.TestVacuum(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestClose", func(t *testing.T) {
+		testsupport.TestClose(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestCloseDuringCommit", func(t *testing.T) {
+		testsupport.TestCloseDuringCommit(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestRegisterTypes", func(t *testing.T) {
+		testsupport.TestRegisterTypes(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestVerifyRegistry", func(t *testing.T) {
+		testsupport.TestVerifyRegistry(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestRegisterGlobal", func(t *testing.T) {
+		testsupport.TestRegisterGlobal(adapt(t), newSQLiteImpl(t))
+	})
 	t.Run("TestSubscriptions", func(t *testing.T) {
 		testsupport.TestSubscriptions(adapt(t), newSQLiteImpl(t))
 	})
+	t.Run("TestSubscribeRaw", func(t *testing.T) {
+		testsupport.TestSubscribeRaw(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionTypeMismatch", func(t *testing.T) {
+		testsupport.TestSubscriptionTypeMismatch(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscribeDetails", func(t *testing.T) {
+		testsupport.TestSubscribeDetails(adapt(t), newSQLiteImpl(t))
+	})
 	t.Run("TestSubscribeToInitialDetails", func(t *testing.T) {
 		testsupport.TestSubscribeToInitialDetails(adapt(t), newSQLiteImpl(t))
 	})
@@ -29,12 +88,210 @@ func TestDB(t *testing.T) {
 	t.Run("TestDetailSubscriptionModifyIndex", func(t *testing.T) {
 		testsupport.TestDetailSubscriptionModifyIndex(adapt(t), newSQLiteImpl(t))
 	})
+	t.Run("TestPutErrors", func(t *testing.T) {
+		testsupport.TestPutErrors(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPathExists", func(t *testing.T) {
+		testsupport.TestPathExists(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutExisting", func(t *testing.T) {
+		testsupport.TestPutExisting(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestCompareAndSwap", func(t *testing.T) {
+		testsupport.TestCompareAndSwap(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestValueCipher", func(t *testing.T) {
+		testsupport.TestValueCipher(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestValueCipherJoinDetails", func(t *testing.T) {
+		testsupport.TestValueCipherJoinDetails(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestIncrement", func(t *testing.T) {
+		testsupport.TestIncrement(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestEmptyValues", func(t *testing.T) {
+		testsupport.TestEmptyValues(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutIfGeneration", func(t *testing.T) {
+		testsupport.TestPutIfGeneration(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSavepoints", func(t *testing.T) {
+		testsupport.TestSavepoints(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestAfterCommit", func(t *testing.T) {
+		testsupport.TestAfterCommit(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestJSONArray", func(t *testing.T) {
+		testsupport.TestJSONArray(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDeleteExisting", func(t *testing.T) {
+		testsupport.TestDeleteExisting(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestMigrate", func(t *testing.T) {
+		testsupport.TestMigrate(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestMutateWithRetry", func(t *testing.T) {
+		testsupport.TestMutateWithRetry(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDeletePrefixExcept", func(t *testing.T) {
+		testsupport.TestDeletePrefixExcept(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDeleteMulti", func(t *testing.T) {
+		testsupport.TestDeleteMulti(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDeleteAll", func(t *testing.T) {
+		testsupport.TestDeleteAll(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionIncludePrevious", func(t *testing.T) {
+		testsupport.TestSubscriptionIncludePrevious(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionFailCommitOnError", func(t *testing.T) {
+		testsupport.TestSubscriptionFailCommitOnError(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionDeliveryOrder", func(t *testing.T) {
+		testsupport.TestSubscriptionDeliveryOrder(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionSegmentGlob", func(t *testing.T) {
+		testsupport.TestSubscriptionSegmentGlob(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestUnsubscribeAll", func(t *testing.T) {
+		testsupport.TestUnsubscribeAll(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestInvalidSchema", func(t *testing.T) {
+		testsupport.TestInvalidSchema(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestWithSchemaSubscriptions", func(t *testing.T) {
+		testsupport.TestWithSchemaSubscriptions(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionAsync", func(t *testing.T) {
+		testsupport.TestSubscriptionAsync(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionDebounce", func(t *testing.T) {
+		testsupport.TestSubscriptionDebounce(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestBarrier", func(t *testing.T) {
+		testsupport.TestBarrier(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionFilter", func(t *testing.T) {
+		testsupport.TestSubscriptionFilter(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSubscriptionMinDelta", func(t *testing.T) {
+		testsupport.TestSubscriptionMinDelta(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestImportItems", func(t *testing.T) {
+		testsupport.TestImportItems(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestTail", func(t *testing.T) {
+		testsupport.TestTail(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestFollowTailConcurrentAppend", func(t *testing.T) {
+		testsupport.TestFollowTailConcurrentAppend(adapt(t), newSQLiteImpl(t))
+	})
 	t.Run("TestList", func(t *testing.T) {
 		testsupport.TestList(adapt(t), newSQLiteImpl(t))
 	})
+	t.Run("TestGetOr", func(t *testing.T) {
+		testsupport.TestGetOr(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestGetAll", func(t *testing.T) {
+		testsupport.TestGetAll(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListMissingDetails", func(t *testing.T) {
+		testsupport.TestListMissingDetails(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestStrictDetailPaths", func(t *testing.T) {
+		testsupport.TestStrictDetailPaths(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestRawQuery", func(t *testing.T) {
+		testsupport.TestRawQuery(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListWithTotal", func(t *testing.T) {
+		testsupport.TestListWithTotal(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestDistinctDetails", func(t *testing.T) {
+		testsupport.TestDistinctDetails(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestJoinDepth", func(t *testing.T) {
+		testsupport.TestJoinDepth(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListPage", func(t *testing.T) {
+		testsupport.TestListPage(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestExportJSON", func(t *testing.T) {
+		testsupport.TestExportJSON(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestExportImport", func(t *testing.T) {
+		testsupport.TestExportImport(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestOrderByInsertion", func(t *testing.T) {
+		testsupport.TestOrderByInsertion(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListProjection", func(t *testing.T) {
+		testsupport.TestListProjection(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListMultiplePaths", func(t *testing.T) {
+		testsupport.TestListMultiplePaths(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListExclude", func(t *testing.T) {
+		testsupport.TestListExclude(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestListGlob", func(t *testing.T) {
+		testsupport.TestListGlob(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestHasAny", func(t *testing.T) {
+		testsupport.TestHasAny(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestExportCSV", func(t *testing.T) {
+		testsupport.TestExportCSV(adapt(t), newSQLiteImpl(t))
+	})
 	t.Run("TestSearch", func(t *testing.T) {
 		testsupport.TestSearch(adapt(t), newSQLiteImpl(t))
 	})
+	t.Run("TestSearchTerms", func(t *testing.T) {
+		testsupport.TestSearchTerms(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSearchSkipsSnippetsOfLargeDocuments", func(t *testing.T) {
+		testsupport.TestSearchSkipsSnippetsOfLargeDocuments(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSearchHighlightRanges", func(t *testing.T) {
+		testsupport.TestSearchHighlightRanges(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutIndexed", func(t *testing.T) {
+		testsupport.TestPutIndexed(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutAllWithFullText", func(t *testing.T) {
+		testsupport.TestPutAllWithFullText(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutBatch", func(t *testing.T) {
+		testsupport.TestPutBatch(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPutAllOrdered", func(t *testing.T) {
+		testsupport.TestPutAllOrdered(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestFullTextColumns", func(t *testing.T) {
+		testsupport.TestFullTextColumns(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestTokenizer", func(t *testing.T) {
+		testsupport.TestTokenizer(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestSearchColumnWeights", func(t *testing.T) {
+		testsupport.TestSearchColumnWeights(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestTruncateOversizedFullText", func(t *testing.T) {
+		testsupport.TestTruncateOversizedFullText(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestRejectOversizedFullText", func(t *testing.T) {
+		testsupport.TestRejectOversizedFullText(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPageSize", func(t *testing.T) {
+		testsupport.TestPageSize(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPragmas", func(t *testing.T) {
+		testsupport.TestPragmas(adapt(t), newSQLiteImpl(t))
+	})
+	t.Run("TestPathDictionary", func(t *testing.T) {
+		testsupport.TestPathDictionary(adapt(t), newSQLiteImpl(t))
+	})
 	t.Run("TestSearchChinese", func(t *testing.T) {
 		testsupport.TestSearchChinese(adapt(t), newSQLiteImpl(t))
 	})
@@ -46,15 +303,3 @@ func newSQLiteImpl(t *testing.T) minisql.DB {
 	require.NoError(t, err)
 	return &minisql.DBAdapter{DB: db}
 }
-
-func adapt(t *testing.T) testsupport.TestingT {
-	return &testingTAdapter{t}
-}
-
-type testingTAdapter struct {
-	*testing.T
-}
-
-func (ta *testingTAdapter) Errorf(msg string) {
-	ta.T.Error(msg)
-}
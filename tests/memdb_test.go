@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/getlantern/pathdb/internal/memdb"
+	"github.com/getlantern/pathdb/minisql"
+	"github.com/getlantern/pathdb/testsupport"
+)
+
+// TestMemDB runs the tests that don't depend on full text search or on SQLite specific behavior
+// (like pragmas and tokenizers) against an in-memory database (see internal/memdb), so that they
+// also run without cgo
+func TestMemDB(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(testsupport.TestingT, minisql.DB)
+	}{
+		{"TestTransactions", testsupport.TestTransactions},
+		{"TestMinisqlContext", testsupport.TestMinisqlContext},
+		{"TestTransactionStats", testsupport.TestTransactionStats},
+		{"TestSubscriptionStats", testsupport.TestSubscriptionStats},
+		{"TestSchemaStats", testsupport.TestSchemaStats},
+		{"TestDeleteFullText", testsupport.TestDeleteFullText},
+		{"TestSnapshot", testsupport.TestSnapshot},
+		{"TestView", testsupport.TestView},
+		{"TestVacuum", testsupport.TestVacuum},
+		{"TestClose", testsupport.TestClose},
+		{"TestCloseDuringCommit", testsupport.TestCloseDuringCommit},
+		{"TestRegisterTypes", testsupport.TestRegisterTypes},
+		{"TestVerifyRegistry", testsupport.TestVerifyRegistry},
+		{"TestRegisterGlobal", testsupport.TestRegisterGlobal},
+		{"TestSubscriptions", testsupport.TestSubscriptions},
+		{"TestSubscribeRaw", testsupport.TestSubscribeRaw},
+		{"TestSubscriptionTypeMismatch", testsupport.TestSubscriptionTypeMismatch},
+		{"TestSubscribeDetails", testsupport.TestSubscribeDetails},
+		{"TestSubscribeToInitialDetails", testsupport.TestSubscribeToInitialDetails},
+		{"TestDetailSubscriptionModifyDetails", testsupport.TestDetailSubscriptionModifyDetails},
+		{"TestDetailSubscriptionModifyIndex", testsupport.TestDetailSubscriptionModifyIndex},
+		{"TestCompareAndSwap", testsupport.TestCompareAndSwap},
+		{"TestValueCipherJoinDetails", testsupport.TestValueCipherJoinDetails},
+		{"TestIncrement", testsupport.TestIncrement},
+		{"TestEmptyValues", testsupport.TestEmptyValues},
+		{"TestPutIfGeneration", testsupport.TestPutIfGeneration},
+		{"TestAfterCommit", testsupport.TestAfterCommit},
+		{"TestJSONArray", testsupport.TestJSONArray},
+		{"TestDeleteExisting", testsupport.TestDeleteExisting},
+		{"TestMigrate", testsupport.TestMigrate},
+		{"TestMutateWithRetry", testsupport.TestMutateWithRetry},
+		{"TestDeleteAll", testsupport.TestDeleteAll},
+		{"TestSubscriptionIncludePrevious", testsupport.TestSubscriptionIncludePrevious},
+		{"TestSubscriptionFailCommitOnError", testsupport.TestSubscriptionFailCommitOnError},
+		{"TestSubscriptionDeliveryOrder", testsupport.TestSubscriptionDeliveryOrder},
+		{"TestSubscriptionSegmentGlob", testsupport.TestSubscriptionSegmentGlob},
+		{"TestUnsubscribeAll", testsupport.TestUnsubscribeAll},
+		{"TestInvalidSchema", testsupport.TestInvalidSchema},
+		{"TestWithSchemaSubscriptions", testsupport.TestWithSchemaSubscriptions},
+		{"TestSubscriptionAsync", testsupport.TestSubscriptionAsync},
+		{"TestSubscriptionDebounce", testsupport.TestSubscriptionDebounce},
+		{"TestBarrier", testsupport.TestBarrier},
+		{"TestSubscriptionFilter", testsupport.TestSubscriptionFilter},
+		{"TestSubscriptionMinDelta", testsupport.TestSubscriptionMinDelta},
+		{"TestImportItems", testsupport.TestImportItems},
+		{"TestTail", testsupport.TestTail},
+		{"TestFollowTailConcurrentAppend", testsupport.TestFollowTailConcurrentAppend},
+		{"TestList", testsupport.TestList},
+		{"TestGetOr", testsupport.TestGetOr},
+		{"TestGetAll", testsupport.TestGetAll},
+		{"TestListMissingDetails", testsupport.TestListMissingDetails},
+		{"TestStrictDetailPaths", testsupport.TestStrictDetailPaths},
+		{"TestListWithTotal", testsupport.TestListWithTotal},
+		{"TestDistinctDetails", testsupport.TestDistinctDetails},
+		{"TestJoinDepth", testsupport.TestJoinDepth},
+		{"TestListPage", testsupport.TestListPage},
+		{"TestExportJSON", testsupport.TestExportJSON},
+		{"TestExportImport", testsupport.TestExportImport},
+		{"TestOrderByInsertion", testsupport.TestOrderByInsertion},
+		{"TestListProjection", testsupport.TestListProjection},
+		{"TestListExclude", testsupport.TestListExclude},
+		{"TestListGlob", testsupport.TestListGlob},
+		{"TestHasAny", testsupport.TestHasAny},
+		{"TestExportCSV", testsupport.TestExportCSV},
+		{"TestPutBatch", testsupport.TestPutBatch},
+		{"TestRejectOversizedFullText", testsupport.TestRejectOversizedFullText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(adapt(t), memdb.New())
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package testsupport
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/pathdb/minisql"
+)
+
+// ErrInjectedFault is the error returned by statements that a FaultyDB fails, unless the fault
+// specifies a different error
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultyDB wraps a minisql.DB and fails specific statements, which makes it possible to test how
+// errors from the database are handled. Statements run both directly on the DB and within its
+// transactions count towards faults. The optional interfaces of the wrapped DB (like
+// minisql.ResultQueryable) are hidden, so callers use their fallbacks for DBs without them.
+type FaultyDB struct {
+	minisql.DB
+	mx     sync.Mutex
+	faults []*fault
+}
+
+type fault struct {
+	sql     string
+	n       int
+	err     error
+	matches int
+}
+
+// NewFaultyDB wraps the given DB without injecting any faults yet
+func NewFaultyDB(db minisql.DB) *FaultyDB {
+	return &FaultyDB{DB: db}
+}
+
+// FailNth makes the nth statement from now on (starting at 1) whose SQL contains sql fail with
+// err, or with ErrInjectedFault if err is nil. If n is 0, all such statements fail until
+// ClearFaults is called. Statements that match several faults fail with the error of the fault
+// that was added first.
+func (db *FaultyDB) FailNth(sql string, n int, err error) {
+	if err == nil {
+		err = ErrInjectedFault
+	}
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	db.faults = append(db.faults, &fault{sql: sql, n: n, err: err})
+}
+
+// ClearFaults removes all pending faults
+func (db *FaultyDB) ClearFaults() {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	db.faults = nil
+}
+
+// check returns the error with which the given statement should fail, if any. Faults that have
+// fired are removed.
+func (db *FaultyDB) check(query string) error {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	var result error
+	remaining := db.faults[:0]
+	for _, f := range db.faults {
+		if !strings.Contains(query, f.sql) {
+			remaining = append(remaining, f)
+			continue
+		}
+		f.matches++
+		if f.n == 0 || f.matches == f.n {
+			if result == nil {
+				result = f.err
+			}
+			if f.n != 0 {
+				// fired, don't keep it around
+				continue
+			}
+		}
+		remaining = append(remaining, f)
+	}
+	db.faults = remaining
+	return result
+}
+
+func (db *FaultyDB) Exec(query string, args minisql.Values) error {
+	err := db.check(query)
+	if err != nil {
+		return err
+	}
+	return db.DB.Exec(query, args)
+}
+
+func (db *FaultyDB) Query(query string, args minisql.Values) (minisql.Rows, error) {
+	err := db.check(query)
+	if err != nil {
+		return nil, err
+	}
+	return db.DB.Query(query, args)
+}
+
+func (db *FaultyDB) Begin() (minisql.Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyTx{Tx: tx, db: db}, nil
+}
+
+type faultyTx struct {
+	minisql.Tx
+	db *FaultyDB
+}
+
+func (tx *faultyTx) Exec(query string, args minisql.Values) error {
+	err := tx.db.check(query)
+	if err != nil {
+		return err
+	}
+	return tx.Tx.Exec(query, args)
+}
+
+func (tx *faultyTx) Query(query string, args minisql.Values) (minisql.Rows, error) {
+	err := tx.db.check(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Tx.Query(query, args)
+}
@@ -1,11 +1,20 @@
 package testsupport
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -42,6 +51,23 @@ func TestTransactions(t TestingT, mdb minisql.DB) {
 		require.Equal(adapt(t), "hello world", get[string](t, db, "path"))
 		require.Equal(adapt(t), pathdb.UnloadedRaw(db, "hello world"), rget[string](t, db, "path"))
 		require.Equal(adapt(t), pathdb.UnloadedRaw(db, "hello other world"), rget[string](t, db, "path2"))
+		serialized, err := pathdb.Serialize(db, "hello world")
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), rget[string](t, db, "path").Bytes, serialized, "serialized value should match stored value")
+		deserialized, err := pathdb.Deserialize(db, serialized)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), "hello world", deserialized)
+		multi, err := pathdb.GetMulti[string](db, []string{"path", "path2", "path3"})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{"path": "hello world", "path2": "hello other world"}, multi, "missing paths should be absent from GetMulti")
+		batch, err := pathdb.GetBatch[string](db, []string{"path3", "path2", "path4", "path"})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			nil,
+			{"path2", "", "hello other world"},
+			nil,
+			{"path", "", "hello world"},
+		}, batch, "GetBatch should preserve order and return nil for missing paths")
 
 		// delete and rollback something
 		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
@@ -60,7 +86,211 @@ func TestTransactions(t TestingT, mdb minisql.DB) {
 		})
 		require.ErrorIs(adapt(t), err, errTest)
 		require.Equal(adapt(t), "hello world", get[string](t, db, "path"), "delete should have been rolled back")
+
+		// delete with a context that gets cancelled before commit
+		ctx, cancel := context.WithCancel(context.Background())
+		err = pathdb.MutateContext(ctx, db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Delete(tx, "path"))
+			cancel()
+			return nil
+		})
+		require.ErrorIs(adapt(t), err, context.Canceled)
+		require.Equal(adapt(t), "hello world", get[string](t, db, "path"), "delete should have been rolled back when context was cancelled")
+
+		// try to mutate with an already cancelled context
+		err = pathdb.MutateContext(ctx, db, func(tx pathdb.TX) error {
+			return nil
+		})
+		require.ErrorIs(adapt(t), err, context.Canceled)
+	})
+}
+
+func TestCancelQuery(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		tx, err := db.BeginContext(ctx)
+		require.NoError(adapt(t), err)
+
+		// counts to a billion unless interrupted
+		rows, err := pathdb.RawQuery(tx, "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c LIMIT 1000000000) SELECT COUNT(*) FROM c")
+		require.NoError(adapt(t), err)
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		require.False(adapt(t), rows.Next(), "query should have been interrupted")
+		require.Less(adapt(t), time.Since(start), 10*time.Second)
+		rows.Close()
+
+		require.Error(adapt(t), pathdb.Put(tx, "/a", "a", ""), "the transaction should have been rolled back")
+		require.ErrorIs(adapt(t), tx.Commit(), context.Canceled)
+		require.Nil(adapt(t), rget[string](t, db, "/a"))
+	})
+}
+
+type jsonObject struct {
+	A string
+	B int
+}
+
+func TestReadYourWrites(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/committed", "committed", "committed")
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "hello", "hello"))
+			require.Equal(adapt(t), "hello", get[string](t, tx, "/a"))
+			require.EqualValues(adapt(t), []string{"/a", "/committed"}, listPaths(t, tx, &pathdb.QueryParams{Path: "%"}))
+			require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, tx, "hello"), "new full text should be searchable")
+
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "goodbye", "goodbye"))
+			require.Equal(adapt(t), "goodbye", get[string](t, tx, "/a"))
+			require.Empty(adapt(t), searchPaths(t, tx, "hello"), "replaced full text should not be searchable")
+			require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, tx, "goodbye"), "updated full text should be searchable")
+
+			require.NoError(adapt(t), pathdb.Put(tx, "/committed", "changed", "changed"))
+			require.Empty(adapt(t), searchPaths(t, tx, "committed"))
+			require.EqualValues(adapt(t), []string{"/committed"}, searchPaths(t, tx, "changed"))
+
+			require.NoError(adapt(t), pathdb.Delete(tx, "/a"))
+			require.Nil(adapt(t), rget[string](t, tx, "/a"))
+			require.EqualValues(adapt(t), []string{"/committed"}, listPaths(t, tx, &pathdb.QueryParams{Path: "%"}))
+			require.Empty(adapt(t), searchPaths(t, tx, "goodbye"), "deleted full text should not be searchable")
+
+			// none of this is visible outside of the transaction
+			require.Equal(adapt(t), "committed", get[string](t, db, "/committed"))
+			require.EqualValues(adapt(t), []string{"/committed"}, searchPaths(t, db, "committed"))
+			return errTest
+		})
+		require.ErrorIs(adapt(t), err, errTest)
+
+		require.Equal(adapt(t), "committed", get[string](t, db, "/committed"))
+		require.EqualValues(adapt(t), []string{"/committed"}, listPaths(t, db, &pathdb.QueryParams{Path: "%"}))
+		require.EqualValues(adapt(t), []string{"/committed"}, searchPaths(t, db, "committed"), "rolled back full text changes should be undone")
+		require.Empty(adapt(t), searchPaths(t, db, "changed"))
+	})
+}
+
+func TestMinisqlContext(t TestingT, mdb minisql.DB) {
+	core := minisql.Wrap(mdb)
+	defer core.Close()
+	require.NoError(adapt(t), core.ExecContext(context.Background(), "CREATE TABLE things (id INTEGER)"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(adapt(t), core.ExecContext(ctx, "INSERT INTO things(id) VALUES(?)", 1), context.Canceled)
+	_, err := core.QueryContext(ctx, "SELECT id FROM things")
+	require.ErrorIs(adapt(t), err, context.Canceled)
+	_, err = core.BeginContext(ctx)
+	require.ErrorIs(adapt(t), err, context.Canceled)
+
+	rows, err := core.QueryContext(context.Background(), "SELECT COUNT(*) FROM things")
+	require.NoError(adapt(t), err)
+	defer rows.Close()
+	require.True(adapt(t), rows.Next())
+	var count int
+	require.NoError(adapt(t), rows.Scan(&count))
+	require.Zero(adapt(t), count, "nothing should have been inserted with a cancelled context")
+}
+
+func TestRegisterTypes(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		pathdb.RegisterProtobufType(db, 1, &pathdb.PBUFObject{})
+		pathdb.RegisterJSONType(db, 1, &jsonObject{})
+
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/pbuf", &pathdb.PBUFObject{A: "a", B: 5}, ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/json", &jsonObject{A: "a", B: 5}, ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		pbuf := get[*pathdb.PBUFObject](t, db, "/pbuf")
+		require.Equal(adapt(t), "a", pbuf.A)
+		require.EqualValues(adapt(t), 5, pbuf.B)
+		require.EqualValues(adapt(t), &jsonObject{A: "a", B: 5}, get[*jsonObject](t, db, "/json"))
+	})
+}
+
+type otherJSONObject struct {
+	C string
+}
+
+func TestVerifyRegistry(t TestingT, mdb minisql.DB) {
+	original, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+	defer original.Close()
+	pathdb.RegisterProtobufType(original, 1, &pathdb.PBUFObject{})
+	pathdb.RegisterJSONType(original, 1, &jsonObject{})
+	pathdb.RegisterJSONType(original, 2, &otherJSONObject{})
+	err = pathdb.Mutate(original, func(tx pathdb.TX) error {
+		require.NoError(adapt(t), pathdb.Put(tx, "/typed/pbuf", &pathdb.PBUFObject{A: "a", B: 5}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/typed/json1", &jsonObject{A: "a", B: 5}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/typed/json2", &jsonObject{A: "b", B: 6}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/typed/other", &otherJSONObject{C: "c"}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/untyped/other", &otherJSONObject{C: "c"}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/typed/string", "plain", ""))
+		return nil
+	})
+	require.NoError(adapt(t), err)
+
+	mismatches, err := pathdb.VerifyRegistry(original, "/")
+	require.NoError(adapt(t), err)
+	require.Empty(adapt(t), mismatches, "original registry should match")
+
+	// reopen with JSON type 1 reassigned to a different type and JSON type 2 missing
+	upgraded, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+	defer upgraded.Close()
+	pathdb.RegisterProtobufType(upgraded, 1, &pathdb.PBUFObject{})
+	pathdb.RegisterJSONType(upgraded, 1, &otherJSONObject{})
+
+	mismatches, err = pathdb.VerifyRegistry(upgraded, "/typed/")
+	require.NoError(adapt(t), err)
+	require.Len(adapt(t), mismatches, 2)
+	require.EqualValues(adapt(t), pathdb.JSON, mismatches[0].Kind)
+	require.EqualValues(adapt(t), 1, mismatches[0].TypeID)
+	require.Equal(adapt(t), pathdb.MismatchSuspiciousType, mismatches[0].Reason)
+	require.Equal(adapt(t), 2, mismatches[0].Count)
+	require.Equal(adapt(t), "/typed/json1", mismatches[0].ExamplePath)
+	require.Error(adapt(t), mismatches[0].Err)
+	require.EqualValues(adapt(t), pathdb.JSON, mismatches[1].Kind)
+	require.EqualValues(adapt(t), 2, mismatches[1].TypeID)
+	require.Equal(adapt(t), pathdb.MismatchUnregistered, mismatches[1].Reason)
+	require.Equal(adapt(t), 1, mismatches[1].Count, "only paths under prefix should be checked")
+	require.Equal(adapt(t), "/typed/other", mismatches[1].ExamplePath)
+}
+
+type globalJSONObject struct {
+	A string
+}
+
+func TestRegisterGlobal(t TestingT, mdb minisql.DB) {
+	pathdb.RegisterGlobal(100, &globalJSONObject{})
+
+	db1, err := pathdb.NewDB(mdb, "test1")
+	require.NoError(adapt(t), err)
+	db2, err := pathdb.NewDB(mdb, "test2")
+	require.NoError(adapt(t), err)
+	defer db2.Close()
+	defer db1.Close()
+
+	for _, db := range []pathdb.DB{db1, db2} {
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/global", &globalJSONObject{A: "a"}, "")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), &globalJSONObject{A: "a"}, get[*globalJSONObject](t, db, "/global"))
+	}
+
+	db3, err := pathdb.NewDBWithOptions(mdb, "test3", &pathdb.Options{IgnoreGlobalTypes: true})
+	require.NoError(adapt(t), err)
+	defer db3.Close()
+	err = pathdb.Mutate(db3, func(tx pathdb.TX) error {
+		return pathdb.Put(tx, "/global", &globalJSONObject{A: "a"}, "")
 	})
+	require.ErrorIs(adapt(t), err, pathdb.ErrUnregisteredJSONType, "db that ignores global types should not know about globally registered type")
 }
 
 func TestSubscriptions(t TestingT, mdb minisql.DB) {
@@ -154,6 +384,201 @@ func TestSubscribeToInitialDetails(t TestingT, mdb minisql.DB) {
 	)
 }
 
+func TestSubscribeRaw(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/mixed/initial", int64(1), "")
+		})
+		require.NoError(adapt(t), err)
+
+		values := make(map[string]interface{})
+		types := make(map[string]byte)
+		err = pathdb.SubscribeRaw(db, &pathdb.RawSubscription{
+			ID:             "raw",
+			PathPrefixes:   []string{"/mixed/"},
+			ReceiveInitial: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[any]) error {
+				for path, u := range cs.Updates {
+					value, err := u.Value.Value()
+					if err != nil {
+						return err
+					}
+					values[path] = value
+					types[path], err = u.Value.Type()
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.Put(tx, "/mixed/string", "hello", "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/mixed/int", int64(2), "")
+		})
+		require.NoError(adapt(t), err)
+		require.NoError(adapt(t), pathdb.Barrier(db))
+
+		require.EqualValues(adapt(t), map[string]interface{}{
+			"/mixed/initial": int64(1),
+			"/mixed/string":  "hello",
+			"/mixed/int":     int64(2),
+		}, values)
+		require.Equal(adapt(t), byte(pathdb.TEXT), types["/mixed/string"])
+		require.NotEqual(adapt(t), byte(pathdb.TEXT), types["/mixed/int"])
+	})
+}
+
+func TestSubscriptionTypeMismatch(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.Put(tx, "/values/initial", int64(1), "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/index/bad", int64(2), "")
+		})
+		require.NoError(adapt(t), err)
+
+		errs := make(map[string]error)
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:             "mismatch",
+			PathPrefixes:   []string{"/values/"},
+			ReceiveInitial: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				for path, u := range cs.Updates {
+					_, errs[path] = u.Value.Value()
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		var detailUpdates int
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "details",
+			PathPrefixes: []string{"/index/"},
+			JoinDetails:  true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				detailUpdates += len(cs.Updates)
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		require.NotPanics(adapt(t), func() {
+			err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+				err := pathdb.Put(tx, "/values/new", int64(3), "")
+				if err != nil {
+					return err
+				}
+				err = pathdb.Put(tx, "/values/string", "hello", "")
+				if err != nil {
+					return err
+				}
+				return pathdb.Put(tx, "/index/bad", int64(4), "")
+			})
+		})
+		require.NoError(adapt(t), err)
+		require.NoError(adapt(t), pathdb.Barrier(db))
+
+		require.ErrorIs(adapt(t), errs["/values/initial"], pathdb.ErrTypeMismatch)
+		require.ErrorIs(adapt(t), errs["/values/new"], pathdb.ErrTypeMismatch)
+		require.NoError(adapt(t), errs["/values/string"])
+		require.Zero(adapt(t), detailUpdates, "index entries that aren't detail paths should be skipped")
+	})
+}
+
+func TestSubscribeDetails(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.Put(tx, "/detail/1", int64(1), "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/index/1", "/detail/1", "")
+		})
+		require.NoError(adapt(t), err)
+
+		var changeSets, otherChangeSets []*pathdb.DetailChangeSet[string, int64]
+		err = pathdb.SubscribeDetails(db, &pathdb.DetailSubscription[string, int64]{
+			ID:             "details",
+			PathPrefixes:   []string{"/index/"},
+			ReceiveInitial: true,
+			OnUpdate: func(cs *pathdb.DetailChangeSet[string, int64]) error {
+				changeSets = append(changeSets, cs)
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+		// a second subscriber to the same index entries shouldn't be affected by the first
+		err = pathdb.SubscribeDetails(db, &pathdb.DetailSubscription[string, int64]{
+			ID:             "other",
+			PathPrefixes:   []string{"/index/"},
+			ReceiveInitial: true,
+			OnUpdate: func(cs *pathdb.DetailChangeSet[string, int64]) error {
+				otherChangeSets = append(otherChangeSets, cs)
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.Put(tx, "/detail/2", int64(2), "")
+			if err != nil {
+				return err
+			}
+			err = pathdb.Put(tx, "/index/2", "/detail/2", "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/detail/1", int64(11), "")
+		})
+		require.NoError(adapt(t), err)
+		stored, err := db.GetMulti([]string{"/index/1", "/index/2"})
+		require.NoError(adapt(t), err)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Delete(tx, "/index/2")
+		})
+		require.NoError(adapt(t), err)
+		require.NoError(adapt(t), pathdb.Barrier(db))
+
+		type detail struct {
+			index  string
+			detail int64
+		}
+		values := func(cs *pathdb.DetailChangeSet[string, int64]) map[string]detail {
+			result := make(map[string]detail)
+			for path, u := range cs.Updates {
+				require.Equal(adapt(t), path, u.Path)
+				index, err := u.Value.Value()
+				require.NoError(adapt(t), err)
+				require.Equal(adapt(t), u.DetailPath, index, "index value should be the detail path")
+				require.Equal(adapt(t), stored[path], u.Value.Bytes, "index value should be passed through as stored")
+				value, err := u.Detail.Value()
+				require.NoError(adapt(t), err)
+				result[path] = detail{index, value}
+			}
+			return result
+		}
+
+		require.Len(adapt(t), changeSets, 3)
+		require.EqualValues(adapt(t), map[string]detail{"/index/1": {"/detail/1", 1}}, values(changeSets[0]), "initial values")
+		require.EqualValues(adapt(t), map[string]detail{"/index/1": {"/detail/1", 11}, "/index/2": {"/detail/2", 2}}, values(changeSets[1]))
+		require.Empty(adapt(t), changeSets[2].Updates)
+		require.EqualValues(adapt(t), map[string]bool{"/index/2": true}, changeSets[2].Deletes)
+		require.Len(adapt(t), otherChangeSets, 3)
+		for i, cs := range otherChangeSets {
+			require.EqualValues(adapt(t), values(changeSets[i]), values(cs))
+		}
+	})
+}
+
 func TestDetailSubscriptionModifyDetails(t TestingT, mdb minisql.DB) {
 	TestSubscription(
 		t,
@@ -238,108 +663,2418 @@ func TestSubscription(
 	})
 }
 
-func TestList(t TestingT, mdb minisql.DB) {
-	withDB(t, mdb, func(db pathdb.DB) {
+func TestPutErrors(t TestingT, mdb minisql.DB) {
+	faulty := NewFaultyDB(mdb)
+	withDB(t, faulty, func(db pathdb.DB) {
 		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
-			return pathdb.PutAll(tx, map[string]string{
-				"/contacts/32af234asdf324":                         "That Person",
-				"/contacts/32af234asdf324/messages_by_timestamp/1": "/messages/c",
-				"/contacts/32af234asdf324/messages_by_timestamp/2": "/messages/a",
-				"/contacts/32af234asdf324/messages_by_timestamp/3": "/messages/b",
-				"/contacts/32af234asdf324/messages_by_timestamp/4": "/messages/e", // this one doesn't exist
-				"/messages/c": "Message C",
-				"/messages/d": "Message D", // this one isn't referenced by messages_by_timestamp
-				"/messages/a": "Message A",
-				"/messages/b": "Message B",
-			})
+			return pathdb.Put(tx, "/existing", "existing", "existing")
 		})
 		require.NoError(adapt(t), err)
 
-		require.EqualValues(adapt(t), "That Person", get[string](t, db, "/contacts/32af234asdf324"))
-
-		require.EqualValues(adapt(t), []*pathdb.Item[string]{
-			{"/messages/a", "", "Message A"},
-			{"/messages/b", "", "Message B"},
-			{"/messages/c", "", "Message C"},
-			{"/messages/d", "", "Message D"},
-		}, list[string](t, db, &pathdb.QueryParams{Path: "/messages/%"}),
-			"items should be ordered ascending by path",
-		)
-
-		require.EqualValues(adapt(t), []*pathdb.Item[string]{
-			{"/messages/d", "", "Message D"},
-			{"/messages/c", "", "Message C"},
-			{"/messages/b", "", "Message B"},
-			{"/messages/a", "", "Message A"},
-		}, list[string](t, db, &pathdb.QueryParams{Path: "/messages/%", ReverseSort: true}),
-			"items should be ordered descending by path",
-		)
-
-		require.EqualValues(adapt(t), []*pathdb.Item[*pathdb.Raw[string]]{
-			{"/messages/a", "", pathdb.UnloadedRaw(db, "Message A")},
-			{"/messages/b", "", pathdb.UnloadedRaw(db, "Message B")},
-			{"/messages/c", "", pathdb.UnloadedRaw(db, "Message C")},
-			{"/messages/d", "", pathdb.UnloadedRaw(db, "Message D")},
-		}, rlist[string](t, db, &pathdb.QueryParams{Path: "/messages/%"}),
-			"should be able to retrieve raw items",
-		)
-
-		require.EqualValues(adapt(t), []*pathdb.Item[string]{
-			{"/contacts/32af234asdf324/messages_by_timestamp/3", "/messages/b", "Message B"},
-			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
-			{"/contacts/32af234asdf324/messages_by_timestamp/1", "/messages/c", "Message C"},
-		}, list[string](t, db, &pathdb.QueryParams{
-			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
-			Start:       0,
-			Count:       10,
-			JoinDetails: true,
-			ReverseSort: true,
-		}),
-			"wildcard detail query should return the right items",
-		)
-
-		require.EqualValues(adapt(t), []*pathdb.Item[string]{
-			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
-		}, list[string](t, db, &pathdb.QueryParams{
-			Path:        "/contacts/32af234asdf324/messages_by_timestamp/2",
-			Start:       0,
-			Count:       10,
-			JoinDetails: true,
-			ReverseSort: true,
-		}),
-			"specific detail query should return the right items",
-		)
-
-		require.EqualValues(adapt(t), []*pathdb.Item[string]{
-			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
-		}, list[string](t, db, &pathdb.QueryParams{
-			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
-			Start:       1,
-			Count:       1,
-			JoinDetails: true,
-		}),
-			"detail query respects start and count",
-		)
+		for _, tc := range []struct {
+			sql      string
+			path     string
+			fullText string
+			expected string
+		}{
+			{"INSERT INTO test_data(path, value)", "/new", "", "put: insert"},
+			{"INSERT INTO test_counters(id, value) VALUES(0, 0)", "/new", "text", "put: increment sequence"},
+			{"SELECT value FROM test_counters", "/new", "text", "put: query sequence value"},
+			{"INSERT INTO test_data(path, value, rowid)", "/new", "text", "put: insert indexed value"},
+			{"INSERT INTO test_fts2", "/new", "text", "put: insert into fts index"},
+			{"UPDATE test_fts2", "/existing", "updated", "put: update fts index"},
+		} {
+			faulty.FailNth(tc.sql, 1, nil)
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, tc.path, "updated", tc.fullText)
+			})
+			require.ErrorIs(adapt(t), err, ErrInjectedFault, tc.expected)
+			require.Contains(adapt(t), err.Error(), tc.expected)
+		}
+		faulty.ClearFaults()
 
-		require.EqualValues(adapt(t), []string{
-			"/messages/b",
-		}, listPaths(t, db, &pathdb.QueryParams{
-			Path:  "/messages/%",
-			Start: 1,
-			Count: 1,
-		}),
-			"path query respects start and count",
-		)
+		require.Nil(adapt(t), rget[string](t, db, "/new"), "failed puts should be rolled back")
+		require.Equal(adapt(t), "existing", get[string](t, db, "/existing"), "failed puts should be rolled back")
+		require.EqualValues(adapt(t), []string{"/existing"}, searchPaths(t, db, "existing"))
 	})
 }
 
-func TestSearch(t TestingT, mdb minisql.DB) {
+func TestPutExisting(t TestingT, mdb minisql.DB) {
 	withDB(t, mdb, func(db pathdb.DB) {
+		var updated bool
 		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/c", "Message C blah blah", "Message C blah blah"))
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/d", "Message D blah blah blah", "Message D blah blah blah"))
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A blah", "Message A blah"))
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/b", "Message B", "Message B"))
+			var err error
+			updated, err = pathdb.PutExisting(tx, "/a", "new", "new")
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.False(adapt(t), updated, "nothing should be put at a new path")
+		require.Nil(adapt(t), rget[string](t, db, "/a"))
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/a", "old", "old")
+		})
+		require.NoError(adapt(t), err)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			var err error
+			updated, err = pathdb.PutExisting(tx, "/a", "updated", "updated")
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.True(adapt(t), updated)
+		require.Equal(adapt(t), "updated", get[string](t, db, "/a"))
+		require.Empty(adapt(t), searchPaths(t, db, "old"), "old full text should be replaced")
+		require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, db, "updated"))
+	})
+}
+
+func TestPathExists(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.Put(tx, "/plain", "plain", "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/text", "text", "text")
+		})
+		require.NoError(adapt(t), err)
+
+		for _, fullText := range []string{"", "other text"} {
+			path := "/plain"
+			if fullText != "" {
+				path = "/text"
+			}
+			err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return tx.Put(path, "other", nil, fullText, false)
+			})
+			require.ErrorIs(adapt(t), err, pathdb.ErrPathExists)
+
+			var didPut bool
+			err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+				var err error
+				didPut, err = pathdb.PutIfAbsent(tx, path, "other", fullText)
+				return err
+			})
+			require.NoError(adapt(t), err)
+			require.False(adapt(t), didPut)
+		}
+
+		require.Equal(adapt(t), "plain", get[string](t, db, "/plain"))
+		require.Equal(adapt(t), "text", get[string](t, db, "/text"))
+		require.Empty(adapt(t), searchPaths(t, db, "other"), "full text of rejected put should not be indexed")
+	})
+}
+
+func TestCompareAndSwap(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		cas := func(expected, new int64) bool {
+			var swapped bool
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				var err error
+				swapped, err = pathdb.CompareAndSwap(tx, "/counter", expected, new, "")
+				return err
+			})
+			require.NoError(adapt(t), err)
+			return swapped
+		}
+
+		require.False(adapt(t), cas(0, 1), "nothing should be swapped at a new path")
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/counter", int64(0), "")
+		})
+		require.NoError(adapt(t), err)
+
+		require.True(adapt(t), cas(0, 1))
+		require.True(adapt(t), cas(1, 2))
+		require.False(adapt(t), cas(0, 5), "stale expectation should fail")
+		require.False(adapt(t), cas(1, 5), "stale expectation should fail")
+		require.EqualValues(adapt(t), 2, get[int64](t, db, "/counter"))
+		gen, err := pathdb.Generation(db, "/counter")
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 3, gen, "only successful swaps should put")
+	})
+}
+
+func TestValueCipher(t TestingT, mdb minisql.DB) {
+	withDBOptions(t, mdb, &pathdb.Options{ValueCipher: &xorCipher{key: 0x5a}}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/secrets/a", "top secret", "findme")
+		})
+		require.NoError(adapt(t), err)
+
+		stored, err := db.Get("/secrets/a")
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), pathdb.ENCRYPTED, stored[0])
+		require.NotContains(adapt(t), string(stored), "top secret", "value should be stored encrypted")
+
+		require.Equal(adapt(t), "top secret", get[string](t, db, "/secrets/a"))
+		require.EqualValues(adapt(t), []string{"/secrets/a"}, listPaths(t, db, &pathdb.QueryParams{Path: "/secrets/%"}), "paths should remain queryable")
+		require.EqualValues(adapt(t), []string{"/secrets/a"}, searchPaths(t, db, "findme"), "full text should remain searchable")
+
+		var swapped bool
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			var err error
+			swapped, err = pathdb.CompareAndSwap(tx, "/secrets/a", "top secret", "new secret", "")
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.True(adapt(t), swapped, "encrypted values should compare by their plaintext")
+		require.Equal(adapt(t), "new secret", get[string](t, db, "/secrets/a"))
+
+		stored, err = db.Get("/secrets/a")
+		require.NoError(adapt(t), err)
+		other, err := pathdb.NewDB(mdb, "other")
+		require.NoError(adapt(t), err)
+		defer other.Close()
+		_, err = pathdb.Deserialize(other, stored)
+		require.ErrorIs(adapt(t), err, pathdb.ErrNoValueCipher, "encrypted values shouldn't be readable without a cipher")
+	})
+}
+
+func TestValueCipherJoinDetails(t TestingT, mdb minisql.DB) {
+	withDBOptions(t, mdb, &pathdb.Options{ValueCipher: &xorCipher{key: 0x5a}}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/index/1":    "/messages/1",
+				"/messages/1": "one",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		// index entries are encrypted, so their detail paths can't be joined in SQL
+		for _, query := range []*pathdb.QueryParams{
+			{Path: "/index/%", JoinDetails: true},
+			{Path: "/index/%", JoinDetails: true, StrictDetailPaths: true},
+			{Path: "/index/%", JoinDetails: true, DistinctDetails: true},
+			{Path: "/index/%", JoinDetails: true, JoinDepth: 2},
+		} {
+			_, err = pathdb.List[string](db, query)
+			require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+			_, err = db.Count(query)
+			require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+		}
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true}, &pathdb.SearchParams{Search: "one"})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "details",
+			PathPrefixes: []string{"/index/"},
+			JoinDetails:  true,
+			OnUpdate:     func(cs *pathdb.ChangeSet[string]) error { return nil },
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSubscription)
+		err = pathdb.SubscribeDetails(db, &pathdb.DetailSubscription[string, string]{
+			ID:           "details",
+			PathPrefixes: []string{"/index/"},
+			OnUpdate:     func(cs *pathdb.DetailChangeSet[string, string]) error { return nil },
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSubscription)
+
+		// without joining details, index entries are just encrypted values
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{Path: "/index/1", Value: "/messages/1"},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "/index/%"}))
+	})
+}
+
+// xorCipher is a trivial pathdb.ValueCipher that, like real ciphers, encrypts the same plaintext
+// differently every time by including a random nonce
+type xorCipher struct {
+	key byte
+}
+
+func (c *xorCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := byte(rand.Intn(255))
+	if nonce >= c.key {
+		// skip the nonce that would cancel out the key
+		nonce++
+	}
+	result := make([]byte, 1+len(plaintext))
+	result[0] = nonce
+	for i, b := range plaintext {
+		result[i+1] = b ^ c.key ^ nonce
+	}
+	return result, nil
+}
+
+func (c *xorCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, errors.New("missing nonce")
+	}
+	nonce := ciphertext[0]
+	result := make([]byte, len(ciphertext)-1)
+	for i, b := range ciphertext[1:] {
+		result[i] = b ^ c.key ^ nonce
+	}
+	return result, nil
+}
+
+func TestIncrement(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		increment := func(path string, delta int64) (int64, error) {
+			var result int64
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				var err error
+				result, err = pathdb.Increment(tx, path, delta)
+				return err
+			})
+			return result, err
+		}
+
+		result, err := increment("/counter", 5)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 5, result, "missing value should count as 0")
+		result, err = increment("/counter", -7)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), -2, result)
+		require.EqualValues(adapt(t), -2, get[int64](t, db, "/counter"))
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/small", int16(3), ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/max", int64(math.MaxInt64), ""))
+			return pathdb.Put(tx, "/text", "3", "")
+		})
+		require.NoError(adapt(t), err)
+		result, err = increment("/small", 1)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 4, result, "smaller integer types should be incremented too")
+
+		_, err = increment("/max", 1)
+		require.ErrorIs(adapt(t), err, pathdb.ErrIntegerOverflow)
+		require.EqualValues(adapt(t), int64(math.MaxInt64), get[int64](t, db, "/max"), "value shouldn't change on overflow")
+		result, err = increment("/max", -1)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), int64(math.MaxInt64-1), result)
+		_, err = increment("/counter", math.MinInt64)
+		require.ErrorIs(adapt(t), err, pathdb.ErrIntegerOverflow)
+
+		_, err = increment("/text", 1)
+		require.ErrorIs(adapt(t), err, pathdb.ErrNotAnInteger)
+	})
+}
+
+func TestEmptyValues(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/empty/string", "", ""))
+			return pathdb.Put(tx, "/empty/bytes", []byte{}, "")
+		})
+		require.NoError(adapt(t), err)
+
+		require.Nil(adapt(t), rget[any](t, db, "/empty/missing"))
+		emptyString := rget[string](t, db, "/empty/string")
+		require.NotNil(adapt(t), emptyString, "empty string should be found")
+		value, err := emptyString.Value()
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), "", value)
+		emptyBytes := rget[[]byte](t, db, "/empty/bytes")
+		require.NotNil(adapt(t), emptyBytes, "empty byte array should be found")
+		b, err := emptyBytes.Value()
+		require.NoError(adapt(t), err)
+		require.Empty(adapt(t), b)
+
+		items, err := pathdb.RList[any](db, &pathdb.QueryParams{Path: "/empty/%"})
+		require.NoError(adapt(t), err)
+		require.Len(adapt(t), items, 2)
+		for _, item := range items {
+			require.NotNil(adapt(t), item.Value, "listed empty value at %v should be present", item.Path)
+		}
+
+		values, err := pathdb.GetMulti[any](db, []string{"/empty/string", "/empty/bytes", "/empty/missing"})
+		require.NoError(adapt(t), err)
+		require.Len(adapt(t), values, 2)
+	})
+}
+
+func TestPutIfGeneration(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		putIfGeneration := func(value string, expectedGen int64) (bool, int64) {
+			var ok bool
+			var newGen int64
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				var err error
+				ok, newGen, err = pathdb.PutIfGeneration(tx, "/path", value, expectedGen, "")
+				return err
+			})
+			require.NoError(adapt(t), err)
+			return ok, newGen
+		}
+
+		ok, gen := putIfGeneration("a", 0)
+		require.True(adapt(t), ok, "generation 0 should match absent path")
+		require.EqualValues(adapt(t), 1, gen)
+
+		ok, gen = putIfGeneration("b", 1)
+		require.True(adapt(t), ok, "matching generation should succeed")
+		require.EqualValues(adapt(t), 2, gen, "generation should be bumped")
+		require.Equal(adapt(t), "b", get[string](t, db, "/path"))
+
+		ok, gen = putIfGeneration("c", 1)
+		require.False(adapt(t), ok, "stale generation should fail")
+		require.EqualValues(adapt(t), 2, gen, "current generation should be returned")
+		require.Equal(adapt(t), "b", get[string](t, db, "/path"), "stale generation should not write")
+
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/path", "d", "")
+		})
+		require.NoError(adapt(t), err)
+		gen, err = pathdb.Generation(db, "/path")
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 3, gen, "regular put should bump generation")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return tx.Delete("/path")
+		})
+		require.NoError(adapt(t), err)
+		ok, gen = putIfGeneration("e", 0)
+		require.False(adapt(t), ok, "delete should not reset generation")
+		require.EqualValues(adapt(t), 3, gen)
+	})
+}
+
+func TestSavepoints(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var changes []*pathdb.ChangeSet[string]
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "sub",
+			PathPrefixes: []string{"/"},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				changes = append(changes, cs)
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/outer", "outer", ""))
+
+			err := pathdb.Nested(tx, func(tx pathdb.TX) error {
+				require.NoError(adapt(t), pathdb.Put(tx, "/failed", "failed", "failed"))
+				require.NoError(adapt(t), tx.Delete("/outer"))
+				return errTest
+			})
+			require.ErrorIs(adapt(t), err, errTest)
+
+			err = pathdb.Nested(tx, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, "/succeeded", "succeeded", "")
+			})
+			require.NoError(adapt(t), err)
+
+			require.NoError(adapt(t), tx.Savepoint("a"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "a", ""))
+			require.NoError(adapt(t), tx.Savepoint("b"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/b", "b", ""))
+			require.NoError(adapt(t), tx.RollbackTo("a"))
+			require.Nil(adapt(t), get[interface{}](t, tx, "/a"), "rolling back to a should undo changes after a")
+			require.Nil(adapt(t), get[interface{}](t, tx, "/b"), "rolling back to a should undo changes after b")
+			require.NoError(adapt(t), pathdb.Put(tx, "/c", "c", ""))
+			require.NoError(adapt(t), tx.Release("a"))
+			require.Error(adapt(t), tx.RollbackTo("b"), "releasing a should release b")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/c", "/outer", "/succeeded"}, listPaths(t, db, &pathdb.QueryParams{Path: "%"}))
+		require.Empty(adapt(t), searchPaths(t, db, "failed"), "rolled back full text should be removed")
+		require.Len(adapt(t), changes, 1)
+		require.Len(adapt(t), changes[0].Updates, 3, "subscribers should only see changes that weren't rolled back")
+		require.Contains(adapt(t), changes[0].Updates, "/outer")
+		require.Empty(adapt(t), changes[0].Deletes)
+	})
+}
+
+func TestAfterCommit(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var calls []string
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "a", ""))
+			tx.AfterCommit(func() {
+				require.Equal(adapt(t), "a", get[string](t, db, "/a"), "hook should run after commit")
+				calls = append(calls, "first")
+			})
+			tx.AfterCommit(func() {
+				calls = append(calls, "second")
+			})
+			require.Empty(adapt(t), calls, "hooks shouldn't run before commit")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"first", "second"}, calls, "hooks should run once each in registration order")
+
+		calls = nil
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			tx.AfterCommit(func() {
+				calls = append(calls, "rolled back")
+			})
+			return errTest
+		})
+		require.ErrorIs(adapt(t), err, errTest)
+		require.Empty(adapt(t), calls, "hooks shouldn't run on rollback")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			tx.AfterCommit(func() {
+				calls = append(calls, "kept")
+			})
+			err := pathdb.Nested(tx, func(tx pathdb.TX) error {
+				tx.AfterCommit(func() {
+					calls = append(calls, "discarded")
+				})
+				return errTest
+			})
+			require.ErrorIs(adapt(t), err, errTest)
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"kept"}, calls, "hooks from rolled back savepoint shouldn't run")
+	})
+}
+
+func TestJSONArray(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		pathdb.RegisterJSONType(db, 1, &[]string{})
+
+		mutate := func(fn func(tx pathdb.TX) error) {
+			require.NoError(adapt(t), pathdb.Mutate(db, fn))
+		}
+
+		mutate(func(tx pathdb.TX) error {
+			return pathdb.AppendToJSONArray(tx, "/ids", "a")
+		})
+		require.EqualValues(adapt(t), &[]string{"a"}, get[*[]string](t, db, "/ids"), "appending to new path should create array")
+
+		mutate(func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.AppendToJSONArray(tx, "/ids", "b"))
+			require.NoError(adapt(t), pathdb.AppendToJSONArray(tx, "/ids", "a"))
+			return pathdb.AppendToJSONArray(tx, "/ids", "c")
+		})
+		require.EqualValues(adapt(t), &[]string{"a", "b", "a", "c"}, get[*[]string](t, db, "/ids"), "appending to existing path should extend array")
+
+		mutate(func(tx pathdb.TX) error {
+			removed, err := pathdb.RemoveFromJSONArray(tx, "/ids", "a")
+			require.NoError(adapt(t), err)
+			require.Equal(adapt(t), 2, removed)
+			removed, err = pathdb.RemoveFromJSONArray(tx, "/ids", "d")
+			require.NoError(adapt(t), err)
+			require.Zero(adapt(t), removed)
+			removed, err = pathdb.RemoveFromJSONArray(tx, "/missing", "a")
+			require.NoError(adapt(t), err)
+			require.Zero(adapt(t), removed)
+			return nil
+		})
+		require.EqualValues(adapt(t), &[]string{"b", "c"}, get[*[]string](t, db, "/ids"), "removing should remove all occurrences")
+		require.Nil(adapt(t), get[*[]string](t, db, "/missing"), "removing from missing path should not create array")
+	})
+}
+
+func TestDeleteExisting(t TestingT, mdb minisql.DB) {
+	testDeleteExisting := func(mdb minisql.DB, schema string) pathdb.DB {
+		db, err := pathdb.NewDB(mdb, schema)
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/a", "a", "")
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			existed, err := pathdb.DeleteExisting(tx, "/a")
+			require.NoError(adapt(t), err)
+			require.True(adapt(t), existed, "%v: deleting existing path", schema)
+			existed, err = pathdb.DeleteExisting(tx, "/a")
+			require.NoError(adapt(t), err)
+			require.False(adapt(t), existed, "%v: deleting already deleted path", schema)
+			existed, err = pathdb.DeleteExisting(tx, "/b")
+			require.NoError(adapt(t), err)
+			require.False(adapt(t), existed, "%v: deleting missing path", schema)
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.Nil(adapt(t), get[interface{}](t, db, "/a"))
+		return db
+	}
+
+	// both DBs share the same underlying database, so only close them once done with both
+	reporting := testDeleteExisting(mdb, "reporting")
+	nonReporting := testDeleteExisting(&nonReportingDB{mdb}, "nonreporting")
+	require.NoError(adapt(t), reporting.Close())
+	require.NoError(adapt(t), nonReporting.Close())
+}
+
+// nonReportingDB hides the ability of the wrapped DB to report affected rows
+type nonReportingDB struct {
+	minisql.DB
+}
+
+func (db *nonReportingDB) Begin() (minisql.Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &nonReportingTx{tx}, nil
+}
+
+type nonReportingTx struct {
+	minisql.Tx
+}
+
+func TestMigrate(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var applied []int
+		migration := func(version int) pathdb.Migration {
+			return pathdb.Migration{
+				Version: version,
+				Up: func(tx pathdb.TX) error {
+					applied = append(applied, version)
+					return pathdb.Put(tx, fmt.Sprintf("/migrations/%d", version), version, "")
+				},
+			}
+		}
+
+		err := pathdb.Migrate(db, []pathdb.Migration{migration(2), migration(1)})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []int{1, 2}, applied, "migrations should be applied in order of version")
+
+		applied = nil
+		err = pathdb.Migrate(db, []pathdb.Migration{migration(1), migration(2), migration(3)})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []int{3}, applied, "only new migrations should be applied")
+
+		applied = nil
+		failing := pathdb.Migration{
+			Version: 5,
+			Up: func(tx pathdb.TX) error {
+				err := pathdb.Put(tx, "/migrations/5", 5, "")
+				if err != nil {
+					return err
+				}
+				return errTest
+			},
+		}
+		err = pathdb.Migrate(db, []pathdb.Migration{migration(4), failing, migration(6)})
+		require.ErrorIs(adapt(t), err, errTest)
+		require.EqualValues(adapt(t), []int{4}, applied, "migrations after a failed one should not be applied")
+		require.Nil(adapt(t), rget[int](t, db, "/migrations/5"), "changes of a failed migration should be rolled back")
+
+		applied = nil
+		err = pathdb.Migrate(db, []pathdb.Migration{migration(5), migration(6)})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []int{5, 6}, applied, "failed migration should be retried")
+
+		applied = nil
+		err = pathdb.Migrate(db, []pathdb.Migration{migration(7), migration(7)})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions)
+		err = pathdb.Migrate(db, []pathdb.Migration{migration(0)})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions)
+		require.Empty(adapt(t), applied, "invalid migrations should not apply anything")
+	})
+}
+
+func TestMutateWithRetry(t TestingT, mdb minisql.DB) {
+	busy := &busyDB{DB: mdb}
+	db, err := pathdb.NewDB(busy, "test")
+	require.NoError(adapt(t), err)
+	defer db.Close()
+	opts := pathdb.RetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	calls := 0
+	busy.busyBegins.Store(2)
+	err = pathdb.MutateWithRetry(db, func(tx pathdb.TX) error {
+		calls++
+		return pathdb.Put(tx, "/a", "a", "")
+	}, opts)
+	require.NoError(adapt(t), err, "transaction should succeed once the database is no longer busy")
+	require.Equal(adapt(t), 1, calls)
+	require.Equal(adapt(t), "a", get[string](t, db, "/a"))
+
+	busy.busyBegins.Store(5)
+	err = pathdb.MutateWithRetry(db, func(tx pathdb.TX) error {
+		return pathdb.Put(tx, "/b", "b", "")
+	}, opts)
+	require.Error(adapt(t), err)
+	require.Contains(adapt(t), err.Error(), "database is locked")
+	require.EqualValues(adapt(t), 2, busy.busyBegins.Load(), "should give up after MaxAttempts")
+	busy.busyBegins.Store(0)
+
+	calls = 0
+	err = pathdb.MutateWithRetry(db, func(tx pathdb.TX) error {
+		calls++
+		return errTest
+	}, opts)
+	require.ErrorIs(adapt(t), err, errTest)
+	require.Equal(adapt(t), 1, calls, "other errors shouldn't be retried")
+}
+
+// busyDB fails to begin transactions the way SQLite does when another connection holds a lock,
+// as long as busyBegins is positive
+type busyDB struct {
+	minisql.DB
+	busyBegins atomic.Int32
+}
+
+func (db *busyDB) Begin() (minisql.Tx, error) {
+	if db.busyBegins.Add(-1) >= 0 {
+		return nil, errors.New("database is locked")
+	}
+	return db.DB.Begin()
+}
+
+func TestDeletePrefixExcept(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var lastCS *pathdb.ChangeSet[string]
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "s1",
+			PathPrefixes: []string{"/cache/"},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				lastCS = cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/cache/a", "a", "a is searchable"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/cache/b", "b", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/cache/c", "c", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/cache/d", "d", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/other", "other", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			n, err := pathdb.DeletePrefixExcept(tx, "/cache/", []string{"/cache/b", "/cache/d"})
+			require.NoError(adapt(t), err)
+			require.Equal(adapt(t), 2, n)
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/cache/b", "/cache/d", "/other"}, listPaths(t, db, &pathdb.QueryParams{Path: "%"}))
+		require.EqualValues(adapt(t), map[string]bool{"/cache/a": true, "/cache/c": true}, lastCS.Deletes, "subscriber should be notified of deletes")
+		require.Empty(adapt(t), searchPaths(t, db, "searchable"))
+	})
+}
+
+func TestDeleteMulti(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var lastCS *pathdb.ChangeSet[string]
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "s1",
+			PathPrefixes: []string{"/"},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				lastCS = cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		// more paths than fit into a single statement
+		values := make(map[string]string)
+		var toDelete []string
+		for i := 0; i < 1200; i++ {
+			path := fmt.Sprintf("/items/%04d", i)
+			values[path] = path
+			if i%2 == 0 {
+				toDelete = append(toDelete, path)
+			}
+		}
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.PutAll(tx, values))
+			return pathdb.Put(tx, "/searchable", "searchable", "searchable")
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			n, err := pathdb.DeleteMulti(tx, append(toDelete, "/searchable", "/missing"))
+			require.NoError(adapt(t), err)
+			require.Equal(adapt(t), 601, n, "only existing paths should be counted")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		remaining := listPaths(t, db, &pathdb.QueryParams{Path: "%"})
+		require.Len(adapt(t), remaining, 600)
+		require.Equal(adapt(t), "/items/0001", remaining[0])
+		require.Len(adapt(t), lastCS.Deletes, 601, "subscriber should be notified of each delete")
+		require.False(adapt(t), lastCS.Deletes["/missing"], "subscriber shouldn't be notified of paths that didn't exist")
+		require.Empty(adapt(t), searchPaths(t, db, "searchable"), "full text should be deleted too")
+	})
+}
+
+func TestDeleteAll(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var lastCS *pathdb.ChangeSet[string]
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "s1",
+			PathPrefixes: []string{"/contacts/"},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				lastCS = cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/x":   "x",
+				"/contacts/x/a": "a",
+				"/contacts/x/b": "b",
+				"/contacts/y/a": "a",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			n, err := pathdb.DeleteAll(tx, "/contacts/x/%")
+			require.NoError(adapt(t), err)
+			require.Equal(adapt(t), 2, n)
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/contacts/x", "/contacts/y/a"}, listPaths(t, db, &pathdb.QueryParams{Path: "%"}))
+		require.EqualValues(adapt(t), map[string]bool{"/contacts/x/a": true, "/contacts/x/b": true}, lastCS.Deletes, "subscriber should be notified of deletes")
+	})
+}
+
+func TestSubscriptionIncludePrevious(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "p1", "old", "")
+		})
+		require.NoError(adapt(t), err)
+
+		var lastCS *pathdb.ChangeSet[string]
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:              "s1",
+			PathPrefixes:    []string{"p"},
+			IncludePrevious: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				lastCS = cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "p1", "intermediate", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "p1", "new", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "p2", "inserted", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), map[string]*pathdb.Raw[string]{
+			"p1": pathdb.UnloadedRaw(db, "old"),
+		}, lastCS.Previous, "previous should contain value from before transaction and nothing for inserts")
+		require.Nil(adapt(t), lastCS.Previous["p2"])
+	})
+}
+
+func TestSubscriptionFailCommitOnError(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var lastCS *pathdb.ChangeSet[string]
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:                "failing",
+			PathPrefixes:      []string{"p"},
+			FailCommitOnError: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				if cs.Updates["p1"] != nil {
+					return errTest
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "other",
+			PathPrefixes: []string{"p"},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				lastCS = cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "p1", "rejected", "")
+		})
+		require.ErrorIs(adapt(t), err, errTest, "subscriber error should fail commit")
+		require.Empty(adapt(t), get[string](t, db, "p1"), "failed commit should have been rolled back")
+		require.Nil(adapt(t), lastCS, "other subscribers should not be notified of failed commit")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "p2", "accepted", "")
+		})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), "accepted", get[string](t, db, "p2"))
+		require.EqualValues(adapt(t), &pathdb.ChangeSet[string]{
+			Updates: map[string]*pathdb.Item[*pathdb.Raw[string]]{
+				"p2": {"p2", "", pathdb.LoadedRaw(db, "accepted")},
+			},
+		}, lastCS, "other subscriber should only see successful commit")
+	})
+}
+
+func TestSubscriptionDeliveryOrder(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var delivered []string
+		for _, id := range []string{"s3", "s1", "s4", "s2"} {
+			id := id
+			err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+				ID:           id,
+				PathPrefixes: []string{"p"},
+				OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+					delivered = append(delivered, id)
+					return nil
+				},
+			})
+			require.NoError(adapt(t), err)
+		}
+
+		for i := 0; i < 10; i++ {
+			delivered = nil
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, "p1", fmt.Sprint(i), "")
+			})
+			require.NoError(adapt(t), err)
+			require.EqualValues(adapt(t), []string{"s1", "s2", "s3", "s4"}, delivered, "subscribers should be notified in order of ID")
+		}
+	})
+}
+
+func TestSubscriptionSegmentGlob(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/a/status":       "online",
+				"/contacts/a/name":         "A",
+				"/contacts/a/status/since": "today",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		updates := make(map[string]string)
+		var deletes []string
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:             "glob",
+			PathPrefixes:   []string{"/contacts/*/status"},
+			Matcher:        pathdb.MatchSegmentGlob,
+			ReceiveInitial: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				for path, item := range cs.Updates {
+					value, err := item.Value.Value()
+					if err != nil {
+						return err
+					}
+					updates[path] = value
+				}
+				for path := range cs.Deletes {
+					deletes = append(deletes, path)
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{"/contacts/a/status": "online"}, updates, "initial values should only include matching paths")
+
+		updates = make(map[string]string)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/b/status":       "away",
+				"/contacts/b/name":         "B",
+				"/contacts/b/status/since": "yesterday",
+				"/contacts/b/c/status":     "nested",
+			})
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{"/contacts/b/status": "away"}, updates, "* should match exactly one segment")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Delete(tx, "/contacts/a/status"))
+			return pathdb.Delete(tx, "/contacts/a/name")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"/contacts/a/status"}, deletes)
+
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:           "invalid",
+			PathPrefixes: []string{"/contacts/[/status"},
+			Matcher:      pathdb.MatchSegmentGlob,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				return nil
+			},
+		})
+		require.Error(adapt(t), err, "malformed templates should be rejected")
+	})
+}
+
+func TestUnsubscribeAll(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		require.Empty(adapt(t), pathdb.Subscriptions(db))
+
+		notified := 0
+		for _, id := range []string{"s2", "s1", "s3"} {
+			err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+				ID:              id,
+				PathPrefixes:    []string{"/a", "/b"},
+				JoinDetails:     id == "s3",
+				IncludePrevious: id == "s1",
+				OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+					notified++
+					return nil
+				},
+			})
+			require.NoError(adapt(t), err)
+		}
+		require.EqualValues(adapt(t), []string{"s1", "s2", "s3"}, pathdb.Subscriptions(db))
+
+		pathdb.Unsubscribe(db, "s2")
+		require.EqualValues(adapt(t), []string{"s1", "s3"}, pathdb.Subscriptions(db))
+
+		pathdb.UnsubscribeAll(db)
+		require.Empty(adapt(t), pathdb.Subscriptions(db))
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/a", "a", "")
+		})
+		require.NoError(adapt(t), err)
+		require.Zero(adapt(t), notified, "no subscribers should be notified after unsubscribing all")
+
+		stats, err := db.Stats()
+		require.NoError(adapt(t), err)
+		require.Zero(adapt(t), stats.TrieNodeCount)
+	})
+}
+
+func TestInvalidSchema(t TestingT, mdb minisql.DB) {
+	// fail every statement so that we notice if any get run for an invalid schema
+	faulty := NewFaultyDB(mdb)
+	faulty.FailNth("", 0, nil)
+	malicious := []string{
+		"",
+		"1test",
+		"test data",
+		"test'",
+		`test"`,
+		"test;DROP TABLE test_data;--",
+		"test_data(path) --",
+		"tëst",
+	}
+	for _, schema := range malicious {
+		_, err := pathdb.NewDB(faulty, schema)
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSchema, "%q should be rejected", schema)
+	}
+	faulty.ClearFaults()
+
+	withDB(t, mdb, func(db pathdb.DB) {
+		for _, schema := range malicious {
+			require.Panics(adapt(t), func() {
+				db.WithSchema(schema)
+			}, "%q should be rejected", schema)
+			_, err := pathdb.WithSchemaE(db, schema)
+			require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSchema, "%q should be rejected", schema)
+		}
+		require.NotPanics(adapt(t), func() {
+			db.WithSchema("Other_schema2")
+		})
+		sibling, err := pathdb.WithSchemaE(db, "Other_schema2")
+		require.NoError(adapt(t), err)
+		require.NotNil(adapt(t), sibling)
+	})
+}
+
+func TestWithSchemaSubscriptions(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		other, err := pathdb.NewSiblingDB(db, "other")
+		require.NoError(adapt(t), err)
+		_, err = pathdb.NewSiblingDB(db, "other")
+		require.NoError(adapt(t), err, "setting up a sibling again should be okay")
+		_, err = pathdb.NewSiblingDB(db, "bad schema")
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSchema)
+
+		var testUpdates, otherUpdates []string
+		subscribe := func(d pathdb.DB, id string, updates *[]string) {
+			err := pathdb.Subscribe(d, &pathdb.Subscription[string]{
+				ID:             id,
+				PathPrefixes:   []string{"/"},
+				ReceiveInitial: true,
+				OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+					for path := range cs.Updates {
+						*updates = append(*updates, path)
+					}
+					return nil
+				},
+			})
+			require.NoError(adapt(t), err)
+		}
+
+		err = pathdb.Mutate(other, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/initial", "initial", "")
+		})
+		require.NoError(adapt(t), err)
+		subscribe(db, "test", &testUpdates)
+		subscribe(other, "other", &otherUpdates)
+		require.EqualValues(adapt(t), []string{"/initial"}, otherUpdates, "initial values should come from the sibling's schema")
+		require.Empty(adapt(t), testUpdates)
+
+		err = pathdb.Mutate(other, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/a", "a", "")
+		})
+		require.NoError(adapt(t), err)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/b", "b", "")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"/initial", "/a"}, otherUpdates, "subscriptions should only see their own schema")
+		require.EqualValues(adapt(t), []string{"/b"}, testUpdates, "subscriptions should only see their own schema")
+
+		require.EqualValues(adapt(t), []string{"other", "test"}, pathdb.Subscriptions(other), "siblings should share a registry")
+		pathdb.Unsubscribe(other, "other")
+		require.EqualValues(adapt(t), []string{"test"}, pathdb.Subscriptions(db))
+	})
+}
+
+func TestSubscriptionAsync(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		started := make(chan interface{})
+		release := make(chan interface{})
+		received := make(chan string, 10)
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:             "slow",
+			PathPrefixes:   []string{"p"},
+			BufferSize:     1,
+			OverflowPolicy: pathdb.DropOldestOnOverflow,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				value, err := cs.Updates["p"].Value.Value()
+				if err != nil {
+					return err
+				}
+				if value == "1" {
+					close(started)
+					<-release
+				}
+				received <- value
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		put := func(value string) error {
+			return pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, "p", value, "")
+			})
+		}
+		require.NoError(adapt(t), put("1"))
+		<-started
+		// the subscriber is now stuck handling the first change set, but commits shouldn't be
+		committed := make(chan error, 1)
+		go func() {
+			err := put("2")
+			if err == nil {
+				err = put("3")
+			}
+			committed <- err
+		}()
+		select {
+		case err := <-committed:
+			require.NoError(adapt(t), err)
+		case <-time.After(5 * time.Second):
+			require.Fail(adapt(t), "slow subscriber should not block commits")
+		}
+
+		close(release)
+		require.Equal(adapt(t), "1", <-received)
+		require.Equal(adapt(t), "3", <-received, "oldest buffered change set should have been dropped")
+
+		// subscribing with the same ID replaces the subscription, including its delivery goroutine
+		replaced := make(chan string, 10)
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:              "slow",
+			PathPrefixes:    []string{"q"},
+			BufferSize:      1,
+			IncludePrevious: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				for path := range cs.Updates {
+					replaced <- path
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"slow"}, pathdb.Subscriptions(db))
+		require.NoError(adapt(t), put("4"))
+		require.NoError(adapt(t), pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "q", "5", "")
+		}))
+		require.Equal(adapt(t), "q", <-replaced)
+		pathdb.Unsubscribe(db, "slow")
+		select {
+		case value := <-received:
+			require.Fail(adapt(t), "replaced subscription should have been stopped", "received %v", value)
+		default:
+		}
+
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:                "invalid",
+			PathPrefixes:      []string{"p"},
+			BufferSize:        1,
+			FailCommitOnError: true,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				return nil
+			},
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidSubscription)
+	})
+}
+
+func TestSubscriptionDebounce(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		received := make(chan *pathdb.ChangeSet[string], 10)
+		err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:               "debounced",
+			PathPrefixes:     []string{"/"},
+			DebounceInterval: time.Second,
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				received <- cs
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		for _, mutate := range []func(tx pathdb.TX) error{
+			func(tx pathdb.TX) error { return pathdb.Put(tx, "/a", "a1", "") },
+			func(tx pathdb.TX) error { return pathdb.Put(tx, "/b", "b1", "") },
+			func(tx pathdb.TX) error { return pathdb.Delete(tx, "/a") },
+			func(tx pathdb.TX) error { return pathdb.Put(tx, "/c", "c1", "") },
+			func(tx pathdb.TX) error { return pathdb.Delete(tx, "/c") },
+			func(tx pathdb.TX) error { return pathdb.Put(tx, "/c", "c2", "") },
+			func(tx pathdb.TX) error { return pathdb.Put(tx, "/b", "b2", "") },
+		} {
+			require.NoError(adapt(t), pathdb.Mutate(db, mutate))
+		}
+
+		var cs *pathdb.ChangeSet[string]
+		select {
+		case cs = <-received:
+		case <-time.After(5 * time.Second):
+			require.Fail(adapt(t), "debounced change set should have been delivered")
+		}
+		values := make(map[string]string)
+		for path, item := range cs.Updates {
+			value, err := item.Value.Value()
+			require.NoError(adapt(t), err)
+			values[path] = value
+		}
+		require.EqualValues(adapt(t), map[string]string{"/b": "b2", "/c": "c2"}, values, "later updates should supersede earlier updates and deletes")
+		require.EqualValues(adapt(t), map[string]bool{"/a": true}, cs.Deletes, "later deletes should supersede earlier updates")
+
+		select {
+		case <-received:
+			require.Fail(adapt(t), "commits within the interval should be delivered once")
+		case <-time.After(500 * time.Millisecond):
+		}
+	})
+}
+
+func TestBarrier(t TestingT, mdb minisql.DB) {
+	db, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+	defer db.Close()
+
+	// asynchronous subscribers are still being notified when Mutate returns
+	var buffered, debounced atomic.Int64
+	release := make(chan interface{})
+	err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+		ID:           "buffered",
+		PathPrefixes: []string{"p"},
+		BufferSize:   10,
+		OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+			<-release
+			buffered.Add(int64(len(cs.Updates)))
+			return nil
+		},
+	})
+	require.NoError(adapt(t), err)
+	err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+		ID:               "debounced",
+		PathPrefixes:     []string{"p"},
+		DebounceInterval: time.Hour,
+		OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+			debounced.Add(int64(len(cs.Updates)))
+			return nil
+		},
+	})
+	require.NoError(adapt(t), err)
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		i := i
+		go func() {
+			errs <- pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, fmt.Sprintf("p%d", i), "value", "")
+			})
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(adapt(t), <-errs)
+	}
+	require.Zero(adapt(t), buffered.Load())
+	require.Zero(adapt(t), debounced.Load())
+
+	barrier := make(chan error, 1)
+	go func() {
+		barrier <- pathdb.Barrier(db)
+	}()
+	select {
+	case <-barrier:
+		require.Fail(adapt(t), "barrier should wait for the buffered subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(adapt(t), <-barrier)
+	require.EqualValues(adapt(t), 10, buffered.Load())
+	require.EqualValues(adapt(t), 10, debounced.Load(), "barrier shouldn't wait for the debounce interval")
+	require.NoError(adapt(t), pathdb.Barrier(db.WithSchema("other")), "barrier should work with other schemas")
+
+	require.NoError(adapt(t), db.Close())
+	require.ErrorIs(adapt(t), pathdb.Barrier(db), pathdb.ErrDBClosed)
+}
+
+func TestSubscriptionMinDelta(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var delivered []int64
+		err := pathdb.Subscribe(db, &pathdb.Subscription[int64]{
+			ID:           "s1",
+			PathPrefixes: []string{"/progress"},
+			MinDelta:     10,
+			OnUpdate: func(cs *pathdb.ChangeSet[int64]) error {
+				for _, u := range cs.Updates {
+					v, err := u.Value.Value()
+					require.NoError(adapt(t), err)
+					delivered = append(delivered, v)
+				}
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		for _, v := range []int64{0, 5, 9, 12, 15, 21, 22, 40, 31} {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, "/progress", v, "")
+			})
+			require.NoError(adapt(t), err)
+		}
+		require.EqualValues(adapt(t), []int64{0, 12, 22, 40}, delivered, "only sufficiently large changes should be delivered")
+	})
+}
+
+func TestSubscriptionFilter(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/status/a": "online",
+				"/status/b": "offline",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		var changeSets []*pathdb.ChangeSet[string]
+		err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+			ID:             "s1",
+			PathPrefixes:   []string{"/status/"},
+			ReceiveInitial: true,
+			Filter: func(i *pathdb.Item[*pathdb.Raw[string]]) bool {
+				v, err := i.Value.Value()
+				return err == nil && v == "online"
+			},
+			DeleteFilter: func(path string) bool {
+				return path != "/status/ignored"
+			},
+			OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+				changeSets = append(changeSets, cs)
+				return nil
+			},
+		})
+		require.NoError(adapt(t), err)
+
+		put := func(path, value string) {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, path, value, "")
+			})
+			require.NoError(adapt(t), err)
+		}
+		del := func(path string) {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Delete(tx, path)
+			})
+			require.NoError(adapt(t), err)
+		}
+		put("/status/b", "away")
+		put("/status/b", "online")
+		put("/status/ignored", "online")
+		del("/status/ignored")
+		del("/status/a")
+		require.NoError(adapt(t), pathdb.Barrier(db))
+
+		require.Len(adapt(t), changeSets, 4, "change sets that are entirely filtered out shouldn't be delivered")
+		require.EqualValues(adapt(t), []string{"/status/a"}, updatedPaths(changeSets[0]), "initial values should be filtered")
+		require.EqualValues(adapt(t), []string{"/status/b"}, updatedPaths(changeSets[1]))
+		require.EqualValues(adapt(t), []string{"/status/ignored"}, updatedPaths(changeSets[2]))
+		require.Empty(adapt(t), changeSets[3].Updates)
+		require.EqualValues(adapt(t), []string{"/status/a"}, changeSets[3].OrderedDeletes())
+	})
+}
+
+func updatedPaths[T any](cs *pathdb.ChangeSet[T]) []string {
+	paths := make([]string, 0, len(cs.Updates))
+	for _, u := range cs.OrderedUpdates() {
+		paths = append(paths, u.Path)
+	}
+	return paths
+}
+
+func TestImportItems(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]int64{
+				"/a": 1,
+				"/b": 5,
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		incoming := []*pathdb.Item[*pathdb.Raw[any]]{
+			{Path: "/a", Value: pathdb.UnloadedRaw[any](db, int64(3))},
+			{Path: "/b", Value: pathdb.UnloadedRaw[any](db, int64(2))},
+			{Path: "/c", Value: pathdb.UnloadedRaw[any](db, int64(7))},
+		}
+		var conflicts []string
+		keepLarger := func(path string, existing, incoming *pathdb.Raw[any]) (*pathdb.Raw[any], error) {
+			conflicts = append(conflicts, path)
+			e, err := existing.Value()
+			if err != nil {
+				return nil, err
+			}
+			i, err := incoming.Value()
+			if err != nil {
+				return nil, err
+			}
+			if i.(int64) > e.(int64) {
+				return incoming, nil
+			}
+			return existing, nil
+		}
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.ImportItems(tx, incoming, keepLarger)
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"/a", "/b"}, conflicts, "resolver should only be called for existing paths")
+		require.EqualValues(adapt(t), 3, get[int64](t, db, "/a"), "larger incoming value should win")
+		require.EqualValues(adapt(t), 5, get[int64](t, db, "/b"), "larger existing value should win")
+		require.EqualValues(adapt(t), 7, get[int64](t, db, "/c"), "new path should be imported")
+
+		// without a resolver, incoming values overwrite existing ones
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.ImportItems(tx, incoming, nil)
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 2, get[int64](t, db, "/b"))
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.ImportItems(tx, incoming, func(path string, existing, incoming *pathdb.Raw[any]) (*pathdb.Raw[any], error) {
+				return nil, errTest
+			})
+		})
+		require.ErrorIs(adapt(t), err, errTest)
+	})
+}
+
+func TestTail(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		appendEntries := func(from, to int) {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				for i := from; i <= to; i++ {
+					require.NoError(adapt(t), pathdb.Put(tx, fmt.Sprintf("/log/%04d", i), fmt.Sprintf("entry %d", i), ""))
+				}
+				return nil
+			})
+			require.NoError(adapt(t), err)
+		}
+		appendEntries(1, 5)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/log/0003", "", "entry 3"},
+			{"/log/0004", "", "entry 4"},
+			{"/log/0005", "", "entry 5"},
+		}, tail[string](t, db, "/log/", 3), "tail should return latest entries in chronological order")
+
+		var followed []*pathdb.Item[string]
+		err := pathdb.FollowTail(db, "follower", "/log/", 2, func(items []*pathdb.Item[string]) error {
+			followed = append(followed, items...)
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		defer pathdb.Unsubscribe(db, "follower")
+		appendEntries(6, 7)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/log/0004", "", "entry 4"},
+			{"/log/0005", "", "entry 5"},
+			{"/log/0006", "", "entry 6"},
+			{"/log/0007", "", "entry 7"},
+		}, followed, "following should receive tail followed by new entries")
+	})
+}
+
+func TestFollowTailConcurrentAppend(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		appendEntries := func(from, to int) error {
+			return pathdb.Mutate(db, func(tx pathdb.TX) error {
+				for i := from; i <= to; i++ {
+					err := pathdb.Put(tx, fmt.Sprintf("/log/%04d", i), fmt.Sprintf("entry %d", i), "")
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		require.NoError(adapt(t), appendEntries(1, 3))
+
+		var followed [][]string
+		err := pathdb.FollowTail(db, "follower", "/log/", 2, func(items []*pathdb.Item[string]) error {
+			paths := make([]string, 0, len(items))
+			for _, item := range items {
+				paths = append(paths, item.Path)
+			}
+			followed = append(followed, paths)
+			if len(followed) == 1 {
+				// commit while the initial tail is being delivered
+				return appendEntries(4, 5)
+			}
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		defer pathdb.Unsubscribe(db, "follower")
+		require.EqualValues(adapt(t), [][]string{
+			{"/log/0002", "/log/0003"},
+			{"/log/0004", "/log/0005"},
+		}, followed, "entries appended during the initial delivery should follow the tail")
+
+		require.NoError(adapt(t), appendEntries(6, 6))
+		require.EqualValues(adapt(t), []string{"/log/0006"}, followed[len(followed)-1])
+
+		failingCalls := 0
+		err = pathdb.FollowTail(db, "failing", "/log/", 1, func(items []*pathdb.Item[string]) error {
+			failingCalls++
+			err := appendEntries(7, 7)
+			if err != nil {
+				return err
+			}
+			return errTest
+		})
+		require.ErrorIs(adapt(t), err, errTest)
+		require.NoError(adapt(t), appendEntries(8, 8))
+		require.Equal(adapt(t), 1, failingCalls, "failed follower should have been unsubscribed")
+	})
+}
+
+func TestList(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/32af234asdf324":                         "That Person",
+				"/contacts/32af234asdf324/messages_by_timestamp/1": "/messages/c",
+				"/contacts/32af234asdf324/messages_by_timestamp/2": "/messages/a",
+				"/contacts/32af234asdf324/messages_by_timestamp/3": "/messages/b",
+				"/contacts/32af234asdf324/messages_by_timestamp/4": "/messages/e", // this one doesn't exist
+				"/messages/c": "Message C",
+				"/messages/d": "Message D", // this one isn't referenced by messages_by_timestamp
+				"/messages/a": "Message A",
+				"/messages/b": "Message B",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), "That Person", get[string](t, db, "/contacts/32af234asdf324"))
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/messages/a", "", "Message A"},
+			{"/messages/b", "", "Message B"},
+			{"/messages/c", "", "Message C"},
+			{"/messages/d", "", "Message D"},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "/messages/%"}),
+			"items should be ordered ascending by path",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/messages/d", "", "Message D"},
+			{"/messages/c", "", "Message C"},
+			{"/messages/b", "", "Message B"},
+			{"/messages/a", "", "Message A"},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "/messages/%", ReverseSort: true}),
+			"items should be ordered descending by path",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[*pathdb.Raw[string]]{
+			{"/messages/a", "", pathdb.UnloadedRaw(db, "Message A")},
+			{"/messages/b", "", pathdb.UnloadedRaw(db, "Message B")},
+			{"/messages/c", "", pathdb.UnloadedRaw(db, "Message C")},
+			{"/messages/d", "", pathdb.UnloadedRaw(db, "Message D")},
+		}, rlist[string](t, db, &pathdb.QueryParams{Path: "/messages/%"}),
+			"should be able to retrieve raw items",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/32af234asdf324/messages_by_timestamp/3", "/messages/b", "Message B"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/1", "/messages/c", "Message C"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
+			Start:       0,
+			Count:       10,
+			JoinDetails: true,
+			ReverseSort: true,
+		}),
+			"wildcard detail query should return the right items",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/32af234asdf324/messages_by_timestamp/2",
+			Start:       0,
+			Count:       10,
+			JoinDetails: true,
+			ReverseSort: true,
+		}),
+			"specific detail query should return the right items",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
+			Start:       1,
+			Count:       1,
+			JoinDetails: true,
+		}),
+			"detail query respects start and count",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/3", "/messages/b", "Message B"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/1", "/messages/c", "Message C"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
+			JoinDetails: true,
+			OrderBy:     pathdb.OrderByDetailPath,
+		}),
+			"detail query can be ordered by detail path",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/32af234asdf324/messages_by_timestamp/1", "/messages/c", "Message C"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/3", "/messages/b", "Message B"},
+			{"/contacts/32af234asdf324/messages_by_timestamp/2", "/messages/a", "Message A"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/32af234asdf324/messages_by_timestamp/%",
+			JoinDetails: true,
+			OrderBy:     pathdb.OrderByDetailPath,
+			ReverseSort: true,
+		}),
+			"detail query can be ordered by detail path in reverse",
+		)
+
+		require.EqualValues(adapt(t), []string{
+			"/messages/b",
+		}, listPaths(t, db, &pathdb.QueryParams{
+			Path:  "/messages/%",
+			Start: 1,
+			Count: 1,
+		}),
+			"path query respects start and count",
+		)
+
+		var iterated []string
+		err = pathdb.ForEach(db, &pathdb.QueryParams{Path: "/messages/%"}, func(item *pathdb.Item[string]) error {
+			iterated = append(iterated, item.Value)
+			if len(iterated) == 2 {
+				return errTest
+			}
+			return nil
+		})
+		require.ErrorIs(adapt(t), err, errTest, "error from callback should be returned")
+		require.EqualValues(adapt(t), []string{"Message A", "Message B"}, iterated, "iteration should stop at error")
+	})
+}
+
+func TestGetOr(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/zero", int64(0), "")
+		})
+		require.NoError(adapt(t), err)
+
+		result, err := pathdb.GetOr[int64](db, "/zero", 5)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 0, result, "stored zero value should be returned")
+		result, err = pathdb.GetOr[int64](db, "/missing", 5)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 5, result, "default should be returned for missing value")
+
+		result, err = rget[int64](t, db, "/missing").ValueOr(7)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 7, result, "nil raw should return default")
+		result, err = rget[int64](t, db, "/zero").ValueOr(7)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 0, result)
+	})
+}
+
+func TestGetAll(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/index/1":    "/messages/a",
+				"/index/2":    "/messages/a",
+				"/index/3":    "/messages/b",
+				"/messages/a": "Message A",
+				"/messages/b": "Message B",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		values, err := pathdb.GetAll[string](db, &pathdb.QueryParams{Path: "/messages/%"})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{"/messages/a": "Message A", "/messages/b": "Message B"}, values)
+
+		values, err = pathdb.GetAll[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{
+			"/index/1": "Message A",
+			"/index/2": "Message A",
+			"/index/3": "Message B",
+		}, values, "details should be keyed by index path")
+
+		values, err = pathdb.GetAll[string](db, &pathdb.QueryParams{Path: "/nothing/%"})
+		require.NoError(adapt(t), err)
+		require.Empty(adapt(t), values)
+	})
+}
+
+func TestListMissingDetails(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/index/1":    "/messages/a",
+				"/index/2":    "/messages/b", // this one doesn't exist
+				"/messages/a": "Message A",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		items, err := pathdb.RList[string](db, &pathdb.QueryParams{
+			Path:                "/index/%",
+			JoinDetails:         true,
+			IncludeEmptyDetails: true,
+			ProjectionFields:    pathdb.ProjectDefault | pathdb.ProjectSize,
+		})
+		require.NoError(adapt(t), err)
+		require.Len(adapt(t), items, 2)
+		require.Equal(adapt(t), "/messages/a", items[0].DetailPath)
+		value, err := items[0].Value.Value()
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), "Message A", value)
+		require.Equal(adapt(t), "/messages/b", items[1].DetailPath)
+		require.Nil(adapt(t), items[1].Value, "missing detail should have no value")
+
+		// NULLs scan into zero values rather than failing
+		rows, err := minisql.Wrap(mdb).Query("SELECT NULL, NULL, NULL")
+		require.NoError(adapt(t), err)
+		defer rows.Close()
+		require.True(adapt(t), rows.Next())
+		b := []byte("not null")
+		str := "not null"
+		i := 5
+		require.NoError(adapt(t), rows.Scan(&b, &str, &i))
+		require.Nil(adapt(t), b)
+		require.Empty(adapt(t), str)
+		require.Zero(adapt(t), i)
+	})
+}
+
+func TestStrictDetailPaths(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/index/1", "/messages/a", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/index/2", []byte("/messages/b"), ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A", "Message A"))
+			return pathdb.Put(tx, "/messages/b", "Message B", "Message B")
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/index/1"}, listPaths(t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true}), "entries that aren't strings should be skipped by default")
+
+		_, err = pathdb.List[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, StrictDetailPaths: true})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+		require.Contains(adapt(t), err.Error(), "/index/2")
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, StrictDetailPaths: true}, &pathdb.SearchParams{Search: "Message"})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+
+		require.EqualValues(adapt(t), []string{"/index/1"}, listPaths(t, db, &pathdb.QueryParams{Path: "/index/1", JoinDetails: true, StrictDetailPaths: true}), "valid entries should be listed")
+	})
+}
+
+func TestRawQuery(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		require.Equal(adapt(t), "test", pathdb.SchemaName(db))
+
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/a/1": "one",
+				"/contacts/a/2": "two",
+				"/contacts/b/1": "three",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		counts := func(q pathdb.Queryable) map[string]int {
+			rows, err := pathdb.RawQuery(q, fmt.Sprintf("SELECT SUBSTR(path, 1, 11), COUNT(*) FROM %s_data WHERE path LIKE ? GROUP BY 1", pathdb.SchemaName(q)), "/contacts/%")
+			require.NoError(adapt(t), err)
+			defer rows.Close()
+			result := make(map[string]int)
+			for rows.Next() {
+				var prefix string
+				var count int
+				require.NoError(adapt(t), rows.Scan(&prefix, &count))
+				result[prefix] = count
+			}
+			return result
+		}
+		require.EqualValues(adapt(t), map[string]int{"/contacts/a": 2, "/contacts/b": 1}, counts(db))
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/contacts/b/2", "four", ""))
+			require.EqualValues(adapt(t), map[string]int{"/contacts/a": 2, "/contacts/b": 2}, counts(tx), "raw queries should see the transaction's writes")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		_, err = pathdb.RawQuery(db, "SELECT * FROM nonexistent")
+		require.Error(adapt(t), err)
+	})
+}
+
+func TestListWithTotal(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			for i := 1; i <= 5; i++ {
+				err := pathdb.Put(tx, fmt.Sprintf("/items/%d", i), int64(i), "")
+				if err != nil {
+					return err
+				}
+			}
+			err := pathdb.Put(tx, "/index/1", "/items/1", "")
+			if err != nil {
+				return err
+			}
+			err = pathdb.Put(tx, "/index/2", "/items/2", "")
+			if err != nil {
+				return err
+			}
+			return pathdb.Put(tx, "/index/missing", "/items/missing", "")
+		})
+		require.NoError(adapt(t), err)
+
+		page, err := pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/items/%", Start: 1, Count: 2})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 5, page.Total)
+		require.Len(adapt(t), page.Items, 2)
+		require.Equal(adapt(t), "/items/2", page.Items[0].Path)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/items/%", After: "/items/4", Count: 2})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 5, page.Total, "total shouldn't depend on After")
+		require.Len(adapt(t), page.Items, 1)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/items/%", Exclude: []string{"/items/1"}})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 4, page.Total)
+		require.Len(adapt(t), page.Items, 4)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, Count: 1})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 2, page.Total, "index entries without details shouldn't count")
+		require.Len(adapt(t), page.Items, 1)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, IncludeEmptyDetails: true})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 3, page.Total)
+		require.Len(adapt(t), page.Items, 3)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/items/%", Start: 10})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 5, page.Total, "total should be known even past the last page")
+		require.Empty(adapt(t), page.Items)
+
+		page, err = pathdb.ListWithTotal[int64](db, &pathdb.QueryParams{Path: "/none/%"})
+		require.NoError(adapt(t), err)
+		require.Zero(adapt(t), page.Total)
+		require.Empty(adapt(t), page.Items)
+
+		_, err = db.Count(&pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 100})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "count should validate like list")
+	})
+}
+
+func TestDistinctDetails(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.PutAll(tx, map[string]string{
+				"/messages/1":        "one",
+				"/messages/2":        "two",
+				"/messages/3":        "three",
+				"/linktomessage/a/1": "/messages/2",
+				"/linktomessage/a/2": "/messages/1",
+				"/linktomessage/b/1": "/messages/2",
+				"/linktomessage/b/2": "/messages/missing",
+				"/linktomessage/c/1": "/messages/3",
+				"/unrelated/1":       "/messages/3",
+			})
+			if err != nil {
+				return err
+			}
+			// index entries that aren't detail paths are ignored
+			return pathdb.Put(tx, "/linktomessage/b/bad", int64(5), "")
+		})
+		require.NoError(adapt(t), err)
+
+		query := func() *pathdb.QueryParams {
+			return &pathdb.QueryParams{
+				Path:            "/linktomessage/%",
+				Exclude:         []string{"/linktomessage/c/%"},
+				JoinDetails:     true,
+				DistinctDetails: true,
+			}
+		}
+		items := list[string](t, db, query())
+		require.Len(adapt(t), items, 2)
+		require.Equal(adapt(t), &pathdb.Item[string]{Path: "/messages/1", DetailPath: "/messages/1", Value: "one"}, items[0])
+		require.Equal(adapt(t), &pathdb.Item[string]{Path: "/messages/2", DetailPath: "/messages/2", Value: "two"}, items[1])
+
+		reversed := query()
+		reversed.ReverseSort = true
+		require.EqualValues(adapt(t), []string{"/messages/2", "/messages/1"}, listPaths(t, db, reversed))
+
+		paged := query()
+		paged.After = "/messages/1"
+		require.EqualValues(adapt(t), []string{"/messages/2"}, listPaths(t, db, paged), "after should apply to detail paths")
+
+		count, err := db.Count(query())
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 2, count)
+
+		invalid := query()
+		invalid.IncludeEmptyDetails = true
+		_, err = pathdb.List[string](db, invalid)
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+		_, err = pathdb.List[string](db, &pathdb.QueryParams{Path: "/linktomessage/%", DistinctDetails: true})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "distinct details require joining details")
+		_, err = pathdb.Search[string](db, query(), &pathdb.SearchParams{Search: "one"})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+	})
+}
+
+func TestJoinDepth(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.PutAll(tx, map[string]string{
+				"/messages/1": "one",
+				"/messages/2": "two",
+				"/pointer/1":  "/messages/2",
+				"/pointer/2":  "/messages/1",
+				"/pointer/3":  "/messages/missing",
+				"/cycle/a":    "/cycle/b",
+				"/cycle/b":    "/cycle/a",
+				"/index/1":    "/pointer/1",
+				"/index/2":    "/pointer/2",
+				"/index/3":    "/pointer/3",
+				"/index/4":    "/pointer/4",
+				"/index/5":    "/messages/1",
+				"/index/6":    "/cycle/a",
+			})
+			if err != nil {
+				return err
+			}
+			// chains that reach a value that isn't a path end early
+			return pathdb.Put(tx, "/pointer/4", int64(4), "")
+		})
+		require.NoError(adapt(t), err)
+
+		items := list[string](t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 2})
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{Path: "/index/1", DetailPath: "/messages/2", Value: "two"},
+			{Path: "/index/2", DetailPath: "/messages/1", Value: "one"},
+			{Path: "/index/6", DetailPath: "/cycle/b", Value: "/cycle/a"},
+		}, items)
+
+		items = list[string](t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 2, OrderBy: pathdb.OrderByDetailPath})
+		require.EqualValues(adapt(t), []string{"/cycle/b", "/messages/1", "/messages/2"}, []string{items[0].DetailPath, items[1].DetailPath, items[2].DetailPath})
+
+		require.EqualValues(adapt(t), []string{"/index/1", "/index/2", "/index/3", "/index/4", "/index/5", "/index/6"},
+			listPaths(t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 2, IncludeEmptyDetails: true}))
+		require.EqualValues(adapt(t), []string{"/messages/1", "/messages/2"},
+			listPaths(t, db, &pathdb.QueryParams{Path: "/index/%", Exclude: []string{"/index/6"}, JoinDetails: true, JoinDepth: 2, DistinctDetails: true}))
+
+		count, err := db.Count(&pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 2})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 3, count)
+
+		// /pointer/1-4 all exist, while /index/5 points at /messages/1 directly
+		for _, depth := range []int{0, 1} {
+			require.EqualValues(adapt(t), []string{"/index/1", "/index/2", "/index/3", "/index/4", "/index/5"},
+				listPaths(t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: depth, Exclude: []string{"/index/6"}}),
+				"a depth of %d should join details as usual", depth)
+			items = list[string](t, db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: depth, Exclude: []string{"/index/4", "/index/6"}})
+			require.Equal(adapt(t), &pathdb.Item[string]{Path: "/index/1", DetailPath: "/pointer/1", Value: "/messages/2"}, items[0])
+			require.Equal(adapt(t), &pathdb.Item[string]{Path: "/index/5", DetailPath: "/messages/1", Value: "one"}, items[3])
+		}
+
+		_, err = pathdb.List[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 9})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "/index/%", JoinDetails: true, JoinDepth: 2}, &pathdb.SearchParams{Search: "one"})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+	})
+}
+
+func TestListPage(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/p/1": "1",
+				"/p/3": "3",
+				"/p/5": "5",
+				"/p/7": "7",
+				"/q/1": "other",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		listPage := func(query *pathdb.QueryParams) ([]string, string) {
+			items, cursor, err := pathdb.ListPage[string](db, query)
+			require.NoError(adapt(t), err)
+			paths := make([]string, 0, len(items))
+			for _, item := range items {
+				paths = append(paths, item.Path)
+			}
+			return paths, cursor
+		}
+
+		paths, cursor := listPage(&pathdb.QueryParams{Path: "/p/%", Count: 2})
+		require.EqualValues(adapt(t), []string{"/p/1", "/p/3"}, paths)
+		require.Equal(adapt(t), "/p/3", cursor)
+
+		// insert before the cursor, which shouldn't shift the next page
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/p/2", "2", "")
+		})
+		require.NoError(adapt(t), err)
+
+		paths, cursor = listPage(&pathdb.QueryParams{Path: "/p/%", Count: 2, After: cursor})
+		require.EqualValues(adapt(t), []string{"/p/5", "/p/7"}, paths, "page after cursor shouldn't repeat or skip items")
+		paths, cursor = listPage(&pathdb.QueryParams{Path: "/p/%", Count: 2, After: cursor})
+		require.Empty(adapt(t), paths)
+		require.Empty(adapt(t), cursor, "there should be no more pages")
+
+		paths, cursor = listPage(&pathdb.QueryParams{Path: "/p/%", Count: 3, After: "/p/5", ReverseSort: true})
+		require.EqualValues(adapt(t), []string{"/p/3", "/p/2", "/p/1"}, paths, "reverse page should continue before cursor")
+		require.Equal(adapt(t), "/p/1", cursor)
+
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "%", After: "/p/1"}, &pathdb.SearchParams{Search: "1"})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "after isn't supported for searches")
+	})
+}
+
+func TestExportCSV(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/export/a", "Hello, \"world\"", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/export/b", int64(5), ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/export/c", []byte("bytes"), ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/export/d", true, ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/other", "not exported", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		var buf bytes.Buffer
+		require.NoError(adapt(t), pathdb.ExportCSV[any](db, &pathdb.QueryParams{Path: "/export/%"}, &buf))
+		records, err := csv.NewReader(&buf).ReadAll()
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), [][]string{
+			{"path", "detailPath", "value"},
+			{"/export/a", "", "Hello, \"world\""},
+			{"/export/b", "", "5"},
+			{"/export/c", "", base64.StdEncoding.EncodeToString([]byte("bytes"))},
+			{"/export/d", "", "true"},
+		}, records)
+	})
+}
+
+func TestExportJSON(t TestingT, mdb minisql.DB) {
+	writer, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+	defer writer.Close()
+	pathdb.RegisterProtobufType(writer, 1, &pathdb.PBUFObject{})
+	pathdb.RegisterJSONType(writer, 1, &jsonObject{})
+	err = pathdb.Mutate(writer, func(tx pathdb.TX) error {
+		require.NoError(adapt(t), pathdb.Put(tx, "/export/a", "hello", ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/export/b", int64(5), ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/export/c", &jsonObject{A: "a", B: 5}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/export/d", &pathdb.PBUFObject{A: "a", B: 5}, ""))
+		return pathdb.Put(tx, "/index/1", "/export/a", "")
+	})
+	require.NoError(adapt(t), err)
+
+	// a reader without any registered types
+	reader, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{IgnoreGlobalTypes: true})
+	require.NoError(adapt(t), err)
+	defer reader.Close()
+	raw, err := pathdb.RGet[any](reader, "/export/d")
+	require.NoError(adapt(t), err)
+
+	exportJSON := func(query *pathdb.QueryParams) string {
+		var buf bytes.Buffer
+		require.NoError(adapt(t), pathdb.ExportJSON(reader, query, &buf))
+		return buf.String()
+	}
+	require.JSONEq(adapt(t), fmt.Sprintf(`[
+		{"path": "/export/a", "value": "hello"},
+		{"path": "/export/b", "value": 5},
+		{"path": "/export/c", "value": {"A": "a", "B": 5}},
+		{"path": "/export/d", "value": %q}
+	]`, base64.StdEncoding.EncodeToString(raw.Bytes)), exportJSON(&pathdb.QueryParams{Path: "/export/%"}))
+	require.JSONEq(adapt(t), `[{"path": "/index/1", "detailPath": "/export/a", "value": "hello"}]`, exportJSON(&pathdb.QueryParams{Path: "/index/%", JoinDetails: true}))
+	require.JSONEq(adapt(t), `[]`, exportJSON(&pathdb.QueryParams{Path: "/nothing/%"}))
+}
+
+func TestExportImport(t TestingT, mdb minisql.DB) {
+	source, err := pathdb.NewDB(mdb, "source")
+	require.NoError(adapt(t), err)
+	defer source.Close()
+	dest, err := pathdb.NewDB(mdb, "dest")
+	require.NoError(adapt(t), err)
+	defer dest.Close()
+	for _, db := range []pathdb.DB{source, dest} {
+		pathdb.RegisterProtobufType(db, 1, &pathdb.PBUFObject{})
+		pathdb.RegisterJSONType(db, 1, &jsonObject{})
+	}
+
+	err = pathdb.Mutate(source, func(tx pathdb.TX) error {
+		require.NoError(adapt(t), pathdb.Put(tx, "/pbuf", &pathdb.PBUFObject{A: "a", B: 5}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/json", &jsonObject{A: "a", B: 5}, ""))
+		require.NoError(adapt(t), pathdb.Put(tx, "/string", "hello", "hello"))
+		return pathdb.Put(tx, "/bytes", []byte{0, 1, 2}, "")
+	})
+	require.NoError(adapt(t), err)
+
+	var buf bytes.Buffer
+	require.NoError(adapt(t), pathdb.Export(source, &buf))
+	exported := buf.Bytes()
+	err = pathdb.Mutate(dest, func(tx pathdb.TX) error {
+		return pathdb.Import(tx, bytes.NewReader(exported))
+	})
+	require.NoError(adapt(t), err)
+
+	sourceItems, err := pathdb.RList[any](source, &pathdb.QueryParams{Path: "%"})
+	require.NoError(adapt(t), err)
+	destItems, err := pathdb.RList[any](dest, &pathdb.QueryParams{Path: "%"})
+	require.NoError(adapt(t), err)
+	require.Len(adapt(t), destItems, 4)
+	for i, item := range destItems {
+		require.Equal(adapt(t), sourceItems[i].Path, item.Path)
+		require.Equal(adapt(t), sourceItems[i].Value.Bytes, item.Value.Bytes, "serialized bytes should be preserved")
+	}
+	require.EqualValues(adapt(t), &jsonObject{A: "a", B: 5}, get[*jsonObject](t, dest, "/json"))
+
+	err = pathdb.Mutate(dest, func(tx pathdb.TX) error {
+		return pathdb.Import(tx, bytes.NewReader(exported[:len(exported)-1]))
+	})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidExport, "truncated exports should be rejected")
+	err = pathdb.Mutate(dest, func(tx pathdb.TX) error {
+		return pathdb.Import(tx, bytes.NewReader([]byte{99}))
+	})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidExport, "unknown versions should be rejected")
+}
+
+func TestOrderByInsertion(t TestingT, mdb minisql.DB) {
+	uuids := []string{
+		"/items/9b2f6c1e-5d1a-4a4e-9a53-0c1f2b7e8d11",
+		"/items/0d4e8a7c-2b6f-4c1d-8e9a-7f3b5c2d1e00",
+		"/items/f1a3c5e7-9b2d-4f6a-8c0e-1d3f5a7b9c22",
+		"/items/4c6e8a0b-1d3f-4a5b-9c7d-2e4f6a8b0c33",
+	}
+	putAll := func(db pathdb.DB) {
+		for i, path := range uuids {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return pathdb.Put(tx, path, i, "")
+			})
+			require.NoError(adapt(t), err)
+		}
+	}
+	update := func(db pathdb.DB, path string) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, path, -1, "")
+		})
+		require.NoError(adapt(t), err)
+	}
+	reversed := func(paths []string) []string {
+		result := make([]string, 0, len(paths))
+		for i := len(paths) - 1; i >= 0; i-- {
+			result = append(result, paths[i])
+		}
+		return result
+	}
+
+	db, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{TrackInsertionOrder: true})
+	require.NoError(adapt(t), err)
+	// all DBs share the same underlying database, so only close them at the end
+	defer db.Close()
+	putAll(db)
+	require.EqualValues(adapt(t), uuids, listPaths(t, db, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion}))
+	require.EqualValues(adapt(t), reversed(uuids), listPaths(t, db, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion, ReverseSort: true}))
+
+	update(db, uuids[0])
+	require.EqualValues(adapt(t), uuids, listPaths(t, db, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion}), "updates should keep their original position")
+
+	_, err = pathdb.ListPaths(db, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion, After: uuids[0]})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery)
+
+	resequenced, err := pathdb.NewDBWithOptions(mdb, "resequenced", &pathdb.Options{TrackInsertionOrder: true, ResequenceOnUpdate: true})
+	require.NoError(adapt(t), err)
+	defer resequenced.Close()
+	putAll(resequenced)
+	update(resequenced, uuids[0])
+	require.EqualValues(adapt(t), append(append([]string{}, uuids[1:]...), uuids[0]), listPaths(t, resequenced, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion}), "updates should move to the end")
+
+	untracked, err := pathdb.NewDB(mdb, "untracked")
+	require.NoError(adapt(t), err)
+	defer untracked.Close()
+	_, err = pathdb.ListPaths(untracked, &pathdb.QueryParams{Path: "/items/%", OrderBy: pathdb.OrderByInsertion})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "ordering by insertion requires tracking it")
+}
+
+func TestListProjection(t TestingT, mdb minisql.DB) {
+	counting := &valueCountingDB{DB: mdb}
+	withDB(t, counting, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/a": "aaaa",
+				"/b": "bb",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		counting.valueBytes = 0
+		items := rlist[string](t, db, &pathdb.QueryParams{Path: "%", ProjectionFields: pathdb.ProjectSize})
+		require.Zero(adapt(t), counting.valueBytes, "values shouldn't have been fetched")
+		require.Len(adapt(t), items, 2)
+		require.Equal(adapt(t), "/a", items[0].Path)
+		require.Equal(adapt(t), 5, items[0].Value.Size, "size should include type tag")
+		require.Empty(adapt(t), items[0].Value.Bytes)
+		require.Equal(adapt(t), "/b", items[1].Path)
+		require.Equal(adapt(t), 3, items[1].Value.Size)
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/a", "", ""},
+			{"/b", "", ""},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "%", ProjectionFields: pathdb.ProjectDetailPath}), "list without values should leave them empty")
+		require.Zero(adapt(t), counting.valueBytes, "values shouldn't have been fetched")
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/a", "", "aaaa"},
+			{"/b", "", "bb"},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "%"}))
+		require.NotZero(adapt(t), counting.valueBytes, "values should have been fetched by default")
+	})
+}
+
+// valueCountingDB counts the bytes of BLOB values that are read through it outside of
+// transactions
+type valueCountingDB struct {
+	minisql.DB
+	valueBytes int
+}
+
+func (db *valueCountingDB) Query(query string, args minisql.Values) (minisql.Rows, error) {
+	rows, err := db.DB.Query(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCountingRows{Rows: rows, db: db}, nil
+}
+
+type valueCountingRows struct {
+	minisql.Rows
+	db *valueCountingDB
+}
+
+func (rows *valueCountingRows) Scan(values minisql.Values) error {
+	err := rows.Rows.Scan(values)
+	for i := 0; i < values.Len(); i++ {
+		if values.Get(i).Type == minisql.ValueTypeBytes {
+			rows.db.valueBytes += len(values.Get(i).Bytes())
+		}
+	}
+	return err
+}
+
+func TestListMultiplePaths(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.PutAllWithFullText(tx, map[string]string{
+				"/messages/a": "message a",
+				"/messages/b": "message b",
+				"/drafts/c":   "draft c",
+				"/other/d":    "other d",
+			}, map[string]string{
+				"/messages/a": "hello a",
+				"/messages/b": "hello b",
+				"/drafts/c":   "hello c",
+				"/other/d":    "hello d",
+			})
+			if err != nil {
+				return err
+			}
+			return pathdb.PutAll(tx, map[string]string{
+				"/links/1":      "/messages/a",
+				"/draftlinks/2": "/drafts/c",
+				"/otherlinks/3": "/other/d",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		prefixes := []string{"/messages/%", "/drafts/%"}
+		require.EqualValues(adapt(t), []string{"/drafts/c", "/messages/a", "/messages/b"}, listPaths(t, db, &pathdb.QueryParams{Paths: prefixes}))
+		require.EqualValues(adapt(t), []string{"/messages/a", "/messages/b"}, listPaths(t, db, &pathdb.QueryParams{Paths: prefixes, Start: 1, Count: 2}), "pagination should apply across all patterns")
+		require.EqualValues(adapt(t), []string{"/messages/b", "/messages/a"}, listPaths(t, db, &pathdb.QueryParams{Paths: prefixes, ReverseSort: true, Count: 2}))
+
+		results := search[string](t, db, &pathdb.QueryParams{Paths: prefixes, OrderBy: pathdb.OrderByPath}, &pathdb.SearchParams{Search: "hello"})
+		paths := make([]string, 0, len(results))
+		for _, result := range results {
+			paths = append(paths, result.Path)
+		}
+		require.EqualValues(adapt(t), []string{"/drafts/c", "/messages/a", "/messages/b"}, paths)
+
+		linkPrefixes := []string{"/links/%", "/draftlinks/%"}
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/draftlinks/2", "/drafts/c", "draft c"},
+			{"/links/1", "/messages/a", "message a"},
+		}, list[string](t, db, &pathdb.QueryParams{Paths: linkPrefixes, JoinDetails: true}))
+
+		results = search[string](t, db, &pathdb.QueryParams{Paths: linkPrefixes, JoinDetails: true, OrderBy: pathdb.OrderByPath}, &pathdb.SearchParams{Search: "hello"})
+		paths = paths[:0]
+		for _, result := range results {
+			paths = append(paths, result.Path)
+		}
+		require.EqualValues(adapt(t), []string{"/draftlinks/2", "/links/1"}, paths)
+	})
+}
+
+func TestListExclude(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/contacts/a":                           "contact a",
+				"/contacts/a/messages_by_timestamp/1":   "/messages/1",
+				"/contacts/a/messages_by_timestamp/2":   "/messages/2",
+				"/contacts/a/messages_by_timestamp/2/x": "/messages/x",
+				"/contacts/b":                           "contact b",
+				"/contacts/b/messages_by_timestamp/3":   "/messages/3",
+				"/contacts/b/notes":                     "notes b",
+				"/messages/1":                           "message 1",
+				"/messages/2":                           "message 2",
+				"/messages/3":                           "message 3",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/contacts/a", "/contacts/b", "/contacts/b/notes"}, listPaths(t, db, &pathdb.QueryParams{
+			Path:    "/contacts/%",
+			Exclude: []string{"/contacts/%/messages_by_timestamp/%"},
+		}))
+		require.EqualValues(adapt(t), []string{"/contacts/a", "/contacts/b"}, listPaths(t, db, &pathdb.QueryParams{
+			Path:    "/contacts/%",
+			Exclude: []string{"/contacts/%/messages_by_timestamp/%", "/contacts/%/notes"},
+		}), "all exclusions should apply")
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/contacts/a/messages_by_timestamp/1", "/messages/1", "message 1"},
+			{"/contacts/b/messages_by_timestamp/3", "/messages/3", "message 3"},
+		}, list[string](t, db, &pathdb.QueryParams{
+			Path:        "/contacts/%/messages_by_timestamp/%",
+			Exclude:     []string{"/contacts/a/messages_by_timestamp/2%"},
+			JoinDetails: true,
+		}), "exclusions should compose with joining details")
+	})
+}
+
+func TestListGlob(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/a%b/1": "1",
+				"/a%b/2": "2",
+				"/axb/1": "x",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/a%b/1", "/a%b/2", "/axb/1"}, listPaths(t, db, &pathdb.QueryParams{Path: "/a%b/%"}), "LIKE treats % as a wildcard")
+		require.EqualValues(adapt(t), []string{"/a%b/1", "/a%b/2"}, listPaths(t, db, &pathdb.QueryParams{Path: "/a%b/*", MatchMode: pathdb.MatchGlob}), "GLOB treats % as a literal")
+		require.EqualValues(adapt(t), []string{"/a%b/2"}, listPaths(t, db, &pathdb.QueryParams{Path: "/a%b/?", MatchMode: pathdb.MatchGlob, Start: 1}), "GLOB supports ? wildcard")
+	})
+}
+
+func TestHasAny(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/notifications/1", "hello", "")
+		})
+		require.NoError(adapt(t), err)
+
+		hasAny, err := pathdb.HasAny(db, "/notifications/")
+		require.NoError(adapt(t), err)
+		require.True(adapt(t), hasAny)
+
+		hasAny, err = pathdb.HasAny(db, "/messages/")
+		require.NoError(adapt(t), err)
+		require.False(adapt(t), hasAny)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			hasAny, err := pathdb.HasAny(tx, "/messages/")
+			require.NoError(adapt(t), err)
+			require.False(adapt(t), hasAny)
+			err = pathdb.Put(tx, "/messages/1", "hi", "")
+			require.NoError(adapt(t), err)
+			hasAny, err = pathdb.HasAny(tx, "/messages/")
+			require.NoError(adapt(t), err)
+			require.True(adapt(t), hasAny, "transaction should see its own writes")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+	})
+}
+
+func TestSearch(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/c", "Message C blah blah", "Message C blah blah"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/d", "Message D blah blah blah", "Message D blah blah blah"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A blah", "Message A blah"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/b", "Message B", "Message B"))
 			return pathdb.PutAll(tx, map[string]string{
 				"/linktomessage/1": "/messages/d",
 				"/linktomessage/2": "/messages/c",
@@ -357,9 +3092,9 @@ func TestSearch(t TestingT, mdb minisql.DB) {
 		}, list[string](t, db, &pathdb.QueryParams{Path: "/messages/%"}))
 
 		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
-			{pathdb.Item[string]{"/messages/d", "", "Message D blah blah blah"}, "...*bla*h *bla*h..."},
-			{pathdb.Item[string]{"/messages/c", "", "Message C blah blah"}, "...*bla*h *bla*h"},
-			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...ge A *bla*h"},
+			{pathdb.Item[string]{"/messages/d", "", "Message D blah blah blah"}, "...*bla*h *bla*h...", nil},
+			{pathdb.Item[string]{"/messages/c", "", "Message C blah blah"}, "...*bla*h *bla*h", nil},
+			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...ge A *bla*h", nil},
 		}, search[string](
 			t,
 			db,
@@ -370,9 +3105,9 @@ func TestSearch(t TestingT, mdb minisql.DB) {
 		)
 
 		require.EqualValues(adapt(t), []*pathdb.SearchResult[*pathdb.Raw[string]]{
-			{pathdb.Item[*pathdb.Raw[string]]{"/messages/d", "", pathdb.UnloadedRaw(db, "Message D blah blah blah")}, "...*bla*h *bla*h..."},
-			{pathdb.Item[*pathdb.Raw[string]]{"/messages/c", "", pathdb.UnloadedRaw(db, "Message C blah blah")}, "...*bla*h *bla*h"},
-			{pathdb.Item[*pathdb.Raw[string]]{"/messages/a", "", pathdb.UnloadedRaw(db, "Message A blah")}, "...ge A *bla*h"},
+			{pathdb.Item[*pathdb.Raw[string]]{"/messages/d", "", pathdb.UnloadedRaw(db, "Message D blah blah blah")}, "...*bla*h *bla*h...", nil},
+			{pathdb.Item[*pathdb.Raw[string]]{"/messages/c", "", pathdb.UnloadedRaw(db, "Message C blah blah")}, "...*bla*h *bla*h", nil},
+			{pathdb.Item[*pathdb.Raw[string]]{"/messages/a", "", pathdb.UnloadedRaw(db, "Message A blah")}, "...ge A *bla*h", nil},
 		}, rsearch[string](
 			t,
 			db,
@@ -383,9 +3118,35 @@ func TestSearch(t TestingT, mdb minisql.DB) {
 		)
 
 		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
-			{pathdb.Item[string]{"/linktomessage/1", "/messages/d", "Message D blah blah blah"}, "...*bla*h *bla*h..."},
-			{pathdb.Item[string]{"/linktomessage/2", "/messages/c", "Message C blah blah"}, "...*bla*h *bla*h"},
-			{pathdb.Item[string]{"/linktomessage/4", "/messages/a", "Message A blah"}, "...ge A *bla*h"},
+			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...ge A *bla*h", nil},
+			{pathdb.Item[string]{"/messages/c", "", "Message C blah blah"}, "...*bla*h *bla*h", nil},
+			{pathdb.Item[string]{"/messages/d", "", "Message D blah blah blah"}, "...*bla*h *bla*h...", nil},
+		}, search[string](
+			t,
+			db,
+			&pathdb.QueryParams{Path: "/messages/%", OrderBy: pathdb.OrderByPath},
+			&pathdb.SearchParams{Search: "bla*", NumTokens: 7},
+		),
+			"search ordered by path",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
+			{pathdb.Item[string]{"/messages/d", "", "Message D blah blah blah"}, "...*bla*h *bla*h...", nil},
+			{pathdb.Item[string]{"/messages/c", "", "Message C blah blah"}, "...*bla*h *bla*h", nil},
+			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...ge A *bla*h", nil},
+		}, search[string](
+			t,
+			db,
+			&pathdb.QueryParams{Path: "/messages/%", OrderBy: pathdb.OrderByPath, ReverseSort: true},
+			&pathdb.SearchParams{Search: "bla*", NumTokens: 7},
+		),
+			"search ordered by path in reverse",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
+			{pathdb.Item[string]{"/linktomessage/1", "/messages/d", "Message D blah blah blah"}, "...*bla*h *bla*h...", nil},
+			{pathdb.Item[string]{"/linktomessage/2", "/messages/c", "Message C blah blah"}, "...*bla*h *bla*h", nil},
+			{pathdb.Item[string]{"/linktomessage/4", "/messages/a", "Message A blah"}, "...ge A *bla*h", nil},
 		}, search[string](
 			t,
 			db,
@@ -395,54 +3156,524 @@ func TestSearch(t TestingT, mdb minisql.DB) {
 			"prefix match with joinDetails with highlighting",
 		)
 
-		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
-			// delete an entry including the full text index
-			require.NoError(adapt(t), pathdb.Delete(tx, "/messages/d"))
-			// add the entry back without full-text indexing to make sure it doesn't show up in results
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/d", "Message D blah blah blah", ""))
-			// delete another entry without deleting the full text index
-			require.NoError(adapt(t), pathdb.Delete(tx, "/messages/c"))
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			// delete an entry including the full text index
+			require.NoError(adapt(t), pathdb.Delete(tx, "/messages/d"))
+			// add the entry back without full-text indexing to make sure it doesn't show up in results
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/d", "Message D blah blah blah", ""))
+			// delete another entry, which also deletes its full text index entry
+			require.NoError(adapt(t), pathdb.Delete(tx, "/messages/c"))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
+			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...*bla*...", nil},
+		}, search[string](
+			t,
+			db,
+			&pathdb.QueryParams{Path: "/messages/%"},
+			&pathdb.SearchParams{Search: "blah", NumTokens: 1},
+		),
+			"results should exclude deleted rows and deleted fulltext",
+		)
+
+		// now update
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A is different now", "Message A is different now"))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.Empty(adapt(t), search[string](
+			t,
+			db,
+			&pathdb.QueryParams{Path: "/messages/%"},
+			&pathdb.SearchParams{Search: "blah"},
+		),
+			"results exclude updated fulltext",
+		)
+
+		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
+			{pathdb.Item[string]{"/messages/a", "", "Message A is different now"}, "Message A is *diff*erent now", nil},
+		}, search[string](
+			t,
+			db,
+			&pathdb.QueryParams{Path: "/messages/%"},
+			&pathdb.SearchParams{Search: "diff"},
+		),
+			"results include updated fulltext",
+		)
+	})
+}
+
+func TestSearchTerms(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllWithFullText(tx, map[string]string{
+				"/1": "1",
+				"/2": "2",
+				"/3": "3",
+			}, map[string]string{
+				"/1": "the quick brown fox",
+				"/2": "quick red fox",
+				"/3": `the lazy dog's "quoted" bone`,
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		searchTerms := func(combinator pathdb.SearchCombinator, terms ...pathdb.SearchTerm) []string {
+			results := search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Terms: terms, Combinator: combinator})
+			paths := make([]string, 0, len(results))
+			for _, result := range results {
+				paths = append(paths, result.Path)
+			}
+			return paths
+		}
+		require.ElementsMatch(adapt(t), []string{"/1", "/2"}, searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "fox quick"}))
+		require.ElementsMatch(adapt(t), []string{"/1"}, searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "quick brown", Phrase: true}))
+		require.Empty(adapt(t), searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "brown quick", Phrase: true}))
+		require.ElementsMatch(adapt(t), []string{"/1", "/2"}, searchTerms(pathdb.CombineOr, pathdb.SearchTerm{Text: "brown"}, pathdb.SearchTerm{Text: "red"}))
+		require.Empty(adapt(t), searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "brown"}, pathdb.SearchTerm{Text: "red"}))
+		require.ElementsMatch(adapt(t), []string{"/2"}, searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "fox"}, pathdb.SearchTerm{Text: "brown", Negate: true}))
+		require.ElementsMatch(adapt(t), []string{"/3"}, searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: `dog's "quoted"`, Phrase: true}), "quotes should be matched literally")
+		require.Empty(adapt(t), searchTerms(pathdb.CombineAnd, pathdb.SearchTerm{Text: "fox NOT brown"}), "operators should be matched literally")
+
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Terms: []pathdb.SearchTerm{{Text: "fox", Negate: true}}})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "negated terms need something to exclude from")
+	})
+}
+
+func TestSearchSkipsSnippetsOfLargeDocuments(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		large := strings.Repeat("lorem ipsum dolor sit amet ", 100000) + "needle"
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllWithFullText(tx, map[string]string{
+				"/large": "large",
+				"/small": "small",
+			}, map[string]string{
+				"/large": large,
+				"/small": "a small needle",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		results := search[string](t, db, &pathdb.QueryParams{Path: "%", OrderBy: pathdb.OrderByPath}, &pathdb.SearchParams{
+			Search:                   "needle",
+			MaxSnippetDocumentLength: 1000,
+			SnippetPlaceholder:       "[too large]",
+		})
+		require.Len(adapt(t), results, 2)
+		require.Equal(adapt(t), "/large", results[0].Path)
+		require.Equal(adapt(t), "[too large]", results[0].Snippet)
+		require.Equal(adapt(t), "/small", results[1].Path)
+		require.Equal(adapt(t), "a small *needle*", results[1].Snippet)
+
+		results = search[string](t, db, &pathdb.QueryParams{Path: "/large"}, &pathdb.SearchParams{
+			Search:                   "needle",
+			MaxSnippetDocumentLength: len(large),
+		})
+		require.Len(adapt(t), results, 1)
+		require.Contains(adapt(t), results[0].Snippet, "*needle*", "documents at the limit should still get snippets")
+	})
+}
+
+func TestSearchHighlightRanges(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/messages/a", "Message A", "Price *special* offer")
+		})
+		require.NoError(adapt(t), err)
+
+		results := search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: "special", HighlightRanges: true})
+		require.Len(adapt(t), results, 1)
+		require.Equal(adapt(t), "Price *special* offer", results[0].Snippet, "snippet should be plain text including literal markers")
+		require.EqualValues(adapt(t), []pathdb.Highlight{{Start: 7, End: 14}}, results[0].Highlights)
+		h := results[0].Highlights[0]
+		require.Equal(adapt(t), "special", results[0].Snippet[h.Start:h.End])
+
+		results = search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: "special"})
+		require.Len(adapt(t), results, 1)
+		require.Equal(adapt(t), "Price **special** offer", results[0].Snippet, "without ranges, snippet should use markers")
+		require.Empty(adapt(t), results[0].Highlights)
+	})
+}
+
+func TestPutIndexed(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		var first, second, updated, plain int64
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			var err error
+			first, err = pathdb.PutIndexed(tx, "/messages/a", "Message A", "hello world")
+			if err != nil {
+				return err
+			}
+			second, err = pathdb.PutIndexed(tx, "/messages/b", "Message B", "goodbye world")
+			if err != nil {
+				return err
+			}
+			updated, err = pathdb.PutIndexed(tx, "/messages/a", "Message A2", "hello again")
+			if err != nil {
+				return err
+			}
+			plain, err = pathdb.PutIndexed(tx, "/messages/c", "Message C", "")
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.NotEqual(adapt(t), first, second, "inserts should allocate new rowids")
+		require.Equal(adapt(t), first, updated, "updates should keep the existing rowid")
+		require.EqualValues(adapt(t), -1, plain, "values without full text aren't indexed")
+
+		rowIDOf := func(text string) int64 {
+			rows, err := pathdb.RawQuery(db, fmt.Sprintf("SELECT rowid FROM %s_fts2 WHERE %s_fts2 MATCH ?", pathdb.SchemaName(db), pathdb.SchemaName(db)), text)
+			require.NoError(adapt(t), err)
+			defer rows.Close()
+			require.True(adapt(t), rows.Next())
+			var rowID int64
+			require.NoError(adapt(t), rows.Scan(&rowID))
+			return rowID
+		}
+		require.Equal(adapt(t), first, rowIDOf("again"))
+		require.Equal(adapt(t), second, rowIDOf("goodbye"))
+		require.EqualValues(adapt(t), []string{"/messages/a"}, searchPaths(t, db, "again"))
+	})
+}
+
+func TestPutAllWithFullText(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllWithFullText(tx, map[string]string{
+				"/messages/a": "Message A",
+				"/messages/b": "Message B",
+				"/messages/c": "Message C",
+			}, map[string]string{
+				"/messages/a": "hello world",
+				"/messages/b": "goodbye world",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		require.EqualValues(adapt(t), []string{"/messages/a", "/messages/b", "/messages/c"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/%"}))
+		require.EqualValues(adapt(t), []string{"/messages/b"}, searchPaths(t, db, "goodbye"))
+		require.Len(adapt(t), searchPaths(t, db, "world"), 2, "path without full text should not be indexed")
+	})
+}
+
+func TestPutAllOrdered(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllOrdered(tx, []string{"/a", "/b"}, []string{"a"}, nil)
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrLengthMismatch)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllOrdered(tx, []string{"/a"}, []string{"a"}, []string{"a", "b"})
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrLengthMismatch)
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAllOrdered(
+				tx,
+				[]string{"/messages/c", "/messages/a", "/messages/b"},
+				[]string{"Message C", "Message A", "Message B"},
+				[]string{"third", "first", ""},
+			)
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), []string{"/messages/a", "/messages/b", "/messages/c"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/%"}))
+		require.EqualValues(adapt(t), []string{"/messages/a"}, searchPaths(t, db, "first"))
+		require.EqualValues(adapt(t), []string{"/messages/c"}, searchPaths(t, db, "third"))
+
+		rows, err := minisql.Wrap(mdb).Query("SELECT path FROM test_data WHERE rowid IS NOT NULL ORDER BY rowid")
+		require.NoError(adapt(t), err)
+		var paths []string
+		for rows.Next() {
+			var path string
+			require.NoError(adapt(t), rows.Scan(&path))
+			paths = append(paths, path)
+		}
+		rows.Close()
+		require.EqualValues(adapt(t), []string{"/messages/c", "/messages/a"}, paths, "row IDs should be assigned in the given order")
+	})
+}
+
+func TestPutBatch(t TestingT, mdb minisql.DB) {
+	db, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{TrackInsertionOrder: true})
+	require.NoError(adapt(t), err)
+	defer db.Close()
+
+	var updated atomic.Int64
+	err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+		ID:           "s1",
+		PathPrefixes: []string{"/batch/"},
+		OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+			updated.Add(int64(len(cs.Updates)))
+			return nil
+		},
+	})
+	require.NoError(adapt(t), err)
+
+	// more values than fit into a single statement
+	values := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		values[fmt.Sprintf("/batch/%04d", i)] = fmt.Sprintf("value %d", i)
+	}
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.PutBatch(tx, values)
+	})
+	require.NoError(adapt(t), err)
+	require.EqualValues(adapt(t), 1000, updated.Load(), "subscriber should be notified of every value")
+	require.Len(adapt(t), list[string](t, db, &pathdb.QueryParams{Path: "/batch/%"}), 1000)
+	value, err := pathdb.Get[string](db, "/batch/0500")
+	require.NoError(adapt(t), err)
+	require.Equal(adapt(t), "value 500", value)
+	paths := listPaths(t, db, &pathdb.QueryParams{Path: "/batch/%", OrderBy: pathdb.OrderByInsertion, Count: 3})
+	require.EqualValues(adapt(t), []string{"/batch/0000", "/batch/0001", "/batch/0002"}, paths, "batches should be inserted in path order")
+
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.PutBatch(tx, map[string]string{"/batch/0500": "updated", "/batch/new": "new"})
+	})
+	require.NoError(adapt(t), err)
+	value, err = pathdb.Get[string](db, "/batch/0500")
+	require.NoError(adapt(t), err)
+	require.Equal(adapt(t), "updated", value)
+	generation, err := pathdb.Generation(db, "/batch/0500")
+	require.NoError(adapt(t), err)
+	require.EqualValues(adapt(t), 2, generation)
+	generation, err = pathdb.Generation(db, "/batch/new")
+	require.NoError(adapt(t), err)
+	require.EqualValues(adapt(t), 1, generation)
+	require.EqualValues(adapt(t), 1002, updated.Load())
+}
+
+func TestFullTextColumns(t TestingT, mdb minisql.DB) {
+	// start out with the default single column
+	legacy, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+	err = pathdb.Mutate(legacy, func(tx pathdb.TX) error {
+		return pathdb.Put(tx, "/a", "a", "apple pie")
+	})
+	require.NoError(adapt(t), err)
+
+	_, err = pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{FullTextColumns: []string{"value", "Value"}})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions, "duplicate columns should be rejected")
+
+	_, err = pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{FullTextColumns: []string{"value", "title", "body"}})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions, "changing columns should require RebuildFullTextIndex")
+
+	// both DBs share the same underlying database, so only close them once done with both
+	db, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{FullTextColumns: []string{"value", "title", "body"}, RebuildFullTextIndex: true})
+	require.NoError(adapt(t), err)
+	defer db.Close()
+	defer legacy.Close()
+
+	searchColumns := func(term string, columns ...string) []string {
+		results := search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: term, Columns: columns})
+		paths := make([]string, 0, len(results))
+		for _, result := range results {
+			paths = append(paths, result.Path)
+		}
+		return paths
+	}
+	require.EqualValues(adapt(t), []string{"/a"}, searchColumns("apple"), "existing index entries should survive migration")
+
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.PutWithFullTextFields(tx, "/b", "b", map[string]string{
+			"title": "banana",
+			"body":  "cherry",
+		})
+	})
+	require.NoError(adapt(t), err)
+	require.EqualValues(adapt(t), []string{"/b"}, searchColumns("banana"))
+	require.EqualValues(adapt(t), []string{"/b"}, searchColumns("banana", "title"))
+	require.Empty(adapt(t), searchColumns("cherry", "title"), "body shouldn't match when searching only title")
+	require.EqualValues(adapt(t), []string{"/b"}, searchColumns("cherry", "title", "body"))
+	require.Empty(adapt(t), searchColumns("apple", "body"))
+
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.PutWithFullTextFields(tx, "/b", "b", map[string]string{"body": "durian"})
+	})
+	require.NoError(adapt(t), err)
+	require.Empty(adapt(t), searchColumns("banana"), "updating should replace all columns")
+	require.EqualValues(adapt(t), []string{"/b"}, searchColumns("durian", "body"))
+
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.PutWithFullTextFields(tx, "/c", "c", map[string]string{"unknown": "text"})
+	})
+	require.ErrorIs(adapt(t), err, pathdb.ErrUnknownFullTextColumn)
+}
+
+func TestTokenizer(t TestingT, mdb minisql.DB) {
+	_, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{Tokenizer: "nonexistent"})
+	require.Error(adapt(t), err, "unknown tokenizer should be rejected")
+
+	db, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{Tokenizer: "unicode61"})
+	require.NoError(adapt(t), err)
+	// both DBs share the same underlying database, so only close them once done with both
+	defer db.Close()
+	err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+		return pathdb.Put(tx, "/a", "a", "running quickly")
+	})
+	require.NoError(adapt(t), err)
+	require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, db, "running"))
+	require.Empty(adapt(t), searchPaths(t, db, "run"), "unicode61 should match only whole words")
+
+	_, err = pathdb.NewDB(mdb, "test")
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions, "changing the tokenizer should require RebuildFullTextIndex")
+
+	defaultDB, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{RebuildFullTextIndex: true})
+	require.NoError(adapt(t), err)
+	defer defaultDB.Close()
+	require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, defaultDB, "run"), "index should be rebuilt with the default tokenizer")
+	require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, defaultDB, "uick"))
+}
+
+func TestSearchColumnWeights(t TestingT, mdb minisql.DB) {
+	withDBOptions(t, mdb, &pathdb.Options{FullTextColumns: []string{"title", "body"}}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			err := pathdb.PutWithFullTextFields(tx, "/a", "a", map[string]string{"title": "apple", "body": "a tart"})
+			if err != nil {
+				return err
+			}
+			return pathdb.PutWithFullTextFields(tx, "/b", "b", map[string]string{"title": "a tart", "body": "apple"})
+		})
+		require.NoError(adapt(t), err)
+
+		searchWeighted := func(weights ...float64) []string {
+			results := search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: "apple", ColumnWeights: weights})
+			paths := make([]string, 0, len(results))
+			for _, result := range results {
+				paths = append(paths, result.Path)
+			}
+			return paths
+		}
+		require.EqualValues(adapt(t), []string{"/a", "/b"}, searchWeighted(10, 1), "title matches should rank first")
+		require.EqualValues(adapt(t), []string{"/b", "/a"}, searchWeighted(1, 10), "body matches should rank first")
+
+		_, err = pathdb.Search[string](db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: "apple", ColumnWeights: []float64{1}})
+		require.ErrorIs(adapt(t), err, pathdb.ErrInvalidQuery, "weights should match number of columns")
+	})
+}
+
+func TestTruncateOversizedFullText(t TestingT, mdb minisql.DB) {
+	withDBOptions(t, mdb, &pathdb.Options{MaxFullTextBytes: 20}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "value", "early terms then lots of later terms"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/b", "value", "冬奥会冬奥会冬奥会冬奥会"))
 			return nil
 		})
 		require.NoError(adapt(t), err)
 
+		require.EqualValues(adapt(t), []string{"/messages/a"}, searchPaths(t, db, "early"), "early terms should still be searchable")
+		require.Empty(adapt(t), searchPaths(t, db, "later"), "later terms should have been truncated")
 		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
-			{pathdb.Item[string]{"/messages/a", "", "Message A blah"}, "...*bla*..."},
-		}, search[string](
-			t,
-			db,
-			&pathdb.QueryParams{Path: "/messages/%"},
-			&pathdb.SearchParams{Search: "blah", NumTokens: 1},
-		),
-			"results should exclude deleted rows and deleted fulltext",
+			{pathdb.Item[string]{"/messages/b", "", "value"}, "*冬奥会冬奥会*", nil},
+		}, search[string](t, db, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: "冬奥会"}),
+			"truncation should respect character boundaries",
 		)
+	})
+}
 
-		// now update
-		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
-			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A is different now", "Message A is different now"))
-			return nil
+func TestRejectOversizedFullText(t TestingT, mdb minisql.DB) {
+	withDBOptions(t, mdb, &pathdb.Options{MaxFullTextBytes: 20, OversizedFullTextPolicy: pathdb.RejectOversizedFullText}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/messages/a", "value", "early terms then lots of later terms")
+		})
+		require.ErrorIs(adapt(t), err, pathdb.ErrFullTextTooLarge)
+	})
+}
+
+func TestPageSize(t TestingT, mdb minisql.DB) {
+	_, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{PageSize: 1000})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions, "page size must be a power of two")
+
+	withDBOptions(t, mdb, &pathdb.Options{PageSize: 8192, CacheSize: -4000}, func(db pathdb.DB) {
+		pageSize := func() int {
+			rows, err := mdb.Query("PRAGMA page_size", minisql.NewValues(nil))
+			require.NoError(adapt(t), err)
+			defer rows.Close()
+			require.True(adapt(t), rows.Next())
+			result := minisql.NewValues([]interface{}{0})
+			require.NoError(adapt(t), rows.Scan(result))
+			return result.Get(0).Int()
+		}
+		require.Equal(adapt(t), 8192, pageSize())
+	})
+}
+
+func TestPragmas(t TestingT, mdb minisql.DB) {
+	_, err := pathdb.NewDBWithOptions(mdb, "test", &pathdb.Options{Pragmas: map[string]string{"user_version = 1; DROP TABLE test_data": "1"}})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidOptions, "pragma names must be plain identifiers")
+
+	withDBOptions(t, mdb, &pathdb.Options{Pragmas: map[string]string{"journal_mode": "WAL", "user_version": "7"}}, func(db pathdb.DB) {
+		pragma := func(name string) string {
+			rows, err := minisql.Wrap(mdb).Query(fmt.Sprintf("PRAGMA %s", name))
+			require.NoError(adapt(t), err)
+			defer rows.Close()
+			require.True(adapt(t), rows.Next())
+			var value string
+			require.NoError(adapt(t), rows.Scan(&value))
+			return value
+		}
+		require.Equal(adapt(t), "wal", pragma("journal_mode"))
+		require.Equal(adapt(t), "7", pragma("user_version"))
+	})
+}
+
+func TestPathDictionary(t TestingT, mdb minisql.DB) {
+	_, err := pathdb.NewDBWithOptions(mdb, "invalid", &pathdb.Options{PathDictionary: []string{"/a/", "/a/"}})
+	require.ErrorIs(adapt(t), err, pathdb.ErrInvalidPathDictionary, "duplicate entries should be rejected")
+
+	withDBOptions(t, mdb, &pathdb.Options{PathDictionary: []string{"/messages/", "/messages/archived/", "/linktomessage/"}}, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/a", "Message A blah", "Message A blah"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/b", "Message B", "Message B"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/messages/archived/c", "Message C blah", "Message C blah"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/other/d", "Message D", ""))
+			return pathdb.PutAll(tx, map[string]string{
+				"/linktomessage/1": "/messages/b",
+				"/linktomessage/2": "/messages/archived/c",
+				"/linktomessage/3": "/other/d",
+			})
 		})
 		require.NoError(adapt(t), err)
 
-		require.Empty(adapt(t), search[string](
-			t,
-			db,
-			&pathdb.QueryParams{Path: "/messages/%"},
-			&pathdb.SearchParams{Search: "blah"},
-		),
-			"results exclude updated fulltext",
-		)
+		rows, err := minisql.Wrap(mdb).Query("SELECT path FROM test_data WHERE path LIKE '/messages/%' OR path LIKE '/linktomessage/%'")
+		require.NoError(adapt(t), err)
+		require.False(adapt(t), rows.Next(), "dictionary prefixes should not be stored verbatim")
+		rows.Close()
+
+		require.Equal(adapt(t), "Message C blah", get[string](t, db, "/messages/archived/c"))
+		require.Equal(adapt(t), "Message D", get[string](t, db, "/other/d"))
+		values, err := pathdb.GetMulti[string](db, []string{"/messages/a", "/other/d"})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), map[string]string{"/messages/a": "Message A blah", "/other/d": "Message D"}, values)
+
+		require.EqualValues(adapt(t), []string{"/messages/a", "/messages/archived/c", "/messages/b"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/%"}), "pattern with dictionary prefix")
+		require.EqualValues(adapt(t), []string{"/messages/archived/c"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/archived/%"}), "pattern with longer dictionary prefix")
+		require.EqualValues(adapt(t), []string{"/messages/a", "/messages/archived/c", "/messages/b"}, listPaths(t, db, &pathdb.QueryParams{Path: "/mess%"}), "pattern ending within dictionary prefix")
+		require.EqualValues(adapt(t), []string{"/messages/archived/c"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/ar*", MatchMode: pathdb.MatchGlob}), "glob pattern")
+		require.EqualValues(adapt(t), []string{"/linktomessage/1", "/linktomessage/2", "/linktomessage/3", "/messages/a", "/messages/archived/c", "/messages/b", "/other/d"}, listPaths(t, db, &pathdb.QueryParams{Path: "%"}), "paths should be sorted by their decoded value")
+
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/linktomessage/1", "/messages/b", "Message B"},
+			{"/linktomessage/2", "/messages/archived/c", "Message C blah"},
+			{"/linktomessage/3", "/other/d", "Message D"},
+		}, list[string](t, db, &pathdb.QueryParams{Path: "/linktomessage/%", JoinDetails: true}))
 
 		require.EqualValues(adapt(t), []*pathdb.SearchResult[string]{
-			{pathdb.Item[string]{"/messages/a", "", "Message A is different now"}, "Message A is *diff*erent now"},
-		}, search[string](
-			t,
-			db,
-			&pathdb.QueryParams{Path: "/messages/%"},
-			&pathdb.SearchParams{Search: "diff"},
-		),
-			"results include updated fulltext",
-		)
+			{pathdb.Item[string]{"/linktomessage/2", "/messages/archived/c", "Message C blah"}, "Message C *blah*", nil},
+		}, search[string](t, db, &pathdb.QueryParams{Path: "/linktomessage/%", JoinDetails: true}, &pathdb.SearchParams{Search: "blah C"}))
+
+		var deleted int
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			var err error
+			deleted, err = pathdb.DeletePrefixExcept(tx, "/messages/", []string{"/messages/a"})
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.Equal(adapt(t), 2, deleted)
+		require.EqualValues(adapt(t), []string{"/messages/a"}, listPaths(t, db, &pathdb.QueryParams{Path: "/messages/%"}))
+		require.EqualValues(adapt(t), []string{"/messages/a"}, searchPaths(t, db, "blah"), "full text index should be cleaned up")
 	})
 }
 
@@ -465,6 +3696,7 @@ func TestSearchChinese(t TestingT, mdb minisql.DB) {
 				"",
 				"当日，北京2022年冬奥会单板滑雪项目男子坡面障碍技巧决赛在张家口云顶滑雪公园举行。苏翊鸣夺得男子坡面障碍技巧银牌。"},
 				"...22*年冬奥会*单板滑...",
+				nil,
 			},
 		}, search[string](
 			t,
@@ -474,15 +3706,384 @@ func TestSearchChinese(t TestingT, mdb minisql.DB) {
 		),
 			"match 年冬奥会 (winter olympics)  in larger sentence",
 		)
+
+		tokens, err := pathdb.FTSTokens(db, "/item")
+		require.NoError(adapt(t), err)
+		require.Len(adapt(t), tokens, 56, "trigram tokenizer should produce one token per character except the last two")
+		require.EqualValues(adapt(t), []string{"当日，", "日，北", "，北京", "北京2", "京20"}, tokens[:5])
+		require.Contains(adapt(t), tokens, "年冬奥")
+		require.Contains(adapt(t), tokens, "冬奥会")
+
+		tokens, err = pathdb.FTSTokens(db, "/missing")
+		require.NoError(adapt(t), err)
+		require.Empty(adapt(t), tokens)
+	})
+}
+
+func TestTransactionStats(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		openTransactions := func() int64 {
+			stats, err := db.Stats()
+			require.NoError(adapt(t), err)
+			return stats.OpenTransactions
+		}
+
+		tx, err := db.Begin()
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 1, openTransactions())
+		require.NoError(adapt(t), tx.Rollback())
+		require.EqualValues(adapt(t), 0, openTransactions())
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.EqualValues(adapt(t), 1, openTransactions())
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 0, openTransactions())
+
+		// leak a transaction
+		func() {
+			_, err := db.Begin()
+			require.NoError(adapt(t), err)
+		}()
+		require.EqualValues(adapt(t), 1, openTransactions())
+
+		// finalizers run asynchronously after garbage collection, so give them some time
+		var stats *pathdb.Stats
+		for i := 0; i < 50; i++ {
+			runtime.GC()
+			stats, err = db.Stats()
+			require.NoError(adapt(t), err)
+			if stats.LeakedTransactions > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.EqualValues(adapt(t), 1, stats.LeakedTransactions, "leaked transaction should have been detected")
+	})
+}
+
+func TestSubscriptionStats(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/index/1":  "/detail/1",
+				"/index/2":  "/detail/2",
+				"/detail/1": "one",
+				"/detail/2": "two",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		stats := func() *pathdb.Stats {
+			stats, err := db.Stats()
+			require.NoError(adapt(t), err)
+			return stats
+		}
+
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("sub%d", i)
+			err := pathdb.Subscribe(db, &pathdb.Subscription[string]{
+				ID:           id,
+				PathPrefixes: []string{fmt.Sprintf("/other/%d/", i), "/index/"},
+				JoinDetails:  true,
+				OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+					return nil
+				},
+			})
+			require.NoError(adapt(t), err)
+			if i == 0 {
+				require.Equal(adapt(t), 2, stats().SubscriptionPrefixCount)
+				require.Equal(adapt(t), 4, stats().TrieNodeCount, "detail paths should be counted")
+			}
+			pathdb.Unsubscribe(db, id)
+		}
+
+		s := stats()
+		require.Zero(adapt(t), s.SubscriptionPrefixCount, "unsubscribing should prune empty prefixes")
+		require.Zero(adapt(t), s.TrieNodeCount, "unsubscribing should prune empty detail paths")
+	})
+}
+
+func TestSchemaStats(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		stats, err := pathdb.SchemaStats(db)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), &pathdb.DBStats{}, stats, "empty db should have no rows")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "a", "a"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/b", "b", "b"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/c", "c", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		stats, err = pathdb.SchemaStats(db)
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), &pathdb.DBStats{
+			DataRows:     3,
+			IndexedRows:  2,
+			FTSRows:      2,
+			CounterValue: 1,
+		}, stats)
+	})
+}
+
+func TestDeleteFullText(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		ftsRows := func() int64 {
+			stats, err := pathdb.SchemaStats(db)
+			require.NoError(adapt(t), err)
+			return stats.FTSRows
+		}
+
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "a", "apple"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/b", "b", "banana"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/c", "c", "cherry"))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 3, ftsRows())
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Delete(tx, "/a")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 2, ftsRows(), "delete should remove full text index entry")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			_, err := pathdb.DeleteExisting(tx, "/b")
+			return err
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 1, ftsRows(), "delete existing should remove full text index entry")
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put[interface{}](tx, "/c", nil, "")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 0, ftsRows(), "delete through put should remove full text index entry")
+	})
+}
+
+func TestRebuildFTS(t TestingT, mdb minisql.DB) {
+	withDB(t, mdb, func(db pathdb.DB) {
+		stats := func() *pathdb.DBStats {
+			stats, err := pathdb.SchemaStats(db)
+			require.NoError(adapt(t), err)
+			return stats
+		}
+
+		for i := 0; i < 10; i++ {
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				require.NoError(adapt(t), pathdb.Put(tx, "/x", "x", "temporary"))
+				return pathdb.Delete(tx, "/x")
+			})
+			require.NoError(adapt(t), err)
+		}
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "a", "apple"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/b", "b", "banana"))
+			require.NoError(adapt(t), pathdb.Put(tx, "/n", "n", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 11, stats().CounterValue)
+
+		require.NoError(adapt(t), pathdb.RebuildFTS(db))
+		require.EqualValues(adapt(t), &pathdb.DBStats{
+			DataRows:     3,
+			IndexedRows:  2,
+			FTSRows:      2,
+			CounterValue: 1,
+		}, stats(), "counter should be reset to the number of indexed paths")
+		require.EqualValues(adapt(t), []string{"/a"}, searchPaths(t, db, "apple"))
+		require.EqualValues(adapt(t), []string{"/b"}, searchPaths(t, db, "banana"))
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/c", "c", "cherry")
+		})
+		require.NoError(adapt(t), err)
+		require.EqualValues(adapt(t), 2, stats().CounterValue)
+		require.EqualValues(adapt(t), []string{"/c"}, searchPaths(t, db, "cherry"))
+		require.EqualValues(adapt(t), []string{"/b"}, searchPaths(t, db, "banana"), "new rowid shouldn't collide with renumbered ones")
+	})
+}
+
+func TestSnapshot(t TestingT, mdb minisql.DB) {
+	// snapshot isolation relies on WAL mode
+	require.NoError(adapt(t), mdb.Exec("PRAGMA journal_mode=WAL", minisql.NewValues(nil)))
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.Put(tx, "/a", "original", "")
+		})
+		require.NoError(adapt(t), err)
+
+		snapshot, err := db.Snapshot()
+		require.NoError(adapt(t), err)
+		defer snapshot.Close()
+
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			require.NoError(adapt(t), pathdb.Put(tx, "/a", "updated", ""))
+			require.NoError(adapt(t), pathdb.Put(tx, "/b", "new", ""))
+			return nil
+		})
+		require.NoError(adapt(t), err)
+
+		require.Equal(adapt(t), "original", get[string](t, snapshot, "/a"), "snapshot shouldn't see update")
+		require.Empty(adapt(t), get[string](t, snapshot, "/b"), "snapshot shouldn't see insert")
+		require.EqualValues(adapt(t), []*pathdb.Item[string]{
+			{"/a", "", "original"},
+		}, list[string](t, snapshot, &pathdb.QueryParams{Path: "%"}), "snapshot list shouldn't see changes")
+		require.Equal(adapt(t), "updated", get[string](t, db, "/a"), "db should see update")
+	})
+}
+
+func TestView(t TestingT, mdb minisql.DB) {
+	// snapshot isolation relies on WAL mode
+	require.NoError(adapt(t), mdb.Exec("PRAGMA journal_mode=WAL", minisql.NewValues(nil)))
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			return pathdb.PutAll(tx, map[string]string{
+				"/index/1":  "/detail/1",
+				"/detail/1": "one",
+			})
+		})
+		require.NoError(adapt(t), err)
+
+		err = pathdb.View(db, func(q pathdb.Queryable) error {
+			index := list[string](t, q, &pathdb.QueryParams{Path: "/index/%"})
+			require.Len(adapt(t), index, 1)
+
+			err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+				return tx.Delete("/detail/1")
+			})
+			require.NoError(adapt(t), err)
+
+			require.Equal(adapt(t), "one", get[string](t, q, index[0].Value), "view shouldn't see concurrent delete")
+			return nil
+		})
+		require.NoError(adapt(t), err)
+		require.Empty(adapt(t), get[string](t, db, "/detail/1"), "db should see delete")
+
+		err = pathdb.View(db, func(q pathdb.Queryable) error {
+			return errTest
+		})
+		require.ErrorIs(adapt(t), err, errTest)
+	})
+}
+
+func TestVacuum(t TestingT, mdb minisql.DB) {
+	// incremental vacuuming has to be enabled before any tables are created
+	require.NoError(adapt(t), mdb.Exec("PRAGMA auto_vacuum=INCREMENTAL", minisql.NewValues(nil)))
+	withDB(t, mdb, func(db pathdb.DB) {
+		err := pathdb.Mutate(db, func(tx pathdb.TX) error {
+			for i := 0; i < 100; i++ {
+				err := pathdb.Put(tx, fmt.Sprintf("/big/%d", i), string(make([]byte, 10000)), "")
+				if err != nil {
+					return err
+				}
+			}
+			return pathdb.Put(tx, "/small", "kept", "")
+		})
+		require.NoError(adapt(t), err)
+		err = pathdb.Mutate(db, func(tx pathdb.TX) error {
+			_, err := pathdb.DeleteAll(tx, "/big/%")
+			return err
+		})
+		require.NoError(adapt(t), err)
+
+		require.NoError(adapt(t), pathdb.Compact(db))
+		require.NoError(adapt(t), pathdb.Vacuum(db))
+		require.Equal(adapt(t), "kept", get[string](t, db, "/small"), "maintenance shouldn't affect data")
+	})
+}
+
+func TestClose(t TestingT, mdb minisql.DB) {
+	db, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+
+	tx, err := db.Begin()
+	require.NoError(adapt(t), err)
+	require.NoError(adapt(t), pathdb.Put(tx, "path", "hello world", ""))
+
+	require.NoError(adapt(t), db.Close())
+	require.NoError(adapt(t), db.Close(), "closing twice should be okay")
+
+	require.ErrorIs(adapt(t), tx.Commit(), pathdb.ErrDBClosed, "commit after close should fail")
+	_, err = db.Begin()
+	require.ErrorIs(adapt(t), err, pathdb.ErrDBClosed, "begin after close should fail")
+	err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+		ID:           "s1",
+		PathPrefixes: []string{"p%"},
+		OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+			return nil
+		},
+	})
+	require.ErrorIs(adapt(t), err, pathdb.ErrDBClosed, "subscribe after close should fail")
+	pathdb.Unsubscribe(db, "s1")
+}
+
+func TestCloseDuringCommit(t TestingT, mdb minisql.DB) {
+	db, err := pathdb.NewDB(mdb, "test")
+	require.NoError(adapt(t), err)
+
+	notified := make(chan interface{})
+	release := make(chan interface{})
+	err = pathdb.Subscribe(db, &pathdb.Subscription[string]{
+		ID:                "blocking",
+		PathPrefixes:      []string{"p"},
+		FailCommitOnError: true,
+		OnUpdate: func(cs *pathdb.ChangeSet[string]) error {
+			close(notified)
+			<-release
+			return nil
+		},
 	})
+	require.NoError(adapt(t), err)
+
+	tx, err := db.Begin()
+	require.NoError(adapt(t), err)
+	require.NoError(adapt(t), pathdb.Put(tx, "p", "hello world", ""))
+	afterCommit := false
+	tx.AfterCommit(func() {
+		afterCommit = true
+	})
+	committed := make(chan error, 1)
+	go func() {
+		committed <- tx.Commit()
+	}()
+
+	// close the DB while the mainLoop is in the middle of the commit
+	<-notified
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	require.Eventually(adapt(t), func() bool {
+		_, err := db.Begin()
+		return errors.Is(err, pathdb.ErrDBClosed)
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+
+	require.NoError(adapt(t), <-committed, "a commit that the mainLoop took on should complete")
+	require.True(adapt(t), afterCommit)
+	require.NoError(adapt(t), <-closed)
 }
 
 func withDB(t TestingT, mdb minisql.DB, fn func(db pathdb.DB)) {
+	withDBOptions(t, mdb, nil, fn)
+}
+
+func withDBOptions(t TestingT, mdb minisql.DB, opts *pathdb.Options, fn func(db pathdb.DB)) {
 	file, err := ioutil.TempFile("", "")
 	require.NoError(adapt(t), err)
 	defer panicOnError(os.Remove(file.Name()))
-	db, err := pathdb.NewDB(mdb, "test")
+	db, err := pathdb.NewDBWithOptions(mdb, "test", opts)
 	require.NoError(adapt(t), err)
+	defer db.Close()
 	fn(db)
 }
 
@@ -504,6 +4105,12 @@ func list[T any](t TestingT, q pathdb.Queryable, query *pathdb.QueryParams) []*p
 	return result
 }
 
+func tail[T any](t TestingT, q pathdb.Queryable, prefix string, n int) []*pathdb.Item[T] {
+	result, err := pathdb.Tail[T](q, prefix, n)
+	require.NoError(adapt(t), err)
+	return result
+}
+
 func listPaths(t TestingT, q pathdb.Queryable, query *pathdb.QueryParams) []string {
 	result, err := pathdb.ListPaths(q, query)
 	require.NoError(adapt(t), err)
@@ -522,6 +4129,15 @@ func search[T any](t TestingT, q pathdb.Queryable, query *pathdb.QueryParams, se
 	return result
 }
 
+func searchPaths(t TestingT, q pathdb.Queryable, term string) []string {
+	results := search[string](t, q, &pathdb.QueryParams{Path: "%"}, &pathdb.SearchParams{Search: term})
+	paths := make([]string, 0, len(results))
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	return paths
+}
+
 func rsearch[T any](t TestingT, q pathdb.Queryable, query *pathdb.QueryParams, search *pathdb.SearchParams) []*pathdb.SearchResult[*pathdb.Raw[T]] {
 	result, err := pathdb.RSearch[T](q, query, search)
 	require.NoError(adapt(t), err)
@@ -0,0 +1,186 @@
+package pathdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	changeSetWireVersion = 1
+)
+
+var (
+	ErrInvalidChangeSet = errors.New("invalid change set")
+)
+
+// Marshal encodes this ChangeSet into a stable binary format that can be decoded with
+// UnmarshalChangeSet, for example in another process. Values are encoded using their stored
+// (serialized) bytes, so the decoding side needs to have the same types registered.
+//
+// The format is a version byte followed by the updates, deletes and previous values. Each section
+// starts with a uvarint count of entries. Strings and byte arrays are encoded as a uvarint length
+// followed by the data. Updates are encoded as path, detail path and value, deletes as path and
+// previous values as path and value. Entries are sorted by path.
+func (cs *ChangeSet[T]) Marshal() ([]byte, error) {
+	b := []byte{changeSetWireVersion}
+
+	updatePaths := sortedKeys(cs.Updates)
+	b = binary.AppendUvarint(b, uint64(len(updatePaths)))
+	for _, path := range updatePaths {
+		u := cs.Updates[path]
+		var value []byte
+		if u.Value != nil {
+			value = u.Value.Bytes
+		}
+		b = appendBytes(b, []byte(path))
+		b = appendBytes(b, []byte(u.DetailPath))
+		b = appendBytes(b, value)
+	}
+
+	deletePaths := sortedKeys(cs.Deletes)
+	b = binary.AppendUvarint(b, uint64(len(deletePaths)))
+	for _, path := range deletePaths {
+		b = appendBytes(b, []byte(path))
+	}
+
+	previousPaths := sortedKeys(cs.Previous)
+	b = binary.AppendUvarint(b, uint64(len(previousPaths)))
+	for _, path := range previousPaths {
+		var value []byte
+		if cs.Previous[path] != nil {
+			value = cs.Previous[path].Bytes
+		}
+		b = appendBytes(b, []byte(path))
+		b = appendBytes(b, value)
+	}
+
+	return b, nil
+}
+
+// UnmarshalChangeSet decodes a ChangeSet that was encoded with ChangeSet.Marshal. Values are
+// deserialized lazily using the given DB's registered types.
+func UnmarshalChangeSet[T any](d DB, b []byte) (*ChangeSet[T], error) {
+	serde := d.getSerde()
+	r := &wireReader{b: b}
+	version := r.readByte()
+	if r.err == nil && version != changeSetWireVersion {
+		return nil, fmt.Errorf("unmarshalchangeset: unsupported version %d: %w", version, ErrInvalidChangeSet)
+	}
+
+	cs := &ChangeSet[T]{}
+	numUpdates := r.readCount()
+	for i := 0; i < numUpdates && r.err == nil; i++ {
+		path := string(r.readBytes())
+		detailPath := string(r.readBytes())
+		value := r.readBytes()
+		if cs.Updates == nil {
+			cs.Updates = make(map[string]*Item[*Raw[T]], numUpdates)
+		}
+		item := &Item[*Raw[T]]{
+			Path:       path,
+			DetailPath: detailPath,
+		}
+		if len(value) > 0 {
+			item.Value = &Raw[T]{serde: serde, Bytes: value}
+		}
+		cs.Updates[path] = item
+	}
+
+	numDeletes := r.readCount()
+	for i := 0; i < numDeletes && r.err == nil; i++ {
+		if cs.Deletes == nil {
+			cs.Deletes = make(map[string]bool, numDeletes)
+		}
+		cs.Deletes[string(r.readBytes())] = true
+	}
+
+	numPrevious := r.readCount()
+	for i := 0; i < numPrevious && r.err == nil; i++ {
+		path := string(r.readBytes())
+		value := r.readBytes()
+		if cs.Previous == nil {
+			cs.Previous = make(map[string]*Raw[T], numPrevious)
+		}
+		cs.Previous[path] = &Raw[T]{serde: serde, Bytes: value}
+	}
+
+	if r.err == nil && len(r.b) > 0 {
+		r.err = fmt.Errorf("%d trailing bytes: %w", len(r.b), ErrInvalidChangeSet)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("unmarshalchangeset: %w", r.err)
+	}
+	return cs, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// wireReader reads the encoding used by ChangeSet.Marshal, remembering the first error
+type wireReader struct {
+	b   []byte
+	err error
+}
+
+func (r *wireReader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) == 0 {
+		r.err = fmt.Errorf("unexpected end of data: %w", ErrInvalidChangeSet)
+		return 0
+	}
+	result := r.b[0]
+	r.b = r.b[1:]
+	return result
+}
+
+func (r *wireReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	result, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid length: %w", ErrInvalidChangeSet)
+		return 0
+	}
+	r.b = r.b[n:]
+	return result
+}
+
+// readCount reads a count of entries, each of which takes at least one byte
+func (r *wireReader) readCount() int {
+	count := r.readUvarint()
+	if r.err == nil && count > uint64(len(r.b)) {
+		r.err = fmt.Errorf("count %d exceeds remaining data: %w", count, ErrInvalidChangeSet)
+		return 0
+	}
+	return int(count)
+}
+
+func (r *wireReader) readBytes() []byte {
+	length := r.readUvarint()
+	if r.err != nil {
+		return nil
+	}
+	if length > uint64(len(r.b)) {
+		r.err = fmt.Errorf("length %d exceeds remaining data: %w", length, ErrInvalidChangeSet)
+		return nil
+	}
+	result := r.b[:length]
+	r.b = r.b[length:]
+	return result
+}
@@ -0,0 +1,36 @@
+package pathdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeSetMarshalRoundTrip(t *testing.T) {
+	db, err := NewDB(newSQLiteImpl(t), "test")
+	require.NoError(t, err)
+	defer db.Close()
+
+	cs := &ChangeSet[string]{
+		Updates: map[string]*Item[*Raw[string]]{
+			"/index/1": {"/index/1", "/detail/1", UnloadedRaw(db, "one")},
+			"/plain":   {"/plain", "", UnloadedRaw(db, "plain")},
+		},
+		Deletes: map[string]bool{"/deleted/1": true, "/deleted/2": true},
+		Previous: map[string]*Raw[string]{
+			"/plain": UnloadedRaw(db, "old plain"),
+		},
+	}
+	b, err := cs.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalChangeSet[string](db, b)
+	require.NoError(t, err)
+	require.EqualValues(t, cs, decoded)
+
+	value, err := decoded.Updates["/index/1"].Value.Value()
+	require.NoError(t, err)
+	require.Equal(t, "one", value)
+
+	_, err = UnmarshalChangeSet[string](db, b[:len(b)-1])
+	require.ErrorIs(t, err, ErrInvalidChangeSet, "truncated change set should fail to decode")
+}